@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/filecontrol"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// runAudit - "cardslurp audit".  Check that every file on the cards has
+// an intact copy in the target directory or the library, and print a
+// verdict for each card.  Returns exitVerify unless every card is safe to
+// format.
+func runAudit(args []string) int {
+
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	mountListStr := fs.String("mountlist", "", "Comma delimited list of mounted cards.")
+	targetDir := fs.String("targetdir", "", "Directory the cards were imported into.")
+	libraryRootsStr := fs.String("libraryroots", "", "Comma delimited list of library directories.")
+	libraryIndex := fs.String("libraryindex", "", "Library index file (default .cardslurp-index.jsonl in the first library root)")
+	hashAlgoStr := fs.String("hash", "sha256", "Digest algorithm used to compare files (sha256 or xxh64)")
+	verifyChunkSize := fs.Uint64("verifychunksize", 16384, "Size of the read buffer")
+	cardTimeout := fs.Duration("cardtimeout", filecontrol.DefaultCardTimeout, "Give up on a card when one read from it stalls this long (0 to wait forever)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		panic("error processing command line arguments: " + err.Error())
+	}
+
+	cards := commaList(*mountListStr)
+	if len(cards) == 0 {
+		panic("error processing command line arguments: -mountlist is a required parameter")
+	}
+
+	libraryRoots := commaList(*libraryRootsStr)
+	if *targetDir == "" && len(libraryRoots) == 0 {
+		panic("error processing command line arguments: -targetdir or -libraryroots is required")
+	}
+
+	if *verifyChunkSize == 0 {
+		panic("error processing command line arguments: -verifychunksize must not be zero")
+	}
+
+	hashAlgo, err := cardfileutil.ParseHashAlgo(*hashAlgoStr)
+	if err != nil {
+		panic("error processing command line arguments: invalid -hash: " + err.Error())
+	}
+
+	cfu := cardfileutil.NewCardFileUtil(*verifyChunkSize, 1, hashAlgo,
+		cardfileutil.DefaultFileMode)
+
+	// Only the operating system files are left out.  A file an import
+	// filter leaves on the card is still lost when the card is formatted.
+	filter, err := filecontrol.NewFilter(filecontrol.FilterOpts{})
+	if err != nil {
+		panic("error making discovery filter: " + err.Error())
+	}
+
+	auditOpts := filecontrol.AuditOpts{
+		TargetDir:   *targetDir,
+		Hasher:      cfu,
+		CardTimeout: *cardTimeout,
+		Filter:      filter,
+	}
+
+	if *targetDir != "" {
+		prior, err := ledger.ReadDir(*targetDir)
+		if err != nil {
+			panic("error reading import ledger: " + err.Error())
+		}
+		auditOpts.Imported = ledger.NewImported(prior)
+	}
+
+	if len(libraryRoots) != 0 {
+		if *libraryIndex == "" {
+			*libraryIndex = filepath.Join(libraryRoots[0], libindex.DefaultFileName)
+		}
+		libIndex, err := libindex.Load(*libraryIndex, hashAlgo, cfu)
+		if err != nil {
+			panic("error loading library index: " + err.Error())
+		}
+
+		fmt.Printf("Updating library index: %s\n", *libraryIndex)
+		stats, err := libIndex.Update(libraryRoots)
+		if err != nil {
+			panic("error updating library index: " + err.Error())
+		}
+		fmt.Printf("Library index has %d files (hashed: %d - reused: %d - removed: %d)\n",
+			libIndex.Len(), stats.Hashed, stats.Reused, stats.Removed)
+
+		auditOpts.LibraryIndex = libIndex
+		defer func() {
+			err := libIndex.Save()
+			if err != nil {
+				fmt.Printf("error saving library index: %s\n", err.Error())
+			}
+		}()
+	}
+
+	ctx, stopSignals := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	audits, err := filecontrol.AuditCards(ctx, cards, auditOpts)
+	if err != nil {
+		panic("error auditing cards: " + err.Error())
+	}
+
+	rv := exitOK
+	for _, a := range audits {
+
+		if a.Safe() {
+			fmt.Printf("SAFE TO FORMAT  %s (%d files, each has an intact copy)\n", a.Card, a.Files)
+		} else {
+			rv = exitVerify
+			fmt.Printf("NOT SAFE        %s (%d of %d files have an intact copy)\n", a.Card,
+				len(a.Found), a.Files)
+		}
+
+		if a.Err != nil {
+			fmt.Printf("  ERROR       %s\n", a.Err.Error())
+		}
+		for _, m := range a.Missing {
+			fmt.Printf("  MISSING     %s\n", m)
+		}
+		for _, d := range a.Different {
+			fmt.Printf("  DIFFERENT   %s\n", d)
+		}
+		for _, p := range a.SkippedPaths {
+			fmt.Printf("  UNREADABLE  %s\n", p)
+		}
+		if a.Filtered != 0 {
+			fmt.Printf("  (%d operating system and camera catalog files not checked)\n", a.Filtered)
+		}
+	}
+
+	return rv
+}
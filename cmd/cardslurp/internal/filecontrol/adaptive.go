@@ -0,0 +1,167 @@
+package filecontrol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock - Source of time for the adaptive controller.  Tests use a fake
+// clock, so the controller's decisions are deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// DefaultAdaptiveWindow - How long the adaptive controller measures a
+// device before each decision.
+const DefaultAdaptiveWindow = 10 * time.Second
+
+// aimdDrop - The controller halves the workers when throughput falls by
+// more than this fraction from one window to the next.
+const aimdDrop = 0.10
+
+// deviceLimiter - Limits the number of groups being copied from one source
+// device.  With adaptive set, the limit is tuned by an AIMD controller:
+// measure bytes per second over each window, add one worker while
+// throughput holds up, and halve the workers when it falls.  Like TCP, it
+// settles into a sawtooth around the number of workers the device can
+// really use.  Without adaptive, the limit never changes.
+type deviceLimiter struct {
+	sync.Mutex
+	device   string
+	adaptive bool
+	clock    Clock
+	window   time.Duration
+	min      int
+	max      int
+	limit    int
+	active   int
+	// wake is closed (and replaced) whenever a slot may have opened up.
+	wake chan struct{}
+	// Measurement for the current window.
+	windowStart time.Time
+	windowBytes int64
+	lastRate    float64
+}
+
+// newDeviceLimiter - Constructor for deviceLimiter.  The limit starts at
+// start, and an adaptive limiter keeps it between 1 and max.
+func newDeviceLimiter(device string, start int, max int, adaptive bool,
+	clock Clock, window time.Duration) *deviceLimiter {
+
+	if start < 1 {
+		start = 1
+	}
+	if max < start {
+		max = start
+	}
+
+	return &deviceLimiter{
+		device:      device,
+		adaptive:    adaptive,
+		clock:       clock,
+		window:      window,
+		min:         1,
+		max:         max,
+		limit:       start,
+		wake:        make(chan struct{}),
+		windowStart: clock.Now(),
+	}
+}
+
+// acquire - Wait for a free slot on the device.  Returns false if stop is
+// closed first.
+func (d *deviceLimiter) acquire(stop <-chan struct{}) bool {
+	for {
+		d.Lock()
+		if d.active < d.limit {
+			d.active++
+			d.Unlock()
+			return true
+		}
+		wake := d.wake
+		d.Unlock()
+
+		select {
+		case <-wake:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// release - Give a slot back, along with the number of bytes copied while
+// holding it.
+func (d *deviceLimiter) release(bytes int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.active--
+	d.windowBytes += bytes
+
+	if d.adaptive {
+		elapsed := d.clock.Now().Sub(d.windowStart)
+		if elapsed >= d.window {
+			d.adjust(elapsed)
+		}
+	}
+
+	d.broadcast()
+}
+
+func (d *deviceLimiter) broadcast() {
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+// adjust - The AIMD step, at the end of each window.  Caller must hold
+// the lock.
+func (d *deviceLimiter) adjust(elapsed time.Duration) {
+
+	rate := float64(d.windowBytes) / elapsed.Seconds()
+	d.windowStart = d.clock.Now()
+	d.windowBytes = 0
+
+	// An idle window says nothing about the device.
+	if rate == 0 {
+		return
+	}
+
+	prev := d.limit
+	var why string
+
+	if d.lastRate != 0 && rate < d.lastRate*(1-aimdDrop) {
+		// Multiplicative decrease.  Fewer workers will move fewer bytes,
+		// so the next window starts a fresh baseline rather than being
+		// compared against this one.
+		d.limit = d.limit / 2
+		if d.limit < d.min {
+			d.limit = d.min
+		}
+		why = "falling"
+		d.lastRate = 0
+	} else {
+		if d.limit < d.max {
+			// Additive increase.
+			d.limit++
+			why = "holding up"
+		} else {
+			why = "at the maximum"
+		}
+		d.lastRate = rate
+	}
+
+	fmt.Printf("Device %s: %.1f MB/s with %d workers (%s), now %d workers\n",
+		d.device, rate/1e6, prev, why, d.limit)
+}
+
+// currentLimit - The number of workers the device may use right now.
+func (d *deviceLimiter) currentLimit() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.limit
+}
@@ -0,0 +1,147 @@
+package filecontrol
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// deviceRate - Bytes per second from a fake card reader that is fastest
+// with three copies, and slows down with more, like a reader thrashing
+// between files.
+func deviceRate(workers int) int64 {
+	switch {
+	case workers <= 3:
+		return int64(workers) * 40e6
+	default:
+		return 120e6 - int64(workers-3)*30e6
+	}
+}
+
+func TestDeviceLimiterAdaptive(t *testing.T) {
+
+	clock := &fakeClock{now: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)}
+	window := 10 * time.Second
+	lim := newDeviceLimiter("dev:1", 1, 6, true, clock, window)
+	stop := make(chan struct{})
+
+	got := make([]int, 0)
+	for i := 0; i < 9; i++ {
+		workers := lim.currentLimit()
+		if !lim.acquire(stop) {
+			t.Fatal("acquire failed with stop open")
+		}
+		clock.advance(window)
+		lim.release(deviceRate(workers) * int64(window/time.Second))
+		got = append(got, lim.currentLimit())
+	}
+
+	// Grow to four, see the drop, halve to two, and climb again.
+	want := []int{2, 3, 4, 2, 3, 4, 2, 3, 4}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDeviceLimiterBounds(t *testing.T) {
+
+	clock := &fakeClock{now: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)}
+	window := time.Second
+	lim := newDeviceLimiter("dev:1", 2, 3, true, clock, window)
+	stop := make(chan struct{})
+
+	// Steady throughput grows the limit, but never past the max.
+	for i := 0; i < 5; i++ {
+		lim.acquire(stop)
+		clock.advance(window)
+		lim.release(100e6)
+	}
+	if lim.currentLimit() != 3 {
+		t.Fatalf("limit is %d, want 3", lim.currentLimit())
+	}
+
+	// Collapsing throughput halves it, but never below one.
+	rate := int64(100e6)
+	for i := 0; i < 5; i++ {
+		rate /= 2
+		lim.acquire(stop)
+		clock.advance(window)
+		lim.release(rate)
+	}
+	if lim.currentLimit() != 1 {
+		t.Fatalf("limit is %d, want 1", lim.currentLimit())
+	}
+
+	// An idle window changes nothing.
+	clock.advance(window)
+	lim.acquire(stop)
+	lim.release(0)
+	if lim.currentLimit() != 1 {
+		t.Fatalf("limit is %d after an idle window, want 1", lim.currentLimit())
+	}
+}
+
+func TestDeviceLimiterFixed(t *testing.T) {
+
+	clock := &fakeClock{now: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)}
+	lim := newDeviceLimiter("dev:1", 2, 8, false, clock, time.Second)
+	stop := make(chan struct{})
+
+	for i := 0; i < 2; i++ {
+		if !lim.acquire(stop) {
+			t.Fatal("acquire failed below the limit")
+		}
+	}
+
+	// The third worker waits until a slot is released.
+	acquired := make(chan bool)
+	go func() {
+		acquired <- lim.acquire(stop)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire did not wait at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.advance(time.Minute)
+	lim.release(100e6)
+	if !<-acquired {
+		t.Fatal("acquire failed after a release")
+	}
+	if lim.currentLimit() != 2 {
+		t.Fatalf("fixed limit changed to %d", lim.currentLimit())
+	}
+
+	// A waiting worker gives up when the pool stops.
+	go func() {
+		acquired <- lim.acquire(stop)
+	}()
+	close(stop)
+	if <-acquired {
+		t.Fatal("acquire succeeded after stop")
+	}
+}
@@ -0,0 +1,341 @@
+package filecontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// Hasher - Computes file digests.  cardfileutil.CardFileUtil satisfies
+// this.
+type Hasher interface {
+	HashFile(fileName string) (cardfileutil.FileDigest, error)
+}
+
+// AuditOpts - Where AuditCards looks for the files on the cards.  At
+// least one of TargetDir and LibraryIndex should be set.
+type AuditOpts struct {
+	// TargetDir - Directory the cards were imported into.  Any file in it
+	// with the same size and digest counts, whatever its name.
+	TargetDir string
+	// Imported - Card files the ledger of TargetDir says were imported,
+	// which are checked against their recorded target first.
+	Imported *ledger.Imported
+	// LibraryIndex - An up to date index of the library.
+	LibraryIndex *libindex.Index
+	Hasher       Hasher
+	// CardTimeout - How long one read from a card may take.
+	CardTimeout time.Duration
+	// Filter - Which files on the cards need to be found.  The operating
+	// system files it drops are not checked.
+	Filter *Filter
+}
+
+// CardAudit - Whether one card is safe to format.
+type CardAudit struct {
+	Card string
+	// Files - Files found on the card.
+	Files uint64
+	// Found - Files with an intact copy, and where the copy is.
+	Found map[string]string
+	// Missing - Card files with no copy anywhere.
+	Missing []string
+	// Different - Card files whose recorded or same named copy does not
+	// match, with the copy.
+	Different []string
+	// Filtered - Files the filter dropped, so they were not checked.
+	Filtered uint64
+	// SkippedPaths - Paths on the card that could not be read, so their
+	// files could not be checked.
+	SkippedPaths []string
+	// Err - The card could not be searched.
+	Err error
+}
+
+// Safe - True if every file on the card has an intact copy.
+func (c CardAudit) Safe() bool {
+	return c.Err == nil && len(c.Missing) == 0 && len(c.Different) == 0 &&
+		len(c.SkippedPaths) == 0
+}
+
+// targetSizes - Files in the target directory by size, so a card file is
+// only compared to files it could be.  Digests are computed the first
+// time a file is a candidate, and kept.
+type targetSizes struct {
+	sync.Mutex
+	bySize  map[int64][]string
+	digests map[string]cardfileutil.FileDigest
+	hasher  Hasher
+}
+
+// loadTargetSizes - Walk targetDir.  Hidden files and directories are
+// skipped, since that is where cardslurp keeps its own bookkeeping.
+func loadTargetSizes(targetDir string, hasher Hasher) (*targetSizes, error) {
+
+	rv := &targetSizes{
+		bySize:  make(map[int64][]string),
+		digests: make(map[string]cardfileutil.FileDigest),
+		hasher:  hasher,
+	}
+
+	if targetDir == "" {
+		return rv, nil
+	}
+
+	err := filepath.WalkDir(targetDir, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileName != targetDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rv.bySize[info.Size()] = append(rv.bySize[info.Size()], fileName)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading target directory %s: %w", targetDir, err)
+	}
+
+	return rv, nil
+}
+
+// digestOf - The digest of a file in the target.
+func (t *targetSizes) digestOf(fileName string) (cardfileutil.FileDigest, error) {
+
+	t.Lock()
+	digest, ok := t.digests[fileName]
+	t.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	digest, err := t.hasher.HashFile(fileName)
+	if err != nil {
+		return digest, err
+	}
+
+	t.Lock()
+	t.digests[fileName] = digest
+	t.Unlock()
+
+	return digest, nil
+}
+
+// compare - True if fileName is an intact copy, or why it is not.
+func (t *targetSizes) compare(fileName string, size int64,
+	digest cardfileutil.FileDigest) (bool, string) {
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return false, err.Error()
+	}
+	if info.Size() != size {
+		return false, fmt.Sprintf("%s is %d bytes", fileName, info.Size())
+	}
+
+	copyDigest, err := t.digestOf(fileName)
+	if err != nil {
+		return false, err.Error()
+	}
+	if !copyDigest.Equal(digest) {
+		return false, fmt.Sprintf("%s has %s", fileName, copyDigest)
+	}
+
+	return true, ""
+}
+
+// AuditCards - Check that every file on the cards has an intact copy in
+// the target directory or the library, so the cards are safe to format.
+// The cards are walked the same way an import walks them, and every file
+// on them is read and hashed.  A file counts as found if a file in the
+// target or the library has the same size and digest.  The results are in
+// the order of cardPathList.  Cancelling ctx stops the walks, and the
+// cards not finished are not safe.
+func AuditCards(ctx context.Context, cardPathList []string, opts AuditOpts) ([]CardAudit, error) {
+
+	for _, cp := range cardPathList {
+		stat, err := os.Stat(cp)
+		if err != nil {
+			return nil, fmt.Errorf("error checking card %s: %w", cp, err)
+		}
+		if !stat.IsDir() {
+			return nil, fmt.Errorf("card %s is not a directory", cp)
+		}
+	}
+
+	target, err := loadTargetSizes(opts.TargetDir, opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-finished:
+		}
+	}()
+
+	rv := make([]CardAudit, len(cardPathList))
+	var wg sync.WaitGroup
+	for i, cp := range cardPathList {
+		wg.Add(1)
+		go func(i int, cp string) {
+			defer wg.Done()
+			rv[i] = auditCard(ctx, filepath.Clean(cp), opts, target, stop)
+		}(i, cp)
+	}
+	wg.Wait()
+
+	return rv, nil
+}
+
+// auditCard - Walk one card, and look for each of its files.
+func auditCard(ctx context.Context, cardPath string, opts AuditOpts, target *targetSizes,
+	stop <-chan struct{}) CardAudit {
+
+	rv := CardAudit{
+		Card:         cardPath,
+		Found:        make(map[string]string),
+		Missing:      make([]string, 0),
+		Different:    make([]string, 0),
+		SkippedPaths: make([]string, 0),
+	}
+
+	card := &cardWalk{
+		path:    cardPath,
+		groups:  make(chan *AssetGroup, cardQueueDepth),
+		timeout: opts.CardTimeout,
+		readDir: os.ReadDir,
+		filter:  opts.Filter,
+	}
+	go locateFiles(card, stop, false)
+
+	for g := range card.groups {
+		for _, wMsg := range g.members {
+			if rv.Err != nil {
+				// Drain the walk, so it can finish.
+				continue
+			}
+			rv.Files++
+			err := auditFile(&rv, wMsg, opts, target, stop)
+			if err != nil {
+				rv.Err = err
+			}
+		}
+	}
+
+	rv.Filtered = card.result.Filtered
+	rv.SkippedPaths = append(card.result.SkippedPaths, rv.SkippedPaths...)
+	if rv.Err == nil {
+		rv.Err = card.result.LocateError
+	}
+	if rv.Err == nil && ctx.Err() != nil {
+		rv.Err = fmt.Errorf("audit of %s stopped: %w", cardPath, ctx.Err())
+	}
+
+	return rv
+}
+
+// auditFile - Look for one card file.  The copy the ledger recorded is
+// tried first, then every file of the same size in the target, and then
+// the library.  Every candidate is hashed again before it counts.  Only a stalled or stopped card is returned as an error.
+func auditFile(rv *CardAudit, wMsg CardSlurpWork, opts AuditOpts, target *targetSizes,
+	stop <-chan struct{}) error {
+
+	sourceFile := path.Join(wMsg.parentDir, wMsg.fileName)
+	rel, err := filepath.Rel(rv.Card, sourceFile)
+	if err != nil {
+		rel = sourceFile
+	}
+	rel = filepath.ToSlash(rel)
+
+	var digest cardfileutil.FileDigest
+	err = stallGuard(opts.CardTimeout, stop, "reading "+sourceFile, func() error {
+		var err error
+		digest, err = opts.Hasher.HashFile(sourceFile)
+		return err
+	})
+	if errors.Is(err, errCardStalled) || errors.Is(err, errLocateStopped) {
+		return err
+	}
+	if err != nil {
+		rv.SkippedPaths = append(rv.SkippedPaths, fmt.Sprintf("%s: %s", sourceFile, err.Error()))
+		return nil
+	}
+
+	// A copy that should match, but does not, is worth naming.
+	different := ""
+
+	if opts.Imported != nil {
+		recorded, _, ok := opts.Imported.Lookup(sourceFile, wMsg.fileSize, wMsg.fileTime)
+		if ok {
+			match, why := target.compare(recorded, wMsg.fileSize, digest)
+			if match {
+				rv.Found[rel] = recorded
+				return nil
+			}
+			different = why
+		}
+	}
+
+	for _, c := range target.bySize[wMsg.fileSize] {
+		match, why := target.compare(c, wMsg.fileSize, digest)
+		if match {
+			rv.Found[rel] = c
+			return nil
+		}
+		if different == "" && strings.EqualFold(filepath.Base(c), wMsg.fileName) {
+			different = why
+		}
+	}
+
+	if opts.LibraryIndex != nil {
+		existing, ok := opts.LibraryIndex.Lookup(wMsg.fileSize, digest)
+		if ok {
+			// The index keeps a digest for as long as the size and
+			// modification time hold, and bit rot changes neither, so
+			// the library copy is read again too.
+			match, why := target.compare(existing, wMsg.fileSize, digest)
+			if match {
+				rv.Found[rel] = existing
+				return nil
+			}
+			if different == "" {
+				different = why
+			}
+		}
+	}
+
+	if different != "" {
+		rv.Different = append(rv.Different, fmt.Sprintf("%s: %s, but %s", rel, digest, different))
+		return nil
+	}
+
+	rv.Missing = append(rv.Missing, rel)
+	return nil
+}
@@ -0,0 +1,129 @@
+package filecontrol
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestAuditCards(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3", "DCIM/100CANON/IMG_0003.CR3"})
+	targetDir := t.TempDir()
+	libraryDir := t.TempDir()
+
+	copyTo := func(name string, to string) {
+		data, err := os.ReadFile(filepath.Join(cardDir, "DCIM", "100CANON", name))
+		if err != nil {
+			t.Fatal("error reading card file: " + err.Error())
+		}
+		err = os.WriteFile(to, data, 0644)
+		if err != nil {
+			t.Fatal("error writing copy: " + err.Error())
+		}
+	}
+
+	// 0001 under its own name, 0002 renamed, and 0003 only in the library.
+	copyTo("IMG_0001.CR3", filepath.Join(targetDir, "IMG_0001.CR3"))
+	copyTo("IMG_0002.CR3", filepath.Join(targetDir, "20260301_R5_0002.CR3"))
+	copyTo("IMG_0003.CR3", filepath.Join(libraryDir, "IMG_0003.CR3"))
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+	idx, err := libindex.Load(filepath.Join(libraryDir, libindex.DefaultFileName),
+		cardfileutil.HashSHA256, cfu)
+	if err != nil {
+		t.Fatal("error loading library index: " + err.Error())
+	}
+	_, err = idx.Update([]string{libraryDir})
+	if err != nil {
+		t.Fatal("error updating library index: " + err.Error())
+	}
+
+	filter, err := NewFilter(FilterOpts{})
+	if err != nil {
+		t.Fatal("error making filter: " + err.Error())
+	}
+	opts := AuditOpts{
+		TargetDir:    targetDir,
+		LibraryIndex: idx,
+		Hasher:       cfu,
+		Filter:       filter,
+	}
+
+	audits, err := AuditCards(context.Background(), []string{cardDir}, opts)
+	if err != nil {
+		t.Fatal("error auditing: " + err.Error())
+	}
+	if len(audits) != 1 || !audits[0].Safe() || audits[0].Files != 3 {
+		t.Fatalf("expected the card to be safe, got %+v", audits)
+	}
+	if audits[0].Found["DCIM/100CANON/IMG_0002.CR3"] != filepath.Join(targetDir, "20260301_R5_0002.CR3") {
+		t.Errorf("unexpected copies %v", audits[0].Found)
+	}
+
+	// A damaged copy, and a file nobody copied.
+	err = os.WriteFile(filepath.Join(targetDir, "IMG_0001.CR3"), []byte("image DCIM/100CANON/IMG_0009.CR3"), 0644)
+	if err != nil {
+		t.Fatal("error altering copy: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(cardDir, "DCIM", "100CANON", "IMG_0004.CR3"), []byte("new image"), 0644)
+	if err != nil {
+		t.Fatal("error writing card file: " + err.Error())
+	}
+
+	audits, err = AuditCards(context.Background(), []string{cardDir}, opts)
+	if err != nil {
+		t.Fatal("error auditing: " + err.Error())
+	}
+	a := audits[0]
+	if a.Safe() || a.Files != 4 || len(a.Found) != 2 {
+		t.Errorf("expected 2 of 4 files to have a copy, got %+v", a)
+	}
+	if len(a.Different) != 1 || !strings.HasPrefix(a.Different[0], "DCIM/100CANON/IMG_0001.CR3: ") {
+		t.Errorf("unexpected different files %v", a.Different)
+	}
+	if len(a.Missing) != 1 || a.Missing[0] != "DCIM/100CANON/IMG_0004.CR3" {
+		t.Errorf("unexpected missing files %v", a.Missing)
+	}
+
+	// Bit rot in the library leaves the size and modification time alone,
+	// so the index still has the old digest.
+	libraryFile := filepath.Join(libraryDir, "IMG_0003.CR3")
+	info, err := os.Stat(libraryFile)
+	if err != nil {
+		t.Fatal("error calling stat on library file: " + err.Error())
+	}
+	data, err := os.ReadFile(libraryFile)
+	if err != nil {
+		t.Fatal("error reading library file: " + err.Error())
+	}
+	data[0] ^= 0xff
+	err = os.WriteFile(libraryFile, data, 0644)
+	if err != nil {
+		t.Fatal("error corrupting library file: " + err.Error())
+	}
+	err = os.Chtimes(libraryFile, info.ModTime(), info.ModTime())
+	if err != nil {
+		t.Fatal("error restoring library file time: " + err.Error())
+	}
+	_, err = idx.Update([]string{libraryDir})
+	if err != nil {
+		t.Fatal("error updating library index: " + err.Error())
+	}
+
+	audits, err = AuditCards(context.Background(), []string{cardDir}, opts)
+	if err != nil {
+		t.Fatal("error auditing: " + err.Error())
+	}
+	a = audits[0]
+	if a.Safe() || a.Found["DCIM/100CANON/IMG_0003.CR3"] != "" || len(a.Different) != 2 {
+		t.Errorf("expected the rotten library copy to not count, got %+v", a)
+	}
+}
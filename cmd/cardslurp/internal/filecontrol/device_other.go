@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package filecontrol
+
+// deviceID - Without a way to find the device, treat every path as its
+// own device.
+func deviceID(path string) (string, error) {
+	return path, nil
+}
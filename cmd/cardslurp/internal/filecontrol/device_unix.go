@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package filecontrol
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// deviceID - Identify the device a path lives on, from st_dev.
+func deviceID(path string) (string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error calling stat on %s: %w", path, err)
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return path, nil
+	}
+
+	return fmt.Sprintf("dev:%d", st.Dev), nil
+}
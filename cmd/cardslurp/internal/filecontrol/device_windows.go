@@ -0,0 +1,27 @@
+//go:build windows
+
+package filecontrol
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// deviceID - Identify the device a path lives on.  On Windows each card
+// reader gets its own drive letter, so the volume name is enough.
+func deviceID(path string) (string, error) {
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error calling stat on %s: %w", path, err)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("error making %s absolute: %w", path, err)
+	}
+
+	return strings.ToUpper(filepath.VolumeName(abs)), nil
+}
@@ -0,0 +1,110 @@
+package filecontrol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// ErrorCategory - What kind of failure stopped a file.  main turns these
+// into exit codes, so a wrapper script can tell a bad card from a full
+// target disk.
+type ErrorCategory string
+
+const (
+	// CategorySourceRead - The file could not be read from the card.
+	CategorySourceRead ErrorCategory = "source read"
+	// CategoryTargetWrite - The copy, the ledger or the journal could not
+	// be written to the target.
+	CategoryTargetWrite ErrorCategory = "target write"
+	// CategoryVerify - The copy still did not match the source after every
+	// retry.
+	CategoryVerify ErrorCategory = "verify mismatch"
+	// CategoryNaming - No target name could be picked for the file.
+	CategoryNaming ErrorCategory = "naming"
+	// CategoryDiscovery - A card could not be searched for files.
+	CategoryDiscovery ErrorCategory = "discovery"
+)
+
+// FileError - One file (or card, for CategoryDiscovery) that failed, and
+// why.
+type FileError struct {
+	Category ErrorCategory
+	File     string
+	Err      error
+}
+
+func (f *FileError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", f.File, f.Category, f.Err.Error())
+}
+
+func (f *FileError) Unwrap() error {
+	return f.Err
+}
+
+// copyErrCategory - Sort an error from CardFileCopy.  Anything that was
+// not reading the card, or a mismatch, happened on the target side.
+func copyErrCategory(err error) ErrorCategory {
+	switch {
+	case errors.Is(err, cardfileutil.ErrSourceRead):
+		return CategorySourceRead
+	case errors.Is(err, cardfileutil.ErrVerifyMismatch),
+		errors.Is(err, cardfileutil.ErrMetadataMismatch):
+		return CategoryVerify
+	default:
+		return CategoryTargetWrite
+	}
+}
+
+// ErrorMode - How a run reacts to a file that fails.
+type ErrorMode string
+
+const (
+	// PolicyFailFast - Stop at the first failed file.  This is the default.
+	PolicyFailFast ErrorMode = "failfast"
+	// PolicyContinue - Copy everything that can be copied, and report the
+	// failures at the end.
+	PolicyContinue ErrorMode = "continue"
+	// PolicyBudget - Like PolicyContinue, but stop once more than
+	// ErrorPolicy.Budget files have failed.
+	PolicyBudget ErrorMode = "budget"
+)
+
+// ErrErrorBudget - More files failed than the error policy allows.
+var ErrErrorBudget = errors.New("error budget exhausted")
+
+// ParseErrorMode - Convert a command line string to an ErrorMode.
+func ParseErrorMode(name string) (ErrorMode, error) {
+	switch ErrorMode(name) {
+	case PolicyFailFast, PolicyContinue, PolicyBudget:
+		return ErrorMode(name), nil
+	default:
+		return "", fmt.Errorf("unknown error policy %q (failfast, continue or budget)", name)
+	}
+}
+
+// ErrorPolicy - When a run gives up on the files it has not reached yet.
+// The zero value is PolicyFailFast.
+type ErrorPolicy struct {
+	Mode ErrorMode
+	// Budget - Failed files allowed by PolicyBudget.
+	Budget uint64
+}
+
+// exhausted - True once failures is more than the policy allows.
+func (p ErrorPolicy) exhausted(failures int) bool {
+	switch p.Mode {
+	case PolicyContinue:
+		return false
+	case PolicyBudget:
+		return uint64(failures) > p.Budget
+	default:
+		return failures > 0
+	}
+}
+
+// failFast - True if a group should stop at its first failed member.
+func (p ErrorPolicy) failFast() bool {
+	return p.Mode != PolicyContinue && p.Mode != PolicyBudget
+}
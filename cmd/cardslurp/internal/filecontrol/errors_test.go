@@ -0,0 +1,122 @@
+package filecontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// unreadableCard - Fails to read any card file with BAD in its name, like
+// a card with a few damaged sectors.
+type unreadableCard struct {
+	*cardfileutil.CardFileUtil
+}
+
+func (u unreadableCard) CardFileCopy(ctx context.Context, fromFile string,
+	toFile string, obs cardfileutil.CopyObserver) (cardfileutil.CopyResult, error) {
+	if strings.Contains(fromFile, "BAD") {
+		return cardfileutil.CopyResult{}, fmt.Errorf("%w: %w",
+			cardfileutil.ErrSourceRead, errInjected)
+	}
+	return u.CardFileUtil.CardFileCopy(ctx, fromFile, toFile, obs)
+}
+
+func TestErrorPolicy(t *testing.T) {
+
+	cardDir := t.TempDir()
+	for _, name := range []string{"A_0001.CR2", "B_BAD2.CR2", "C_BAD3.CR2",
+		"D_0004.CR2", "E_0005.CR2"} {
+		err := os.WriteFile(filepath.Join(cardDir, name), []byte("image "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+	}
+
+	cfu := unreadableCard{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+	}
+
+	runImport := func(policy ErrorPolicy) (WorkerPoolFinishMsg, error) {
+
+		nameOracle, err := NewTargetNameGenManager(t.TempDir(), "", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+
+		// One worker, so the files are copied in directory order.
+		workerPool := NewWorkerPool(1, nameOracle, false, cfu, 1, WorkerPoolOpts{
+			DeviceWorkers: 1,
+			ErrorPolicy:   policy,
+		})
+
+		err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+		if err != nil {
+			t.Fatal("error locating files: " + err.Error())
+		}
+
+		return workerPool.ParallelFileCopy(context.Background())
+	}
+
+	// Continue copies everything else, and reports both failures.
+	res, err := runImport(ErrorPolicy{Mode: PolicyContinue})
+	if err != nil {
+		t.Fatal("continue policy returned an error: " + err.Error())
+	}
+	if res.Copied != 3 || len(res.Failed) != 2 {
+		t.Fatalf("expected 3 copied and 2 failed, got %+v", res)
+	}
+	for _, f := range res.Failed {
+		if f.Category != CategorySourceRead || !strings.Contains(f.File, "BAD") {
+			t.Errorf("unexpected failure %s", f.Error())
+		}
+		if !errors.Is(f, errInjected) {
+			t.Errorf("failure %s lost its cause", f.Error())
+		}
+	}
+
+	// Fail fast stops at the first one.
+	res, err = runImport(ErrorPolicy{})
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) || !strings.HasSuffix(fileErr.File, "B_BAD2.CR2") {
+		t.Fatalf("expected the first failure from fail fast, got %v", err)
+	}
+	if res.Copied != 1 || len(res.Failed) != 1 {
+		t.Fatalf("expected 1 copied and 1 failed, got %+v", res)
+	}
+
+	// A budget of one lets the first failure go, but not the second.
+	res, err = runImport(ErrorPolicy{Mode: PolicyBudget, Budget: 1})
+	if !errors.Is(err, ErrErrorBudget) {
+		t.Fatalf("expected ErrErrorBudget, got %v", err)
+	}
+	if len(res.Failed) != 2 {
+		t.Fatalf("expected 2 failed, got %+v", res)
+	}
+}
+
+func TestCopyErrCategory(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{fmt.Errorf("wrapped: %w", cardfileutil.ErrSourceRead), CategorySourceRead},
+		{fmt.Errorf("wrapped: %w", cardfileutil.ErrVerifyMismatch), CategoryVerify},
+		{fmt.Errorf("wrapped: %w", cardfileutil.ErrMetadataMismatch), CategoryVerify},
+		{errInjected, CategoryTargetWrite},
+	}
+
+	for _, tc := range tests {
+		got := copyErrCategory(tc.err)
+		if got != tc.want {
+			t.Errorf("copyErrCategory(%v) = %s, expected %s", tc.err, got, tc.want)
+		}
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/journal"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/manifest"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+	"github.com/pheckenlively123/cardSlurp/internal/mediameta"
 )
 
 // WorkerPoolFinishMsg - passed back to main from the per card worker threads.
@@ -21,143 +27,431 @@ type WorkerPoolFinishMsg struct {
 	Skipped   uint64
 	Copied    uint64
 	Retries   uint64
+	Groups    uint64
 	MinorErrs []string
+	// Interrupted - The run was cancelled before everything was copied.
+	Interrupted bool
+	// Remaining - Files that were found, but neither copied nor skipped.
+	Remaining uint64
+	// UnfinishedCards - Cards that were not completely walked, so they
+	// may have more files than Remaining counts.
+	UnfinishedCards []string
+	// Failed - Every file that could not be copied, and why, in the order
+	// they failed.  Cards that could not be searched are at the end.
+	Failed []*FileError
+	// SkippedPaths - Directories and files on the cards that could not be
+	// read, so their files were never found.
+	SkippedPaths []string
+	// Targets - What each target got, starting with the WorkerPool's own,
+	// then WorkerPoolOpts.Mirrors in order.  Skipped, Copied and Failed
+	// above add up every target, so a mirrored file counts once for each.
+	Targets []TargetResult
+}
+
+// TargetResult - Files copied to, skipped in, and failed in one target
+// directory.
+type TargetResult struct {
+	Dir     string
+	Copied  uint64
+	Skipped uint64
+	Failed  uint64
 }
 
 type LocateFilesFinishMsg struct {
 	ParentDir   string
 	FileCount   uint64
+	GroupCount  uint64
 	LocateError error
+	// SkippedPaths - Directories and files under the card that could not
+	// be read, with the reason.
+	SkippedPaths []string
+	// Filtered - Files the discovery filter dropped.
+	Filtered uint64
 }
 
 // Put the work request and the results in a single structure.
 // This makes doing retries easier.
 type CardSlurpWork struct {
+	sourceCard  string
 	parentDir   string
 	fileName    string
 	targetName  string
 	fileTime    time.Time
+	captureTime time.Time
+	// captureTime and the camera fields come from the file's metadata,
+	// when it has any.  They feed sorting, the layout and the rename
+	// template.
+	cameraMake   string
+	cameraModel  string
+	cameraSerial string
+	orientation  int
+	// Only set for video.
+	duration    time.Duration
+	width       int
+	height      int
+	fileSize    int64
 	skipped     bool
 	copied      bool
 	retriesUsed uint64
+	digest      cardfileutil.FileDigest
+	extras      []cardfileutil.FileDigest
 	minorErr    []string
-	majorErr    error
+	majorErr    *FileError
+	// mirrors - This file in each of WorkerPoolOpts.Mirrors, in order.
+	// Only the outcome (targetName, skipped, copied, the digests, retries
+	// and errors) is their own.
+	mirrors []CardSlurpWork
+	// mirrorDir - For the outcome in a mirror, its target directory.
+	mirrorDir string
 }
 
-type CardFileUtilProvider interface {
-	IsFileSame(fromFile string, toFile string) (bool, error)
-	CardFileCopy(fromFile string, toFile string) error
+// outcomes - The file in every target, starting with the WorkerPool's
+// own.
+func (c *CardSlurpWork) outcomes() []*CardSlurpWork {
+	rv := make([]*CardSlurpWork, 0, len(c.mirrors)+1)
+	rv = append(rv, c)
+	for i := range c.mirrors {
+		rv = append(rv, &c.mirrors[i])
+	}
+	return rv
 }
 
-func OrchestrateLocate(cardPathList []string, workerPool *WorkerPool,
-	debugMode bool) error {
+// failed - True if the file failed in any target.
+func (c *CardSlurpWork) failed() bool {
+	for _, o := range c.outcomes() {
+		if o.majorErr != nil {
+			return true
+		}
+	}
+	return false
+}
 
-	finishCh := make(chan LocateFilesFinishMsg)
+// sourceLabel - The source file, for progress messages, and the mirror
+// it is going to.
+func (c CardSlurpWork) sourceLabel() string {
+	sourceFile := path.Join(c.parentDir, c.fileName)
+	if c.mirrorDir == "" {
+		return sourceFile
+	}
+	return sourceFile + " (mirror " + c.mirrorDir + ")"
+}
 
-	wg := &sync.WaitGroup{}
+// bestTime - When the file was shot.  The capture time from the file's
+// metadata is preferred, and the filesystem mtime is the fallback.
+func (c CardSlurpWork) bestTime() time.Time {
+	if !c.captureTime.IsZero() {
+		return c.captureTime
+	}
+	return c.fileTime
+}
 
-	for _, cp := range cardPathList {
-		wg.Add(1)
-		go locateFiles(cp, wg, workerPool, finishCh, debugMode)
+// fail - Record a major error for this file.  In a mirror, the error says
+// which one.
+func (c *CardSlurpWork) fail(category ErrorCategory, err error) {
+	if c.mirrorDir != "" {
+		err = fmt.Errorf("mirror %s: %w", c.mirrorDir, err)
 	}
+	c.majorErr = &FileError{
+		Category: category,
+		File:     path.Join(c.parentDir, c.fileName),
+		Err:      err,
+	}
+}
+
+// applyMetadata - Copy what the metadata reader found into the work
+// request.
+func (c *CardSlurpWork) applyMetadata(md mediameta.Metadata) {
+	c.captureTime = md.CaptureTime
+	c.cameraMake = md.Make
+	c.cameraModel = md.Model
+	c.cameraSerial = md.Serial
+	c.orientation = md.Orientation
+	c.duration = md.Duration
+	c.width = md.Width
+	c.height = md.Height
+}
+
+type CardFileUtilProvider interface {
+	IsFileSame(fromFile string, toFile string) (bool, error)
+	CardFileCopy(ctx context.Context, fromFile string, toFile string,
+		obs cardfileutil.CopyObserver) (cardfileutil.CopyResult, error)
+	HashFile(fileName string) (cardfileutil.FileDigest, error)
+}
 
-	for i := 0; i < len(cardPathList); i++ {
+// OrchestrateLocate - Start walking every card.  Asset groups are handed to
+// the worker pool as soon as they are found, so ParallelFileCopy can start
+// copying right away.  The cards are sorted by the device they are mounted
+// from, and each device gets its own workers (see feedDevice).  Returns
+// once every card has been checked and the walks are running.  Errors
+// found while walking are returned by ParallelFileCopy.  Cancelling ctx
+// stops discovery and the copy (see ParallelFileCopy).
+func OrchestrateLocate(ctx context.Context, cardPathList []string,
+	workerPool *WorkerPool, debugMode bool) error {
 
-		locMsg := <-finishCh
-		if locMsg.LocateError != nil {
-			// If we got a major error, no point in continuing.
-			return fmt.Errorf("major error locating files for %s: %w",
-				locMsg.ParentDir, locMsg.LocateError)
+	for _, cp := range cardPathList {
+		stat, err := os.Stat(cp)
+		if err != nil {
+			return fmt.Errorf("error checking card %s: %w", cp, err)
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("card %s is not a directory", cp)
 		}
+	}
+
+	cards := make([]*cardWalk, 0, len(cardPathList))
+	for _, cp := range cardPathList {
+		cards = append(cards, &cardWalk{
+			path:   filepath.Clean(cp),
+			groups: make(chan *AssetGroup, cardQueueDepth),
+		})
+	}
 
-		fmt.Printf("Located %d files in: %s\n", locMsg.FileCount, locMsg.ParentDir)
+	devices, err := groupByDevice(cards)
+	if err != nil {
+		return err
 	}
+	workerPool.devices = devices
+	workerPool.groupTargets()
 
-	// The LocateFiles goroutines should all have returned by this point,
-	// so this is a belt + suspenders measure.
-	wg.Wait()
+	go workerPool.watch(ctx)
+
+	for _, dev := range devices {
+		for _, card := range dev.cards {
+			card.timeout = workerPool.opts.CardTimeout
+			card.readDir = workerPool.readDir
+			card.filter = workerPool.opts.Filter
+			go locateFiles(card, workerPool.stop, debugMode)
+		}
+		workerPool.feeders.Add(1)
+		go func(dev *sourceDevice) {
+			defer workerPool.feeders.Done()
+			workerPool.feedDevice(dev)
+		}(dev)
+	}
 
 	return nil
 }
 
-// locateFiles - Recurse each of the cards for all files.
-func locateFiles(fullPath string, wg *sync.WaitGroup,
-	workerPool *WorkerPool, locateFinishCh chan LocateFilesFinishMsg,
-	debugMode bool) {
+// cardQueueDepth - How many asset groups each card walk may get ahead of
+// the copy.
+const cardQueueDepth = 16
+
+var errLocateStopped = errors.New("file discovery stopped")
+
+// cardWalk - One card being walked.  result is only valid once groups
+// has been closed.
+type cardWalk struct {
+	path   string
+	groups chan *AssetGroup
+	result LocateFilesFinishMsg
+	// timeout - How long one read from the card may take (see
+	// stallGuard).
+	timeout time.Duration
+	// readDir - os.ReadDir, unless a test needs a card that misbehaves.
+	readDir func(name string) ([]os.DirEntry, error)
+	// filter - Which files to import.  Nil keeps everything.
+	filter *Filter
+	// done - Every group from the card was handed to the workers.  Only
+	// touched by feedDevice.
+	done bool
+}
 
-	defer wg.Done()
+// skip - Note a path under the card that could not be read.  The walk
+// carries on without it.
+func (c *cardWalk) skip(name string, err error) {
+	fmt.Printf("Warning: skipping unreadable %s: %s\n", name, err.Error())
+	c.result.SkippedPaths = append(c.result.SkippedPaths,
+		fmt.Sprintf("%s: %s", name, err.Error()))
+}
 
-	rv := LocateFilesFinishMsg{
-		ParentDir: fullPath,
-	}
+// locateFiles - Recurse a card for all files, sending each asset group
+// out as soon as its directory has been read.  groups is always closed,
+// so the card reports back, even if it stalls or can not be read at all.
+func locateFiles(card *cardWalk, stop <-chan struct{}, debugMode bool) {
 
-	foundFiles := make([]CardSlurpWork, 0)
+	defer close(card.groups)
 
-	var wdf fs.WalkDirFunc = func(path string, d fs.DirEntry, err error) error {
+	card.result.ParentDir = card.path
 
+	if card.filter != nil {
+		var filter *Filter
+		err := stallGuard(card.timeout, stop, "reading "+IgnoreFileName, func() error {
+			var err error
+			filter, err = card.filter.ForCard(card.path)
+			return err
+		})
 		if err != nil {
-			return fmt.Errorf("wdf received an error in input: %w", err)
+			card.result.LocateError = fmt.Errorf("error loading filter for %s: %w", card.path, err)
+			return
 		}
+		card.filter = filter
+	}
 
-		if debugMode {
-			fmt.Printf("Examining path: %s\n", path)
+	err := walkCardDir(card, card.path, stop, debugMode)
+	if err != nil {
+		card.result.LocateError = fmt.Errorf("error recursing path %s: %w", card.path, err)
+	}
+}
+
+// walkCardDir - Hand off the asset groups in one directory, then descend
+// into its subdirectories.  Only one directory's files are held in memory
+// at a time, and a group can never be split by a subdirectory.
+//
+// Directories and files that can not be read are skipped, with a warning,
+// and so is anything that is not a regular file.  Only an unreadable card
+// root, a stalled read, or a stop ends the walk with an error.
+func walkCardDir(card *cardWalk, dir string, stop <-chan struct{}, debugMode bool) error {
+
+	if debugMode {
+		fmt.Printf("Examining path: %s\n", dir)
+	}
+
+	var entries []os.DirEntry
+	err := stallGuard(card.timeout, stop, "reading "+dir, func() error {
+		var err error
+		entries, err = card.readDir(dir)
+		return err
+	})
+	if errors.Is(err, errCardStalled) || errors.Is(err, errLocateStopped) {
+		return err
+	}
+	if err != nil {
+		if dir == card.path {
+			return fmt.Errorf("error reading directory %s: %w", dir, err)
 		}
+		// ReadDir returns whatever it read before the error.
+		card.skip(dir, err)
+	}
 
-		if !d.IsDir() {
+	foundFiles := make([]CardSlurpWork, 0)
+	subDirs := make([]string, 0)
 
-			fileInfo, err := d.Info()
-			if err != nil {
-				return fmt.Errorf("errro getting info for %s: %w", d.Name(), err)
-			}
+	for _, d := range entries {
 
-			parentPath, fileName := filepath.Split(path)
-			parentPath = strings.TrimSuffix(parentPath, "/")
+		fullName := filepath.Join(dir, d.Name())
 
-			if fileName != d.Name() {
-				return fmt.Errorf(
-					"filename from filepath.Split and DirEntry do not match %s != %s",
-					fileName, d.Name())
+		if card.filter != nil {
+			rel, err := filepath.Rel(card.path, fullName)
+			if err != nil {
+				return fmt.Errorf("error finding %s on the card: %w", fullName, err)
 			}
-			foundRec := CardSlurpWork{
-				parentDir: parentPath,
-				fileName:  fileName,
-				fileTime:  fileInfo.ModTime(),
+			dec := card.filter.Decide(rel, d.IsDir())
+			if !dec.Keep {
+				if debugMode {
+					fmt.Printf("Filtered out %s (%s)\n", fullName, dec.Rule)
+				}
+				if !d.IsDir() {
+					card.result.Filtered++
+				}
+				continue
 			}
+		}
 
-			foundFiles = append(foundFiles, foundRec)
+		if d.IsDir() {
+			subDirs = append(subDirs, fullName)
+			continue
 		}
 
-		return nil
+		// A symlink would be copied from wherever it points, with the
+		// size of the link.
+		if !d.Type().IsRegular() {
+			fmt.Printf("Skipping %s: (not a regular file)\n", fullName)
+			continue
+		}
+
+		var fileInfo os.FileInfo
+		err = stallGuard(card.timeout, stop, "reading "+fullName, func() error {
+			var err error
+			fileInfo, err = d.Info()
+			return err
+		})
+		if errors.Is(err, errCardStalled) || errors.Is(err, errLocateStopped) {
+			return err
+		}
+		if err != nil {
+			card.skip(fullName, err)
+			continue
+		}
+
+		foundRec := CardSlurpWork{
+			sourceCard: card.path,
+			parentDir:  dir,
+			fileName:   d.Name(),
+			fileTime:   fileInfo.ModTime(),
+			fileSize:   fileInfo.Size(),
+		}
+
+		// Metadata is nice to have.  Files without it, or with
+		// metadata we can not parse, fall back to the mtime.
+		var md mediameta.Metadata
+		err = stallGuard(card.timeout, stop, "reading metadata of "+fullName, func() error {
+			var err error
+			md, err = mediameta.ReadFile(fullName)
+			return err
+		})
+		if errors.Is(err, errCardStalled) || errors.Is(err, errLocateStopped) {
+			return err
+		}
+		if err == nil {
+			foundRec.applyMetadata(md)
+			if debugMode {
+				fmt.Printf("Metadata for %s: shot %s with %s %s, %dx%d %s\n",
+					d.Name(), md.CaptureTime, md.Make, md.Model,
+					md.Width, md.Height, md.Duration)
+			}
+		} else if debugMode && !errors.Is(err, mediameta.ErrNoMetadata) {
+			fmt.Printf("Unable to read metadata: %s\n", err.Error())
+		}
+
+		foundFiles = append(foundFiles, foundRec)
 	}
 
-	err := filepath.WalkDir(fullPath, wdf)
-	if err != nil {
-		// Punch out early
-		rv.LocateError = fmt.Errorf("error recursing path %s: %w", fullPath, err)
-		return
+	// Hand off the asset groups to the worker pool to copy in parallel.
+	// This blocks when the copy falls behind.
+	for _, g := range groupFiles(foundFiles) {
+		select {
+		case card.groups <- g:
+		case <-stop:
+			return errLocateStopped
+		}
+		card.result.FileCount += uint64(len(g.members))
+		card.result.GroupCount++
 	}
 
-	// Hand off the list of files to the worker pool to copy in parallel.
-	for _, foundFile := range foundFiles {
-		workerPool.queueFile(foundFile)
-		rv.FileCount++
+	for _, sub := range subDirs {
+		err = walkCardDir(card, sub, stop, debugMode)
+		if err != nil {
+			return err
+		}
 	}
 
-	locateFinishCh <- rv
+	return nil
 }
 
 // TargetNameGenManager - Manage naming of the target filename.  All Calls for
 // a new filename require writing to the map, so make this struct compose sync.Mutex
 // instead of sync.RWMutex.
+//
+// Known targets are keyed by their lower case name, so names that only
+// differ by case count as a collision.  Otherwise a case insensitive
+// filesystem (the default on MacOS and Windows) would quietly overwrite.
 type TargetNameGenManager struct {
 	sync.Mutex
 	knowntargets map[string]bool
+	loadedDirs   map[string]bool
 	targetDir    string
+	layout       string
+	renamer      *RenameTemplate
+	counter      uint64
 	cfu          CardFileUtilProvider
 }
 
-// NewTargetNameGenManager - Constructor for TargetNameGenManager
-func NewTargetNameGenManager(targetDir string,
+// NewTargetNameGenManager - Constructor for TargetNameGenManager.  If layout
+// is not empty, each file goes into a subdirectory of targetDir made from
+// the layout template and the file's capture time (see expandLayout).  If
+// renameTmpl is not empty, target file names are built from it (see
+// RenameTemplate), instead of keeping the name from the card.
+func NewTargetNameGenManager(targetDir string, layout string, renameTmpl string,
 	cfu CardFileUtilProvider) (*TargetNameGenManager, error) {
 
 	stat, err := os.Stat(targetDir)
@@ -170,286 +464,1320 @@ func NewTargetNameGenManager(targetDir string,
 			"%s is not a directory", targetDir)
 	}
 
+	if layout != "" {
+		err = validateLayout(layout)
+		if err != nil {
+			return &TargetNameGenManager{}, err
+		}
+	}
+
+	var renamer *RenameTemplate
+	if renameTmpl != "" {
+		renamer, err = ParseRenameTemplate(renameTmpl)
+		if err != nil {
+			return &TargetNameGenManager{}, err
+		}
+	}
+
 	rv := &TargetNameGenManager{
 		Mutex:        sync.Mutex{},
 		knowntargets: make(map[string]bool),
+		loadedDirs:   make(map[string]bool),
 		targetDir:    targetDir,
+		layout:       layout,
+		renamer:      renamer,
 		cfu:          cfu,
 	}
 
-	files, err := os.ReadDir(targetDir)
+	err = rv.loadDir(targetDir)
 	if err != nil {
-		return &TargetNameGenManager{}, fmt.Errorf(
-			"error calling ReadDir: %w", err)
+		return &TargetNameGenManager{}, err
+	}
+
+	return rv, nil
+}
+
+// bookkeepingDirs - Directories cardslurp keeps its own records in, inside
+// a target directory.  They are not imported files, so the name oracle
+// skips them.
+var bookkeepingDirs = map[string]bool{
+	journal.DirName: true,
+	mhl.DirName:     true,
+}
+
+// loadDir - Make sure dir exists, and add the files already in it to the
+// known targets.  Each directory is only read once.  Caller must hold the
+// lock (or own the manager exclusively), which also keeps the workers from
+// racing each other to create the same directory.
+func (t *TargetNameGenManager) loadDir(dir string) error {
+
+	if t.loadedDirs[dir] {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error making target directory %s: %w", dir, err)
+	}
+
+	// Clean up temporary files from any copy that was interrupted, before
+	// they can be mistaken for real targets.
+	removed, err := cardfileutil.RemoveStaleTemps(dir)
+	if err != nil {
+		return fmt.Errorf("error removing stale temp files: %w", err)
+	}
+	for _, rm := range removed {
+		fmt.Printf("Removed leftover temp file: %s\n", rm)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error calling ReadDir: %w", err)
 	}
 
 	for _, fl := range files {
 
+		if fl.IsDir() && bookkeepingDirs[fl.Name()] {
+			continue
+		}
+
 		if !fl.Type().IsRegular() {
-			return &TargetNameGenManager{}, fmt.Errorf(
+			// With a layout, the subdirectories are expected.
+			if t.layout != "" && fl.IsDir() {
+				continue
+			}
+			return fmt.Errorf(
 				"target directory should only contain normal files: %s",
 				fl.Name(),
 			)
 		}
 
-		knownName := path.Join(targetDir, fl.Name())
-		rv.knowntargets[knownName] = true
+		t.markKnown(path.Join(dir, fl.Name()))
 	}
 
-	return rv, nil
+	t.loadedDirs[dir] = true
+
+	return nil
 }
 
-func (t *TargetNameGenManager) getTargetName(fullName string, prevTryName string) (string, bool, error) {
+func (t *TargetNameGenManager) isKnown(name string) bool {
+	return t.knowntargets[strings.ToLower(name)]
+}
 
-	// Lock, to protoect t.knowntargets
-	t.Lock()
-	defer t.Unlock()
+func (t *TargetNameGenManager) markKnown(name string) {
+	t.knowntargets[strings.ToLower(name)] = true
+}
 
-	// Skip the target filename creation log, if we have a known previous name attempt.
-	var tryName string
-	var fileName string
-	if prevTryName == "" {
-		_, fileName = path.Split(fullName)
-		tryName = path.Join(t.targetDir, fileName)
+// targetFileName - Name the file should have in the target directory.
+// Without a rename template, this is the name from the card.
+func (t *TargetNameGenManager) targetFileName(wMsg CardSlurpWork, counter uint64) (string, error) {
 
-		if !t.knowntargets[tryName] {
-			t.knowntargets[tryName] = true
-			return tryName, false, nil
-		}
-	} else {
-		tryName = prevTryName
+	if t.renamer == nil {
+		return wMsg.fileName, nil
+	}
+
+	return t.renamer.render(wMsg, counter)
+}
+
+// targetDirFor - Directory the file should be written to.  With a layout,
+// this is a subdirectory chosen by the file's capture time.
+func (t *TargetNameGenManager) targetDirFor(wMsg CardSlurpWork) (string, error) {
+
+	if t.layout == "" {
+		return t.targetDir, nil
 	}
 
-	// If we got this far, we have a naming conflict.  Start
-	// by seeing if the file was already copied successfully.
-	// We might be running again, after some sort of failure.
+	subDir, err := expandLayout(t.layout, wMsg.bestTime())
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Join(t.targetDir, subDir)
+	err = t.loadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// alreadyCopied - Check if a known target name holds a finished copy of
+// the source.  We might be running again, after some sort of failure.
+func (t *TargetNameGenManager) alreadyCopied(sourceFile string, tryName string) (bool, error) {
 
 	// Since multiple goroutines may be trying to write the same
 	// file name, we can't assume the file has been written yet,
 	// so we need to check that it is there, before we compare them.
 	_, err := os.Stat(tryName)
-	if err == nil {
-		// We should be safe to compare the files now.
-		same, err := t.cfu.IsFileSame(fullName, tryName)
+	if err != nil {
+		return false, nil
+	}
+
+	same, err := t.cfu.IsFileSame(sourceFile, tryName)
+	if err != nil {
+		return false, fmt.Errorf("error calling IsFileSame: %w", err)
+	}
+
+	return same, nil
+}
+
+// getGroupTargetNames - Pick the target names for the members of an asset
+// group, all at once.  The second return value says, for each member,
+// whether it was already copied and can be skipped.
+//
+// If any member collides with a different file, every member of the group
+// gets the same UUID suffix, so the base names stay in sync.
+func (t *TargetNameGenManager) getGroupTargetNames(members []CardSlurpWork) ([]string, []bool, error) {
+
+	names, skips, err := mirrorGroupTargetNames([]*TargetNameGenManager{t}, members)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return names[0], skips[0], nil
+}
+
+// mirrorGroupTargetNames - getGroupTargetNames for several targets at
+// once, so a group gets the same names in every one of them.  The names
+// come from the first oracle's rename template and counter.  A collision
+// in any target gives the group the same UUID suffix in all of them.  The
+// names and skips are by oracle, then by member.
+//
+// The oracles are all locked, in order, so every caller must pass them in
+// the same order.
+func mirrorGroupTargetNames(oracles []*TargetNameGenManager,
+	members []CardSlurpWork) ([][]string, [][]bool, error) {
+
+	// Lock, to protoect t.knowntargets
+	for _, t := range oracles {
+		t.Lock()
+		defer t.Unlock()
+	}
+	lead := oracles[0]
+
+	// The whole group uses one time, so date and time tokens, and the
+	// layout folder, agree for every member.
+	shot := groupTime(members)
+	first := members[0]
+	first.captureTime = shot
+
+	targetDirs := make([]string, len(oracles))
+	for o, t := range oracles {
+		dir, err := t.targetDirFor(first)
 		if err != nil {
-			return "", false, fmt.Errorf("error calling IsFileSame: %w", err)
+			return nil, nil, err
 		}
-		if same {
-			// Let the caller know that this file can be skipped, because
-			// it was already copied successfully.
-			return tryName, true, nil
+		targetDirs[o] = dir
+	}
+
+	// One counter value for the whole group, so {counter} matches too.
+	if lead.renamer != nil {
+		lead.counter++
+	}
+
+	fileNames := make([]string, len(members))
+	inGroup := make(map[string]string)
+
+	for i, m := range members {
+
+		m.captureTime = shot
+		fileName, err := lead.targetFileName(m, lead.counter)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileNames[i] = fileName
+
+		lower := strings.ToLower(fileName)
+		if other, ok := inGroup[lower]; ok {
+			return nil, nil, fmt.Errorf("%s and %s would both be named %s",
+				other, m.fileName, fileName)
+		}
+		inGroup[lower] = m.fileName
+	}
+
+	names := make([][]string, len(oracles))
+	skips := make([][]bool, len(oracles))
+	conflict := false
+
+	for o, t := range oracles {
+
+		names[o] = make([]string, len(members))
+		skips[o] = make([]bool, len(members))
+
+		for i, m := range members {
+
+			names[o][i] = path.Join(targetDirs[o], fileNames[i])
+
+			if !t.isKnown(names[o][i]) {
+				continue
+			}
+
+			same, err := t.alreadyCopied(path.Join(m.parentDir, m.fileName), names[o][i])
+			if err != nil {
+				return nil, nil, err
+			}
+			if same {
+				// Let the caller know that this file can be skipped,
+				// because it was already copied successfully.
+				skips[o][i] = true
+				continue
+			}
+
+			conflict = true
+		}
+	}
+
+	if !conflict {
+		for o, t := range oracles {
+			for i := range names[o] {
+				if !skips[o][i] {
+					t.markKnown(names[o][i])
+				}
+			}
 		}
+		return names, skips, nil
 	}
 
-	// Since we are going to be appending to the filename, we
-	// now need to handle the file extention.
-	fileParts := strings.Split(fileName, ".")
+	// If we got this far, we have a naming conflict.  The whole group is
+	// renamed, including members that were already copied under the old
+	// name, or the new name would leave them unpaired.
 
 	// Use an atomic bomb to crack a walnut.  :-P
 	uuid, err := uuid.NewUUID()
 	if err != nil {
-		return "", false, fmt.Errorf("error making uuid: %w", err)
+		return nil, nil, fmt.Errorf("error making uuid: %w", err)
 	}
 	uuidStr := uuid.String()
 
-	var tryFileName string
-	switch len(fileParts) {
-	case 1:
-		tryFileName = fmt.Sprintf("%s-%s", fileParts[0], uuidStr)
-	case 2:
-		tryFileName = fmt.Sprintf("%s_%s.%s", fileParts[0], uuidStr, fileParts[1])
-	default:
-		return "", false, errors.New(
-			"unexpected number of periods in fileName: " + fileName)
+	for i := range fileNames {
+
+		// Since we are going to be appending to the filename, we
+		// now need to handle the file extention.
+		base, ext := splitExt(path.Base(fileNames[i]))
+
+		var tryFileName string
+		if ext == "" {
+			tryFileName = fmt.Sprintf("%s-%s", base, uuidStr)
+		} else {
+			tryFileName = fmt.Sprintf("%s_%s.%s", base, uuidStr, ext)
+		}
+
+		for o, t := range oracles {
+			names[o][i] = path.Join(targetDirs[o], tryFileName)
+			skips[o][i] = false
+
+			if t.isKnown(names[o][i]) {
+				// Time to give up, and let the caller know we failed.
+				return nil, nil, errors.New("failed to find unique target name")
+			}
+		}
 	}
 
-	finalTryName := path.Join(t.targetDir, tryFileName)
+	for o, t := range oracles {
+		for i := range names[o] {
+			t.markKnown(names[o][i])
+		}
+	}
 
-	if !t.knowntargets[finalTryName] {
-		t.knowntargets[finalTryName] = true
-		return finalTryName, false, nil
+	return names, skips, nil
+}
+
+// claim - Take name in this target for sourceFile, whose name another
+// target already decided.  Returns true if name already holds a copy of
+// sourceFile.  A name that holds some other file is an error.
+func (t *TargetNameGenManager) claim(sourceFile string, name string) (bool, error) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	err := t.loadDir(filepath.Dir(name))
+	if err != nil {
+		return false, err
+	}
+
+	if !t.isKnown(name) {
+		t.markKnown(name)
+		return false, nil
+	}
+
+	same, err := t.alreadyCopied(sourceFile, name)
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		return false, fmt.Errorf("%s is already taken by another file", name)
 	}
 
-	// Time to give up, and let the caller know we failed.
+	return true, nil
+}
+
+// WorkerPoolOpts - Optional features of the WorkerPool.  The zero value
+// turns all of them off.
+type WorkerPoolOpts struct {
+	// ImportLedger - Every copied or skipped file is recorded here.
+	ImportLedger *ledger.Ledger
+	// LibraryIndex - Files whose content is already somewhere in the
+	// library are skipped.  Copied files are added to it.
+	LibraryIndex *libindex.Index
+	// DeviceWorkers - Concurrent copies from each source device (card
+	// reader).  Zero uses the pool size.
+	DeviceWorkers uint64
+	// Adaptive - Tune the workers for each source device from its measured
+	// throughput, starting at DeviceWorkers and going up to the pool size.
+	Adaptive bool
+	// AdaptiveWindow - How long to measure between decisions.  Zero uses
+	// DefaultAdaptiveWindow.
+	AdaptiveWindow time.Duration
+	// Clock - Time source for the adaptive controller.  Nil uses the real
+	// clock.
+	Clock Clock
+	// Imported - Card files that earlier runs already imported.  Those that
+	// still hash to the recorded digest are skipped without being copied,
+	// so an interrupted run picks up where it left off.
+	Imported *ledger.Imported
+	// Journal - Write ahead journal of the session.  Each file is recorded
+	// as planned, in progress, copied and verified.
+	Journal *journal.Journal
+	// Resume - Progress of the interrupted session being resumed.  Call
+	// RecoverSession first.
+	Resume *journal.Progress
+	// ErrorPolicy - Whether a failed file stops the run.  The zero value
+	// stops at the first one.
+	ErrorPolicy ErrorPolicy
+	// CardTimeout - Give up on a card when one read from it takes longer
+	// than this.  Zero waits forever.
+	CardTimeout time.Duration
+	// Filter - Which files on the cards are imported.  Nil imports
+	// everything.
+	Filter *Filter
+	// History - Every copied file is added to this ASC MHL generation,
+	// with the digest it was verified against.
+	History *mhl.Generation
+	// Manifests - Every copied file is added to these checksum manifests.
+	// The CardFileUtil must compute the digests they need (see
+	// manifest.Algos).
+	Manifests *manifest.Writer
+	// Mirrors - More targets that every file is copied to.  Each file is
+	// read from the card once, and written to every target that does not
+	// have it yet (see cardfileutil.CardFileMirror).  A file that fails in
+	// one target is still copied to the others.  Only the WorkerPool's own
+	// target is journaled.
+	Mirrors []ImportTarget
+}
+
+// ImportTarget - A target directory, and the records kept in it.  The
+// WorkerPool's own target is made from its name oracle and options.
+type ImportTarget struct {
+	// NameOracle - Names the files in this target.  Mirrors must use the
+	// same layout and rename template as the WorkerPool's name oracle,
+	// which picks the names for every target.
+	NameOracle *TargetNameGenManager
+	// ImportLedger, Imported, History and Manifests - The same as in
+	// WorkerPoolOpts, for this target.
+	ImportLedger *ledger.Ledger
+	Imported     *ledger.Imported
+	History      *mhl.Generation
+	Manifests    *manifest.Writer
+}
 
-	return "", false, errors.New("failed to find unique target name")
+// Mirrorer - Copies a file to several targets, reading it once.
+// cardfileutil.CardFileUtil satisfies this.  A CardFileUtilProvider that
+// does not is asked for one copy per target instead.
+type Mirrorer interface {
+	CardFileMirror(ctx context.Context, fromFile string, toFiles []string,
+		obs []cardfileutil.CopyObserver) ([]cardfileutil.CopyResult, []error)
 }
 
+// WorkerPool - Copies the asset groups found by OrchestrateLocate.  The
+// groups arrive through one queue per source device, which is unbuffered,
+// so discovery can only get a little ahead of the copy.  Closing stop
+// tells discovery and the workers to wind down.
 type WorkerPool struct {
 	// wg         *sync.WaitGroup
-	poolSize   uint64
-	queuedWork []CardSlurpWork
-	nameOracle *TargetNameGenManager
-	debug      bool
-	maxRetries uint64
-	cfu        CardFileUtilProvider
+	poolSize uint64
+	devices  []*sourceDevice
+	feeders  sync.WaitGroup
+	// targetDevices - Where the targets are, each with its own slots.
+	targetDevices []*targetDevice
+	stop          chan struct{}
+	stopOnce      sync.Once
+	// ctx - Passed to every copy, so a cancel rolls back the copies in
+	// flight.  Set by ParallelFileCopy before the workers start.
+	ctx         context.Context
+	interrupted atomic.Bool
+	failedFiles atomic.Int64
+	policyStop  atomic.Bool
+	// locateMu - Guards failedCards and unreadable, which are what
+	// discovery could not read.
+	locateMu    sync.Mutex
+	failedCards []*FileError
+	unreadable  []string
+	nameOracle  *TargetNameGenManager
+	debug       bool
+	maxRetries  uint64
+	cfu         CardFileUtilProvider
+	opts        WorkerPoolOpts
+	// targets - The pool's own target, then WorkerPoolOpts.Mirrors.
+	targets []ImportTarget
+	// readDir - Test hook for reading card directories.
+	readDir func(name string) ([]os.DirEntry, error)
 }
 
+// NewWorkerPool - Constructor for WorkerPool.
 func NewWorkerPool(poolSize uint64, nameManager *TargetNameGenManager,
 	debugMode bool, cfu CardFileUtilProvider,
-	maxRetries uint64) *WorkerPool {
+	maxRetries uint64, opts WorkerPoolOpts) *WorkerPool {
 
 	rv := &WorkerPool{
 		poolSize:   poolSize,
-		queuedWork: make([]CardSlurpWork, 0),
+		stop:       make(chan struct{}),
 		nameOracle: nameManager,
 		debug:      debugMode,
 		maxRetries: maxRetries,
 		cfu:        cfu,
+		opts:       opts,
+		readDir:    os.ReadDir,
 	}
 
+	rv.targets = append([]ImportTarget{{
+		NameOracle:   nameManager,
+		ImportLedger: opts.ImportLedger,
+		Imported:     opts.Imported,
+		History:      opts.History,
+		Manifests:    opts.Manifests,
+	}}, opts.Mirrors...)
+
 	return rv
 }
 
-func (w *WorkerPool) queueFile(workReq CardSlurpWork) {
-	w.queuedWork = append(w.queuedWork, workReq)
+// sourceDigest - Digest of a card file, read the first time it is needed,
+// so the ledger and library checks of every target share one read.
+type sourceDigest struct {
+	cfu      CardFileUtilProvider
+	fileName string
+	done     bool
+	digest   cardfileutil.FileDigest
+	err      error
+}
+
+func (s *sourceDigest) get() (cardfileutil.FileDigest, error) {
+	if !s.done {
+		s.digest, s.err = s.cfu.HashFile(s.fileName)
+		s.done = true
+	}
+	return s.digest, s.err
+}
+
+// inLibrary - Check the library index for a file with the same content.
+// The source is only hashed when some library file has the same size,
+// so most files cost nothing extra.  Returns the existing location.
+func (w *WorkerPool) inLibrary(sourceFile string, wMsg CardSlurpWork,
+	source *sourceDigest) (string, bool, error) {
+
+	if w.opts.LibraryIndex == nil || !w.opts.LibraryIndex.HasSize(wMsg.fileSize) {
+		return "", false, nil
+	}
+
+	digest, err := source.get()
+	if err != nil {
+		return "", false, fmt.Errorf("error hashing %s for library check: %w", sourceFile, err)
+	}
+
+	existing, found := w.opts.LibraryIndex.Lookup(wMsg.fileSize, digest)
+	return existing, found, nil
+}
+
+// recordWork - Write the provenance of a finished file to the ledger of
+// target t, and for the pool's own target, mark it verified in the
+// journal.  Both serialize appends, so this is safe to call from the
+// workers.
+func (w *WorkerPool) recordWork(t int, wMsg CardSlurpWork) error {
+
+	rec := ledgerRecord(wMsg)
+
+	err := w.targets[t].record(rec, wMsg)
+	if err != nil {
+		return err
+	}
+
+	if t != 0 {
+		return nil
+	}
+
+	// The ledger comes first.  If the process stops in between, the file
+	// is checked again on resume, which is harmless.
+	return w.journalState(wMsg, journal.StateVerified, wMsg.targetName, "", rec.Digest)
+}
+
+// record - Add a finished file to the ledger, and a copied file to the
+// ASC MHL history and the checksum manifests of the target.
+func (t *ImportTarget) record(rec ledger.Record, wMsg CardSlurpWork) error {
+
+	if t.ImportLedger != nil {
+		err := t.ImportLedger.Append(rec)
+		if err != nil {
+			return fmt.Errorf("error recording %s in ledger: %w", rec.SourcePath, err)
+		}
+	}
+
+	if t.History != nil && wMsg.copied {
+		err := t.History.Add(wMsg.targetName,
+			mhlDigest(cardfileutil.CopyResult{Digest: wMsg.digest, Extra: wMsg.extras}))
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.Manifests != nil && wMsg.copied {
+		digests := append([]cardfileutil.FileDigest{wMsg.digest}, wMsg.extras...)
+		err := t.Manifests.Add(wMsg.targetName, digests)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mhlDigest - The xxh64 digest of a copy, which is the one ASC MHL takes.
+// Without one, it is the copy's own digest, which Generation.Add turns
+// down.
+func mhlDigest(res cardfileutil.CopyResult) cardfileutil.FileDigest {
+	digest, ok := res.DigestFor(cardfileutil.HashXXH64)
+	if !ok {
+		return res.Digest
+	}
+	return digest
 }
 
-func (w *WorkerPool) ParallelFileCopy() (WorkerPoolFinishMsg, error) {
+// ledgerRecord - The ledger's view of a finished file.
+func ledgerRecord(wMsg CardSlurpWork) ledger.Record {
 
-	// Start by sorting the queued files by modification time.
-	// As long as the two camaras time are close, this should cause
-	// the cards to offload in parallel.
-	sort.Slice(w.queuedWork, func(i, j int) bool {
-		return w.queuedWork[i].fileTime.UnixNano() < w.queuedWork[j].fileTime.UnixNano()
+	status := ledger.StatusCopied
+	if wMsg.skipped {
+		status = ledger.StatusSkipped
+	}
+
+	rec := ledger.Record{
+		Status:        status,
+		SourceCard:    wMsg.sourceCard,
+		SourcePath:    path.Join(wMsg.parentDir, wMsg.fileName),
+		OriginalName:  wMsg.fileName,
+		TargetName:    wMsg.targetName,
+		Size:          wMsg.fileSize,
+		SourceModTime: wMsg.fileTime,
+		CaptureTime:   wMsg.bestTime(),
+		CameraModel:   wMsg.cameraModel,
+		CameraSerial:  wMsg.cameraSerial,
+		Retries:       wMsg.retriesUsed,
+	}
+	if len(wMsg.digest.Sum) != 0 {
+		rec.Digest = wMsg.digest.String()
+	}
+
+	return rec
+}
+
+// abort - Stop discovery, and keep the workers from starting new groups.
+func (w *WorkerPool) abort() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
 	})
+}
 
-	// Make the input and output channels the same size as our work queue,
-	// so we don't block writing.
+// watch - Wind down when ctx is cancelled, and note that the run was
+// interrupted, rather than stopped by an error.
+func (w *WorkerPool) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		if !w.interrupted.Swap(true) {
+			fmt.Printf("Interrupted: stopping discovery, and rolling back copies in flight.\n")
+		}
+		w.abort()
+	case <-w.stop:
+	}
+}
 
-	inputWork := make(chan CardSlurpWork, len(w.queuedWork))
-	outputWork := make(chan CardSlurpWork, len(w.queuedWork))
+// wasInterrupted - True if a cancelled context stopped the run.
+func (w *WorkerPool) wasInterrupted() bool {
+	return w.interrupted.Load()
+}
 
-	// Fire up the worker pool to copy in parallel.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	wg := &sync.WaitGroup{}
+// earlierImport - Check the ledger of earlier runs in this target for
+// this card file.  A reformatted card can hold a different file with the
+// same path, size and modification time, so it only counts if the card
+// file still has the digest that was recorded, and the copy is still
+// there, with the right size.
+func (t *ImportTarget) earlierImport(wMsg CardSlurpWork, source *sourceDigest) (string, bool) {
 
-	for i := 0; i < int(w.poolSize); i++ {
+	if t.Imported == nil {
+		return "", false
+	}
 
-		wg.Add(1)
-		go func(wkCtx context.Context, wg *sync.WaitGroup,
-			nameMan *TargetNameGenManager, inWork chan CardSlurpWork,
-			outWork chan<- CardSlurpWork, debug bool, maxRetries uint64) {
+	target, recorded, found := t.Imported.Lookup(path.Join(wMsg.parentDir, wMsg.fileName),
+		wMsg.fileSize, wMsg.fileTime)
+	if !found || recorded == "" {
+		return "", false
+	}
 
-			wg.Done()
+	// A card file that can not be read is left for the copy to report.
+	digest, err := source.get()
+	if err != nil || digest.String() != recorded {
+		return "", false
+	}
 
-		Loop:
-			for {
-				select {
-				case <-wkCtx.Done():
-					return
-				case wMsg := <-inWork:
+	info, err := os.Stat(target)
+	if err != nil || info.Size() != wMsg.fileSize {
+		return "", false
+	}
 
-					sourceFile := wMsg.parentDir + "/" + wMsg.fileName
+	return target, true
+}
 
-					targetName, same, err := nameMan.getTargetName(sourceFile, wMsg.targetName)
-					if err != nil {
-						// We failed to get a target name, so don't retry.
-						wMsg.majorErr = fmt.Errorf("error getting target name for %s: %w", sourceFile, err)
-						outWork <- wMsg
-						continue Loop
-					}
+// cardFinished - Collect what discovery could not read on a card, once
+// its walk is over.  A card that failed is counted against the error
+// policy, like a failed file.
+func (w *WorkerPool) cardFinished(card *cardWalk) {
+
+	var failure *FileError
+	if card.result.LocateError != nil {
+		failure = &FileError{
+			Category: CategoryDiscovery,
+			File:     card.result.ParentDir,
+			Err:      card.result.LocateError,
+		}
+		fmt.Printf("Failed %s\n", failure.Error())
+	}
 
-					if same {
-						// The naming oracle says this file is already
-						// copied, so skip it.
-						wMsg.skipped = true
-						fmt.Printf("Skipping %s: (already copied...)\n", targetName)
-						outWork <- wMsg
-						continue Loop
-					}
+	w.locateMu.Lock()
+	w.unreadable = append(w.unreadable, card.result.SkippedPaths...)
+	if failure != nil {
+		w.failedCards = append(w.failedCards, failure)
+	}
+	w.locateMu.Unlock()
 
-					if debug {
-						fmt.Printf("Using %s for write name.\n", targetName)
-					}
+	if failure != nil {
+		w.noteFailures(1)
+	}
+}
 
-					err = w.cfu.CardFileCopy(sourceFile, targetName)
-					if err != nil {
-						// Handle an error copying the file as a major error.
-						wMsg.majorErr = fmt.Errorf(
-							"error copying %s to %s: %w", sourceFile, targetName, err)
-						outWork <- wMsg
-						continue Loop
-					}
+// locateResults - The cards that could not be searched, and the paths on
+// them that could not be read.
+func (w *WorkerPool) locateResults() ([]*FileError, []string) {
+	w.locateMu.Lock()
+	defer w.locateMu.Unlock()
+	return append([]*FileError(nil), w.failedCards...),
+		append([]string(nil), w.unreadable...)
+}
 
-					sameStat, err := w.cfu.IsFileSame(sourceFile, targetName)
-					if err != nil {
-						// Handle an error calling IsFileSame as a major error.
-						wMsg.majorErr = fmt.Errorf(
-							"error calling IsFileSame for %s: %w", sourceFile, err)
-						outWork <- wMsg
-						continue Loop
-					}
+// skipWork - Mark a file as skipped in target t, and record it in the
+// ledger.
+func (w *WorkerPool) skipWork(t int, wMsg *CardSlurpWork, targetName string) {
+	wMsg.skipped = true
+	wMsg.targetName = targetName
+	err := w.recordWork(t, *wMsg)
+	if err != nil {
+		wMsg.fail(CategoryTargetWrite, err)
+	}
+}
+
+// targetCopy - A copy to make of one file: the target, by index, and the
+// name it gets there.
+type targetCopy struct {
+	target int
+	name   string
+}
+
+// copyWork - Copy one member of a group to its target names.  With more
+// than one target, the card is read once for all of them.  A copy that
+// fails verification is retried by itself, with the same name, up to
+// maxRetries times.
+func (w *WorkerPool) copyWork(wMsg *CardSlurpWork, to []targetCopy) {
+
+	outcomes := wMsg.outcomes()
+
+	if w.debug {
+		for _, c := range to {
+			fmt.Printf("Using %s for write name.\n", c.name)
+		}
+	}
+
+	if len(to) == 1 {
+		w.copyOne(outcomes[to[0].target], to[0].target, to[0].name)
+		return
+	}
+
+	names := make([]string, len(to))
+	observers := make([]cardfileutil.CopyObserver, len(to))
+	for n, c := range to {
+		names[n] = c.name
+		observers[n] = w.observer(outcomes[c.target], c.target, c.name)
+	}
+
+	results, errs := w.mirrorCopy(path.Join(wMsg.parentDir, wMsg.fileName), names, observers)
+	for n, c := range to {
+		if w.copied(outcomes[c.target], c.target, c.name, results[n], errs[n]) {
+			w.copyOne(outcomes[c.target], c.target, c.name)
+		}
+	}
+}
+
+// copyOne - Copy a file to one target, retrying until it verifies, or the
+// retries run out.
+func (w *WorkerPool) copyOne(wMsg *CardSlurpWork, t int, targetName string) {
+
+	sourceFile := path.Join(wMsg.parentDir, wMsg.fileName)
+
+	for {
+		copyRes, err := w.cfu.CardFileCopy(w.ctx, sourceFile, targetName,
+			w.observer(wMsg, t, targetName))
+		if !w.copied(wMsg, t, targetName, copyRes, err) {
+			return
+		}
+	}
+}
+
+// observer - The journal watches copies to the pool's own target.
+func (w *WorkerPool) observer(wMsg *CardSlurpWork, t int, targetName string) cardfileutil.CopyObserver {
+	if t != 0 || w.opts.Journal == nil {
+		return nil
+	}
+	return journalObserver{w: w, wMsg: wMsg, targetName: targetName}
+}
+
+// mirrorCopy - Copy sourceFile to every name, reading it once if the
+// CardFileUtilProvider can.
+func (w *WorkerPool) mirrorCopy(sourceFile string, names []string,
+	observers []cardfileutil.CopyObserver) ([]cardfileutil.CopyResult, []error) {
+
+	mirrorer, ok := w.cfu.(Mirrorer)
+	if ok {
+		return mirrorer.CardFileMirror(w.ctx, sourceFile, names, observers)
+	}
+
+	results := make([]cardfileutil.CopyResult, len(names))
+	errs := make([]error, len(names))
+	for n := range names {
+		results[n], errs[n] = w.cfu.CardFileCopy(w.ctx, sourceFile, names[n], observers[n])
+	}
+
+	return results, errs
+}
+
+// copied - Deal with how one copy of a file to target t went.  A finished
+// copy is recorded, and a failed one is noted on wMsg.  Returns true if
+// the copy failed verification, and should be tried again.
+func (w *WorkerPool) copied(wMsg *CardSlurpWork, t int, targetName string,
+	copyRes cardfileutil.CopyResult, err error) bool {
+
+	sourceFile := path.Join(wMsg.parentDir, wMsg.fileName)
+	label := wMsg.sourceLabel()
+
+	if err != nil && w.ctx.Err() != nil {
+		// Cancelled.  CardFileCopy removed the temp file, so the
+		// file is simply left for the next run.
+		fmt.Printf("Rolled back: %s\n", label)
+		return false
+	}
+	if errors.Is(err, cardfileutil.ErrVerifyMismatch) {
+		// Handle a verification error as a minor error.
+		fmt.Printf("File verification did not match for: %s (%s)\n",
+			label, copyRes.Verify)
+		wMsg.minorErr = append(wMsg.minorErr,
+			fmt.Sprintf("verification failed for: %s (%s)", label, copyRes.Verify))
+		if wMsg.retriesUsed < w.maxRetries {
+			// Copies are written to a temp file and renamed into
+			// place, so nothing is under the target name yet.  Just
+			// try it again.
+			wMsg.retriesUsed++
+			fmt.Printf("Retrying: %s\n", label)
+			return true
+		}
+		wMsg.fail(CategoryVerify, fmt.Errorf("out of retries: %w", err))
+		return false
+	}
+	if err != nil {
+		// Handle an error copying the file as a major error.
+		wMsg.fail(copyErrCategory(err), fmt.Errorf(
+			"error copying %s to %s: %w", sourceFile, targetName, err))
+		return false
+	}
+
+	if w.debug {
+		fmt.Printf("%s digest: %s verify: %s\n", targetName,
+			copyRes.Digest, copyRes.Verify)
+	}
+
+	wMsg.retriesUsed += copyRes.RangeRetries
+	wMsg.targetName = targetName
+	wMsg.digest = copyRes.Digest
+	wMsg.extras = copyRes.Extra
+	wMsg.copied = true
+	if w.opts.LibraryIndex != nil && t == 0 {
+		w.opts.LibraryIndex.Add(targetName, wMsg.fileSize, wMsg.fileTime, copyRes.Digest)
+	}
+	err = w.recordWork(t, *wMsg)
+	if err != nil {
+		wMsg.fail(CategoryTargetWrite, err)
+	}
+	return false
+}
+
+// failures - The major errors of every member, in every target, in
+// member order.
+func (g *AssetGroup) failures() []*FileError {
+	rv := make([]*FileError, 0)
+	for i := range g.members {
+		for _, o := range g.members[i].outcomes() {
+			if o.majorErr != nil {
+				rv = append(rv, o.majorErr)
+			}
+		}
+	}
+	return rv
+}
+
+// halted - True once the run is cancelled, or stopped by the error policy.
+func (w *WorkerPool) halted() bool {
+	if w.ctx.Err() != nil {
+		return true
+	}
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// noteFailures - Count n more failed files, and halt the run once the
+// error policy has seen too many.  The workers do this before they take
+// another group, so fail fast really is fast.
+func (w *WorkerPool) noteFailures(n int) {
+
+	if n == 0 {
+		return
+	}
+
+	if w.opts.ErrorPolicy.exhausted(int(w.failedFiles.Add(int64(n)))) {
+		if !w.policyStop.Swap(true) {
+			fmt.Printf("Too many failed files: stopping discovery, and finishing copies in flight.\n")
+		}
+		w.abort()
+	}
+}
+
+// stopErr - Why the error policy halted the run, or nil if it did not.
+func (w *WorkerPool) stopErr(failed []*FileError) error {
+
+	if !w.opts.ErrorPolicy.exhausted(len(failed)) {
+		return nil
+	}
 
-					if sameStat {
-						// Handle a verification error as a minor error.
-						fmt.Printf("%s/%s - Done\n", wMsg.parentDir, wMsg.fileName)
-						wMsg.copied = true
-						outWork <- wMsg
-					} else {
-						fmt.Printf("File verification did not match for: %s\n", sourceFile)
-						wMsg.minorErr = append(wMsg.minorErr,
-							fmt.Sprintf("verification failed for: %s", sourceFile))
-						if wMsg.retriesUsed < maxRetries {
-							// Send the work request back for another try.
-							wMsg.retriesUsed++
-							wMsg.targetName = targetName
-							inWork <- wMsg
-							fmt.Printf("Requeuing: %s\n", sourceFile)
-						} else {
-							wMsg.majorErr = fmt.Errorf("%s is out of retries", sourceFile)
-							outWork <- wMsg
-						}
+	if w.opts.ErrorPolicy.failFast() {
+		return fmt.Errorf("stopped at the first failed file: %w", failed[0])
+	}
+
+	return fmt.Errorf("stopped after %d failed files: %w", len(failed), ErrErrorBudget)
+}
+
+// targetPlan - What processGroup will do with one member in one target.
+// A member with no name is not copied there.
+type targetPlan struct {
+	name string
+	skip bool
+}
+
+// processGroup - Skip, name and copy every member of an asset group, in
+// every target.  With a fail fast error policy, the group stops at the
+// first member with a major error in any target.  Otherwise the other
+// members, and the other targets, carry on without it.  Either way, the
+// group stops when the run is cancelled or halted.
+func (w *WorkerPool) processGroup(g *AssetGroup) {
+
+	failFast := w.opts.ErrorPolicy.failFast()
+
+	// Every mirror starts from the file as it was found on the card.
+	if len(w.opts.Mirrors) != 0 {
+		for i := range g.members {
+			wMsg := &g.members[i]
+			mirrors := make([]CardSlurpWork, len(w.opts.Mirrors))
+			for m := range mirrors {
+				mirrors[m] = *wMsg
+				mirrors[m].mirrorDir = w.opts.Mirrors[m].NameOracle.targetDir
+			}
+			wMsg.mirrors = mirrors
+		}
+	}
+
+	plans := make([][]targetPlan, len(w.targets))
+	for t := range plans {
+		plans[t] = make([]targetPlan, len(g.members))
+	}
+
+	// Members already imported by an earlier run, or already in the
+	// library, are skipped before naming, so they do not reserve a name
+	// they will never use.  Members that an interrupted session planned
+	// keep the name it gave them.  A member whose name in the pool's own
+	// target is settled gets the same name in the mirrors.
+	pending := make([]int, 0, len(g.members))
+	for i := range g.members {
+		wMsg := &g.members[i]
+		sourceFile := path.Join(wMsg.parentDir, wMsg.fileName)
+		source := &sourceDigest{cfu: w.cfu, fileName: sourceFile}
+
+		settled := ""
+		planned, done := w.resumeWork(wMsg)
+		switch {
+		case done:
+			settled = wMsg.targetName
+		case planned != "":
+			plans[0][i] = targetPlan{name: planned}
+			settled = planned
+		default:
+			target, found := w.targets[0].earlierImport(*wMsg, source)
+			if found {
+				fmt.Printf("Skipping %s: (imported to %s by an earlier run)\n", sourceFile, target)
+				// Recorded again, so the next run can check it too.
+				wMsg.digest = source.digest
+				w.skipWork(0, wMsg, target)
+				if wMsg.majorErr != nil && failFast {
+					return
+				}
+				settled = target
+				break
+			}
+
+			existing, found, err := w.inLibrary(sourceFile, *wMsg, source)
+			if err != nil {
+				for _, o := range wMsg.outcomes() {
+					o.fail(CategorySourceRead, err)
+				}
+				if failFast {
+					return
+				}
+				continue
+			}
+			if found {
+				fmt.Printf("Skipping %s: (already in library at %s)\n", sourceFile, existing)
+				for t, o := range wMsg.outcomes() {
+					w.skipWork(t, o, existing)
+				}
+				if wMsg.failed() && failFast {
+					return
+				}
+				continue
+			}
+			pending = append(pending, i)
+		}
+
+		for t := 1; t < len(w.targets); t++ {
+			o := &wMsg.mirrors[t-1]
+
+			target, found := w.targets[t].earlierImport(*o, source)
+			if found {
+				fmt.Printf("Skipping %s: (imported to %s by an earlier run)\n", sourceFile, target)
+				o.digest = source.digest
+				w.skipWork(t, o, target)
+			} else if settled != "" {
+				plan, err := w.mirroredPlan(t, *o, settled)
+				if err != nil {
+					o.fail(CategoryNaming, err)
+				}
+				plans[t][i] = plan
+			}
+			if o.majorErr != nil && failFast {
+				return
+			}
+		}
+	}
+
+	if len(pending) != 0 {
+		toName := make([]CardSlurpWork, 0, len(pending))
+		for _, i := range pending {
+			toName = append(toName, g.members[i])
+		}
+
+		oracles := make([]*TargetNameGenManager, len(w.targets))
+		for t := range w.targets {
+			oracles[t] = w.targets[t].NameOracle
+		}
+
+		names, skipList, err := mirrorGroupTargetNames(oracles, toName)
+		if err != nil {
+			// We failed to get target names, so don't retry.  None of
+			// the members can be copied without one.
+			err = fmt.Errorf("error getting target names for %s: %w", g.label(), err)
+			for _, i := range pending {
+				for _, o := range g.members[i].outcomes() {
+					if !o.skipped {
+						o.fail(CategoryNaming, err)
 					}
 				}
 			}
+			if failFast {
+				return
+			}
+			pending = pending[:0]
+		}
+
+		for n, i := range pending {
+			for t, o := range g.members[i].outcomes() {
+				// A mirror may have the file from an earlier run.
+				if !o.skipped && o.majorErr == nil {
+					plans[t][i] = targetPlan{name: names[t][n], skip: skipList[t][n]}
+				}
+			}
+			if skipList[0][n] {
+				continue
+			}
+			err = w.journalState(g.members[i], journal.StatePlanned, names[0][n], "", "")
+			if err != nil {
+				g.members[i].fail(CategoryTargetWrite, err)
+				if failFast {
+					return
+				}
+				plans[0][i] = targetPlan{}
+			}
+		}
+	}
+
+	for i := range g.members {
+		wMsg := &g.members[i]
+		outcomes := wMsg.outcomes()
+
+		to := make([]targetCopy, 0, len(outcomes))
+		for t := range outcomes {
+			if plans[t][i].name != "" {
+				to = append(to, targetCopy{target: t, name: plans[t][i].name})
+			}
+		}
+		if len(to) == 0 {
+			continue
+		}
+
+		if w.halted() {
+			return
+		}
+
+		copies := make([]targetCopy, 0, len(to))
+		for _, c := range to {
+			if plans[c.target][i].skip {
+				// The naming oracle says this file is already
+				// copied, so skip it.
+				fmt.Printf("Skipping %s: (already copied...)\n", c.name)
+				w.skipWork(c.target, outcomes[c.target], c.name)
+				continue
+			}
+			copies = append(copies, c)
+		}
+		if len(copies) != 0 {
+			w.copyWork(wMsg, copies)
+		}
+
+		if wMsg.failed() && failFast {
+			return
+		}
+	}
+}
+
+// mirroredPlan - The plan for a file in mirror t, when its name in the
+// pool's own target is already settled.  The mirror gets the same name,
+// relative to its own target directory.
+func (w *WorkerPool) mirroredPlan(t int, wMsg CardSlurpWork, settled string) (targetPlan, error) {
 
-		}(ctx, wg, w.nameOracle, inputWork, outputWork, w.debug, w.maxRetries)
+	rel, err := filepath.Rel(w.nameOracle.targetDir, settled)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return targetPlan{}, fmt.Errorf("%s is not in %s, so it can not be mirrored",
+			settled, w.nameOracle.targetDir)
 	}
 
-	// Now that the worker pool is running, feed all the work
-	// requests into it.
-	for _, wr := range w.queuedWork {
-		inputWork <- wr
+	name := path.Join(w.targets[t].NameOracle.targetDir, filepath.ToSlash(rel))
+	skip, err := w.targets[t].NameOracle.claim(path.Join(wMsg.parentDir, wMsg.fileName), name)
+	if err != nil {
+		return targetPlan{}, err
+	}
+
+	return targetPlan{name: name, skip: skip}, nil
+}
+
+// ParallelFileCopy - Copy the groups found by OrchestrateLocate, which must
+// be called first, until discovery is done.  No more than poolSize copies
+// write to the target at once.
+//
+// Cancelling ctx stops discovery and the workers.  Copies in flight are
+// rolled back, so nothing is left half written, and ParallelFileCopy
+// returns with Interrupted set, and what was left undone.  That is not an
+// error.  The ledger records everything that did finish, so the next run
+// only does what remains (see WorkerPoolOpts.Imported).
+//
+// Files that fail are listed in Failed, with their ErrorCategory.  Once
+// WorkerPoolOpts.ErrorPolicy has seen too many, the run is halted like a
+// cancel, and the error says why.  The results are filled in either way.
+func (w *WorkerPool) ParallelFileCopy(ctx context.Context) (WorkerPoolFinishMsg, error) {
+
+	w.ctx = ctx
+	go w.watch(ctx)
+
+	err := w.reserveResumed()
+	if err != nil {
+		w.abort()
+		return WorkerPoolFinishMsg{}, err
+	}
+
+	// The results are counted as they come in, so nothing is kept for
+	// the whole run.
+	outputWork := make(chan *AssetGroup, w.poolSize)
+
+	// Fire up the workers for each source device to copy in parallel.
+	wg := &sync.WaitGroup{}
+
+	perDevice := w.opts.DeviceWorkers
+	if perDevice == 0 {
+		perDevice = w.poolSize
+	}
+
+	// An adaptive device may grow up to the pool size, so it gets that
+	// many workers, and the limiter decides how many are active.
+	maxWorkers := perDevice
+	if w.opts.Adaptive && w.poolSize > maxWorkers {
+		maxWorkers = w.poolSize
+	}
+
+	clock := w.opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	window := w.opts.AdaptiveWindow
+	if window == 0 {
+		window = DefaultAdaptiveWindow
+	}
+
+	for _, dev := range w.devices {
+		dev.limiter = newDeviceLimiter(dev.id, int(perDevice), int(maxWorkers),
+			w.opts.Adaptive, clock, window)
+
+		if w.opts.Adaptive {
+			fmt.Printf("Source device %s: %d cards, %d workers (adaptive, up to %d)\n",
+				dev.id, len(dev.cards), perDevice, maxWorkers)
+		} else {
+			fmt.Printf("Source device %s: %d cards, %d workers\n", dev.id,
+				len(dev.cards), perDevice)
+		}
+
+		for i := 0; i < int(maxWorkers); i++ {
+			wg.Add(1)
+			go w.deviceWorker(dev, wg, outputWork)
+		}
 	}
 
+	// Once every worker has returned, nothing is still writing to the
+	// target directory.
+	go func() {
+		wg.Wait()
+		close(outputWork)
+	}()
+
 	rv := WorkerPoolFinishMsg{
 		MinorErrs: make([]string, 0),
+		Failed:    make([]*FileError, 0),
+		Targets:   make([]TargetResult, len(w.targets)),
 	}
+	for t := range w.targets {
+		rv.Targets[t].Dir = w.targets[t].NameOracle.targetDir
+	}
+	// Suck out the results.  Every group is counted, even after the run
+	// is halted, so the summary shows everything that did get done.
+	for g := range outputWork {
 
-	// Suck out the results
-	for i := 0; i < len(w.queuedWork); i++ {
-		res := <-outputWork
+		failed := g.failures()
+		rv.Failed = append(rv.Failed, failed...)
 
-		// Handle major errors first.
-		if res.majorErr != nil {
-			return WorkerPoolFinishMsg{}, fmt.Errorf(
-				"major error copying %s: %w", res.fileName, res.majorErr,
-			)
-		}
+		var copied, skipped, remaining uint64
+		for i := range g.members {
+
+			unfinished := false
+			for t, res := range g.members[i].outcomes() {
+
+				if res.skipped {
+					skipped++
+					rv.Targets[t].Skipped++
+				}
 
-		if res.skipped {
-			rv.Skipped++
+				if res.copied {
+					copied++
+					rv.Targets[t].Copied++
+				}
+
+				if res.majorErr != nil {
+					rv.Targets[t].Failed++
+				}
+
+				if !res.skipped && !res.copied {
+					unfinished = true
+				}
+
+				if res.retriesUsed != 0 {
+					rv.Retries += res.retriesUsed
+				}
+
+				if len(res.minorErr) != 0 {
+					rv.MinorErrs = append(rv.MinorErrs, res.minorErr...)
+				}
+			}
+
+			// A file that failed anywhere is counted as failed, not
+			// remaining.
+			if unfinished && !g.members[i].failed() {
+				remaining++
+			}
 		}
 
-		if res.copied {
-			rv.Copied++
+		rv.Copied += copied
+		rv.Skipped += skipped
+		rv.Remaining += remaining
+
+		if len(failed) != 0 {
+			for _, f := range failed {
+				fmt.Printf("Failed %s\n", f.Error())
+			}
+			fmt.Printf("%s - Failed (%d copied, %d skipped, %d failed, %d remaining)\n",
+				g.label(), copied, skipped, len(failed), remaining)
+			continue
 		}
 
-		if res.retriesUsed != 0 {
-			rv.Retries += res.retriesUsed
+		if remaining != 0 {
+			fmt.Printf("%s - Interrupted (%d copied, %d skipped, %d remaining)\n",
+				g.label(), copied, skipped, remaining)
+			continue
 		}
 
-		if len(res.minorErr) != 0 {
-			rv.MinorErrs = append(rv.MinorErrs, res.minorErr...)
+		fmt.Printf("%s - Done (%d copied, %d skipped)\n", g.label(), copied, skipped)
+		rv.Groups++
+	}
+
+	// Once the feeders are done, every card is either finished, or was
+	// cut short.
+	w.feeders.Wait()
+	rv.Interrupted = w.wasInterrupted() || ctx.Err() != nil
+
+	failedCards, skippedPaths := w.locateResults()
+	rv.Failed = append(rv.Failed, failedCards...)
+	rv.SkippedPaths = skippedPaths
+
+	stopErr := w.stopErr(rv.Failed)
+
+	rv.UnfinishedCards = make([]string, 0)
+	for _, dev := range w.devices {
+		for _, card := range dev.cards {
+			if !card.done {
+				rv.UnfinishedCards = append(rv.UnfinishedCards, card.path)
+			}
 		}
 	}
 
-	// Send the worker pool the all done signal, and wait for
-	// the worker goroutines to return
-	cancel()
-	wg.Wait()
+	// Let the context watchers go.
+	w.abort()
 
-	return rv, nil
+	return rv, stopErr
 }
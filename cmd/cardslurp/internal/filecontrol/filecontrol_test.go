@@ -1,13 +1,20 @@
 package filecontrol
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/manifest"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
 	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
 )
 
@@ -16,23 +23,33 @@ var (
 )
 
 type CardFileUtilMock struct {
-	cfu          cardfileutil.CardFileUtil
+	cfu cardfileutil.CardFileUtil
+	// rand.Rand is not safe for concurrent use, and the workers share
+	// the mock.
+	mu           sync.Mutex
 	perturbation rand.Rand
 }
 
 func NewCardFileUtilMock() *CardFileUtilMock {
 	source := rand.NewSource(time.Now().UnixMicro())
 	return &CardFileUtilMock{
-		cfu:          *cardfileutil.NewCardFileUtil(16384, 3),
+		cfu: *cardfileutil.NewCardFileUtil(16384, 3, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
 		perturbation: *rand.New(source),
 	}
 }
 
+func (c *CardFileUtilMock) roll() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.perturbation.Int63n(10)
+}
+
 func (c *CardFileUtilMock) IsFileSame(fromFile string, toFile string) (bool, error) {
 	// 10% of the time, throw and a simulated major error.  10% of the time have
 	// verification fail, but no error.  The rest of the time, return the results
 	// of the actual verify method.
-	dice := c.perturbation.Int63n(10)
+	dice := c.roll()
 	switch dice {
 	case 8:
 		return false, nil
@@ -43,22 +60,35 @@ func (c *CardFileUtilMock) IsFileSame(fromFile string, toFile string) (bool, err
 	}
 }
 
-func (c *CardFileUtilMock) CardFileCopy(fromFile string, toFile string) error {
+func (c *CardFileUtilMock) CardFileCopy(ctx context.Context, fromFile string,
+	toFile string, obs cardfileutil.CopyObserver) (cardfileutil.CopyResult, error) {
 	// 10% of the time, throw and error instead of calling the corresponding cfu method.
-	dice := c.perturbation.Int63n(10)
-	if dice == 9 {
-		return errInjected
+	// Another 10% of the time, copy the file but report a failed verification.
+	dice := c.roll()
+	switch dice {
+	case 8:
+		res, err := c.cfu.CardFileCopy(ctx, fromFile, toFile, obs)
+		if err != nil {
+			return res, err
+		}
+		res.Verify.Passes[len(res.Verify.Passes)-1].Match = false
+		return res, cardfileutil.ErrVerifyMismatch
+	case 9:
+		return cardfileutil.CopyResult{}, errInjected
+	default:
+		return c.cfu.CardFileCopy(ctx, fromFile, toFile, obs)
 	}
-	return c.cfu.CardFileCopy(fromFile, toFile)
+}
+
+func (c *CardFileUtilMock) HashFile(fileName string) (cardfileutil.FileDigest, error) {
+	return c.cfu.HashFile(fileName)
 }
 
 // This test mimics the behavior of the main application.
 // The main purpose is to exersize everything in dlv.
 func TestNewWorkerPool(t *testing.T) {
 
-	homedir := os.Getenv("HOME")
-
-	testDir := homedir + "/go/src/github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/filecontrol/testData"
+	testDir := "testData"
 
 	cardA := testDir + "/source/A"
 	cardB := testDir + "/source/B"
@@ -77,22 +107,46 @@ func TestNewWorkerPool(t *testing.T) {
 
 	cfum := NewCardFileUtilMock()
 
-	nameOracle, err := NewTargetNameGenManager(targetDir, cfum)
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfum)
 	if err != nil {
 		t.Fatal("error making name oracle: " + err.Error())
 	}
 
-	workerPool := NewWorkerPool(4, nameOracle, false, cfum, 5)
+	importLedger, err := ledger.Open(targetDir, "test-session")
+	if err != nil {
+		t.Fatal("error opening ledger: " + err.Error())
+	}
 
-	err = OrchestrateLocate([]string{cardA, cardB, cardC, cardD},
+	workerPool := NewWorkerPool(4, nameOracle, false, cfum, 5,
+		WorkerPoolOpts{ImportLedger: importLedger})
+
+	err = OrchestrateLocate(context.Background(), []string{cardA, cardB, cardC, cardD},
 		workerPool, true)
 	if err != nil && !errors.Is(err, errInjected) {
 		t.Fatal("unexpected from OrchestrateLocate: " + err.Error())
 	}
 
-	finalResults, err := workerPool.ParallelFileCopy()
-	if err != nil && !errors.Is(err, errInjected) {
-		t.Fatal("unexpected error from parallel file copy: " + err.Error())
+	finalResults, copyErr := workerPool.ParallelFileCopy(context.Background())
+	if copyErr != nil && !errors.Is(copyErr, errInjected) {
+		t.Fatal("unexpected error from parallel file copy: " + copyErr.Error())
+	}
+
+	err = importLedger.Close()
+	if err != nil {
+		t.Fatal("error closing ledger: " + err.Error())
+	}
+
+	// When the run finished cleanly, every copied or skipped file must be
+	// in the ledger.
+	if copyErr == nil {
+		recs, err := ledger.ReadDir(targetDir)
+		if err != nil {
+			t.Fatal("error reading ledger: " + err.Error())
+		}
+		if uint64(len(recs)) != finalResults.Copied+finalResults.Skipped {
+			t.Errorf("ledger has %d records, expected %d", len(recs),
+				finalResults.Copied+finalResults.Skipped)
+		}
 	}
 
 	// Print the summary results.
@@ -113,3 +167,726 @@ func TestNewWorkerPool(t *testing.T) {
 		t.Fatal("Error removing targetDir at the end of testing: " + err.Error() + "\n")
 	}
 }
+
+func TestWorkerPoolLibrarySkip(t *testing.T) {
+
+	cardDir := t.TempDir()
+	libraryDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	// The library already has one of the card files, under a name that
+	// the name oracle would never match.
+	err := os.WriteFile(filepath.Join(cardDir, "PAH_0001.CR2"), []byte("already imported"), 0644)
+	if err != nil {
+		t.Fatal("error writing card file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(cardDir, "PAH_0002.CR2"), []byte("brand new image"), 0644)
+	if err != nil {
+		t.Fatal("error writing card file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(libraryDir, "PAH_0001_renamed.CR2"), []byte("already imported"), 0644)
+	if err != nil {
+		t.Fatal("error writing library file: " + err.Error())
+	}
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	idx, err := libindex.Load(filepath.Join(libraryDir, libindex.DefaultFileName),
+		cardfileutil.HashSHA256, cfu)
+	if err != nil {
+		t.Fatal("error loading library index: " + err.Error())
+	}
+	_, err = idx.Update([]string{libraryDir})
+	if err != nil {
+		t.Fatal("error updating library index: " + err.Error())
+	}
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(2, nameOracle, false, cfu, 1,
+		WorkerPoolOpts{LibraryIndex: idx})
+
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	finalResults, err := workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+
+	if finalResults.Skipped != 1 || finalResults.Copied != 1 {
+		t.Errorf("expected 1 skipped and 1 copied, got %+v", finalResults)
+	}
+
+	_, err = os.Stat(filepath.Join(targetDir, "PAH_0001.CR2"))
+	if err == nil {
+		t.Error("file already in the library was copied anyway")
+	}
+}
+
+func TestWorkerPoolHistory(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3"})
+	targetDir := t.TempDir()
+
+	// The copies are verified with sha256, and the history gets the xxh64
+	// digest from the same read.
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+	cfu.SetExtraDigests(cardfileutil.HashXXH64)
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "shoot", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	history, err := mhl.Open(targetDir)
+	if err != nil {
+		t.Fatal("error opening history: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(2, nameOracle, false, cfu, 1,
+		WorkerPoolOpts{History: history})
+
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	_, err = workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+
+	if history.Len() != 2 || !history.Known(filepath.Join(targetDir, "shoot", "IMG_0001.CR3")) {
+		t.Fatalf("expected both copies in the history, got %d", history.Len())
+	}
+
+	_, err = history.Commit(time.Now())
+	if err != nil {
+		t.Fatal("error committing history: " + err.Error())
+	}
+
+	report, err := mhl.Verify(targetDir, cardfileutil.NewCardFileUtil(16384, 1,
+		cardfileutil.HashXXH64, cardfileutil.DefaultFileMode))
+	if err != nil {
+		t.Fatal("error verifying history: " + err.Error())
+	}
+	if !report.OK() || report.Verified != 2 {
+		t.Errorf("expected the target to verify, got %+v", report)
+	}
+}
+
+// TestWorkerPoolHistoryTwice - A second import into a flat target finds the
+// ascmhl folder of the first, and must not take it for a stray directory.
+func TestWorkerPoolHistoryTwice(t *testing.T) {
+
+	targetDir := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashXXH64,
+		cardfileutil.DefaultFileMode)
+
+	for _, names := range [][]string{{"DCIM/100CANON/IMG_0001.CR3"},
+		{"DCIM/100CANON/IMG_0002.CR3"}} {
+
+		cardDir := writeCard(t, names)
+
+		nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+
+		history, err := mhl.Open(targetDir)
+		if err != nil {
+			t.Fatal("error opening history: " + err.Error())
+		}
+
+		workerPool := NewWorkerPool(2, nameOracle, false, cfu, 1,
+			WorkerPoolOpts{History: history})
+
+		err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+		if err != nil {
+			t.Fatal("error locating files: " + err.Error())
+		}
+
+		res, err := workerPool.ParallelFileCopy(context.Background())
+		if err != nil {
+			t.Fatal("error copying files: " + err.Error())
+		}
+		if res.Copied != 1 {
+			t.Fatalf("expected one copy, got %+v", res)
+		}
+
+		_, err = history.Commit(time.Now())
+		if err != nil {
+			t.Fatal("error committing history: " + err.Error())
+		}
+	}
+
+	report, err := mhl.Verify(targetDir, cfu)
+	if err != nil {
+		t.Fatal("error verifying history: " + err.Error())
+	}
+	if !report.OK() || report.Verified != 2 {
+		t.Errorf("expected both imports to verify, got %+v", report)
+	}
+}
+
+func TestWorkerPoolManifests(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3"})
+	targetDir := t.TempDir()
+
+	formats := []manifest.Format{manifest.FormatSHA256Sum, manifest.FormatMD5Sum,
+		manifest.FormatBagIt}
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashXXH64,
+		cardfileutil.DefaultFileMode)
+	cfu.SetExtraDigests(manifest.Algos(formats)...)
+
+	manifests, err := manifest.Open(targetDir, formats)
+	if err != nil {
+		t.Fatal("error opening manifests: " + err.Error())
+	}
+
+	nameOracle, err := NewTargetNameGenManager(manifest.PayloadRoot(targetDir, formats),
+		"", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(2, nameOracle, false, cfu, 1,
+		WorkerPoolOpts{Manifests: manifests})
+
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	_, err = workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+	err = manifests.Close()
+	if err != nil {
+		t.Fatal("error closing manifests: " + err.Error())
+	}
+
+	for _, name := range []string{manifest.SHA256SumsName, manifest.MD5SumsName,
+		manifest.BagManifestName} {
+		report, err := manifest.Verify(filepath.Join(targetDir, name),
+			func(algo cardfileutil.HashAlgo) manifest.Hasher {
+				return cardfileutil.NewCardFileUtil(16384, 1, algo, cardfileutil.DefaultFileMode)
+			})
+		if err != nil {
+			t.Fatalf("error verifying %s: %s", name, err.Error())
+		}
+		if !report.OK() || report.Verified != 2 {
+			t.Errorf("expected %s to verify both copies, got %+v", name, report)
+		}
+	}
+}
+
+// cancelAfterCopy - Cancels the run once it has copied one file, like a
+// Ctrl-C in the middle of an import.  It also counts IsFileSame calls,
+// which is how the name oracle would recognize files without the ledger.
+type cancelAfterCopy struct {
+	*cardfileutil.CardFileUtil
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	copies int
+	sames  int
+}
+
+func (c *cancelAfterCopy) CardFileCopy(ctx context.Context, fromFile string,
+	toFile string, obs cardfileutil.CopyObserver) (cardfileutil.CopyResult, error) {
+	res, err := c.CardFileUtil.CardFileCopy(ctx, fromFile, toFile, obs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copies++
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return res, err
+}
+
+func (c *cancelAfterCopy) IsFileSame(fromFile string, toFile string) (bool, error) {
+	c.mu.Lock()
+	c.sames++
+	c.mu.Unlock()
+	return c.CardFileUtil.IsFileSame(fromFile, toFile)
+}
+
+func TestWorkerPoolResume(t *testing.T) {
+
+	cardDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	for _, name := range []string{"PAH_0001.CR2", "PAH_0002.CR2", "PAH_0003.CR2"} {
+		err := os.WriteFile(filepath.Join(cardDir, name), []byte("image "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+	}
+
+	runImport := func(cfu *cancelAfterCopy, ctx context.Context) WorkerPoolFinishMsg {
+
+		prior, err := ledger.ReadDir(targetDir)
+		if err != nil {
+			t.Fatal("error reading ledger: " + err.Error())
+		}
+		importLedger, err := ledger.Open(targetDir, "test-session")
+		if err != nil {
+			t.Fatal("error opening ledger: " + err.Error())
+		}
+		defer func() {
+			_ = importLedger.Close()
+		}()
+
+		nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+
+		// One worker, so the cancel lands between two files.
+		workerPool := NewWorkerPool(1, nameOracle, false, cfu, 1, WorkerPoolOpts{
+			ImportLedger:  importLedger,
+			DeviceWorkers: 1,
+			Imported:      ledger.NewImported(prior),
+		})
+
+		err = OrchestrateLocate(ctx, []string{cardDir}, workerPool, false)
+		if err != nil {
+			t.Fatal("error locating files: " + err.Error())
+		}
+
+		rv, err := workerPool.ParallelFileCopy(ctx)
+		if err != nil {
+			t.Fatal("error copying files: " + err.Error())
+		}
+		return rv
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := &cancelAfterCopy{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+		cancel: cancel,
+	}
+
+	res := runImport(first, ctx)
+	if !res.Interrupted {
+		t.Fatal("first run was not reported as interrupted")
+	}
+	if res.Copied != 1 {
+		t.Fatalf("expected 1 copied before the cancel, got %+v", res)
+	}
+
+	// Nothing half written may be left behind.
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal("error reading target: " + err.Error())
+	}
+	for _, ent := range entries {
+		if cardfileutil.IsTempName(ent.Name()) {
+			t.Errorf("interrupted run left %s behind", ent.Name())
+		}
+	}
+
+	second := &cancelAfterCopy{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+	}
+
+	res = runImport(second, context.Background())
+	if res.Interrupted {
+		t.Fatal("second run was reported as interrupted")
+	}
+	if res.Copied != 2 || res.Skipped != 1 {
+		t.Fatalf("expected 2 copied and 1 skipped, got %+v", res)
+	}
+	if second.sames != 0 {
+		t.Errorf("second run compared %d files, instead of using the ledger", second.sames)
+	}
+
+	for _, name := range []string{"PAH_0001.CR2", "PAH_0002.CR2", "PAH_0003.CR2"} {
+		_, err = os.Stat(filepath.Join(targetDir, name))
+		if err != nil {
+			t.Errorf("%s missing after the second run: %s", name, err.Error())
+		}
+	}
+
+	// A different file with the same path, size and modification time, as
+	// on a reformatted card, is not taken for the one in the ledger.
+	changed := filepath.Join(cardDir, "PAH_0002.CR2")
+	info, err := os.Stat(changed)
+	if err != nil {
+		t.Fatal("error reading card file: " + err.Error())
+	}
+	err = os.WriteFile(changed, []byte("image PAH_000X.CR2"), 0644)
+	if err != nil {
+		t.Fatal("error writing card file: " + err.Error())
+	}
+	err = os.Chtimes(changed, info.ModTime(), info.ModTime())
+	if err != nil {
+		t.Fatal("error setting card file time: " + err.Error())
+	}
+
+	third := &cancelAfterCopy{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+	}
+
+	res = runImport(third, context.Background())
+	if res.Copied != 1 || res.Skipped != 2 {
+		t.Fatalf("expected 1 copied and 2 skipped, got %+v", res)
+	}
+	if third.sames != 1 {
+		t.Errorf("third run compared %d files, want only the changed one", third.sames)
+	}
+}
+
+func TestFeedDevice(t *testing.T) {
+
+	base := time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC)
+	makeCard := func(name string, minutes ...int) *cardWalk {
+		card := &cardWalk{
+			path:   name,
+			groups: make(chan *AssetGroup, len(minutes)),
+		}
+		for i, m := range minutes {
+			card.groups <- &AssetGroup{members: []CardSlurpWork{{
+				sourceCard: name,
+				parentDir:  name,
+				fileName:   fmt.Sprintf("IMG_%04d.JPG", i),
+				fileTime:   base.Add(time.Duration(m) * time.Minute),
+			}}}
+		}
+		card.result = LocateFilesFinishMsg{ParentDir: name}
+		close(card.groups)
+		return card
+	}
+
+	// Cards in one reader are interleaved by capture time.
+	dev := &sourceDevice{
+		id:    "reader",
+		cards: []*cardWalk{makeCard("A", 1, 4, 5, 9), makeCard("B", 2, 3, 8), makeCard("C")},
+		queue: make(chan *AssetGroup),
+	}
+	workerPool := NewWorkerPool(1, nil, false, nil, 1, WorkerPoolOpts{})
+	go workerPool.feedDevice(dev)
+
+	order := ""
+	var last time.Time
+	for g := range dev.queue {
+		if g.bestTime().Before(last) {
+			t.Errorf("group from %s at %s came after %s", g.members[0].sourceCard,
+				g.bestTime(), last)
+		}
+		last = g.bestTime()
+		order += g.members[0].sourceCard
+	}
+	if order != "ABBAABA" {
+		t.Errorf("expected capture time order ABBAABA, got %s", order)
+	}
+	failures, _ := workerPool.locateResults()
+	if len(failures) != 0 {
+		t.Errorf("unexpected locate error: %s", failures[0])
+	}
+
+	// By default, a card that fails stops the feed, and the error is kept
+	// for ParallelFileCopy.
+	broken := makeCard("D", 1)
+	broken.result.LocateError = errInjected
+	dev = &sourceDevice{
+		id:    "reader",
+		cards: []*cardWalk{broken},
+		queue: make(chan *AssetGroup),
+	}
+	workerPool = NewWorkerPool(1, nil, false, nil, 1, WorkerPoolOpts{})
+	go workerPool.feedDevice(dev)
+	for range dev.queue {
+	}
+	failures, _ = workerPool.locateResults()
+	if len(failures) != 1 || !errors.Is(failures[0], errInjected) ||
+		failures[0].Category != CategoryDiscovery {
+		t.Errorf("expected the injected locate error, got %v", failures)
+	}
+	select {
+	case <-workerPool.stop:
+	default:
+		t.Error("a failed card did not stop the run")
+	}
+
+	// With the continue policy, the other cards carry on.
+	broken = makeCard("D")
+	broken.result.LocateError = errInjected
+	dev = &sourceDevice{
+		id:    "reader",
+		cards: []*cardWalk{broken, makeCard("E", 1)},
+		queue: make(chan *AssetGroup),
+	}
+	workerPool = NewWorkerPool(1, nil, false, nil, 1,
+		WorkerPoolOpts{ErrorPolicy: ErrorPolicy{Mode: PolicyContinue}})
+	go workerPool.feedDevice(dev)
+	order = ""
+	for g := range dev.queue {
+		order += g.members[0].sourceCard
+	}
+	if order != "E" {
+		t.Errorf("expected card E to carry on, got %q", order)
+	}
+}
+
+func TestGroupByDevice(t *testing.T) {
+
+	// Two directories on one filesystem are one device.
+	root := t.TempDir()
+	cardA := filepath.Join(root, "A")
+	cardB := filepath.Join(root, "B")
+	for _, dir := range []string{cardA, cardB} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal("error making card dir: " + err.Error())
+		}
+	}
+
+	devices, err := groupByDevice([]*cardWalk{{path: cardA}, {path: cardB}})
+	if err != nil {
+		t.Fatal("error grouping cards by device: " + err.Error())
+	}
+	if len(devices) != 1 || len(devices[0].cards) != 2 {
+		t.Errorf("expected one device with two cards, got %d devices", len(devices))
+	}
+
+	_, err = groupByDevice([]*cardWalk{{path: filepath.Join(root, "missing")}})
+	if err == nil {
+		t.Error("expected an error for a missing card")
+	}
+}
+
+func TestGroupTargets(t *testing.T) {
+
+	// A primary and a mirror on one filesystem share a device, and a
+	// mirror that is not there gets one of its own.
+	root := t.TempDir()
+	cfu := NewCardFileUtilMock()
+	oracle := func(dir string) *TargetNameGenManager {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal("error making target dir: " + err.Error())
+		}
+		nameOracle, err := NewTargetNameGenManager(dir, "", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+		return nameOracle
+	}
+
+	gone := oracle(filepath.Join(root, "gone"))
+	err := os.Remove(filepath.Join(root, "gone"))
+	if err != nil {
+		t.Fatal("error removing target dir: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(3, oracle(filepath.Join(root, "ssd")), false, cfu, 1,
+		WorkerPoolOpts{Mirrors: []ImportTarget{
+			{NameOracle: oracle(filepath.Join(root, "backup"))},
+			{NameOracle: gone},
+		}})
+	workerPool.groupTargets()
+
+	if len(workerPool.targetDevices) != 2 {
+		t.Fatalf("expected 2 target devices, got %d", len(workerPool.targetDevices))
+	}
+	for _, td := range workerPool.targetDevices {
+		if cap(td.slots) != 3 {
+			t.Errorf("expected 3 slots on %s, got %d", td.id, cap(td.slots))
+		}
+	}
+}
+
+// targetFiles - The names of the files in dir, without the hidden ones
+// cardslurp keeps its records in.
+func targetFiles(t *testing.T, dir string) map[string]bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("error reading target: " + err.Error())
+	}
+	rv := make(map[string]bool)
+	for _, ent := range entries {
+		if ent.Name()[0] != '.' {
+			rv[ent.Name()] = true
+		}
+	}
+	return rv
+}
+
+func TestWorkerPoolMirror(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3", "DCIM/100CANON/IMG_0003.CR3"})
+	ssdDir := t.TempDir()
+	nasDir := t.TempDir()
+
+	// Something else already has one of the names on the NAS, so the file
+	// gets a new name in both targets.
+	err := os.WriteFile(filepath.Join(nasDir, "IMG_0002.CR3"), []byte("another camera"), 0644)
+	if err != nil {
+		t.Fatal("error writing target file: " + err.Error())
+	}
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	target := func(dir string) ImportTarget {
+		nameOracle, err := NewTargetNameGenManager(dir, "", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+		prior, err := ledger.ReadDir(dir)
+		if err != nil {
+			t.Fatal("error reading ledger: " + err.Error())
+		}
+		importLedger, err := ledger.Open(dir, "test-session")
+		if err != nil {
+			t.Fatal("error opening ledger: " + err.Error())
+		}
+		t.Cleanup(func() {
+			_ = importLedger.Close()
+		})
+		return ImportTarget{
+			NameOracle:   nameOracle,
+			ImportLedger: importLedger,
+			Imported:     ledger.NewImported(prior),
+		}
+	}
+
+	runImport := func(targets []ImportTarget) WorkerPoolFinishMsg {
+		workerPool := NewWorkerPool(2, targets[0].NameOracle, false, cfu, 1, WorkerPoolOpts{
+			ImportLedger: targets[0].ImportLedger,
+			Imported:     targets[0].Imported,
+			ErrorPolicy:  ErrorPolicy{Mode: PolicyContinue},
+			Mirrors:      targets[1:],
+		})
+		err := OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+		if err != nil {
+			t.Fatal("error locating files: " + err.Error())
+		}
+		res, _ := workerPool.ParallelFileCopy(context.Background())
+		return res
+	}
+
+	res := runImport([]ImportTarget{target(ssdDir), target(nasDir)})
+	if len(res.Failed) != 0 || res.Copied != 6 || len(res.Targets) != 2 ||
+		res.Targets[0].Copied != 3 || res.Targets[1].Copied != 3 {
+		t.Fatalf("expected 3 copies in each target, got %+v", res)
+	}
+
+	ssdFiles := targetFiles(t, ssdDir)
+	nasFiles := targetFiles(t, nasDir)
+	if len(ssdFiles) != 3 || ssdFiles["IMG_0002.CR3"] {
+		t.Errorf("expected IMG_0002.CR3 to be renamed on the SSD too, got %v", ssdFiles)
+	}
+	for name := range ssdFiles {
+		if !nasFiles[name] {
+			t.Errorf("%s is on the SSD, but not the NAS", name)
+		}
+	}
+
+	// A new mirror gets the same names, and one that can not be written
+	// does not hold up the others.
+	usbDir := t.TempDir()
+	goneDir := filepath.Join(t.TempDir(), "gone")
+	err = os.Mkdir(goneDir, 0755)
+	if err != nil {
+		t.Fatal("error making target: " + err.Error())
+	}
+	gone := target(goneDir)
+	err = os.RemoveAll(goneDir)
+	if err != nil {
+		t.Fatal("error removing target: " + err.Error())
+	}
+
+	res = runImport([]ImportTarget{target(ssdDir), target(nasDir), target(usbDir), gone})
+	if res.Targets[0].Skipped != 3 || res.Targets[1].Skipped != 3 ||
+		res.Targets[2].Copied != 3 || res.Targets[3].Failed != 3 || len(res.Failed) != 3 {
+		t.Fatalf("expected only the new mirrors to be copied to, got %+v", res.Targets)
+	}
+	usbFiles := targetFiles(t, usbDir)
+	for name := range ssdFiles {
+		if !usbFiles[name] {
+			t.Errorf("%s is on the SSD, but not the new mirror", name)
+		}
+	}
+}
+
+func TestWorkerPoolMirrorBag(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3"})
+	dirs := []string{t.TempDir(), t.TempDir()}
+
+	formats := []manifest.Format{manifest.FormatBagIt}
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashXXH64,
+		cardfileutil.DefaultFileMode)
+	cfu.SetExtraDigests(manifest.Algos(formats)...)
+
+	// The same order as main: the manifests make the data folder the name
+	// oracle works in.
+	targets := make([]ImportTarget, 0, len(dirs))
+	for _, dir := range dirs {
+		manifests, err := manifest.Open(dir, formats)
+		if err != nil {
+			t.Fatal("error opening manifests: " + err.Error())
+		}
+		nameOracle, err := NewTargetNameGenManager(manifest.PayloadRoot(dir, formats),
+			"", "", cfu)
+		if err != nil {
+			t.Fatal("error making name oracle: " + err.Error())
+		}
+		targets = append(targets, ImportTarget{NameOracle: nameOracle, Manifests: manifests})
+	}
+
+	workerPool := NewWorkerPool(2, targets[0].NameOracle, false, cfu, 1, WorkerPoolOpts{
+		Manifests: targets[0].Manifests,
+		Mirrors:   targets[1:],
+	})
+
+	err := OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	res, err := workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+	if res.Copied != 4 {
+		t.Fatalf("expected 2 copies in each bag, got %+v", res)
+	}
+
+	for i, dir := range dirs {
+		err = targets[i].Manifests.Close()
+		if err != nil {
+			t.Fatal("error closing manifests: " + err.Error())
+		}
+		report, err := manifest.Verify(filepath.Join(dir, manifest.BagManifestName),
+			func(algo cardfileutil.HashAlgo) manifest.Hasher {
+				return cardfileutil.NewCardFileUtil(16384, 1, algo, cardfileutil.DefaultFileMode)
+			})
+		if err != nil {
+			t.Fatalf("error verifying %s: %s", dir, err.Error())
+		}
+		if !report.OK() || report.Verified != 2 {
+			t.Errorf("expected the bag in %s to verify, got %+v", dir, report)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package filecontrol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IgnoreFileName - Rules file read from the root of each card.  It uses
+// the same patterns as -exclude, one per line.  A line starting with ! keeps
+// what it matches, and # starts a comment.
+const IgnoreFileName = ".cardslurpignore"
+
+// cameraProfile - Where one camera layout keeps its media, relative to the
+// card root.  Anything the keep patterns do not match is dropped.
+type cameraProfile struct {
+	keep []string
+	drop []string
+}
+
+// cameraProfiles - The built-in layouts for -profiles.  "all" keeps every
+// file, except the system and camera catalog files every card gets.
+var cameraProfiles = map[string]cameraProfile{
+	"all":  {},
+	"dcim": {keep: []string{"DCIM/**"}},
+	"m4root": {keep: []string{
+		"PRIVATE/M4ROOT/CLIP/**",
+		"PRIVATE/M4ROOT/SUB/**",
+	}},
+	"avchd": {keep: []string{
+		"PRIVATE/AVCHD/BDMV/STREAM/**",
+		"AVCHD/BDMV/STREAM/**",
+	}},
+	"fuji": {keep: []string{"DCIM/*_FUJI/**"}},
+	// GoPro writes a thumbnail next to every video.
+	"gopro": {
+		keep: []string{"DCIM/*GOPRO/**"},
+		drop: []string{"DCIM/*GOPRO/*.THM"},
+	},
+}
+
+// ProfileNames - The built-in camera profiles, sorted.
+func ProfileNames() []string {
+	rv := make([]string, 0, len(cameraProfiles))
+	for name := range cameraProfiles {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// systemCruft - Files that operating systems and cameras leave on a card,
+// which are never photos or video.
+var systemCruft = []string{
+	".Trashes",
+	".Spotlight-V100",
+	".fseventsd",
+	".TemporaryItems",
+	"System Volume Information",
+	"$RECYCLE.BIN",
+	"._*",
+	".DS_Store",
+	"Thumbs.db",
+	"/" + IgnoreFileName,
+	// Camera catalogs and databases.
+	"/MISC",
+	"CANONMSC",
+	"*.CTG",
+	"AVF_INFO",
+}
+
+// FilterOpts - The discovery rules from the command line.
+type FilterOpts struct {
+	// Profiles - Built-in camera layouts to import from.  Empty means
+	// "all".
+	Profiles []string
+	// Include and Exclude - Glob patterns.  A pattern without a / matches
+	// the name of a file or directory anywhere on the card.  One with a /
+	// matches the path from the card root.  ** matches any number of
+	// directories.
+	Include []string
+	Exclude []string
+	// Ext and SkipExt - File extensions, without the period.  If Ext is
+	// not empty, only those extensions are imported.
+	Ext     []string
+	SkipExt []string
+}
+
+// filterRule - One rule.  The last rule that matches a path decides
+// whether it is kept.
+type filterRule struct {
+	// source and pattern - Where the rule came from, and how it was
+	// written, for the dry run.
+	source  string
+	pattern string
+	keep    bool
+	// hits - Does the rule match the path, or one of its directories.
+	// Paths are relative to the card, with forward slashes, and lower
+	// case.
+	hits func(rel string, isDir bool) bool
+	// reaches - For keep rules, could the rule match something under dir.
+	reaches func(dir string) bool
+}
+
+func (r filterRule) String() string {
+	return r.source + " " + r.pattern
+}
+
+// profileKeep - One keep pattern of a camera profile.
+type profileKeep struct {
+	profile string
+	pattern string
+	glob    *globPattern
+}
+
+// Filter - Decides which files on a card are imported.  Matching is not
+// case sensitive, since cards are FAT or exFAT.
+type Filter struct {
+	// keeps - The profile patterns.  Empty keeps everything.
+	keeps    []profileKeep
+	profiles string
+	rules    []filterRule
+	// cardAt - Where the rules from a card's ignore file go.
+	cardAt int
+}
+
+// Decision - What a filter did with one path, and the rule that decided.
+type Decision struct {
+	Keep bool
+	Rule string
+}
+
+// NewFilter - Build the rules for opts.  In order, they are the camera
+// profiles, the system files, the card's .cardslurpignore (see ForCard),
+// -ext, -skipext, -exclude and -include, so -include wins over everything.
+func NewFilter(opts FilterOpts) (*Filter, error) {
+
+	rv := &Filter{}
+
+	profiles := opts.Profiles
+	if len(profiles) == 0 {
+		profiles = []string{"all"}
+	}
+
+	keepAll := false
+	drops := make([]string, 0)
+	for _, name := range profiles {
+		prof, ok := cameraProfiles[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown camera profile %q (%s)", name,
+				strings.Join(ProfileNames(), ", "))
+		}
+		if len(prof.keep) == 0 {
+			keepAll = true
+		}
+		for _, k := range prof.keep {
+			g, err := parseGlob(k)
+			if err != nil {
+				return nil, err
+			}
+			rv.keeps = append(rv.keeps, profileKeep{profile: name, pattern: k, glob: g})
+		}
+		drops = append(drops, prof.drop...)
+	}
+
+	rv.profiles = strings.Join(profiles, ",")
+	if keepAll {
+		rv.keeps = nil
+	}
+
+	for _, d := range drops {
+		err := rv.addGlob("profile", d, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range systemCruft {
+		err := rv.addGlob("system", c, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rv.cardAt = len(rv.rules)
+
+	if len(opts.Ext) != 0 {
+		exts := make(map[string]bool)
+		for _, e := range opts.Ext {
+			exts[normalizeExt(e)] = true
+		}
+		rv.rules = append(rv.rules, filterRule{
+			source:  "-ext",
+			pattern: strings.Join(opts.Ext, ","),
+			hits: func(rel string, isDir bool) bool {
+				return !isDir && !exts[normalizeExt(path.Ext(rel))]
+			},
+		})
+	}
+
+	for _, e := range opts.SkipExt {
+		err := rv.addGlob("-skipext", "*."+normalizeExt(e), false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range opts.Exclude {
+		err := rv.addGlob("-exclude", e, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, i := range opts.Include {
+		err := rv.addGlob("-include", i, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
+// normalizeExt - Extension without the period, in lower case.
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// addGlob - Add a glob pattern rule.  A trailing / only matches
+// directories.
+func (f *Filter) addGlob(source string, pattern string, keep bool) error {
+
+	g, err := parseGlob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid %s pattern: %w", source, err)
+	}
+
+	f.rules = append(f.rules, filterRule{
+		source:  source,
+		pattern: pattern,
+		keep:    keep,
+		hits:    g.hits,
+		reaches: g.reaches,
+	})
+
+	return nil
+}
+
+// ForCard - The filter with the rules from the card's .cardslurpignore
+// added, if it has one.  They go before the command line rules, so
+// -include can still bring back what the card ignores.
+func (f *Filter) ForCard(cardPath string) (*Filter, error) {
+
+	data, err := os.ReadFile(filepath.Join(cardPath, IgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", IgnoreFileName, err)
+	}
+
+	rv := &Filter{
+		keeps:    f.keeps,
+		profiles: f.profiles,
+	}
+	rv.rules = append(rv.rules, f.rules[:f.cardAt]...)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keep := strings.HasPrefix(line, "!")
+		err = rv.addGlob(IgnoreFileName, strings.TrimPrefix(line, "!"), keep)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rv.cardAt = len(rv.rules)
+	rv.rules = append(rv.rules, f.rules[f.cardAt:]...)
+
+	return rv, nil
+}
+
+// Decide - Whether to import rel, a path relative to the card root.  For
+// a directory, Keep false means nothing under it can be kept, so it need
+// not be read.  A nil filter keeps everything.
+func (f *Filter) Decide(rel string, isDir bool) Decision {
+
+	if f == nil {
+		return Decision{Keep: true, Rule: "default"}
+	}
+
+	rel = strings.ToLower(filepath.ToSlash(rel))
+	rv := f.profileDecision(rel, isDir)
+	decider := -1
+	for i, r := range f.rules {
+		if r.hits(rel, isDir) {
+			rv = Decision{Keep: r.keep, Rule: r.String()}
+			decider = i
+		}
+	}
+
+	if isDir && !rv.Keep {
+		// A later rule may still keep something under the directory.
+		for _, r := range f.rules[decider+1:] {
+			if r.keep && r.reaches(rel) {
+				return Decision{Keep: true, Rule: r.String()}
+			}
+		}
+	}
+
+	return rv
+}
+
+// profileDecision - Whether the camera profiles keep rel.  A directory is
+// kept if a profile could match anything under it.
+func (f *Filter) profileDecision(rel string, isDir bool) Decision {
+
+	if len(f.keeps) == 0 {
+		return Decision{Keep: true, Rule: "-profiles " + f.profiles}
+	}
+
+	for _, k := range f.keeps {
+		if isDir && k.glob.reaches(rel) || !isDir && k.glob.match(rel) {
+			return Decision{Keep: true, Rule: "profile " + k.profile + " " + k.pattern}
+		}
+	}
+
+	return Decision{Keep: false, Rule: "-profiles " + f.profiles}
+}
+
+// globPattern - A parsed -include, -exclude or ignore file pattern.
+type globPattern struct {
+	segs     []string
+	anchored bool
+	dirOnly  bool
+}
+
+func parseGlob(pattern string) (*globPattern, error) {
+
+	p := strings.ToLower(filepath.ToSlash(strings.TrimSpace(pattern)))
+	g := &globPattern{}
+
+	if strings.HasSuffix(p, "/") {
+		g.dirOnly = true
+		p = strings.TrimSuffix(p, "/")
+	}
+	if strings.HasPrefix(p, "/") {
+		g.anchored = true
+		p = strings.TrimPrefix(p, "/")
+	}
+	if strings.Contains(p, "/") {
+		g.anchored = true
+	}
+	if p == "" {
+		return nil, fmt.Errorf("empty pattern %q", pattern)
+	}
+
+	g.segs = strings.Split(p, "/")
+	for _, s := range g.segs {
+		_, err := path.Match(s, "")
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+	}
+
+	return g, nil
+}
+
+// match - Does the pattern match rel itself.
+func (g *globPattern) match(rel string) bool {
+	segs := strings.Split(rel, "/")
+	if !g.anchored {
+		return matchSegs(g.segs, segs[len(segs)-1:])
+	}
+	return matchSegs(g.segs, segs)
+}
+
+// hits - Does the pattern match rel, or one of the directories it is in.
+func (g *globPattern) hits(rel string, isDir bool) bool {
+
+	segs := strings.Split(rel, "/")
+	for end := 1; end <= len(segs); end++ {
+		if end == len(segs) && g.dirOnly && !isDir {
+			break
+		}
+		if !g.anchored {
+			if matchSegs(g.segs, segs[end-1:end]) {
+				return true
+			}
+			continue
+		}
+		if matchSegs(g.segs, segs[:end]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reaches - Could the pattern match dir, or anything under it.
+func (g *globPattern) reaches(dir string) bool {
+	if !g.anchored {
+		return true
+	}
+	return prefixSegs(g.segs, strings.Split(dir, "/"))
+}
+
+// matchSegs - Match path segments against pattern segments, where **
+// matches any number of segments.
+func matchSegs(pat []string, segs []string) bool {
+
+	if len(pat) == 0 {
+		return len(segs) == 0
+	}
+
+	if pat[0] == "**" {
+		for skip := 0; skip <= len(segs); skip++ {
+			if matchSegs(pat[1:], segs[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segs) == 0 {
+		return false
+	}
+
+	ok, _ := path.Match(pat[0], segs[0])
+	return ok && matchSegs(pat[1:], segs[1:])
+}
+
+// prefixSegs - Could the pattern match dir, one of its parents, or
+// something under it.
+func prefixSegs(pat []string, dir []string) bool {
+
+	if len(pat) == 0 || len(dir) == 0 || pat[0] == "**" {
+		return true
+	}
+
+	ok, _ := path.Match(pat[0], dir[0])
+	return ok && prefixSegs(pat[1:], dir[1:])
+}
+
+// ListCard - Walk a card with the filter, and write what each rule kept or
+// dropped to out, without copying anything.  A dropped directory is listed
+// once, with the number of files under it, which count as dropped.  Like
+// an import, it skips directories it can not read, and anything that is
+// not a regular file, and lists those as skipped.
+func ListCard(cardPath string, filter *Filter, out io.Writer) error {
+
+	filter, err := filter.ForCard(cardPath)
+	if err != nil {
+		return err
+	}
+
+	l := &cardListing{
+		cardPath: cardPath,
+		filter:   filter,
+		out:      out,
+		readDir:  os.ReadDir,
+	}
+	return l.list()
+}
+
+// cardListing - One card being listed by ListCard.
+type cardListing struct {
+	cardPath string
+	filter   *Filter
+	out      io.Writer
+	// readDir - os.ReadDir, unless a test needs a card that misbehaves.
+	readDir func(name string) ([]os.DirEntry, error)
+	kept    uint64
+	dropped uint64
+	skipped uint64
+}
+
+func (l *cardListing) list() error {
+
+	err := l.listDir("")
+	if err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("%s: %d files kept, %d dropped", l.cardPath, l.kept, l.dropped)
+	if l.skipped != 0 {
+		summary += fmt.Sprintf(", %d skipped", l.skipped)
+	}
+	_, err = fmt.Fprintln(l.out, summary)
+	return err
+}
+
+func (l *cardListing) listDir(rel string) error {
+
+	entries, err := l.readDir(filepath.Join(l.cardPath, rel))
+	if err != nil {
+		if rel == "" {
+			return fmt.Errorf("error reading directory %s: %w", l.cardPath, err)
+		}
+		// ReadDir returns whatever it read before the error.
+		l.skipped++
+		fmt.Fprintf(l.out, "skip  %s/  (unreadable: %s)\n", rel, err.Error())
+	}
+
+	for _, d := range entries {
+		name := path.Join(rel, d.Name())
+		dec := l.filter.Decide(name, d.IsDir())
+
+		if d.IsDir() {
+			if !dec.Keep {
+				n := countFiles(filepath.Join(l.cardPath, name))
+				l.dropped += n
+				fmt.Fprintf(l.out, "drop  %s/  (%s, %d files)\n", name, dec.Rule, n)
+				continue
+			}
+			err = l.listDir(name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case !dec.Keep:
+			l.dropped++
+			fmt.Fprintf(l.out, "drop  %s  (%s)\n", name, dec.Rule)
+		case !d.Type().IsRegular():
+			l.skipped++
+			fmt.Fprintf(l.out, "skip  %s  (not a regular file)\n", name)
+		default:
+			l.kept++
+			fmt.Fprintf(l.out, "keep  %s  (%s)\n", name, dec.Rule)
+		}
+	}
+
+	return nil
+}
+
+// countFiles - The number of files under a dropped directory.  Whatever
+// can not be read is left out, since it would not be imported anyway.
+func countFiles(dir string) uint64 {
+
+	var rv uint64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rv++
+		}
+		return nil
+	})
+
+	return rv
+}
@@ -0,0 +1,253 @@
+package filecontrol
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestFilterDecide(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		opts  FilterOpts
+		rel   string
+		isDir bool
+		keep  bool
+	}{
+		{"all keeps anything", FilterOpts{}, "CLIPS/A001.MOV", false, true},
+		{"system cruft", FilterOpts{}, ".Spotlight-V100/Store-V2/x.db", false, false},
+		{"apple double", FilterOpts{}, "DCIM/100CANON/._IMG_0001.CR3", false, false},
+		{"canon catalog", FilterOpts{}, "DCIM/CANONMSC", true, false},
+		{"misc at the root", FilterOpts{}, "MISC", true, false},
+		{"misc below the root", FilterOpts{}, "DCIM/MISC/IMG_0001.JPG", false, true},
+		{"dcim keeps dcim", FilterOpts{Profiles: []string{"dcim"}}, "DCIM/100CANON/IMG_0001.CR3", false, true},
+		{"dcim drops private", FilterOpts{Profiles: []string{"dcim"}}, "PRIVATE", true, false},
+		{"dcim case", FilterOpts{Profiles: []string{"dcim"}}, "dcim/100canon/img_0001.cr3", false, true},
+		{"m4root walks private", FilterOpts{Profiles: []string{"m4root"}}, "PRIVATE/M4ROOT", true, true},
+		{"m4root keeps clips", FilterOpts{Profiles: []string{"m4root"}}, "PRIVATE/M4ROOT/CLIP/C0001.MP4", false, true},
+		{"m4root drops thumbnails", FilterOpts{Profiles: []string{"m4root"}}, "PRIVATE/M4ROOT/THMBNL", true, false},
+		{"avchd stream", FilterOpts{Profiles: []string{"avchd"}}, "PRIVATE/AVCHD/BDMV/STREAM/00000.MTS", false, true},
+		{"avchd playlist", FilterOpts{Profiles: []string{"avchd"}}, "PRIVATE/AVCHD/BDMV/PLAYLIST/00000.MPL", false, false},
+		{"fuji folder", FilterOpts{Profiles: []string{"fuji"}}, "DCIM/100_FUJI/DSCF0001.RAF", false, true},
+		{"fuji other folder", FilterOpts{Profiles: []string{"fuji"}}, "DCIM/100CANON", true, false},
+		{"gopro video", FilterOpts{Profiles: []string{"gopro"}}, "DCIM/100GOPRO/GX010001.MP4", false, true},
+		{"gopro thumbnail", FilterOpts{Profiles: []string{"gopro"}}, "DCIM/100GOPRO/GX010001.THM", false, false},
+		{"two profiles", FilterOpts{Profiles: []string{"fuji", "m4root"}}, "PRIVATE/M4ROOT/CLIP/C0001.MP4", false, true},
+		{"ext keeps", FilterOpts{Ext: []string{"cr3", ".MP4"}}, "DCIM/100CANON/IMG_0001.CR3", false, true},
+		{"ext drops", FilterOpts{Ext: []string{"cr3", ".MP4"}}, "DCIM/100CANON/IMG_0001.JPG", false, false},
+		{"ext walks dirs", FilterOpts{Ext: []string{"cr3"}}, "DCIM", true, true},
+		{"skipext", FilterOpts{SkipExt: []string{"xml"}}, "CLIPS/A001M01.XML", false, false},
+		{"exclude name", FilterOpts{Exclude: []string{"THMBNL"}}, "PRIVATE/M4ROOT/THMBNL/C0001T01.JPG", false, false},
+		{"exclude anchored", FilterOpts{Exclude: []string{"/DCIM/101*"}}, "DCIM/101CANON", true, false},
+		{"exclude anchored elsewhere", FilterOpts{Exclude: []string{"/DCIM/101*"}}, "OTHER/DCIM/101CANON", true, true},
+		{"exclude dir only", FilterOpts{Exclude: []string{"TMP/"}}, "TMP", false, true},
+		{"exclude double star", FilterOpts{Exclude: []string{"DCIM/**/*.JPG"}}, "DCIM/100CANON/IMG_0001.JPG", false, false},
+		{"include wins", FilterOpts{Ext: []string{"cr3"}, Include: []string{"*.JPG"}}, "DCIM/100CANON/IMG_0001.JPG", false, true},
+		{"include reaches into dropped dir", FilterOpts{Profiles: []string{"dcim"}, Include: []string{"/PRIVATE/M4ROOT/CLIP/*.MP4"}}, "PRIVATE", true, true},
+		{"include keeps from dropped dir", FilterOpts{Profiles: []string{"dcim"}, Include: []string{"/PRIVATE/M4ROOT/CLIP/*.MP4"}}, "PRIVATE/M4ROOT/CLIP/C0001.MP4", false, true},
+	}
+
+	for _, tc := range tests {
+		filter, err := NewFilter(tc.opts)
+		if err != nil {
+			t.Fatal("error making filter: " + err.Error())
+		}
+		dec := filter.Decide(tc.rel, tc.isDir)
+		if dec.Keep != tc.keep {
+			t.Errorf("%s: Decide(%s) = %+v, expected keep %v", tc.name, tc.rel, dec, tc.keep)
+		}
+	}
+
+	_, err := NewFilter(FilterOpts{Profiles: []string{"polaroid"}})
+	if err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+	_, err = NewFilter(FilterOpts{Exclude: []string{"[a-"}})
+	if err == nil {
+		t.Error("expected an error for a bad pattern")
+	}
+}
+
+// writeCard - Make a card with an empty file for each name.
+func writeCard(t *testing.T, names []string) string {
+
+	cardDir := t.TempDir()
+	for _, name := range names {
+		err := os.MkdirAll(filepath.Join(cardDir, filepath.Dir(name)), 0755)
+		if err != nil {
+			t.Fatal("error making card dir: " + err.Error())
+		}
+		err = os.WriteFile(filepath.Join(cardDir, name), []byte("image "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+	}
+
+	return cardDir
+}
+
+func TestFilterIgnoreFile(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0001.JPG", "DCIM/100CANON/IMG_0002.JPG"})
+	err := os.WriteFile(filepath.Join(cardDir, IgnoreFileName),
+		[]byte("# Only the raw files.\n*.JPG\n!IMG_0002.JPG\n"), 0644)
+	if err != nil {
+		t.Fatal("error writing ignore file: " + err.Error())
+	}
+
+	filter, err := NewFilter(FilterOpts{Include: []string{"IMG_0001.JPG"}})
+	if err != nil {
+		t.Fatal("error making filter: " + err.Error())
+	}
+	cardFilter, err := filter.ForCard(cardDir)
+	if err != nil {
+		t.Fatal("error reading ignore file: " + err.Error())
+	}
+
+	for rel, keep := range map[string]bool{
+		"DCIM/100CANON/IMG_0001.CR3": true,
+		// -include comes after the ignore file.
+		"DCIM/100CANON/IMG_0001.JPG": true,
+		"DCIM/100CANON/IMG_0002.JPG": true,
+		"DCIM/100CANON/IMG_0003.JPG": false,
+		IgnoreFileName:               false,
+	} {
+		dec := cardFilter.Decide(rel, false)
+		if dec.Keep != keep {
+			t.Errorf("Decide(%s) = %+v, expected keep %v", rel, dec, keep)
+		}
+	}
+
+	// The filter for other cards is left alone.
+	if !filter.Decide("DCIM/100CANON/IMG_0003.JPG", false).Keep {
+		t.Error("the ignore file leaked into the command line filter")
+	}
+}
+
+func TestListCard(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0001.JPG", "MISC/AUTPRINT.MRK", "PRIVATE/M4ROOT/CLIP/C0001.MP4"})
+
+	filter, err := NewFilter(FilterOpts{Profiles: []string{"dcim"}, SkipExt: []string{"jpg"}})
+	if err != nil {
+		t.Fatal("error making filter: " + err.Error())
+	}
+
+	var out bytes.Buffer
+	err = ListCard(cardDir, filter, &out)
+	if err != nil {
+		t.Fatal("error listing card: " + err.Error())
+	}
+
+	expected := []string{
+		"keep  DCIM/100CANON/IMG_0001.CR3  (profile dcim DCIM/**)",
+		"drop  DCIM/100CANON/IMG_0001.JPG  (-skipext *.jpg)",
+		"drop  MISC/  (system /MISC, 1 files)",
+		"drop  PRIVATE/  (-profiles dcim, 1 files)",
+		cardDir + ": 1 files kept, 3 dropped",
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected listing:\n%s", out.String())
+	}
+}
+
+// TestListCardSkips - The listing skips what an import would: directories
+// that can not be read, and anything that is not a regular file.
+func TestListCardSkips(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3", "DCIM/101CANON/IMG_0002.CR3"})
+	err := os.Symlink("IMG_0001.CR3", filepath.Join(cardDir, "DCIM", "100CANON", "IMG_0003.CR3"))
+	if err != nil {
+		t.Fatal("error making symlink: " + err.Error())
+	}
+
+	filter, err := NewFilter(FilterOpts{})
+	if err != nil {
+		t.Fatal("error making filter: " + err.Error())
+	}
+
+	var out bytes.Buffer
+	l := &cardListing{
+		cardPath: cardDir,
+		filter:   filter,
+		out:      &out,
+		readDir: func(name string) ([]os.DirEntry, error) {
+			if filepath.Base(name) == "101CANON" {
+				return nil, os.ErrPermission
+			}
+			return os.ReadDir(name)
+		},
+	}
+	err = l.list()
+	if err != nil {
+		t.Fatal("error listing card: " + err.Error())
+	}
+
+	expected := []string{
+		"keep  DCIM/100CANON/IMG_0001.CR3  (-profiles all)",
+		"skip  DCIM/100CANON/IMG_0003.CR3  (not a regular file)",
+		"skip  DCIM/101CANON/  (unreadable: permission denied)",
+		cardDir + ": 1 files kept, 0 dropped, 2 skipped",
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected listing:\n%s", out.String())
+	}
+}
+
+func TestFilteredDiscovery(t *testing.T) {
+
+	cardDir := writeCard(t, []string{"DCIM/100CANON/IMG_0001.CR3",
+		"DCIM/100CANON/IMG_0002.CR3", "DCIM/100CANON/._IMG_0002.CR3",
+		"MISC/AUTPRINT.MRK", "PRIVATE/M4ROOT/CLIP/C0001.MP4"})
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	targetDir := t.TempDir()
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	filter, err := NewFilter(FilterOpts{Profiles: []string{"dcim"}})
+	if err != nil {
+		t.Fatal("error making filter: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(1, nameOracle, false, cfu, 1, WorkerPoolOpts{
+		Filter: filter,
+	})
+
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	res, err := workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+	if res.Copied != 2 {
+		t.Errorf("expected 2 copied, got %+v", res)
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal("error reading target: " + err.Error())
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "IMG_000") {
+			t.Errorf("unexpected file %s in the target", e.Name())
+		}
+	}
+}
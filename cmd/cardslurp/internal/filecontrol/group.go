@@ -0,0 +1,130 @@
+package filecontrol
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AssetGroup - Files from one card directory that share a base name, like
+// PAH_1234.CR2, PAH_1234.JPG, a PAH_1234.WAV voice memo and a PAH_1234.xmp
+// sidecar.  The group is named and copied as a unit, so a collision renames
+// every member the same way, and Lightroom stacking and PhotoMechanic
+// pairing keep working.
+type AssetGroup struct {
+	key     string
+	members []CardSlurpWork
+}
+
+// groupKey - Directory plus base name.  Case is ignored, because cameras
+// write IMG_0001.JPG while editors write IMG_0001.xmp.
+func groupKey(wMsg CardSlurpWork) string {
+	base, _ := splitExt(wMsg.fileName)
+	return path.Join(wMsg.parentDir, strings.ToLower(base))
+}
+
+// groupFiles - Collect the files found on a card into asset groups.  Groups
+// are returned in the order their first member was found.
+func groupFiles(found []CardSlurpWork) []*AssetGroup {
+
+	rv := make([]*AssetGroup, 0)
+	byKey := make(map[string]*AssetGroup)
+
+	for _, f := range found {
+		key := groupKey(f)
+		g, ok := byKey[key]
+		if !ok {
+			g = &AssetGroup{key: key}
+			byKey[key] = g
+			rv = append(rv, g)
+		}
+		g.members = append(g.members, f)
+	}
+
+	for _, g := range rv {
+		g.shareMetadata()
+	}
+
+	return rv
+}
+
+// shareMetadata - Sidecars and voice memos have no capture metadata of
+// their own, so give them what the media files in the group have.  This
+// keeps the group in one -layout folder, and gives it one set of rename
+// tokens.
+func (g *AssetGroup) shareMetadata() {
+
+	var lead *CardSlurpWork
+	for i := range g.members {
+		if !g.members[i].captureTime.IsZero() {
+			lead = &g.members[i]
+			break
+		}
+	}
+	if lead == nil {
+		return
+	}
+
+	for i := range g.members {
+		m := &g.members[i]
+		if m.captureTime.IsZero() {
+			m.captureTime = lead.captureTime
+		}
+		if m.cameraMake == "" && m.cameraModel == "" {
+			m.cameraMake = lead.cameraMake
+			m.cameraModel = lead.cameraModel
+		}
+		if m.cameraSerial == "" {
+			m.cameraSerial = lead.cameraSerial
+		}
+	}
+}
+
+// groupTime - The earliest time of any of the members.  After
+// shareMetadata, this is the capture time whenever one is known.
+func groupTime(members []CardSlurpWork) time.Time {
+	var rv time.Time
+	for _, m := range members {
+		if rv.IsZero() || m.bestTime().Before(rv) {
+			rv = m.bestTime()
+		}
+	}
+	return rv
+}
+
+// bestTime - When the group was shot.
+func (g *AssetGroup) bestTime() time.Time {
+	return groupTime(g.members)
+}
+
+// copiedBytes - Bytes actually read from the card for the group, which is
+// what the adaptive controller measures.  A file copied to several targets
+// was only read once.
+func (g *AssetGroup) copiedBytes() int64 {
+	var rv int64
+	for i := range g.members {
+		for _, o := range g.members[i].outcomes() {
+			if o.copied {
+				rv += o.fileSize
+				break
+			}
+		}
+	}
+	return rv
+}
+
+// label - Name of the group for progress messages, like
+// /card/DCIM/100CANON/PAH_1234 [CR2 JPG WAV].
+func (g *AssetGroup) label() string {
+
+	base, _ := splitExt(g.members[0].fileName)
+	exts := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		_, ext := splitExt(m.fileName)
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	return path.Join(g.members[0].parentDir, base) + " [" + strings.Join(exts, " ") + "]"
+}
@@ -0,0 +1,146 @@
+package filecontrol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// singleTargetName - Name one file, as a group of one.
+func singleTargetName(nameOracle *TargetNameGenManager, wMsg CardSlurpWork) (string, bool, error) {
+	names, skips, err := nameOracle.getGroupTargetNames([]CardSlurpWork{wMsg})
+	if err != nil {
+		return "", false, err
+	}
+	return names[0], skips[0], nil
+}
+
+func TestGroupFiles(t *testing.T) {
+
+	shot := time.Date(2024, 3, 7, 18, 45, 0, 0, time.UTC)
+	found := []CardSlurpWork{
+		{parentDir: "/card/DCIM/100CANON", fileName: "PAH_1234.CR2", captureTime: shot, cameraModel: "Canon EOS R5"},
+		{parentDir: "/card/DCIM/100CANON", fileName: "PAH_1235.CR2"},
+		{parentDir: "/card/DCIM/100CANON", fileName: "PAH_1234.JPG", captureTime: shot},
+		{parentDir: "/card/DCIM/100CANON", fileName: "PAH_1234.WAV", fileTime: shot.Add(time.Hour)},
+		{parentDir: "/card/DCIM/100CANON", fileName: "pah_1234.xmp"},
+		{parentDir: "/card/DCIM/101CANON", fileName: "PAH_1234.CR2"},
+	}
+
+	groups := groupFiles(found)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+
+	g := groups[0]
+	if len(g.members) != 4 {
+		t.Fatalf("expected 4 members in the first group, got %d", len(g.members))
+	}
+	if g.label() != "/card/DCIM/100CANON/PAH_1234 [CR2 JPG WAV xmp]" {
+		t.Errorf("unexpected label: %s", g.label())
+	}
+
+	// The voice memo and sidecar take the capture time and camera of the
+	// raw file.
+	for _, m := range g.members {
+		if !m.captureTime.Equal(shot) || m.cameraModel != "Canon EOS R5" {
+			t.Errorf("%s did not get the group metadata: %s %s",
+				m.fileName, m.captureTime, m.cameraModel)
+		}
+	}
+
+	if groups[1].members[0].fileName != "PAH_1235.CR2" || len(groups[1].members) != 1 {
+		t.Errorf("unexpected second group: %+v", groups[1].members)
+	}
+	if groups[2].members[0].parentDir != "/card/DCIM/101CANON" {
+		t.Errorf("same name in another directory should be its own group")
+	}
+}
+
+func TestGroupTargetNames(t *testing.T) {
+
+	cardDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	members := make([]CardSlurpWork, 0)
+	for _, name := range []string{"PAH_1234.CR2", "PAH_1234.JPG", "PAH_1234.JPG.xmp"} {
+		err := os.WriteFile(filepath.Join(cardDir, name), []byte("card "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+		members = append(members, CardSlurpWork{
+			parentDir: cardDir,
+			fileName:  name,
+			fileTime:  time.Now(),
+		})
+	}
+
+	// The raw file was already imported, but the JPG in the target is
+	// from another camera.
+	err := os.WriteFile(filepath.Join(targetDir, "PAH_1234.CR2"), []byte("card PAH_1234.CR2"), 0644)
+	if err != nil {
+		t.Fatal("error writing target file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(targetDir, "PAH_1234.JPG"), []byte("other camera"), 0644)
+	if err != nil {
+		t.Fatal("error writing target file: " + err.Error())
+	}
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	names, skips, err := nameOracle.getGroupTargetNames(members)
+	if err != nil {
+		t.Fatal("error getting group names: " + err.Error())
+	}
+
+	// The whole group moves to one new base name, even the member that
+	// was already copied, so it stays paired.
+	base, _ := splitExt(filepath.Base(names[0]))
+	if !strings.HasPrefix(base, "PAH_1234_") {
+		t.Fatalf("unexpected group name: %s", names[0])
+	}
+	for i, name := range names {
+		if skips[i] {
+			t.Errorf("%s should not be skipped after a group rename", name)
+		}
+		b, ext := splitExt(filepath.Base(name))
+		_, wantExt := splitExt(members[i].fileName)
+		if b != base || ext != wantExt {
+			t.Errorf("member %s was named %s, expected base %s", members[i].fileName, name, base)
+		}
+	}
+
+	// Without a conflict, a finished member is skipped and the rest keep
+	// their names.
+	other := []CardSlurpWork{members[0]}
+	otherTarget := t.TempDir()
+	err = os.WriteFile(filepath.Join(otherTarget, "PAH_1234.CR2"), []byte("card PAH_1234.CR2"), 0644)
+	if err != nil {
+		t.Fatal("error writing target file: " + err.Error())
+	}
+	nameOracle, err = NewTargetNameGenManager(otherTarget, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+	other = append(other, members[1])
+	names, skips, err = nameOracle.getGroupTargetNames(other)
+	if err != nil {
+		t.Fatal("error getting group names: " + err.Error())
+	}
+	if !skips[0] || skips[1] {
+		t.Errorf("expected only the raw file to be skipped, got %v", skips)
+	}
+	if filepath.Base(names[1]) != "PAH_1234.JPG" {
+		t.Errorf("unexpected name for the new member: %s", names[1])
+	}
+}
@@ -0,0 +1,65 @@
+package filecontrol
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// layoutTokens - Tokens understood in a -layout template, and the
+// time.Format layout each one expands to.
+var layoutTokens = map[string]string{
+	"yyyy":       "2006",
+	"yy":         "06",
+	"mm":         "01",
+	"dd":         "02",
+	"yyyy-mm":    "2006-01",
+	"yyyy-mm-dd": "2006-01-02",
+	"yyyymmdd":   "20060102",
+}
+
+// expandLayout - Turn a template like {yyyy}/{yyyy-mm-dd} into a
+// subdirectory for a file with the given capture time.  Text outside of
+// braces is copied as is.  The result always uses forward slashes.
+func expandLayout(layout string, t time.Time) (string, error) {
+
+	var sb strings.Builder
+
+	rest := layout
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			sb.WriteString(rest)
+			break
+		}
+		closing := strings.IndexByte(rest[open:], '}')
+		if closing < 0 {
+			return "", fmt.Errorf("unterminated token in layout: %s", layout)
+		}
+		closing += open
+
+		sb.WriteString(rest[:open])
+		token := rest[open+1 : closing]
+		timeFmt, ok := layoutTokens[token]
+		if !ok {
+			return "", fmt.Errorf("unknown token {%s} in layout: %s", token, layout)
+		}
+		sb.WriteString(t.Format(timeFmt))
+		rest = rest[closing+1:]
+	}
+
+	subDir := path.Clean(strings.ReplaceAll(sb.String(), "\\", "/"))
+	if path.IsAbs(subDir) || subDir == ".." || strings.HasPrefix(subDir, "../") {
+		return "", fmt.Errorf("layout must stay inside the target directory: %s", layout)
+	}
+
+	return subDir, nil
+}
+
+// validateLayout - Catch a bad -layout at startup, instead of on the
+// first file.
+func validateLayout(layout string) error {
+	_, err := expandLayout(layout, time.Now())
+	return err
+}
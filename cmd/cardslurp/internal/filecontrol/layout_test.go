@@ -0,0 +1,104 @@
+package filecontrol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestExpandLayout(t *testing.T) {
+
+	shot := time.Date(2024, 3, 7, 18, 45, 0, 0, time.UTC)
+
+	cases := map[string]string{
+		"{yyyy}/{yyyy-mm-dd}":   "2024/2024-03-07",
+		"{yyyy}/{mm}/{dd}":      "2024/03/07",
+		"shoots/{yyyymmdd}":     "shoots/20240307",
+		"{yy}-{mm}/{yyyy-mm}/.": "24-03/2024-03",
+	}
+	for layout, want := range cases {
+		got, err := expandLayout(layout, shot)
+		if err != nil {
+			t.Errorf("expandLayout(%s) returned error: %s", layout, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("expandLayout(%s) = %s, want %s", layout, got, want)
+		}
+	}
+
+	for _, bad := range []string{"{yyyy", "{hour}", "../{yyyy}", "/{yyyy}"} {
+		_, err := expandLayout(bad, shot)
+		if err == nil {
+			t.Errorf("expandLayout(%s) should have failed", bad)
+		}
+	}
+}
+
+func TestTargetNameLayout(t *testing.T) {
+
+	targetDir := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	// A target directory with subdirectories is fine when using a layout.
+	err := os.MkdirAll(filepath.Join(targetDir, "2023", "2023-12-31"), 0755)
+	if err != nil {
+		t.Fatal("error making old shoot dir: " + err.Error())
+	}
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "{yyyy}/{yyyy-mm-dd}", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	dayOne := CardSlurpWork{
+		parentDir: "/card/DCIM/100CANON",
+		fileName:  "IMG_0001.CR2",
+		fileTime:  time.Date(2024, 3, 7, 10, 0, 0, 0, time.Local),
+	}
+	dayTwo := dayOne
+	dayTwo.fileTime = time.Date(2024, 3, 8, 10, 0, 0, 0, time.Local)
+
+	nameOne, _, err := singleTargetName(nameOracle, dayOne)
+	if err != nil {
+		t.Fatal("error getting target name: " + err.Error())
+	}
+	nameTwo, _, err := singleTargetName(nameOracle, dayTwo)
+	if err != nil {
+		t.Fatal("error getting target name: " + err.Error())
+	}
+
+	// The same file name on different days lands in different folders,
+	// so there is no collision.
+	if nameOne != filepath.ToSlash(filepath.Join(targetDir, "2024", "2024-03-07", "IMG_0001.CR2")) {
+		t.Errorf("unexpected name for day one: %s", nameOne)
+	}
+	if nameTwo != filepath.ToSlash(filepath.Join(targetDir, "2024", "2024-03-08", "IMG_0001.CR2")) {
+		t.Errorf("unexpected name for day two: %s", nameTwo)
+	}
+
+	// The same name on the same day does collide.
+	nameThree, _, err := singleTargetName(nameOracle, dayOne)
+	if err != nil {
+		t.Fatal("error getting target name: " + err.Error())
+	}
+	if nameThree == nameOne || filepath.Dir(nameThree) != filepath.Dir(nameOne) {
+		t.Errorf("expected a new name in the same folder, got %s", nameThree)
+	}
+
+	// A capture time from the file's metadata wins over the mtime.
+	withCapture := dayOne
+	withCapture.fileName = "IMG_0002.CR2"
+	withCapture.captureTime = time.Date(2024, 3, 6, 23, 59, 0, 0, time.Local)
+	nameFour, _, err := singleTargetName(nameOracle, withCapture)
+	if err != nil {
+		t.Fatal("error getting target name: " + err.Error())
+	}
+	if filepath.Base(filepath.Dir(nameFour)) != "2024-03-06" {
+		t.Errorf("capture time was not used for the layout: %s", nameFour)
+	}
+}
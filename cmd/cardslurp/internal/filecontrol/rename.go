@@ -0,0 +1,235 @@
+package filecontrol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// renamePart - One piece of a parsed rename template.  Either literal text,
+// or a token with an optional argument.
+type renamePart struct {
+	literal string
+	token   string
+	arg     string
+}
+
+// RenameTemplate - A parsed -rename template, such as
+// {date:20060102}_{camera}_{seq:4}.{ext}.  The supported tokens are:
+//
+//	{name}           original file name, without the extension
+//	{ext}            original extension, everything after the first period
+//	{date:LAYOUT}    capture date, as a Go time layout (default 20060102)
+//	{time:LAYOUT}    capture time, as a Go time layout (default 150405)
+//	{camera}         camera model, or "unknown"
+//	{serial}         camera body serial number, or "unknown"
+//	{seq:N}          trailing digits of the original name, padded to N
+//	{counter:N}      counter across the whole import, padded to N
+//
+// {name} and {ext} also accept :lower and :upper.
+type RenameTemplate struct {
+	source string
+	parts  []renamePart
+}
+
+// ParseRenameTemplate - Parse and validate a rename template.
+func ParseRenameTemplate(tmpl string) (*RenameTemplate, error) {
+
+	rv := &RenameTemplate{
+		source: tmpl,
+		parts:  make([]renamePart, 0),
+	}
+
+	rest := tmpl
+	for len(rest) > 0 {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			rv.parts = append(rv.parts, renamePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			rv.parts = append(rv.parts, renamePart{literal: rest[:open]})
+		}
+		closing := strings.IndexByte(rest[open:], '}')
+		if closing < 0 {
+			return nil, fmt.Errorf("unterminated token in rename template: %s", tmpl)
+		}
+		closing += open
+
+		token, arg, _ := strings.Cut(rest[open+1:closing], ":")
+		part := renamePart{token: token, arg: arg}
+		err := part.validate()
+		if err != nil {
+			return nil, fmt.Errorf("rename template %s: %w", tmpl, err)
+		}
+		rv.parts = append(rv.parts, part)
+		rest = rest[closing+1:]
+	}
+
+	for _, p := range rv.parts {
+		if strings.ContainsAny(p.literal, `/\`) {
+			return nil, fmt.Errorf("rename template must not contain a path separator: %s", tmpl)
+		}
+	}
+
+	return rv, nil
+}
+
+func (p renamePart) validate() error {
+
+	switch p.token {
+	case "name", "ext":
+		if p.arg != "" && p.arg != "lower" && p.arg != "upper" {
+			return fmt.Errorf("{%s} only accepts :lower or :upper, not %s", p.token, p.arg)
+		}
+	case "date", "time":
+		if strings.ContainsAny(p.arg, `/\`) {
+			return fmt.Errorf("{%s} layout must not contain a path separator", p.token)
+		}
+	case "camera", "serial":
+		if p.arg != "" {
+			return fmt.Errorf("{%s} does not take an argument", p.token)
+		}
+	case "seq", "counter":
+		if p.arg != "" {
+			width, err := strconv.Atoi(p.arg)
+			if err != nil || width < 1 || width > 12 {
+				return fmt.Errorf("{%s} width must be between 1 and 12, not %s", p.token, p.arg)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown token {%s}", p.token)
+	}
+
+	return nil
+}
+
+// String - The template as it was given.
+func (r *RenameTemplate) String() string {
+	return r.source
+}
+
+// splitExt - Split a file name at its first period.  Everything after it
+// is the extension, so a sidecar like IMG_0001.JPG.xmp has the same base
+// as IMG_0001.JPG, and the two stay in the same asset group.  A leading
+// period is part of the base, not an extension.
+func splitExt(fileName string) (string, string) {
+	if len(fileName) < 2 {
+		return fileName, ""
+	}
+	idx := strings.IndexByte(fileName[1:], '.')
+	if idx < 0 {
+		return fileName, ""
+	}
+	return fileName[:idx+1], fileName[idx+2:]
+}
+
+// trailingDigits - The sequence number cameras put at the end of a file
+// name, like the 1234 in IMG_1234.
+func trailingDigits(base string) string {
+	end := len(base)
+	start := end
+	for start > 0 && base[start-1] >= '0' && base[start-1] <= '9' {
+		start--
+	}
+	return base[start:end]
+}
+
+// padDigits - Zero pad (or keep the low digits of) a number string.
+func padDigits(digits string, width string) string {
+	w := 4
+	if width != "" {
+		w, _ = strconv.Atoi(width)
+	}
+	if len(digits) > w {
+		return digits[len(digits)-w:]
+	}
+	return strings.Repeat("0", w-len(digits)) + digits
+}
+
+// sanitizeName - Make metadata values (camera models have spaces and
+// slashes) safe to use in a file name.
+func sanitizeName(val string) string {
+
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return "unknown"
+	}
+
+	var sb strings.Builder
+	lastDash := false
+	for _, r := range val {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.') {
+			sb.WriteRune(r)
+			lastDash = false
+			continue
+		}
+		if !lastDash {
+			sb.WriteByte('-')
+			lastDash = true
+		}
+	}
+
+	return strings.Trim(sb.String(), "-.")
+}
+
+func applyCase(val string, mode string) string {
+	switch mode {
+	case "lower":
+		return strings.ToLower(val)
+	case "upper":
+		return strings.ToUpper(val)
+	default:
+		return val
+	}
+}
+
+// render - Build the target file name for a file.  counter is the import
+// wide counter value for this file.
+func (r *RenameTemplate) render(wMsg CardSlurpWork, counter uint64) (string, error) {
+
+	base, ext := splitExt(wMsg.fileName)
+	shot := wMsg.bestTime()
+
+	var sb strings.Builder
+	for _, p := range r.parts {
+		switch p.token {
+		case "":
+			sb.WriteString(p.literal)
+		case "name":
+			sb.WriteString(applyCase(base, p.arg))
+		case "ext":
+			sb.WriteString(applyCase(ext, p.arg))
+		case "date":
+			layout := p.arg
+			if layout == "" {
+				layout = "20060102"
+			}
+			sb.WriteString(shot.Format(layout))
+		case "time":
+			layout := p.arg
+			if layout == "" {
+				layout = "150405"
+			}
+			sb.WriteString(shot.Format(layout))
+		case "camera":
+			sb.WriteString(sanitizeName(wMsg.cameraModel))
+		case "serial":
+			sb.WriteString(sanitizeName(wMsg.cameraSerial))
+		case "seq":
+			sb.WriteString(padDigits(trailingDigits(base), p.arg))
+		case "counter":
+			sb.WriteString(padDigits(strconv.FormatUint(counter, 10), p.arg))
+		}
+	}
+
+	// A file without an extension would otherwise end in a period.
+	rv := strings.TrimRight(sb.String(), ".")
+	if rv == "" {
+		return "", fmt.Errorf("rename template %s gives an empty name for %s",
+			r.source, wMsg.fileName)
+	}
+
+	return rv, nil
+}
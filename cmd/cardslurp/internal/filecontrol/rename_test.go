@@ -0,0 +1,127 @@
+package filecontrol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestRenameTemplate(t *testing.T) {
+
+	wMsg := CardSlurpWork{
+		fileName:     "PAH_1234.CR2",
+		fileTime:     time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC),
+		captureTime:  time.Date(2024, 3, 6, 18, 45, 12, 0, time.UTC),
+		cameraModel:  "Canon EOS R5",
+		cameraSerial: "012345678901",
+	}
+
+	cases := map[string]string{
+		"{date:20060102}_{camera}_{seq:4}.{ext}": "20240306_Canon-EOS-R5_1234.CR2",
+		"{date}-{time}_{name}.{ext:lower}":       "20240306-184512_PAH_1234.cr2",
+		"{serial}_{seq:6}.{ext}":                 "012345678901_001234.CR2",
+		"{date:2006-01-02}_{counter}.{ext}":      "2024-03-06_0007.CR2",
+		"{name:lower}":                           "pah_1234",
+	}
+	for tmpl, want := range cases {
+		rt, err := ParseRenameTemplate(tmpl)
+		if err != nil {
+			t.Errorf("ParseRenameTemplate(%s) returned error: %s", tmpl, err)
+			continue
+		}
+		got, err := rt.render(wMsg, 7)
+		if err != nil {
+			t.Errorf("render(%s) returned error: %s", tmpl, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("render(%s) = %s, want %s", tmpl, got, want)
+		}
+	}
+
+	// Files without a camera, extension or sequence number still get a name.
+	bare := CardSlurpWork{fileName: "README", fileTime: wMsg.fileTime}
+	rt, err := ParseRenameTemplate("{camera}_{seq:2}.{ext}")
+	if err != nil {
+		t.Fatal("error parsing template: " + err.Error())
+	}
+	got, err := rt.render(bare, 1)
+	if err != nil {
+		t.Fatal("error rendering template: " + err.Error())
+	}
+	if got != "unknown_00" {
+		t.Errorf("unexpected name for bare file: %s", got)
+	}
+
+	for _, bad := range []string{"{date", "{model}", "{seq:x}", "{name:title}",
+		"shoot/{name}.{ext}", "{date:2006/01}"} {
+		_, err := ParseRenameTemplate(bad)
+		if err == nil {
+			t.Errorf("ParseRenameTemplate(%s) should have failed", bad)
+		}
+	}
+}
+
+func TestSplitExt(t *testing.T) {
+
+	cases := map[string][2]string{
+		"IMG_0001.JPG":     {"IMG_0001", "JPG"},
+		"IMG_0001.JPG.xmp": {"IMG_0001", "JPG.xmp"},
+		"README":           {"README", ""},
+		".hidden":          {".hidden", ""},
+	}
+	for in, want := range cases {
+		base, ext := splitExt(in)
+		if base != want[0] || ext != want[1] {
+			t.Errorf("splitExt(%s) = %s, %s, want %s, %s", in, base, ext, want[0], want[1])
+		}
+	}
+}
+
+func TestTargetNameCollisions(t *testing.T) {
+
+	targetDir := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	// A file already in the target, with different case and contents.
+	err := os.WriteFile(filepath.Join(targetDir, "img_0001.jpg.xmp"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal("error writing existing target: " + err.Error())
+	}
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	source := filepath.Join(t.TempDir(), "IMG_0001.JPG.xmp")
+	err = os.WriteFile(source, []byte("new"), 0644)
+	if err != nil {
+		t.Fatal("error writing source: " + err.Error())
+	}
+
+	wMsg := CardSlurpWork{
+		parentDir: filepath.Dir(source),
+		fileName:  filepath.Base(source),
+		fileTime:  time.Now(),
+	}
+
+	// Names with more than one period used to be an error.  Names that
+	// only differ by case must not be reused.
+	name, skip, err := singleTargetName(nameOracle, wMsg)
+	if err != nil {
+		t.Fatal("error getting target name: " + err.Error())
+	}
+	if skip {
+		t.Fatal("different file should not be skipped")
+	}
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, "IMG_0001_") || !strings.HasSuffix(base, ".JPG.xmp") {
+		t.Errorf("unexpected collision name: %s", base)
+	}
+}
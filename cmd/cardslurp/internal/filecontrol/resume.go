@@ -0,0 +1,264 @@
+package filecontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/journal"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+	"github.com/pheckenlively123/cardSlurp/internal/mediameta"
+)
+
+// Resumer - What RecoverSession needs from cardfileutil.CardFileUtil.
+type Resumer interface {
+	ResumeCopy(ctx context.Context, fromFile string, tempName string,
+		toFile string, digest cardfileutil.FileDigest) (cardfileutil.CopyResult, error)
+	HashExtras(ctx context.Context, fileName string) ([]cardfileutil.FileDigest, error)
+}
+
+// RecoverSession - First step of resuming an interrupted session.  Files
+// the journal says were copied, but not verified, are verified from their
+// temp files and renamed into place, without reading the card again.
+// Partial temp files from copies that were in progress are removed.  This
+// has to happen before the name oracle cleans up the temp files in the
+// target.  Returns the number of files recovered.
+//
+// Files that can not be recovered are left for the worker pool, which
+// copies them again to the name the journal planned for them.
+//
+// opts are the pool's options: the journal and its Progress (Resume),
+// and the ledger, MHL history and manifests that recovered files are
+// recorded in.  Files the interrupted session verified, but never got to
+// record in the MHL history, are added to it too.
+func RecoverSession(ctx context.Context, cfu Resumer, opts WorkerPoolOpts) (uint64, error) {
+
+	var recovered uint64
+	progress := opts.Resume
+	history := opts.History
+
+	if history != nil {
+		for _, ent := range progress.Verified() {
+			if ent.Digest == "" || history.Known(ent.TargetName) {
+				continue
+			}
+			digest, err := cardfileutil.ParseFileDigest(ent.Digest)
+			if err != nil {
+				return recovered, fmt.Errorf("error reading digest of %s: %w", ent.TargetName, err)
+			}
+			res := cardfileutil.CopyResult{Digest: digest}
+			if digest.Algo != cardfileutil.HashXXH64 {
+				// The journal only has the -hash digest.
+				res.Extra, err = cfu.HashExtras(ctx, ent.TargetName)
+				if err != nil {
+					return recovered, err
+				}
+			}
+			err = history.Add(ent.TargetName, mhlDigest(res))
+			if err != nil {
+				return recovered, err
+			}
+		}
+	}
+
+	for _, ent := range progress.Unfinished() {
+
+		if ctx.Err() != nil {
+			return recovered, nil
+		}
+
+		switch ent.State {
+		case journal.StateInProgress:
+			err := os.Remove(ent.TempName)
+			if err == nil {
+				fmt.Printf("Removed partial copy: %s\n", ent.TempName)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return recovered, fmt.Errorf("error removing partial copy %s: %w",
+					ent.TempName, err)
+			}
+
+		case journal.StateCopied:
+			digest, err := cardfileutil.ParseFileDigest(ent.Digest)
+			if err != nil {
+				fmt.Printf("Unable to recover %s: %s\n", ent.SourcePath, err.Error())
+				continue
+			}
+
+			res, err := cfu.ResumeCopy(ctx, ent.SourcePath, ent.TempName, ent.TargetName, digest)
+			if errors.Is(err, cardfileutil.ErrNothingToResume) {
+				// Rolled back, which is nothing to worry about.
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Unable to recover %s, it will be copied again: %s\n",
+					ent.SourcePath, err.Error())
+				continue
+			}
+
+			wMsg := CardSlurpWork{
+				sourceCard: ent.SourceCard,
+				parentDir:  path.Dir(ent.SourcePath),
+				fileName:   path.Base(ent.SourcePath),
+				targetName: ent.TargetName,
+				fileTime:   ent.SourceModTime,
+				fileSize:   ent.Size,
+				copied:     true,
+				digest:     res.Digest,
+			}
+			md, err := mediameta.ReadFile(ent.SourcePath)
+			if err == nil {
+				wMsg.applyMetadata(md)
+			}
+
+			if opts.ImportLedger != nil {
+				err = opts.ImportLedger.Append(ledgerRecord(wMsg))
+				if err != nil {
+					return recovered, fmt.Errorf("error recording %s in ledger: %w",
+						ent.SourcePath, err)
+				}
+			}
+
+			if history != nil {
+				err = history.Add(ent.TargetName, mhlDigest(res))
+				if err != nil {
+					return recovered, err
+				}
+			}
+
+			if opts.Manifests != nil {
+				err = opts.Manifests.Add(ent.TargetName,
+					append([]cardfileutil.FileDigest{res.Digest}, res.Extra...))
+				if err != nil {
+					return recovered, err
+				}
+			}
+
+			ent.State = journal.StateVerified
+			ent.TempName = ""
+			err = opts.Journal.Record(ent)
+			if err != nil {
+				return recovered, err
+			}
+			progress.Update(ent)
+
+			fmt.Printf("Recovered: %s (%s)\n", ent.TargetName, res.Verify)
+			recovered++
+		}
+	}
+
+	return recovered, nil
+}
+
+// reserveResumed - Keep the names the interrupted session planned, so no
+// other file is given one of them before its own file is copied.
+func (w *WorkerPool) reserveResumed() error {
+
+	if w.opts.Resume == nil {
+		return nil
+	}
+
+	for _, ent := range w.opts.Resume.Unfinished() {
+		err := w.nameOracle.reserve(ent.TargetName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reserve - Mark a name as taken.
+func (t *TargetNameGenManager) reserve(name string) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	err := t.loadDir(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	t.markKnown(name)
+
+	return nil
+}
+
+// resumeWork - Look a file up in the journal of the session being resumed.
+// A file the journal marks as verified is skipped without reading it again,
+// as long as its target is still there.  A file that was planned, or
+// whose copy did not finish, is copied again to the name planned for it.
+// Returns true if the file is done, or the planned name.
+func (w *WorkerPool) resumeWork(wMsg *CardSlurpWork) (string, bool) {
+
+	if w.opts.Resume == nil {
+		return "", false
+	}
+
+	sourceFile := path.Join(wMsg.parentDir, wMsg.fileName)
+	ent, found := w.opts.Resume.Lookup(sourceFile, wMsg.fileSize, wMsg.fileTime)
+	if !found {
+		return "", false
+	}
+
+	info, err := os.Stat(ent.TargetName)
+
+	if ent.State == journal.StateVerified {
+		if err == nil && info.Size() == wMsg.fileSize {
+			fmt.Printf("Skipping %s: (verified as %s before the interruption)\n",
+				sourceFile, ent.TargetName)
+			wMsg.skipped = true
+			wMsg.targetName = ent.TargetName
+			return "", true
+		}
+		fmt.Printf("%s is gone, copying %s again\n", ent.TargetName, sourceFile)
+		return "", false
+	}
+
+	if err == nil {
+		// Something else has the planned name now, so let the name
+		// oracle sort it out.
+		return "", false
+	}
+
+	return ent.TargetName, false
+}
+
+// journalState - Record a state change for one file, if there is a
+// journal.
+func (w *WorkerPool) journalState(wMsg CardSlurpWork, state journal.State,
+	targetName string, tempName string, digest string) error {
+
+	if w.opts.Journal == nil {
+		return nil
+	}
+
+	return w.opts.Journal.Record(journal.Entry{
+		State:         state,
+		SourceCard:    wMsg.sourceCard,
+		SourcePath:    path.Join(wMsg.parentDir, wMsg.fileName),
+		Size:          wMsg.fileSize,
+		SourceModTime: wMsg.fileTime,
+		TargetName:    targetName,
+		TempName:      tempName,
+		Digest:        digest,
+	})
+}
+
+// journalObserver - Journals the progress of one copy.
+type journalObserver struct {
+	w          *WorkerPool
+	wMsg       *CardSlurpWork
+	targetName string
+}
+
+func (o journalObserver) Started(tempName string) error {
+	return o.w.journalState(*o.wMsg, journal.StateInProgress, o.targetName, tempName, "")
+}
+
+func (o journalObserver) Copied(tempName string, digest cardfileutil.FileDigest) error {
+	return o.w.journalState(*o.wMsg, journal.StateCopied, o.targetName, tempName,
+		digest.String())
+}
@@ -0,0 +1,198 @@
+package filecontrol
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/journal"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestResumeFromJournal(t *testing.T) {
+
+	cardDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	names := []string{"PAH_0001.CR2", "PAH_0002.CR2", "PAH_0003.CR2", "PAH_0004.CR2"}
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(cardDir, name), []byte("image data for "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+	}
+
+	cfu := &cancelAfterCopy{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+	}
+	cfu.SetExtraDigests(cardfileutil.HashXXH64)
+
+	// The interrupted session: 0001 was verified, 0002 was copied but not
+	// verified, 0003 was part way through, and 0004 was only planned, with
+	// a name the name oracle would not pick.
+	jrnl, err := journal.Create(targetDir, "interrupted", nil)
+	if err != nil {
+		t.Fatal("error creating journal: " + err.Error())
+	}
+
+	entryFor := func(name string, state journal.State, targetName string) journal.Entry {
+		sourcePath := path.Join(cardDir, name)
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			t.Fatal("error calling stat on card file: " + err.Error())
+		}
+		return journal.Entry{
+			State:         state,
+			SourceCard:    cardDir,
+			SourcePath:    sourcePath,
+			Size:          info.Size(),
+			SourceModTime: info.ModTime(),
+			TargetName:    path.Join(targetDir, targetName),
+		}
+	}
+
+	first, err := cfu.CardFileCopy(context.Background(), path.Join(cardDir, names[0]),
+		path.Join(targetDir, names[0]), nil)
+	if err != nil {
+		t.Fatal("error copying: " + err.Error())
+	}
+	// Verified, but not yet in the MHL history.
+	verified := entryFor(names[0], journal.StateVerified, names[0])
+	verified.Digest = first.Digest.String()
+
+	data, err := os.ReadFile(path.Join(cardDir, names[1]))
+	if err != nil {
+		t.Fatal("error reading card file: " + err.Error())
+	}
+	copied := entryFor(names[1], journal.StateCopied, names[1])
+	copied.TempName = path.Join(targetDir, "."+names[1]+".0123456789abcdef.cardslurp-tmp")
+	err = os.WriteFile(copied.TempName, data, 0644)
+	if err != nil {
+		t.Fatal("error writing temp file: " + err.Error())
+	}
+	digest, err := cfu.HashFile(path.Join(cardDir, names[1]))
+	if err != nil {
+		t.Fatal("error hashing: " + err.Error())
+	}
+	copied.Digest = digest.String()
+
+	partial := entryFor(names[2], journal.StateInProgress, names[2])
+	partial.TempName = path.Join(targetDir, "."+names[2]+".fedcba9876543210.cardslurp-tmp")
+	err = os.WriteFile(partial.TempName, []byte("image"), 0644)
+	if err != nil {
+		t.Fatal("error writing temp file: " + err.Error())
+	}
+
+	planned := entryFor(names[3], journal.StatePlanned, "planned_0004.CR2")
+
+	for _, ent := range []journal.Entry{verified, copied, partial, planned} {
+		err = jrnl.Record(ent)
+		if err != nil {
+			t.Fatal("error recording: " + err.Error())
+		}
+	}
+	err = jrnl.Close()
+	if err != nil {
+		t.Fatal("error closing journal: " + err.Error())
+	}
+
+	// Resume, like "cardslurp resume" does.
+	sessions, err := journal.List(targetDir)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected one session, got %d (%v)", len(sessions), err)
+	}
+	_, progress, err := journal.Load(sessions[0].FileName())
+	if err != nil {
+		t.Fatal("error loading journal: " + err.Error())
+	}
+	jrnl, err = journal.Reopen(sessions[0])
+	if err != nil {
+		t.Fatal("error reopening journal: " + err.Error())
+	}
+	importLedger, err := ledger.Open(targetDir, sessions[0].SessionID)
+	if err != nil {
+		t.Fatal("error opening ledger: " + err.Error())
+	}
+
+	history, err := mhl.Open(targetDir)
+	if err != nil {
+		t.Fatal("error opening history: " + err.Error())
+	}
+
+	poolOpts := WorkerPoolOpts{
+		ImportLedger: importLedger,
+		Journal:      jrnl,
+		Resume:       progress,
+		History:      history,
+	}
+	recovered, err := RecoverSession(context.Background(), cfu, poolOpts)
+	if err != nil {
+		t.Fatal("error recovering session: " + err.Error())
+	}
+	if recovered != 1 {
+		t.Errorf("expected 1 recovered copy, got %d", recovered)
+	}
+	if history.Len() != 2 {
+		t.Errorf("expected the verified and recovered copies in the history, got %d",
+			history.Len())
+	}
+	_, err = os.Stat(partial.TempName)
+	if err == nil {
+		t.Error("partial temp file was not removed")
+	}
+
+	nameOracle, err := NewTargetNameGenManager(targetDir, "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(2, nameOracle, false, cfu, 1, poolOpts)
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+	res, err := workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+
+	// 0001 and the recovered 0002 are skipped, without comparing them.
+	if res.Copied != 2 || res.Skipped != 2 {
+		t.Errorf("expected 2 copied and 2 skipped, got %+v", res)
+	}
+	if cfu.sames != 0 {
+		t.Errorf("resume compared %d files that the journal had verified", cfu.sames)
+	}
+
+	for _, name := range []string{names[0], names[1], names[2], "planned_0004.CR2"} {
+		_, err = os.Stat(path.Join(targetDir, name))
+		if err != nil {
+			t.Errorf("%s missing after resume: %s", name, err.Error())
+		}
+	}
+	_, err = os.Stat(path.Join(targetDir, names[3]))
+	if err == nil {
+		t.Error("planned file was copied under a new name")
+	}
+
+	err = importLedger.Close()
+	if err != nil {
+		t.Fatal("error closing ledger: " + err.Error())
+	}
+	_, progress, err = journal.Load(sessions[0].FileName())
+	if err != nil {
+		t.Fatal("error loading journal: " + err.Error())
+	}
+	if len(progress.Unfinished()) != 0 {
+		t.Errorf("journal still has %d unfinished files", len(progress.Unfinished()))
+	}
+	err = jrnl.Finish()
+	if err != nil {
+		t.Fatal("error finishing journal: " + err.Error())
+	}
+}
@@ -0,0 +1,218 @@
+package filecontrol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// sourceDevice - One card reader (really, one st_dev) and the cards
+// mounted from it.  Each device has its own workers, so a slow SD reader
+// can not hold up a fast CFexpress reader, and throughput grows with the
+// number of readers plugged in.
+type sourceDevice struct {
+	id      string
+	cards   []*cardWalk
+	queue   chan *AssetGroup
+	limiter *deviceLimiter
+}
+
+// groupByDevice - Sort the cards into source devices, in the order the
+// devices were first seen.
+func groupByDevice(cards []*cardWalk) ([]*sourceDevice, error) {
+
+	rv := make([]*sourceDevice, 0)
+	byID := make(map[string]*sourceDevice)
+
+	for _, card := range cards {
+		id, err := deviceID(card.path)
+		if err != nil {
+			return nil, fmt.Errorf("error finding the device for card %s: %w", card.path, err)
+		}
+
+		dev, ok := byID[id]
+		if !ok {
+			dev = &sourceDevice{
+				id:    id,
+				queue: make(chan *AssetGroup),
+			}
+			byID[id] = dev
+			rv = append(rv, dev)
+		}
+		dev.cards = append(dev.cards, card)
+	}
+
+	return rv, nil
+}
+
+// targetDevice - One device (st_dev) the targets are on.  Each has its
+// own poolSize slots, so a NAS mirror and a local SSD each limit the
+// copies writing to them, while targets that share a disk share a limit.
+type targetDevice struct {
+	id    string
+	slots chan struct{}
+}
+
+// groupTargets - Find the devices of the targets, in target order.  A
+// target that can not be reached gets slots of its own, and fails its
+// copies by itself.
+func (w *WorkerPool) groupTargets() {
+
+	w.targetDevices = make([]*targetDevice, 0, len(w.targets))
+	seen := make(map[string]bool)
+
+	for _, t := range w.targets {
+		id, err := deviceID(t.NameOracle.targetDir)
+		if err != nil {
+			id = t.NameOracle.targetDir
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		w.targetDevices = append(w.targetDevices, &targetDevice{
+			id:    id,
+			slots: make(chan struct{}, w.poolSize),
+		})
+	}
+}
+
+// acquireTargets - Take a slot on every target device, in order, so two
+// workers can not each hold a slot the other is waiting for.  Returns
+// false, holding nothing, if the run is halted first.
+func (w *WorkerPool) acquireTargets() bool {
+
+	for i, td := range w.targetDevices {
+		select {
+		case td.slots <- struct{}{}:
+		case <-w.stop:
+			w.releaseTargets(w.targetDevices[:i])
+			return false
+		}
+	}
+
+	return true
+}
+
+// releaseTargets - Give back the slots acquireTargets took.
+func (w *WorkerPool) releaseTargets(devices []*targetDevice) {
+	for _, td := range devices {
+		<-td.slots
+	}
+}
+
+// feedDevice - Hand the groups from a device's cards to its workers,
+// earliest capture time first.  Each card is walked in directory order,
+// which is close to shooting order on a camera card, so taking the
+// earliest of the cards' next groups gives an approximately time ordered
+// interleave.  That lets cards shot at the same time offload in parallel,
+// as long as the cameras' clocks are close.  A card that can not be
+// searched is dropped, and counted against the error policy.  The device
+// queue is closed when every card is done, or the run is halted.
+func (w *WorkerPool) feedDevice(dev *sourceDevice) {
+
+	defer close(dev.queue)
+
+	heads := make([]*AssetGroup, len(dev.cards))
+	walking := make([]bool, len(dev.cards))
+	for i := range walking {
+		walking[i] = true
+	}
+
+	for {
+		// Every card still walking needs a group at the head, or we
+		// can not know which one is earliest.
+		for i, card := range dev.cards {
+			if heads[i] != nil || !walking[i] {
+				continue
+			}
+
+			g, ok := <-card.groups
+			if ok {
+				heads[i] = g
+				continue
+			}
+
+			walking[i] = false
+			if errors.Is(card.result.LocateError, errLocateStopped) {
+				return
+			}
+			w.cardFinished(card)
+			if card.result.LocateError == nil {
+				fmt.Printf("Located %d files (%d groups) in: %s\n", card.result.FileCount,
+					card.result.GroupCount, card.result.ParentDir)
+				if card.result.Filtered > 0 {
+					fmt.Printf("Filtered out %d files in: %s\n", card.result.Filtered,
+						card.result.ParentDir)
+				}
+				card.done = true
+			}
+		}
+
+		next := -1
+		for i, g := range heads {
+			if g == nil {
+				continue
+			}
+			if next < 0 || g.bestTime().Before(heads[next].bestTime()) {
+				next = i
+			}
+		}
+		if next < 0 {
+			// Every card is done.
+			return
+		}
+
+		select {
+		case dev.queue <- heads[next]:
+			heads[next] = nil
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// deviceWorker - Copy groups from one source device.  A worker needs a
+// slot from the device's limiter before it takes a group, so an adaptive
+// limiter can park workers.  Every copy also needs a slot on each target
+// device, so no target device has more than poolSize copies writing to it,
+// however many readers there are.
+func (w *WorkerPool) deviceWorker(dev *sourceDevice, wg *sync.WaitGroup,
+	outWork chan<- *AssetGroup) {
+
+	defer wg.Done()
+
+	for {
+		if !dev.limiter.acquire(w.stop) {
+			return
+		}
+
+		var g *AssetGroup
+		var ok bool
+
+		select {
+		case <-w.stop:
+			dev.limiter.release(0)
+			return
+		case g, ok = <-dev.queue:
+			if !ok {
+				dev.limiter.release(0)
+				return
+			}
+		}
+
+		if !w.acquireTargets() {
+			// Report the group untouched, so it counts as remaining.
+			dev.limiter.release(0)
+			outWork <- g
+			return
+		}
+
+		w.processGroup(g)
+		w.noteFailures(len(g.failures()))
+		w.releaseTargets(w.targetDevices)
+		dev.limiter.release(g.copiedBytes())
+
+		outWork <- g
+	}
+}
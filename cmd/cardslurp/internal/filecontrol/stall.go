@@ -0,0 +1,43 @@
+package filecontrol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultCardTimeout - How long one read from a card may take before the
+// card is given up on.
+const DefaultCardTimeout = time.Minute
+
+// errCardStalled - A read from the card took longer than the card timeout.
+var errCardStalled = errors.New("card stopped responding")
+
+// stallGuard - Run fn, but give up after timeout, or when stop is closed.
+// A read from a stalled reader can not be interrupted, so fn is left to
+// finish in the background.  It must only set variables that the caller
+// does not look at when stallGuard fails.  A zero timeout waits forever.
+func stallGuard(timeout time.Duration, stop <-chan struct{}, what string,
+	fn func() error) error {
+
+	if timeout == 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%s took longer than %s: %w", what, timeout, errCardStalled)
+	case <-stop:
+		return errLocateStopped
+	}
+}
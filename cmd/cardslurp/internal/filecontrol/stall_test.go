@@ -0,0 +1,81 @@
+package filecontrol
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestTolerantDiscovery(t *testing.T) {
+
+	cardDir := t.TempDir()
+	for _, name := range []string{"DCIM/100/IMG_0001.JPG", "DCIM/BAD/IMG_0002.JPG",
+		"DCIM/STUCK/IMG_0003.JPG", "IMG_0004.JPG"} {
+		err := os.MkdirAll(filepath.Join(cardDir, filepath.Dir(name)), 0755)
+		if err != nil {
+			t.Fatal("error making card dir: " + err.Error())
+		}
+		err = os.WriteFile(filepath.Join(cardDir, name), []byte("image "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing card file: " + err.Error())
+		}
+	}
+
+	// BAD can not be read, and STUCK never answers, until the test is over.
+	release := make(chan struct{})
+	defer close(release)
+	readDir := func(dir string) ([]os.DirEntry, error) {
+		switch filepath.Base(dir) {
+		case "BAD":
+			return nil, errInjected
+		case "STUCK":
+			<-release
+		}
+		return os.ReadDir(dir)
+	}
+
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	nameOracle, err := NewTargetNameGenManager(t.TempDir(), "", "", cfu)
+	if err != nil {
+		t.Fatal("error making name oracle: " + err.Error())
+	}
+
+	workerPool := NewWorkerPool(1, nameOracle, false, cfu, 1, WorkerPoolOpts{
+		ErrorPolicy: ErrorPolicy{Mode: PolicyContinue},
+		CardTimeout: 100 * time.Millisecond,
+	})
+	workerPool.readDir = readDir
+
+	err = OrchestrateLocate(context.Background(), []string{cardDir}, workerPool, false)
+	if err != nil {
+		t.Fatal("error locating files: " + err.Error())
+	}
+
+	// The card stalls in STUCK, after BAD was skipped, and the files
+	// found before that are still copied.
+	res, err := workerPool.ParallelFileCopy(context.Background())
+	if err != nil {
+		t.Fatal("error copying files: " + err.Error())
+	}
+	if res.Copied != 2 {
+		t.Errorf("expected 2 copied, got %+v", res)
+	}
+	if len(res.SkippedPaths) != 1 || !strings.Contains(res.SkippedPaths[0], "BAD") {
+		t.Errorf("expected BAD in the skipped paths, got %v", res.SkippedPaths)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Category != CategoryDiscovery ||
+		!errors.Is(res.Failed[0], errCardStalled) {
+		t.Fatalf("expected the card to stall, got %v", res.Failed)
+	}
+	if len(res.UnfinishedCards) != 1 || res.UnfinishedCards[0] != cardDir {
+		t.Errorf("expected the card to be unfinished, got %v", res.UnfinishedCards)
+	}
+}
@@ -0,0 +1,372 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirName - Directory in each target directory that holds the journals of
+// unfinished import sessions.  It is hidden, like the ledger.
+const DirName = ".cardslurp-journal"
+
+const fileSuffix = ".jsonl"
+
+// State - How far one file got.  Each state is written before the work it
+// describes is trusted, so after a crash the journal never claims more
+// than was done.
+type State string
+
+const (
+	// StatePlanned - The file was found, and given a target name.
+	StatePlanned State = "planned"
+	// StateInProgress - Data is being written to TempName.  A temp file
+	// left in this state is partial.
+	StateInProgress State = "in_progress"
+	// StateCopied - All the data is in TempName and synced, and should
+	// match Digest, but it has not been verified.
+	StateCopied State = "copied"
+	// StateVerified - The target was verified and renamed into place.
+	StateVerified State = "verified"
+)
+
+// Entry - One state change for one file.  Files are identified by source
+// path, size and mtime, so a reformatted card does not match.
+type Entry struct {
+	At            time.Time `json:"at"`
+	State         State     `json:"state"`
+	SourceCard    string    `json:"source_card"`
+	SourcePath    string    `json:"source_path"`
+	Size          int64     `json:"size"`
+	SourceModTime time.Time `json:"source_mtime"`
+	TargetName    string    `json:"target_name"`
+	TempName      string    `json:"temp_name,omitempty"`
+	Digest        string    `json:"digest,omitempty"`
+}
+
+// Session - The first line of each journal.  Options holds whatever the
+// caller needs to run the session again, as JSON.
+type Session struct {
+	SessionID string          `json:"session_id"`
+	StartedAt time.Time       `json:"started_at"`
+	Options   json.RawMessage `json:"options"`
+	fileName  string
+}
+
+// FileName - Where the journal for this session is kept.
+func (s Session) FileName() string {
+	return s.fileName
+}
+
+// Journal - Write ahead journal of one import session.  Every entry is
+// fsynced before Record returns.  Appends are serialized with the embedded
+// mutex, so the worker goroutines can share one Journal.
+type Journal struct {
+	sync.Mutex
+	fi       *os.File
+	fileName string
+	closed   bool
+}
+
+// Create - Start the journal for a new session in targetDir.  options is
+// stored as JSON in the session line.
+func Create(targetDir string, sessionID string, options any) (*Journal, error) {
+
+	dir := filepath.Join(targetDir, DirName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error making journal directory %s: %w", dir, err)
+	}
+
+	optJSON, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling session options: %w", err)
+	}
+
+	line, err := json.Marshal(Session{
+		SessionID: sessionID,
+		StartedAt: time.Now().UTC(),
+		Options:   optJSON,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling session: %w", err)
+	}
+
+	fileName := filepath.Join(dir, sessionID+fileSuffix)
+	fi, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating journal %s: %w", fileName, err)
+	}
+
+	j := &Journal{
+		Mutex:    sync.Mutex{},
+		fi:       fi,
+		fileName: fileName,
+	}
+
+	err = j.write(line)
+	if err != nil {
+		_ = fi.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Reopen - Continue writing the journal of an unfinished session.
+func Reopen(sess Session) (*Journal, error) {
+
+	fi, err := os.OpenFile(sess.fileName, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal %s: %w", sess.fileName, err)
+	}
+
+	j := &Journal{
+		Mutex:    sync.Mutex{},
+		fi:       fi,
+		fileName: sess.fileName,
+	}
+
+	// End a line cut short by the crash, so the next entry is not glued
+	// onto it.
+	info, err := fi.Stat()
+	if err != nil {
+		_ = fi.Close()
+		return nil, fmt.Errorf("error calling stat on journal %s: %w", sess.fileName, err)
+	}
+	last := make([]byte, 1)
+	if info.Size() > 0 {
+		_, err = fi.ReadAt(last, info.Size()-1)
+		if err != nil {
+			_ = fi.Close()
+			return nil, fmt.Errorf("error reading journal %s: %w", sess.fileName, err)
+		}
+		if last[0] != '\n' {
+			err = j.write(nil)
+			if err != nil {
+				_ = fi.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return j, nil
+}
+
+// write - One line per write, so a crash can at worst leave a truncated
+// last line, which Load skips.
+func (j *Journal) write(line []byte) error {
+
+	line = append(line, '\n')
+
+	_, err := j.fi.Write(line)
+	if err != nil {
+		return fmt.Errorf("error writing journal %s: %w", j.fileName, err)
+	}
+
+	err = j.fi.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing journal %s: %w", j.fileName, err)
+	}
+
+	return nil
+}
+
+// Record - Append one entry, and fsync it before returning.  The time is
+// filled in here.
+func (j *Journal) Record(ent Entry) error {
+
+	ent.At = time.Now().UTC()
+
+	line, err := json.Marshal(ent)
+	if err != nil {
+		return fmt.Errorf("error marshaling journal entry: %w", err)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	return j.write(line)
+}
+
+// Close - Close the journal, and keep it for resume.  Safe to call after
+// Finish.
+func (j *Journal) Close() error {
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+
+	err := j.fi.Close()
+	if err != nil {
+		return fmt.Errorf("error closing journal %s: %w", j.fileName, err)
+	}
+
+	return nil
+}
+
+// Finish - The session is complete, so the journal is no longer needed.
+// The ledger is the permanent record.
+func (j *Journal) Finish() error {
+
+	err := j.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(j.fileName)
+	if err != nil {
+		return fmt.Errorf("error removing journal %s: %w", j.fileName, err)
+	}
+
+	return nil
+}
+
+// List - The unfinished sessions in targetDir, oldest first.
+func List(targetDir string) ([]Session, error) {
+
+	dir := filepath.Join(targetDir, DirName)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Session{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal directory %s: %w", dir, err)
+	}
+
+	rv := make([]Session, 0)
+	for _, ent := range entries {
+		if !ent.Type().IsRegular() || !strings.HasSuffix(ent.Name(), fileSuffix) {
+			continue
+		}
+		sess, _, err := Load(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, sess)
+	}
+
+	sort.Slice(rv, func(a, b int) bool {
+		return rv[a].StartedAt.Before(rv[b].StartedAt)
+	})
+
+	return rv, nil
+}
+
+// Load - Read a journal, and replay its entries into the last state of
+// each file.
+func Load(fileName string) (Session, *Progress, error) {
+
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return Session{}, nil, fmt.Errorf("error opening journal %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	scanner := bufio.NewScanner(fi)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		return Session{}, nil, fmt.Errorf("journal %s is empty", fileName)
+	}
+	var sess Session
+	err = json.Unmarshal(scanner.Bytes(), &sess)
+	if err != nil || sess.SessionID == "" {
+		return Session{}, nil, fmt.Errorf("journal %s has no session line", fileName)
+	}
+	sess.fileName = fileName
+
+	rv := &Progress{
+		files: make(map[fileKey]Entry),
+	}
+	for scanner.Scan() {
+		var ent Entry
+		err = json.Unmarshal(scanner.Bytes(), &ent)
+		if err != nil {
+			// The tail of an interrupted write.
+			continue
+		}
+		rv.files[keyOf(ent.SourcePath, ent.Size, ent.SourceModTime)] = ent
+	}
+	err = scanner.Err()
+	if err != nil {
+		return Session{}, nil, fmt.Errorf("error reading journal %s: %w", fileName, err)
+	}
+
+	return sess, rv, nil
+}
+
+type fileKey struct {
+	sourcePath string
+	size       int64
+	modTime    int64
+}
+
+func keyOf(sourcePath string, size int64, modTime time.Time) fileKey {
+	return fileKey{
+		sourcePath: sourcePath,
+		size:       size,
+		modTime:    modTime.UnixNano(),
+	}
+}
+
+// Progress - The last state of every file in a journal.
+type Progress struct {
+	files map[fileKey]Entry
+}
+
+// Lookup - The last entry for a card file, if the journal has one.
+func (p *Progress) Lookup(sourcePath string, size int64, modTime time.Time) (Entry, bool) {
+	ent, ok := p.files[keyOf(sourcePath, size, modTime)]
+	return ent, ok
+}
+
+// Update - Replace the entry for a file, after it was recorded.
+func (p *Progress) Update(ent Entry) {
+	p.files[keyOf(ent.SourcePath, ent.Size, ent.SourceModTime)] = ent
+}
+
+// Unfinished - Entries for files that are not verified yet.
+func (p *Progress) Unfinished() []Entry {
+	rv := make([]Entry, 0)
+	for _, ent := range p.files {
+		if ent.State != StateVerified {
+			rv = append(rv, ent)
+		}
+	}
+	return rv
+}
+
+// Verified - Entries for files that are verified.
+func (p *Progress) Verified() []Entry {
+	rv := make([]Entry, 0)
+	for _, ent := range p.files {
+		if ent.State == StateVerified {
+			rv = append(rv, ent)
+		}
+	}
+	return rv
+}
+
+// Count - Number of files in each state.
+func (p *Progress) Count() map[State]int {
+	rv := make(map[State]int)
+	for _, ent := range p.files {
+		rv[ent.State]++
+	}
+	return rv
+}
@@ -0,0 +1,119 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testOpts struct {
+	MountList []string
+	Layout    string
+}
+
+func TestJournalReplay(t *testing.T) {
+
+	targetDir := t.TempDir()
+	shot := time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)
+
+	j, err := Create(targetDir, "session-1", testOpts{MountList: []string{"/media/card"}})
+	if err != nil {
+		t.Fatal("error creating journal: " + err.Error())
+	}
+
+	ent := Entry{
+		SourceCard:    "/media/card",
+		SourcePath:    "/media/card/DCIM/IMG_0001.CR2",
+		Size:          100,
+		SourceModTime: shot,
+		TargetName:    "/target/IMG_0001.CR2",
+	}
+	for _, state := range []State{StatePlanned, StateInProgress, StateCopied} {
+		ent.State = state
+		err = j.Record(ent)
+		if err != nil {
+			t.Fatal("error recording: " + err.Error())
+		}
+	}
+
+	other := ent
+	other.SourcePath = "/media/card/DCIM/IMG_0002.CR2"
+	other.State = StateVerified
+	err = j.Record(other)
+	if err != nil {
+		t.Fatal("error recording: " + err.Error())
+	}
+
+	err = j.Close()
+	if err != nil {
+		t.Fatal("error closing journal: " + err.Error())
+	}
+
+	// A crash in the middle of a write leaves half a line.
+	fileName := filepath.Join(targetDir, DirName, "session-1"+fileSuffix)
+	fi, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("error opening journal: " + err.Error())
+	}
+	_, _ = fi.WriteString(`{"state":"verified","source_path":"/media/card/DCIM/IMG_0001.CR2"`)
+	_ = fi.Close()
+
+	sessions, err := List(targetDir)
+	if err != nil {
+		t.Fatal("error listing sessions: " + err.Error())
+	}
+	if len(sessions) != 1 || sessions[0].SessionID != "session-1" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+	if string(sessions[0].Options) != `{"MountList":["/media/card"],"Layout":""}` {
+		t.Errorf("unexpected options: %s", sessions[0].Options)
+	}
+
+	_, progress, err := Load(sessions[0].FileName())
+	if err != nil {
+		t.Fatal("error loading journal: " + err.Error())
+	}
+
+	got, ok := progress.Lookup(ent.SourcePath, ent.Size, shot)
+	if !ok || got.State != StateCopied {
+		t.Fatalf("expected the copied state, got %+v", got)
+	}
+	if len(progress.Unfinished()) != 1 {
+		t.Errorf("expected 1 unfinished file, got %d", len(progress.Unfinished()))
+	}
+	counts := progress.Count()
+	if counts[StateVerified] != 1 || counts[StateCopied] != 1 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+
+	// The session can be picked up, and finished.
+	j, err = Reopen(sessions[0])
+	if err != nil {
+		t.Fatal("error reopening journal: " + err.Error())
+	}
+	ent.State = StateVerified
+	err = j.Record(ent)
+	if err != nil {
+		t.Fatal("error recording: " + err.Error())
+	}
+	_, progress, err = Load(sessions[0].FileName())
+	if err != nil {
+		t.Fatal("error loading journal: " + err.Error())
+	}
+	if progress.Count()[StateVerified] != 2 || len(progress.Unfinished()) != 0 {
+		t.Errorf("entry after the torn line was lost: %v", progress.Count())
+	}
+
+	err = j.Finish()
+	if err != nil {
+		t.Fatal("error finishing journal: " + err.Error())
+	}
+	sessions, err = List(targetDir)
+	if err != nil {
+		t.Fatal("error listing sessions: " + err.Error())
+	}
+	if len(sessions) != 0 {
+		t.Errorf("finished session is still listed")
+	}
+}
@@ -0,0 +1,235 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileName - Name of the ledger in each target directory.  It is hidden,
+// so it does not clutter Lightroom or PhotoMechanic.
+const FileName = ".cardslurp-ledger.jsonl"
+
+const (
+	StatusCopied  = "copied"
+	StatusSkipped = "skipped"
+)
+
+// Record - Provenance of one imported file.  One JSON object per line.
+type Record struct {
+	SessionID    string    `json:"session_id"`
+	ImportedAt   time.Time `json:"imported_at"`
+	Status       string    `json:"status"`
+	SourceCard   string    `json:"source_card"`
+	SourcePath   string    `json:"source_path"`
+	OriginalName string    `json:"original_name"`
+	TargetName   string    `json:"target_name"`
+	Size         int64     `json:"size"`
+	// SourceModTime - Modification time of the file on the card.  With
+	// SourcePath and Size, it identifies the file on the next run.
+	SourceModTime time.Time `json:"source_mtime"`
+	CaptureTime   time.Time `json:"capture_time"`
+	CameraModel   string    `json:"camera_model,omitempty"`
+	CameraSerial  string    `json:"camera_serial,omitempty"`
+	Digest        string    `json:"digest,omitempty"`
+	Retries       uint64    `json:"retries"`
+}
+
+// Ledger - Append only record of every file imported into a target
+// directory.  Appends are serialized with the embedded mutex, so the
+// worker goroutines can share one Ledger.
+type Ledger struct {
+	sync.Mutex
+	fi        *os.File
+	fileName  string
+	sessionID string
+}
+
+// NewSessionID - Make an ID for one run of cardslurp.  Every record written
+// during the run carries it.
+func NewSessionID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("error making session id: %w", err)
+	}
+	return id.String(), nil
+}
+
+// Open - Open (or create) the ledger in targetDir for appending.
+func Open(targetDir string, sessionID string) (*Ledger, error) {
+
+	fileName := filepath.Join(targetDir, FileName)
+
+	fi, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger %s: %w", fileName, err)
+	}
+
+	return &Ledger{
+		Mutex:     sync.Mutex{},
+		fi:        fi,
+		fileName:  fileName,
+		sessionID: sessionID,
+	}, nil
+}
+
+// SessionID - ID stamped on every record written through this Ledger.
+func (l *Ledger) SessionID() string {
+	return l.sessionID
+}
+
+// Append - Write one record, and fsync it before returning.  The session
+// ID and import time are filled in here.
+func (l *Ledger) Append(rec Record) error {
+
+	rec.SessionID = l.sessionID
+	rec.ImportedAt = time.Now().UTC()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error marshaling ledger record: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	// A single write per record, so a crash can at worst leave a
+	// truncated last line.  ReadFile skips those.
+	_, err = l.fi.Write(line)
+	if err != nil {
+		return fmt.Errorf("error writing ledger %s: %w", l.fileName, err)
+	}
+
+	err = l.fi.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing ledger %s: %w", l.fileName, err)
+	}
+
+	return nil
+}
+
+// Close - Close the underlying file.
+func (l *Ledger) Close() error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	err := l.fi.Close()
+	if err != nil {
+		return fmt.Errorf("error closing ledger %s: %w", l.fileName, err)
+	}
+
+	return nil
+}
+
+// ReadDir - Read every record from the ledger in targetDir.  A directory
+// without a ledger returns no records and no error.
+func ReadDir(targetDir string) ([]Record, error) {
+	return ReadFile(filepath.Join(targetDir, FileName))
+}
+
+// ReadFile - Read every record from a ledger file.  A line that does not
+// parse is assumed to be the tail of an interrupted write, and skipped.
+func ReadFile(fileName string) ([]Record, error) {
+
+	fi, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	rv := make([]Record, 0)
+	scanner := bufio.NewScanner(fi)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			fmt.Printf("Skipping damaged line in ledger %s\n", fileName)
+			continue
+		}
+		rv = append(rv, rec)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error reading ledger %s: %w", fileName, err)
+	}
+
+	return rv, nil
+}
+
+// importedKey - What identifies a card file between runs, without reading
+// it.
+type importedKey struct {
+	sourcePath string
+	size       int64
+	modTime    int64
+}
+
+// Imported - Card files that an earlier run already copied or skipped,
+// with the target they ended up at.  An interrupted run is picked up by
+// checking each file against this, so only the unfinished work is done.
+// The path, size and modification time only say which card file a record
+// is about.  The digest says whether it is still the same file.
+type Imported struct {
+	targets map[importedKey]importedFile
+}
+
+// importedFile - Where an earlier run put a card file, and its digest.
+type importedFile struct {
+	target string
+	digest string
+}
+
+// NewImported - Index the records of earlier runs.  Records from before
+// source_mtime was recorded never match, so those files go through the
+// usual name check instead.
+func NewImported(records []Record) *Imported {
+
+	rv := &Imported{
+		targets: make(map[importedKey]importedFile),
+	}
+
+	for _, rec := range records {
+		if rec.SourceModTime.IsZero() || rec.TargetName == "" {
+			continue
+		}
+		rv.targets[importedKey{
+			sourcePath: rec.SourcePath,
+			size:       rec.Size,
+			modTime:    rec.SourceModTime.UnixNano(),
+		}] = importedFile{target: rec.TargetName, digest: rec.Digest}
+	}
+
+	return rv
+}
+
+// Lookup - Target and digest of an earlier import of this card file, if
+// any.  The digest is empty if the record has none.
+func (i *Imported) Lookup(sourcePath string, size int64, modTime time.Time) (string, string, bool) {
+	file, ok := i.targets[importedKey{
+		sourcePath: sourcePath,
+		size:       size,
+		modTime:    modTime.UnixNano(),
+	}]
+	return file.target, file.digest, ok
+}
+
+// Len - Number of card files in the index.
+func (i *Imported) Len() int {
+	return len(i.targets)
+}
@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLedgerConcurrentAppend(t *testing.T) {
+
+	targetDir := t.TempDir()
+
+	sessionID, err := NewSessionID()
+	if err != nil {
+		t.Fatal("error making session id: " + err.Error())
+	}
+
+	led, err := Open(targetDir, sessionID)
+	if err != nil {
+		t.Fatal("error opening ledger: " + err.Error())
+	}
+
+	// Hammer the ledger from several goroutines, like the worker pool does.
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := led.Append(Record{
+					Status:       StatusCopied,
+					SourceCard:   "/media/card",
+					OriginalName: fmt.Sprintf("IMG_%d_%d.CR2", worker, i),
+					TargetName:   fmt.Sprintf("/target/IMG_%d_%d.CR2", worker, i),
+					Size:         int64(i),
+				})
+				if err != nil {
+					t.Error("error appending: " + err.Error())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	err = led.Close()
+	if err != nil {
+		t.Fatal("error closing ledger: " + err.Error())
+	}
+
+	recs, err := ReadDir(targetDir)
+	if err != nil {
+		t.Fatal("error reading ledger: " + err.Error())
+	}
+	if len(recs) != 400 {
+		t.Fatalf("expected 400 records, got %d", len(recs))
+	}
+	for _, rec := range recs {
+		if rec.SessionID != sessionID {
+			t.Errorf("record has session %s, expected %s", rec.SessionID, sessionID)
+		}
+		if rec.ImportedAt.IsZero() {
+			t.Error("record is missing its import time")
+		}
+	}
+}
+
+func TestLedgerSkipsTruncatedLine(t *testing.T) {
+
+	targetDir := t.TempDir()
+
+	led, err := Open(targetDir, "session")
+	if err != nil {
+		t.Fatal("error opening ledger: " + err.Error())
+	}
+	err = led.Append(Record{Status: StatusCopied, OriginalName: "IMG_0001.CR2"})
+	if err != nil {
+		t.Fatal("error appending: " + err.Error())
+	}
+	_ = led.Close()
+
+	// Simulate a crash in the middle of a write.
+	fi, err := os.OpenFile(filepath.Join(targetDir, FileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("error reopening ledger: " + err.Error())
+	}
+	_, _ = fi.WriteString(`{"session_id":"session","status":"cop`)
+	_ = fi.Close()
+
+	recs, err := ReadDir(targetDir)
+	if err != nil {
+		t.Fatal("error reading ledger: " + err.Error())
+	}
+	if len(recs) != 1 || recs[0].OriginalName != "IMG_0001.CR2" {
+		t.Errorf("expected only the complete record, got %+v", recs)
+	}
+
+	// A directory that was never imported into has an empty ledger.
+	recs, err = ReadDir(t.TempDir())
+	if err != nil || len(recs) != 0 {
+		t.Errorf("expected no records and no error, got %d, %v", len(recs), err)
+	}
+}
+
+func TestImported(t *testing.T) {
+
+	shot := time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)
+
+	imp := NewImported([]Record{
+		{
+			Status:        StatusCopied,
+			SourcePath:    "/media/card/DCIM/IMG_0001.CR2",
+			TargetName:    "/target/IMG_0001.CR2",
+			Size:          100,
+			SourceModTime: shot,
+			Digest:        "sha256:00ff",
+		},
+		{
+			// Written before source_mtime was recorded.
+			Status:     StatusCopied,
+			SourcePath: "/media/card/DCIM/IMG_0002.CR2",
+			TargetName: "/target/IMG_0002.CR2",
+			Size:       100,
+		},
+	})
+
+	if imp.Len() != 1 {
+		t.Fatalf("expected 1 imported file, got %d", imp.Len())
+	}
+
+	target, digest, ok := imp.Lookup("/media/card/DCIM/IMG_0001.CR2", 100, shot.Local())
+	if !ok || target != "/target/IMG_0001.CR2" || digest != "sha256:00ff" {
+		t.Fatalf("lookup returned %q, %q, %t", target, digest, ok)
+	}
+
+	// Same name on a reformatted card, but a different file.
+	_, _, ok = imp.Lookup("/media/card/DCIM/IMG_0001.CR2", 100, shot.Add(time.Hour))
+	if ok {
+		t.Fatal("lookup matched a file with a different mtime")
+	}
+	_, _, ok = imp.Lookup("/media/card/DCIM/IMG_0001.CR2", 101, shot)
+	if ok {
+		t.Fatal("lookup matched a file with a different size")
+	}
+}
@@ -0,0 +1,322 @@
+package libindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// DefaultFileName - Name of the index, when it is kept in a library root.
+const DefaultFileName = ".cardslurp-index.jsonl"
+
+// Hasher - Computes file digests.  cardfileutil.CardFileUtil satisfies this.
+type Hasher interface {
+	HashFile(fileName string) (cardfileutil.FileDigest, error)
+}
+
+// Entry - One file in the library.  Size and ModTime decide whether the
+// digest can be reused on the next update.
+type Entry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Digest  string    `json:"digest"`
+}
+
+// UpdateStats - What an Update had to do.
+type UpdateStats struct {
+	Hashed  uint64
+	Reused  uint64
+	Removed uint64
+}
+
+// Index - Content addressed index of every file under one or more library
+// roots, keyed by size and digest.  Reads and writes are protected by the
+// embedded RWMutex, so the worker goroutines can share one Index.
+type Index struct {
+	sync.RWMutex
+	fileName string
+	algo     cardfileutil.HashAlgo
+	hasher   Hasher
+	byPath   map[string]Entry
+	bySize   map[int64]map[string]bool
+}
+
+// Load - Read the index from fileName.  A missing file gives an empty
+// index, which Update will fill in.
+func Load(fileName string, algo cardfileutil.HashAlgo, hasher Hasher) (*Index, error) {
+
+	rv := &Index{
+		RWMutex:  sync.RWMutex{},
+		fileName: fileName,
+		algo:     algo,
+		hasher:   hasher,
+		byPath:   make(map[string]Entry),
+		bySize:   make(map[int64]map[string]bool),
+	}
+
+	fi, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening library index %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	scanner := bufio.NewScanner(fi)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ent Entry
+		err = json.Unmarshal(scanner.Bytes(), &ent)
+		if err != nil {
+			// Save writes a temp file and renames it, so a bad line
+			// means someone edited the file.  Drop it, and let Update
+			// hash the file again.
+			continue
+		}
+		rv.put(ent)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error reading library index %s: %w", fileName, err)
+	}
+
+	return rv, nil
+}
+
+// put - Add or replace an entry.  Caller must hold the write lock, or
+// own the Index exclusively.
+func (i *Index) put(ent Entry) {
+
+	old, ok := i.byPath[ent.Path]
+	if ok {
+		i.drop(old)
+	}
+
+	i.byPath[ent.Path] = ent
+	keys, ok := i.bySize[ent.Size]
+	if !ok {
+		keys = make(map[string]bool)
+		i.bySize[ent.Size] = keys
+	}
+	keys[ent.Path] = true
+}
+
+// drop - Remove an entry.  Caller must hold the write lock.
+func (i *Index) drop(ent Entry) {
+	delete(i.byPath, ent.Path)
+	keys := i.bySize[ent.Size]
+	delete(keys, ent.Path)
+	if len(keys) == 0 {
+		delete(i.bySize, ent.Size)
+	}
+}
+
+// Update - Walk the library roots, and bring the index up to date.  Files
+// whose size and mtime have not changed keep their digest, so only new or
+// modified files are read.  Entries under the roots for files that no
+// longer exist are removed.  Hidden files and directories are skipped, since
+// that is where cardslurp keeps its own bookkeeping.
+func (i *Index) Update(roots []string) (UpdateStats, error) {
+
+	rv := UpdateStats{}
+	seen := make(map[string]bool)
+	digestPrefix := string(i.algo) + ":"
+
+	for _, root := range roots {
+
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return rv, fmt.Errorf("error making %s absolute: %w", root, err)
+		}
+
+		err = filepath.WalkDir(absRoot, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error walking %s: %w", path, err)
+			}
+
+			if path != absRoot && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return fmt.Errorf("error getting info for %s: %w", path, err)
+			}
+
+			seen[path] = true
+
+			i.RLock()
+			old, ok := i.byPath[path]
+			i.RUnlock()
+
+			if ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) &&
+				strings.HasPrefix(old.Digest, digestPrefix) {
+				rv.Reused++
+				return nil
+			}
+
+			digest, err := i.hasher.HashFile(path)
+			if err != nil {
+				return err
+			}
+			rv.Hashed++
+
+			i.Lock()
+			i.put(Entry{
+				Path:    path,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Digest:  digest.String(),
+			})
+			i.Unlock()
+
+			return nil
+		})
+		if err != nil {
+			return rv, fmt.Errorf("error indexing library root %s: %w", root, err)
+		}
+
+		// Forget files under this root that have gone away.
+		i.Lock()
+		for path, ent := range i.byPath {
+			if !seen[path] && isUnder(path, absRoot) {
+				i.drop(ent)
+				rv.Removed++
+			}
+		}
+		i.Unlock()
+	}
+
+	return rv, nil
+}
+
+func isUnder(path string, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// HasSize - True if any file in the library has this size.  This is the
+// cheap first check, so a source file only needs to be hashed when a
+// match is possible.
+func (i *Index) HasSize(size int64) bool {
+	i.RLock()
+	defer i.RUnlock()
+	return len(i.bySize[size]) != 0
+}
+
+// Lookup - Path of a library file with the same size and digest, if any.
+// Two files with the same size and digest are treated as the same content.
+// A match is only returned if the file is still there, since files added
+// outside the library roots are not pruned by Update.
+func (i *Index) Lookup(size int64, digest cardfileutil.FileDigest) (string, bool) {
+
+	want := digest.String()
+
+	i.RLock()
+	defer i.RUnlock()
+
+	for path := range i.bySize[size] {
+		if i.byPath[path].Digest != want {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err == nil && info.Size() == size {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// Add - Record a file that was just imported, so later files in the same
+// run are checked against it too.
+func (i *Index) Add(path string, size int64, modTime time.Time, digest cardfileutil.FileDigest) {
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.put(Entry{
+		Path:    absPath,
+		Size:    size,
+		ModTime: modTime,
+		Digest:  digest.String(),
+	})
+}
+
+// Len - Number of files in the index.
+func (i *Index) Len() int {
+	i.RLock()
+	defer i.RUnlock()
+	return len(i.byPath)
+}
+
+// Save - Write the index back to disk.  It goes to a temp file that is
+// renamed into place, so a crash leaves the old index intact.
+func (i *Index) Save() error {
+
+	i.RLock()
+	defer i.RUnlock()
+
+	tempName := i.fileName + ".tmp"
+	fi, err := os.Create(tempName)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", tempName, err)
+	}
+
+	bw := bufio.NewWriter(fi)
+	enc := json.NewEncoder(bw)
+	for _, ent := range i.byPath {
+		err = enc.Encode(ent)
+		if err != nil {
+			_ = fi.Close()
+			return fmt.Errorf("error writing %s: %w", tempName, err)
+		}
+	}
+
+	err = bw.Flush()
+	if err == nil {
+		err = fi.Sync()
+	}
+	closeErr := fi.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", tempName, err)
+	}
+
+	err = os.Rename(tempName, i.fileName)
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", tempName, i.fileName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package libindex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func writeFile(t *testing.T, name string, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		t.Fatal("error making dir: " + err.Error())
+	}
+	err = os.WriteFile(name, []byte(data), 0644)
+	if err != nil {
+		t.Fatal("error writing " + name + ": " + err.Error())
+	}
+}
+
+func TestIndexIncrementalUpdate(t *testing.T) {
+
+	library := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	writeFile(t, filepath.Join(library, "2023", "shoot_a", "IMG_0001.CR2"), "image one")
+	writeFile(t, filepath.Join(library, "2023", "shoot_b", "IMG_0002_renamed.CR2"), "image two")
+	writeFile(t, filepath.Join(library, ".cardslurp-ledger.jsonl"), "not a photo")
+
+	indexFile := filepath.Join(library, DefaultFileName)
+	idx, err := Load(indexFile, cardfileutil.HashSHA256, cfu)
+	if err != nil {
+		t.Fatal("error loading index: " + err.Error())
+	}
+
+	stats, err := idx.Update([]string{library})
+	if err != nil {
+		t.Fatal("error updating index: " + err.Error())
+	}
+	if stats.Hashed != 2 || idx.Len() != 2 {
+		t.Fatalf("expected 2 files hashed and indexed, got %+v and %d", stats, idx.Len())
+	}
+
+	err = idx.Save()
+	if err != nil {
+		t.Fatal("error saving index: " + err.Error())
+	}
+
+	// Reload, and change one file, and remove another.
+	idx, err = Load(indexFile, cardfileutil.HashSHA256, cfu)
+	if err != nil {
+		t.Fatal("error reloading index: " + err.Error())
+	}
+	changed := filepath.Join(library, "2023", "shoot_a", "IMG_0001.CR2")
+	writeFile(t, changed, "image one, edited")
+	err = os.Chtimes(changed, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal("error setting times: " + err.Error())
+	}
+	err = os.Remove(filepath.Join(library, "2023", "shoot_b", "IMG_0002_renamed.CR2"))
+	if err != nil {
+		t.Fatal("error removing file: " + err.Error())
+	}
+	writeFile(t, filepath.Join(library, "2024", "IMG_0003.CR2"), "image three")
+
+	stats, err = idx.Update([]string{library})
+	if err != nil {
+		t.Fatal("error updating index: " + err.Error())
+	}
+	if stats.Hashed != 2 || stats.Reused != 0 || stats.Removed != 1 {
+		t.Errorf("unexpected update stats: %+v", stats)
+	}
+
+	// Nothing changed, so nothing gets read.
+	stats, err = idx.Update([]string{library})
+	if err != nil {
+		t.Fatal("error updating index: " + err.Error())
+	}
+	if stats.Hashed != 0 || stats.Reused != 2 {
+		t.Errorf("unexpected update stats for an unchanged library: %+v", stats)
+	}
+}
+
+func TestIndexLookup(t *testing.T) {
+
+	library := t.TempDir()
+	cardDir := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	existing := filepath.Join(library, "old_shoot", "PAH_1234_5f8e.CR2")
+	writeFile(t, existing, "the same bytes")
+	card := filepath.Join(cardDir, "PAH_1234.CR2")
+	writeFile(t, card, "the same bytes")
+	other := filepath.Join(cardDir, "PAH_1235.CR2")
+	writeFile(t, other, "different byte")
+
+	idx, err := Load(filepath.Join(library, DefaultFileName), cardfileutil.HashSHA256, cfu)
+	if err != nil {
+		t.Fatal("error loading index: " + err.Error())
+	}
+	_, err = idx.Update([]string{library})
+	if err != nil {
+		t.Fatal("error updating index: " + err.Error())
+	}
+
+	if !idx.HasSize(int64(len("the same bytes"))) {
+		t.Fatal("expected a size match")
+	}
+
+	digest, err := cfu.HashFile(card)
+	if err != nil {
+		t.Fatal("error hashing: " + err.Error())
+	}
+	found, ok := idx.Lookup(int64(len("the same bytes")), digest)
+	if !ok || found != existing {
+		t.Errorf("expected to find %s, got %s, %v", existing, found, ok)
+	}
+
+	// Same size, different content.
+	digest, err = cfu.HashFile(other)
+	if err != nil {
+		t.Fatal("error hashing: " + err.Error())
+	}
+	_, ok = idx.Lookup(int64(len("different byte")), digest)
+	if ok {
+		t.Error("file with different content matched")
+	}
+}
@@ -0,0 +1,308 @@
+package manifest
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// Format - A checksum manifest format that other tools already read.
+type Format string
+
+const (
+	// FormatSHA256Sum - SHA256SUMS, which sha256sum -c can check.
+	FormatSHA256Sum Format = "sha256sum"
+	// FormatMD5Sum - MD5SUMS, which md5sum -c can check.
+	FormatMD5Sum Format = "md5sum"
+	// FormatBagIt - A BagIt bag, with the copies in its data folder.
+	FormatBagIt Format = "bagit"
+)
+
+const (
+	// SHA256SumsName and MD5SumsName - The manifests for sha256sum and
+	// md5sum, in the target directory.
+	SHA256SumsName = "SHA256SUMS"
+	MD5SumsName    = "MD5SUMS"
+	// PayloadDir - Where a bag keeps the copied files.
+	PayloadDir = "data"
+	// BagManifestName - The payload manifest of a bag.
+	BagManifestName = "manifest-sha256.txt"
+	bagDeclaration  = "bagit.txt"
+	bagInfo         = "bag-info.txt"
+)
+
+// ParseFormats - Convert command line names to Formats.
+func ParseFormats(names []string) ([]Format, error) {
+
+	rv := make([]Format, 0, len(names))
+	for _, name := range names {
+		switch Format(name) {
+		case FormatSHA256Sum, FormatMD5Sum, FormatBagIt:
+			rv = append(rv, Format(name))
+		default:
+			return nil, fmt.Errorf("unknown manifest format %q (sha256sum, md5sum or bagit)", name)
+		}
+	}
+
+	return rv, nil
+}
+
+// Algos - The digests the formats need, for CardFileUtil.SetExtraDigests.
+func Algos(formats []Format) []cardfileutil.HashAlgo {
+
+	rv := make([]cardfileutil.HashAlgo, 0)
+	seen := make(map[cardfileutil.HashAlgo]bool)
+	for _, f := range formats {
+		algo := algoOf(f)
+		if !seen[algo] {
+			seen[algo] = true
+			rv = append(rv, algo)
+		}
+	}
+
+	return rv
+}
+
+func algoOf(f Format) cardfileutil.HashAlgo {
+	if f == FormatMD5Sum {
+		return cardfileutil.HashMD5
+	}
+	return cardfileutil.HashSHA256
+}
+
+// PayloadRoot - Where the copies go in root.  A bag keeps them in its
+// data folder, and the other formats next to the manifest.
+func PayloadRoot(root string, formats []Format) string {
+	for _, f := range formats {
+		if f == FormatBagIt {
+			return filepath.Join(root, PayloadDir)
+		}
+	}
+	return root
+}
+
+// manifestFile - One manifest being appended to.
+type manifestFile struct {
+	format   Format
+	algo     cardfileutil.HashAlgo
+	fi       *os.File
+	fileName string
+}
+
+// Writer - Appends each copied file to the manifests in a target
+// directory.  Like the ledger, each line is synced before Add returns, so
+// the manifests always list what is in the target.  Appends are
+// serialized with the embedded mutex, so the worker goroutines can share
+// one Writer.
+type Writer struct {
+	sync.Mutex
+	root  string
+	bag   bool
+	files []manifestFile
+}
+
+// Open - Open (or create) the manifests for formats in root.  A bag gets
+// its declaration and data folder here, and its bag-info.txt on Close.
+func Open(root string, formats []Format) (*Writer, error) {
+
+	rv := &Writer{
+		root:  root,
+		files: make([]manifestFile, 0, len(formats)),
+	}
+
+	for _, f := range formats {
+
+		name := SHA256SumsName
+		switch f {
+		case FormatMD5Sum:
+			name = MD5SumsName
+		case FormatBagIt:
+			name = BagManifestName
+			err := startBag(root)
+			if err != nil {
+				_ = rv.Close()
+				return nil, err
+			}
+			rv.bag = true
+		}
+
+		fileName := filepath.Join(root, name)
+		fi, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			_ = rv.Close()
+			return nil, fmt.Errorf("error opening manifest %s: %w", fileName, err)
+		}
+		rv.files = append(rv.files, manifestFile{
+			format:   f,
+			algo:     algoOf(f),
+			fi:       fi,
+			fileName: fileName,
+		})
+	}
+
+	return rv, nil
+}
+
+// startBag - Write the bag declaration, and make the data folder.
+func startBag(root string) error {
+
+	payload := filepath.Join(root, PayloadDir)
+	err := os.MkdirAll(payload, 0755)
+	if err != nil {
+		return fmt.Errorf("error making %s: %w", payload, err)
+	}
+
+	fileName := filepath.Join(root, bagDeclaration)
+	_, err = os.Stat(fileName)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error calling stat on %s: %w", fileName, err)
+	}
+
+	err = os.WriteFile(fileName, []byte("BagIt-Version: 1.0\n"+
+		"Tag-File-Character-Encoding: UTF-8\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// Add - Append a copied file to every manifest.  digests must have the
+// digest each format needs (see Algos).
+func (w *Writer) Add(fileName string, digests []cardfileutil.FileDigest) error {
+
+	rel, err := filepath.Rel(w.root, fileName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not under %s", fileName, w.root)
+	}
+	rel = filepath.ToSlash(rel)
+
+	w.Lock()
+	defer w.Unlock()
+
+	for _, m := range w.files {
+
+		var sum []byte
+		for _, d := range digests {
+			if d.Algo == m.algo {
+				sum = d.Sum
+			}
+		}
+		if sum == nil {
+			return fmt.Errorf("no %s digest of %s for %s", m.algo, fileName, m.fileName)
+		}
+
+		var line string
+		if m.format == FormatBagIt {
+			line = hex.EncodeToString(sum) + "  " + encodeBagPath(rel) + "\n"
+		} else {
+			line = sumLine(hex.EncodeToString(sum), rel)
+		}
+
+		// A single write per line, so a crash can at worst leave a
+		// truncated last line.
+		_, err = m.fi.WriteString(line)
+		if err != nil {
+			return fmt.Errorf("error writing manifest %s: %w", m.fileName, err)
+		}
+		err = m.fi.Sync()
+		if err != nil {
+			return fmt.Errorf("error syncing manifest %s: %w", m.fileName, err)
+		}
+	}
+
+	return nil
+}
+
+// sumLine - One line of sha256sum or md5sum output.  Like coreutils, a
+// name with a backslash or a newline is escaped, and the line starts with
+// a backslash to say so.
+func sumLine(sum string, rel string) string {
+	if strings.ContainsAny(rel, "\\\n") {
+		rel = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(rel)
+		return "\\" + sum + "  " + rel + "\n"
+	}
+	return sum + "  " + rel + "\n"
+}
+
+// encodeBagPath - BagIt percent encodes CR, LF and % in manifest paths.
+func encodeBagPath(rel string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(rel)
+}
+
+// Close - Close the manifests.  A bag also gets a new bag-info.txt, with
+// the size of everything in its data folder.
+func (w *Writer) Close() error {
+
+	w.Lock()
+	defer w.Unlock()
+
+	var rv error
+	for _, m := range w.files {
+		err := m.fi.Close()
+		if err != nil && rv == nil {
+			rv = fmt.Errorf("error closing manifest %s: %w", m.fileName, err)
+		}
+	}
+	w.files = nil
+
+	if w.bag && rv == nil {
+		rv = writeBagInfo(w.root)
+	}
+
+	return rv
+}
+
+// writeBagInfo - Write bag-info.txt, with the Payload-Oxum (bytes and
+// file count) of the data folder.
+func writeBagInfo(root string) error {
+
+	var octets, streams int64
+	payload := filepath.Join(root, PayloadDir)
+	err := filepath.WalkDir(payload, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || cardfileutil.IsTempName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		octets += info.Size()
+		streams++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error measuring %s: %w", payload, err)
+	}
+
+	info := fmt.Sprintf("Bag-Software-Agent: cardslurp\n"+
+		"Bagging-Date: %s\n"+
+		"Payload-Oxum: %d.%d\n", time.Now().Format("2006-01-02"), octets, streams)
+
+	fileName := filepath.Join(root, bagInfo)
+	tempName := fileName + ".tmp"
+	err = os.WriteFile(tempName, []byte(info), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", tempName, err)
+	}
+	err = os.Rename(tempName, fileName)
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", tempName, fileName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package manifest
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// hasherFor - What cardslurp verify -manifest uses.
+func hasherFor(algo cardfileutil.HashAlgo) Hasher {
+	return cardfileutil.NewCardFileUtil(16384, 1, algo, cardfileutil.DefaultFileMode)
+}
+
+// writeFiles - Write each file under root, and add it to w.
+func writeFiles(t *testing.T, w *Writer, root string, names ...string) {
+
+	sha := hasherFor(cardfileutil.HashSHA256)
+	md5 := hasherFor(cardfileutil.HashMD5)
+	for _, name := range names {
+		fileName := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			t.Fatal("error making dir: " + err.Error())
+		}
+		err = os.WriteFile(fileName, []byte("clip "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing file: " + err.Error())
+		}
+		shaDigest, err := sha.HashFile(fileName)
+		if err != nil {
+			t.Fatal("error hashing file: " + err.Error())
+		}
+		md5Digest, err := md5.HashFile(fileName)
+		if err != nil {
+			t.Fatal("error hashing file: " + err.Error())
+		}
+		err = w.Add(fileName, []cardfileutil.FileDigest{shaDigest, md5Digest})
+		if err != nil {
+			t.Fatal("error adding file: " + err.Error())
+		}
+	}
+}
+
+func TestManifests(t *testing.T) {
+
+	root := t.TempDir()
+	formats, err := ParseFormats([]string{"sha256sum", "md5sum", "bagit"})
+	if err != nil {
+		t.Fatal("error parsing formats: " + err.Error())
+	}
+	if len(Algos(formats)) != 2 {
+		t.Errorf("expected sha256 and md5, got %v", Algos(formats))
+	}
+
+	w, err := Open(root, formats)
+	if err != nil {
+		t.Fatal("error opening manifests: " + err.Error())
+	}
+	payload := PayloadRoot(root, formats)
+	writeFiles(t, w, payload, "A001/C0001.MP4", "C0002.MP4", "back\\slash.MP4")
+	err = w.Close()
+	if err != nil {
+		t.Fatal("error closing manifests: " + err.Error())
+	}
+
+	info, err := os.ReadFile(filepath.Join(root, bagInfo))
+	if err != nil {
+		t.Fatal("error reading bag-info.txt: " + err.Error())
+	}
+	if !strings.Contains(string(info), "Payload-Oxum: 52.3\n") {
+		t.Errorf("unexpected bag-info.txt:\n%s", info)
+	}
+
+	for _, name := range []string{SHA256SumsName, MD5SumsName, BagManifestName} {
+		report, err := Verify(filepath.Join(root, name), hasherFor)
+		if err != nil {
+			t.Fatalf("error verifying %s: %s", name, err.Error())
+		}
+		if !report.OK() || report.Verified != 3 {
+			t.Errorf("expected 3 verified files in %s, got %+v", name, report)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(payload, "C0002.MP4"), []byte("altered"), 0644)
+	if err != nil {
+		t.Fatal("error altering file: " + err.Error())
+	}
+	err = os.Remove(filepath.Join(payload, "A001", "C0001.MP4"))
+	if err != nil {
+		t.Fatal("error removing file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(payload, "C0003.MP4"), []byte("clip C0003.MP4"), 0644)
+	if err != nil {
+		t.Fatal("error writing file: " + err.Error())
+	}
+
+	report, err := Verify(filepath.Join(root, BagManifestName), hasherFor)
+	if err != nil {
+		t.Fatal("error verifying bag: " + err.Error())
+	}
+	if report.OK() || report.Verified != 1 {
+		t.Errorf("expected 1 verified file, got %+v", report)
+	}
+	if len(report.Altered) != 1 || !strings.HasPrefix(report.Altered[0], "data/C0002.MP4: sha256") {
+		t.Errorf("unexpected altered files %v", report.Altered)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "data/A001/C0001.MP4" {
+		t.Errorf("unexpected missing files %v", report.Missing)
+	}
+	if len(report.New) != 1 || report.New[0] != "data/C0003.MP4" {
+		t.Errorf("unexpected new files %v", report.New)
+	}
+
+	// A sha256sum manifest does not claim to list everything.
+	report, err = Verify(filepath.Join(root, SHA256SumsName), hasherFor)
+	if err != nil {
+		t.Fatal("error verifying SHA256SUMS: " + err.Error())
+	}
+	if len(report.Altered) != 1 || len(report.Missing) != 1 || len(report.New) != 0 {
+		t.Errorf("unexpected SHA256SUMS report %+v", report)
+	}
+}
+
+func TestVerifyTagFormat(t *testing.T) {
+
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, "C0001.MP4"), []byte("clip"), 0644)
+	if err != nil {
+		t.Fatal("error writing file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(root, "new\nline.MP4"), []byte("clip"), 0644)
+	if err != nil {
+		t.Fatal("error writing file: " + err.Error())
+	}
+
+	sha := hasherFor(cardfileutil.HashSHA256)
+	md5 := hasherFor(cardfileutil.HashMD5)
+	shaDigest, err := sha.HashFile(filepath.Join(root, "C0001.MP4"))
+	if err != nil {
+		t.Fatal("error hashing file: " + err.Error())
+	}
+	md5Digest, err := md5.HashFile(filepath.Join(root, "new\nline.MP4"))
+	if err != nil {
+		t.Fatal("error hashing file: " + err.Error())
+	}
+
+	// What sha256sum --tag and md5sum -b print for these files.
+	sums := "SHA256 (C0001.MP4) = " + strings.ToUpper(hex.EncodeToString(shaDigest.Sum)) + "\n" +
+		"\\" + hex.EncodeToString(md5Digest.Sum) + " *new\\nline.MP4\n"
+
+	manifestFile := filepath.Join(root, "CHECKSUMS")
+	err = os.WriteFile(manifestFile, []byte(sums), 0644)
+	if err != nil {
+		t.Fatal("error writing manifest: " + err.Error())
+	}
+
+	report, err := Verify(manifestFile, hasherFor)
+	if err != nil {
+		t.Fatal("error verifying: " + err.Error())
+	}
+	if !report.OK() || report.Verified != 2 {
+		t.Errorf("expected 2 verified files, got %+v", report)
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+
+	_, err := ParseFormats([]string{"sha256sum", "sha1sum"})
+	if err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
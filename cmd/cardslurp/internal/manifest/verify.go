@@ -0,0 +1,305 @@
+package manifest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// Hasher - Computes the digest of a file.  A CardFileUtil is one.
+type Hasher interface {
+	HashFile(fileName string) (cardfileutil.FileDigest, error)
+}
+
+// Report - What Verify found.  Each list is sorted by path.
+type Report struct {
+	// Verified - Files that still match the manifest.
+	Verified int
+	// Missing - Files in the manifest that are gone.
+	Missing []string
+	// Altered - Files whose digest changed, with the difference.
+	Altered []string
+	// New - Files in a bag's data folder that its manifest does not
+	// list.  A sha256sum or md5sum manifest does not claim to list
+	// everything, so it never has any.
+	New []string
+}
+
+// OK - True if every file matches.
+func (r Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Altered) == 0 && len(r.New) == 0
+}
+
+// Entry - One file listed in a manifest.
+type Entry struct {
+	Algo cardfileutil.HashAlgo
+	// Sum - Lower case hex.
+	Sum string
+	// Rel - Relative to the directory the manifest is in, with forward
+	// slashes.
+	Rel string
+}
+
+// IsManifestName - True for the names of the manifests cardslurp writes,
+// which are the ones it looks for in a library.
+func IsManifestName(name string) bool {
+	switch name {
+	case SHA256SumsName, MD5SumsName, BagManifestName, "manifest-md5.txt":
+		return true
+	default:
+		return false
+	}
+}
+
+// isBagManifest - BagIt payload manifests are manifest-<algo>.txt.
+func isBagManifest(manifestFile string) bool {
+	base := filepath.Base(manifestFile)
+	return strings.HasPrefix(base, "manifest-") && strings.HasSuffix(base, ".txt")
+}
+
+// Read - The files listed in manifestFile, in any of the formats Verify
+// reads.
+func Read(manifestFile string) ([]Entry, error) {
+	if isBagManifest(manifestFile) {
+		return readBagManifest(manifestFile)
+	}
+	return readSums(manifestFile)
+}
+
+// Verify - Check the files listed in manifestFile, which can be a
+// sha256sum or md5sum file (including the --tag format), or a BagIt
+// manifest-sha256.txt or manifest-md5.txt.  Paths are relative to the
+// directory the manifest is in.  hasherFor returns a Hasher for each
+// algorithm the manifest uses.
+func Verify(manifestFile string, hasherFor func(cardfileutil.HashAlgo) Hasher) (Report, error) {
+
+	rv := Report{
+		Missing: make([]string, 0),
+		Altered: make([]string, 0),
+		New:     make([]string, 0),
+	}
+
+	root := filepath.Dir(manifestFile)
+	bag := isBagManifest(manifestFile)
+
+	entries, err := Read(manifestFile)
+	if err != nil {
+		return rv, err
+	}
+
+	listed := make(map[string]bool)
+	for _, ent := range entries {
+
+		listed[ent.Rel] = true
+		fileName := filepath.Join(root, filepath.FromSlash(ent.Rel))
+
+		digest, err := hasherFor(ent.Algo).HashFile(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			rv.Missing = append(rv.Missing, ent.Rel)
+			continue
+		}
+		if err != nil {
+			return rv, err
+		}
+
+		got := hex.EncodeToString(digest.Sum)
+		if got != ent.Sum {
+			rv.Altered = append(rv.Altered, fmt.Sprintf("%s: %s %s, expected %s",
+				ent.Rel, ent.Algo, got, ent.Sum))
+			continue
+		}
+		rv.Verified++
+	}
+
+	if bag {
+		payload := filepath.Join(root, PayloadDir)
+		err = filepath.WalkDir(payload, func(fileName string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || cardfileutil.IsTempName(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, fileName)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !listed[rel] {
+				rv.New = append(rv.New, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return rv, fmt.Errorf("error reading %s: %w", payload, err)
+		}
+	}
+
+	sort.Strings(rv.Missing)
+	sort.Strings(rv.Altered)
+	sort.Strings(rv.New)
+
+	return rv, nil
+}
+
+// readLines - The lines of a manifest, without blank lines.
+func readLines(fileName string, fn func(line string) error) error {
+
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening manifest %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	scanner := bufio.NewScanner(fi)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		err = fn(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", fileName, lineNum, err)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// algoForSum - Tell the algorithm from the length of a hex digest.
+func algoForSum(sum string) (cardfileutil.HashAlgo, error) {
+
+	_, err := hex.DecodeString(sum)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a hex digest", sum)
+	}
+
+	switch len(sum) {
+	case 64:
+		return cardfileutil.HashSHA256, nil
+	case 32:
+		return cardfileutil.HashMD5, nil
+	default:
+		return "", fmt.Errorf("digest %s is not sha256 or md5", sum)
+	}
+}
+
+// readSums - Read sha256sum or md5sum output, in the default or --tag
+// format.
+func readSums(fileName string) ([]Entry, error) {
+
+	rv := make([]Entry, 0)
+	err := readLines(fileName, func(line string) error {
+
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+
+		var sum, rel string
+		if tag, rest, found := strings.Cut(line, " ("); found &&
+			(tag == "SHA256" || tag == "MD5") {
+			// --tag: ALGO (name) = sum
+			i := strings.LastIndex(rest, ") = ")
+			if i < 0 {
+				return fmt.Errorf("can not parse %q", line)
+			}
+			rel, sum = rest[:i], strings.ToLower(rest[i+4:])
+		} else {
+			// sum, a space, then a space (text) or * (binary), then the name.
+			i := strings.IndexByte(line, ' ')
+			if i < 0 || i+2 > len(line) || (line[i+1] != ' ' && line[i+1] != '*') {
+				return fmt.Errorf("can not parse %q", line)
+			}
+			sum, rel = strings.ToLower(line[:i]), line[i+2:]
+		}
+
+		if escaped {
+			rel = unescapeSumName(rel)
+		}
+
+		algo, err := algoForSum(sum)
+		if err != nil {
+			return err
+		}
+
+		rv = append(rv, Entry{Algo: algo, Sum: sum, Rel: strings.TrimPrefix(rel, "./")})
+		return nil
+	})
+
+	return rv, err
+}
+
+// unescapeSumName - Undo the escaping of sumLine.
+func unescapeSumName(name string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			i++
+			switch name[i] {
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(name[i])
+			}
+			continue
+		}
+		b.WriteByte(name[i])
+	}
+
+	return b.String()
+}
+
+// readBagManifest - Read a BagIt payload manifest.
+func readBagManifest(fileName string) ([]Entry, error) {
+
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fileName), "manifest-"), ".txt")
+	var algo cardfileutil.HashAlgo
+	switch name {
+	case "sha256":
+		algo = cardfileutil.HashSHA256
+	case "md5":
+		algo = cardfileutil.HashMD5
+	default:
+		return nil, fmt.Errorf("unsupported BagIt manifest %s (sha256 or md5)", fileName)
+	}
+
+	rv := make([]Entry, 0)
+	err := readLines(fileName, func(line string) error {
+
+		sum, rel, found := strings.Cut(line, " ")
+		rel = strings.TrimLeft(rel, " \t")
+		if !found || rel == "" {
+			return fmt.Errorf("can not parse %q", line)
+		}
+
+		rel = strings.NewReplacer("%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n",
+			"%25", "%").Replace(rel)
+		if !strings.HasPrefix(rel, PayloadDir+"/") {
+			return fmt.Errorf("%s is not in the data folder", rel)
+		}
+
+		rv = append(rv, Entry{Algo: algo, Sum: strings.ToLower(sum), Rel: rel})
+		return nil
+	})
+
+	return rv, err
+}
@@ -0,0 +1,446 @@
+package mhl
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// ASC MHL v2 keeps the history of a folder in an ascmhl directory at its
+// root.  Each run that touches the folder adds a generation, which is an
+// XML hash list, and the chain file lists every generation with its C4 ID,
+// so an altered or missing generation can be spotted.
+
+// DirName - Directory that holds the MHL history of a target directory.
+const DirName = "ascmhl"
+
+// ChainFileName - The list of generations, in DirName.
+const ChainFileName = "ascmhl_chain.xml"
+
+// dateFormat - xs:dateTime, which is what MHL uses for every date.
+const dateFormat = time.RFC3339
+
+// ErrNoHistory - The directory has no MHL history to verify against.
+var ErrNoHistory = errors.New("no ASC MHL history")
+
+// ErrUnsupportedHash - MHL has no element for the digest algorithm.  Only
+// xxh64 is shared by cardslurp and MHL.
+var ErrUnsupportedHash = errors.New("hash algorithm not supported by ASC MHL")
+
+// ignorePatterns - Files that are not part of the media, and so are left
+// out of the history.  Patterns without a / match any file or directory
+// name, like the ignore patterns of the ascmhl tool.
+var ignorePatterns = []string{
+	".DS_Store",
+	DirName,
+	DirName + "/",
+	".cardslurp*",
+	"*.cardslurp-tmp",
+	// The checksum manifests and BagIt tag files of -manifests.
+	"SHA256SUMS",
+	"MD5SUMS",
+	"bagit.txt",
+	"bag-info.txt",
+	"manifest-*.txt",
+	"tagmanifest-*.txt",
+}
+
+type hashList struct {
+	XMLName     xml.Name    `xml:"urn:ASC:MHL:v2.0 hashlist"`
+	Version     string      `xml:"version,attr"`
+	CreatorInfo creatorInfo `xml:"creatorinfo"`
+	ProcessInfo processInfo `xml:"processinfo"`
+	Hashes      []hashEntry `xml:"hashes>hash"`
+}
+
+type creatorInfo struct {
+	CreationDate string `xml:"creationdate"`
+	HostName     string `xml:"hostname"`
+	Tool         tool   `xml:"tool"`
+}
+
+type tool struct {
+	Version string `xml:"version,attr"`
+	Name    string `xml:",chardata"`
+}
+
+type processInfo struct {
+	Process string   `xml:"process"`
+	Ignore  []string `xml:"ignore>pattern"`
+}
+
+type hashEntry struct {
+	Path  hashPath   `xml:"path"`
+	XXH64 *hashValue `xml:"xxh64"`
+}
+
+type hashPath struct {
+	Size                 int64  `xml:"size,attr"`
+	LastModificationDate string `xml:"lastmodificationdate,attr,omitempty"`
+	Path                 string `xml:",chardata"`
+}
+
+type hashValue struct {
+	Action   string `xml:"action,attr"`
+	HashDate string `xml:"hashdate,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type chainFile struct {
+	XMLName xml.Name     `xml:"urn:ASC:MHL:DIRECTORY:v2.0 ascmhldirectory"`
+	Lists   []chainEntry `xml:"hashlist"`
+}
+
+type chainEntry struct {
+	SequenceNr int    `xml:"sequencenr,attr"`
+	Path       string `xml:"path"`
+	C4         string `xml:"c4"`
+}
+
+// Generation - The files copied into a target directory by one run.
+// Adds are serialized with the embedded mutex, so the worker goroutines
+// can share one Generation.  Nothing is written until Commit.
+type Generation struct {
+	sync.Mutex
+	root    string
+	chain   chainFile
+	known   map[string]bool
+	entries []hashEntry
+}
+
+// Open - Start a new generation for root, after the ones it already has.
+func Open(root string) (*Generation, error) {
+
+	chain, err := readChain(root)
+	if err != nil && !errors.Is(err, ErrNoHistory) {
+		return nil, err
+	}
+
+	rv := &Generation{
+		root:    root,
+		chain:   chain,
+		known:   make(map[string]bool),
+		entries: make([]hashEntry, 0),
+	}
+
+	for _, ent := range chain.Lists {
+		list, err := readHashList(root, ent.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range list.Hashes {
+			rv.known[h.Path.Path] = true
+		}
+	}
+
+	return rv, nil
+}
+
+// Known - True if an earlier generation, or this one, has fileName.
+func (g *Generation) Known(fileName string) bool {
+
+	rel, err := g.relPath(fileName)
+	if err != nil {
+		return false
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	return g.known[rel]
+}
+
+// Add - Record a file that was copied under root, with the digest the
+// copy was verified against.
+func (g *Generation) Add(fileName string, digest cardfileutil.FileDigest) error {
+
+	if digest.Algo != cardfileutil.HashXXH64 {
+		return fmt.Errorf("error adding %s to the MHL history: %w: %s",
+			fileName, ErrUnsupportedHash, digest.Algo)
+	}
+
+	rel, err := g.relPath(fileName)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return fmt.Errorf("error adding %s to the MHL history: %w", fileName, err)
+	}
+
+	ent := hashEntry{
+		Path: hashPath{
+			Size:                 stat.Size(),
+			LastModificationDate: stat.ModTime().UTC().Format(dateFormat),
+			Path:                 rel,
+		},
+		XXH64: &hashValue{
+			Action:   "original",
+			HashDate: time.Now().UTC().Format(dateFormat),
+			Value:    hex.EncodeToString(digest.Sum),
+		},
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	g.entries = append(g.entries, ent)
+	g.known[rel] = true
+
+	return nil
+}
+
+// Len - Number of files in the generation.
+func (g *Generation) Len() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.entries)
+}
+
+// relPath - fileName relative to root, with forward slashes.
+func (g *Generation) relPath(fileName string) (string, error) {
+
+	rel, err := filepath.Rel(g.root, fileName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under %s", fileName, g.root)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// Commit - Write the generation, and add it to the chain.  A generation
+// without any files is not written.  Returns the name of the generation
+// file, or "" if there was nothing to write.
+func (g *Generation) Commit(now time.Time) (string, error) {
+
+	g.Lock()
+	defer g.Unlock()
+
+	if len(g.entries) == 0 {
+		return "", nil
+	}
+
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown"
+	}
+
+	sort.Slice(g.entries, func(i, j int) bool {
+		return g.entries[i].Path.Path < g.entries[j].Path.Path
+	})
+
+	list := hashList{
+		Version: "2.0",
+		CreatorInfo: creatorInfo{
+			CreationDate: now.UTC().Format(dateFormat),
+			HostName:     hostName,
+			Tool:         tool{Version: toolVersion(), Name: "cardslurp"},
+		},
+		ProcessInfo: processInfo{
+			Process: "transfer",
+			Ignore:  ignorePatterns,
+		},
+		Hashes: g.entries,
+	}
+
+	data, err := marshal(list)
+	if err != nil {
+		return "", err
+	}
+
+	seq := 1
+	for _, ent := range g.chain.Lists {
+		if ent.SequenceNr >= seq {
+			seq = ent.SequenceNr + 1
+		}
+	}
+
+	dir := filepath.Join(g.root, DirName)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error making %s: %w", dir, err)
+	}
+
+	name := fmt.Sprintf("%04d_%s_%s.mhl", seq, filepath.Base(g.root),
+		now.UTC().Format("2006-01-02_150405Z"))
+	err = writeFile(filepath.Join(dir, name), data)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := C4ID(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	chain := g.chain
+	chain.Lists = append(chain.Lists, chainEntry{SequenceNr: seq, Path: name, C4: id})
+	data, err = marshal(chain)
+	if err != nil {
+		return "", err
+	}
+	err = writeFile(filepath.Join(dir, ChainFileName), data)
+	if err != nil {
+		return "", err
+	}
+
+	// Another Commit starts a new generation.
+	g.chain = chain
+	g.entries = make([]hashEntry, 0)
+
+	return filepath.Join(dir, name), nil
+}
+
+// toolVersion - The module version cardslurp was built from.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
+
+func marshal(v any) ([]byte, error) {
+
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling MHL: %w", err)
+	}
+
+	rv := []byte(xml.Header)
+	rv = append(rv, data...)
+	rv = append(rv, '\n')
+
+	return rv, nil
+}
+
+// writeFile - Write data to a temp file, sync it, and rename it into
+// place, so a crash never leaves half a generation or chain.
+func writeFile(fileName string, data []byte) error {
+
+	tempName := fileName + ".tmp"
+	fi, err := os.Create(tempName)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", tempName, err)
+	}
+
+	_, err = fi.Write(data)
+	if err == nil {
+		err = fi.Sync()
+	}
+	closeErr := fi.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", tempName, err)
+	}
+
+	err = os.Rename(tempName, fileName)
+	if err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", tempName, fileName, err)
+	}
+
+	return nil
+}
+
+func readChain(root string) (chainFile, error) {
+
+	fileName := filepath.Join(root, DirName, ChainFileName)
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return chainFile{}, fmt.Errorf("%s: %w", root, ErrNoHistory)
+	}
+	if err != nil {
+		return chainFile{}, fmt.Errorf("error reading %s: %w", fileName, err)
+	}
+
+	var rv chainFile
+	err = xml.Unmarshal(data, &rv)
+	if err != nil {
+		return chainFile{}, fmt.Errorf("error parsing %s: %w", fileName, err)
+	}
+
+	return rv, nil
+}
+
+func readHashList(root string, name string) (hashList, error) {
+
+	fileName := filepath.Join(root, DirName, name)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return hashList{}, fmt.Errorf("error reading %s: %w", fileName, err)
+	}
+
+	var rv hashList
+	err = xml.Unmarshal(data, &rv)
+	if err != nil {
+		return hashList{}, fmt.Errorf("error parsing %s: %w", fileName, err)
+	}
+
+	return rv, nil
+}
+
+// c4Alphabet - The base58 digits of a C4 ID.
+const c4Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// C4ID - The C4 ID of r, which is its SHA-512 in base58, padded to 88
+// digits, after "c4".  The chain file identifies generations by it.
+func C4ID(r io.Reader) (string, error) {
+
+	h := sha512.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("error computing C4 ID: %w", err)
+	}
+
+	n := new(big.Int).SetBytes(h.Sum(nil))
+	base := big.NewInt(58)
+	mod := new(big.Int)
+	digits := make([]byte, 88)
+	for i := len(digits) - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		digits[i] = c4Alphabet[mod.Int64()]
+	}
+
+	return "c4" + string(digits), nil
+}
+
+// ignored - True if rel, or one of its directories, matches an ignore
+// pattern.
+func ignored(rel string, isDir bool) bool {
+
+	segs := strings.Split(rel, "/")
+	for i, seg := range segs {
+		segIsDir := isDir || i < len(segs)-1
+		for _, p := range ignorePatterns {
+			dirOnly := strings.HasSuffix(p, "/")
+			if dirOnly && !segIsDir {
+				continue
+			}
+			ok, _ := path.Match(strings.TrimSuffix(p, "/"), seg)
+			if ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package mhl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+func TestC4ID(t *testing.T) {
+
+	// From the C4 ID specification.
+	id, err := C4ID(strings.NewReader(""))
+	if err != nil {
+		t.Fatal("error computing C4 ID: " + err.Error())
+	}
+	expected := "c459dsjfscH38cYeXXYogktxf4Cd9ibshE3BHUo6a58hBXmRQdZrAkZzsWcbWtDg5oQstpDuni4Hirj75GEmTc1sFT"
+	if id != expected {
+		t.Errorf("C4 ID of nothing is %s, expected %s", id, expected)
+	}
+}
+
+// addFiles - Write each file under root, and add it to gen.
+func addFiles(t *testing.T, gen *Generation, cfu *cardfileutil.CardFileUtil,
+	root string, names ...string) {
+
+	for _, name := range names {
+		fileName := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			t.Fatal("error making dir: " + err.Error())
+		}
+		err = os.WriteFile(fileName, []byte("clip "+name), 0644)
+		if err != nil {
+			t.Fatal("error writing file: " + err.Error())
+		}
+		digest, err := cfu.HashFile(fileName)
+		if err != nil {
+			t.Fatal("error hashing file: " + err.Error())
+		}
+		err = gen.Add(fileName, digest)
+		if err != nil {
+			t.Fatal("error adding file: " + err.Error())
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+
+	root := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashXXH64,
+		cardfileutil.DefaultFileMode)
+
+	_, err := Verify(root, cfu)
+	if !errors.Is(err, ErrNoHistory) {
+		t.Fatalf("expected ErrNoHistory, got %v", err)
+	}
+
+	gen, err := Open(root)
+	if err != nil {
+		t.Fatal("error opening history: " + err.Error())
+	}
+	addFiles(t, gen, cfu, root, "A001/C0001.MP4", "A001/C0002.MP4", "C0003.MP4")
+
+	first, err := gen.Commit(time.Date(2026, 3, 1, 9, 15, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal("error committing generation: " + err.Error())
+	}
+	if filepath.Base(first) != "0001_"+filepath.Base(root)+"_2026-03-01_091500Z.mhl" {
+		t.Errorf("unexpected generation name %s", first)
+	}
+
+	// A second run adds a generation, and knows about the first.
+	gen, err = Open(root)
+	if err != nil {
+		t.Fatal("error opening history: " + err.Error())
+	}
+	if !gen.Known(filepath.Join(root, "A001", "C0001.MP4")) {
+		t.Error("expected the second generation to know the first one's files")
+	}
+	addFiles(t, gen, cfu, root, "C0004.MP4")
+	second, err := gen.Commit(time.Date(2026, 3, 2, 9, 15, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal("error committing generation: " + err.Error())
+	}
+	if !strings.HasPrefix(filepath.Base(second), "0002_") {
+		t.Errorf("unexpected generation name %s", second)
+	}
+
+	// Nothing to add, so nothing is written.
+	empty, err := gen.Commit(time.Now())
+	if err != nil || empty != "" {
+		t.Errorf("expected no generation, got %q, %v", empty, err)
+	}
+
+	// cardslurp's own files are not media.
+	err = os.WriteFile(filepath.Join(root, ".cardslurp-ledger.jsonl"), []byte("{}\n"), 0644)
+	if err != nil {
+		t.Fatal("error writing ledger: " + err.Error())
+	}
+
+	report, err := Verify(root, cfu)
+	if err != nil {
+		t.Fatal("error verifying: " + err.Error())
+	}
+	if !report.OK() || report.Verified != 4 {
+		t.Fatalf("expected 4 verified files, got %+v", report)
+	}
+
+	err = os.WriteFile(filepath.Join(root, "A001", "C0001.MP4"), []byte("clip A001/C0009.MP4"), 0644)
+	if err != nil {
+		t.Fatal("error altering file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(root, "C0003.MP4"), []byte("short"), 0644)
+	if err != nil {
+		t.Fatal("error altering file: " + err.Error())
+	}
+	err = os.Remove(filepath.Join(root, "A001", "C0002.MP4"))
+	if err != nil {
+		t.Fatal("error removing file: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(root, "C0005.MP4"), []byte("clip C0005.MP4"), 0644)
+	if err != nil {
+		t.Fatal("error writing file: " + err.Error())
+	}
+	data, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal("error reading generation: " + err.Error())
+	}
+	err = os.WriteFile(second, append(data, '\n'), 0644)
+	if err != nil {
+		t.Fatal("error altering generation: " + err.Error())
+	}
+
+	report, err = Verify(root, cfu)
+	if err != nil {
+		t.Fatal("error verifying: " + err.Error())
+	}
+	if report.OK() || report.Verified != 1 {
+		t.Errorf("expected 1 verified file, got %+v", report)
+	}
+	if len(report.Altered) != 2 || !strings.HasPrefix(report.Altered[0], "A001/C0001.MP4: xxh64") ||
+		!strings.HasPrefix(report.Altered[1], "C0003.MP4: size") {
+		t.Errorf("unexpected altered files %v", report.Altered)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "A001/C0002.MP4" {
+		t.Errorf("unexpected missing files %v", report.Missing)
+	}
+	if len(report.New) != 1 || report.New[0] != "C0005.MP4" {
+		t.Errorf("unexpected new files %v", report.New)
+	}
+	if len(report.Chain) != 1 || !strings.Contains(report.Chain[0], "altered") {
+		t.Errorf("expected the second generation to be altered, got %v", report.Chain)
+	}
+}
+
+func TestAddUnsupportedHash(t *testing.T) {
+
+	root := t.TempDir()
+	gen, err := Open(root)
+	if err != nil {
+		t.Fatal("error opening history: " + err.Error())
+	}
+
+	err = gen.Add(filepath.Join(root, "C0001.MP4"), cardfileutil.FileDigest{
+		Algo: cardfileutil.HashSHA256,
+		Sum:  make([]byte, 32),
+	})
+	if !errors.Is(err, ErrUnsupportedHash) {
+		t.Errorf("expected ErrUnsupportedHash, got %v", err)
+	}
+}
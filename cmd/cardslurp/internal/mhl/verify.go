@@ -0,0 +1,178 @@
+package mhl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// Hasher - Computes the xxh64 digest of a file.  A CardFileUtil made with
+// HashXXH64 is one.
+type Hasher interface {
+	HashFile(fileName string) (cardfileutil.FileDigest, error)
+}
+
+// Report - What Verify found.  Each list is sorted by path.
+type Report struct {
+	// Verified - Files that still match their history.
+	Verified int
+	// Missing - Files in the history that are gone.
+	Missing []string
+	// Altered - Files whose size or digest changed, with the difference.
+	Altered []string
+	// New - Files that no generation lists.
+	New []string
+	// Chain - Generations that are missing, or do not match their C4 ID
+	// in the chain file.
+	Chain []string
+}
+
+// OK - True if the directory matches its history exactly.
+func (r Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Altered) == 0 && len(r.New) == 0 &&
+		len(r.Chain) == 0
+}
+
+// Verify - Check every file under root against its MHL history.  The last
+// generation to list a file has its expected size and digest.  Returns
+// ErrNoHistory if root has no history.
+func Verify(root string, hasher Hasher) (Report, error) {
+
+	rv := Report{
+		Missing: make([]string, 0),
+		Altered: make([]string, 0),
+		New:     make([]string, 0),
+		Chain:   make([]string, 0),
+	}
+
+	chain, err := readChain(root)
+	if err != nil {
+		return rv, err
+	}
+
+	sort.Slice(chain.Lists, func(i, j int) bool {
+		return chain.Lists[i].SequenceNr < chain.Lists[j].SequenceNr
+	})
+
+	expected := make(map[string]hashEntry)
+	for _, ent := range chain.Lists {
+
+		data, err := os.ReadFile(filepath.Join(root, DirName, ent.Path))
+		if err != nil {
+			rv.Chain = append(rv.Chain, fmt.Sprintf("%s: %s", ent.Path, err.Error()))
+			continue
+		}
+		id, err := C4ID(bytes.NewReader(data))
+		if err != nil {
+			return rv, err
+		}
+		if id != ent.C4 {
+			rv.Chain = append(rv.Chain, fmt.Sprintf(
+				"%s: generation was altered (C4 ID %s, the chain has %s)", ent.Path, id, ent.C4))
+		}
+
+		list, err := readHashList(root, ent.Path)
+		if err != nil {
+			rv.Chain = append(rv.Chain, fmt.Sprintf("%s: %s", ent.Path, err.Error()))
+			continue
+		}
+		for _, h := range list.Hashes {
+			expected[h.Path.Path] = h
+		}
+	}
+
+	err = filepath.WalkDir(root, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileName == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, fileName)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		want, found := expected[rel]
+		if !found {
+			rv.New = append(rv.New, rel)
+			return nil
+		}
+		delete(expected, rel)
+
+		problem, err := checkFile(fileName, want, hasher)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			rv.Altered = append(rv.Altered, rel+": "+problem)
+			return nil
+		}
+		rv.Verified++
+
+		return nil
+	})
+	if err != nil {
+		return rv, fmt.Errorf("error verifying %s: %w", root, err)
+	}
+
+	for rel := range expected {
+		rv.Missing = append(rv.Missing, rel)
+	}
+
+	sort.Strings(rv.Missing)
+	sort.Strings(rv.Altered)
+	sort.Strings(rv.New)
+
+	return rv, nil
+}
+
+// checkFile - How fileName differs from its history, or "" if it does
+// not.
+func checkFile(fileName string, want hashEntry, hasher Hasher) (string, error) {
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return "", fmt.Errorf("error checking %s: %w", fileName, err)
+	}
+	if stat.Size() != want.Path.Size {
+		return fmt.Sprintf("size %d, expected %d", stat.Size(), want.Path.Size), nil
+	}
+
+	if want.XXH64 == nil {
+		return "no xxh64 digest in the history", nil
+	}
+
+	digest, err := hasher.HashFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	if digest.Algo != cardfileutil.HashXXH64 {
+		return "", fmt.Errorf("error checking %s: %w: %s", fileName, ErrUnsupportedHash, digest.Algo)
+	}
+
+	got := hex.EncodeToString(digest.Sum)
+	if got != want.XXH64.Value {
+		return fmt.Sprintf("xxh64 %s, expected %s", got, want.XXH64.Value), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,530 @@
+package scrub
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/manifest"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// Result - What the scrub found for one file.
+type Result string
+
+const (
+	// ResultOK - The file still has every digest recorded for it.
+	ResultOK Result = "ok"
+	// ResultCorrupt - The file is there, but a recorded digest does not
+	// match.  Nothing cardslurp wrote changes a file after the import, so
+	// this is bit rot, or someone edited the file.
+	ResultCorrupt Result = "corrupt"
+	// ResultMissing - A digest was recorded for the file, but it is gone.
+	ResultMissing Result = "missing"
+	// ResultUntracked - The file has no recorded digest to check.
+	ResultUntracked Result = "untracked"
+	// ResultUnreadable - The file could not be read.
+	ResultUnreadable Result = "unreadable"
+)
+
+// Finding - What the scrub found for one file.  One JSON line in the
+// state file.
+type Finding struct {
+	Path   string `json:"path"`
+	Result Result `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// String - path, and the detail if there is one.
+func (f Finding) String() string {
+	if f.Detail == "" {
+		return f.Path
+	}
+	return f.Path + ": " + f.Detail
+}
+
+// Hasher - Computes digests of what a reader returns.
+// cardfileutil.CardFileUtil satisfies this.
+type Hasher interface {
+	HashAll(r io.Reader, algos []cardfileutil.HashAlgo) ([]cardfileutil.FileDigest, error)
+}
+
+// Opts - How to scrub.
+type Opts struct {
+	// Roots - The library directories to scrub.
+	Roots []string
+	// Rate - Bytes read per second, across all files.  0 for no limit.
+	Rate int64
+	// StateFile - Where progress is kept, so an interrupted scrub can
+	// pick up where it stopped.
+	StateFile string
+	// Restart - Start over, even if StateFile has a scrub to resume.
+	Restart bool
+	Hasher  Hasher
+}
+
+// Report - What a scrub found.  Each list is sorted by path, and covers
+// the files an interrupted scrub finished too.
+type Report struct {
+	Verified   int
+	Corrupt    []Finding
+	Missing    []Finding
+	Untracked  []Finding
+	Unreadable []Finding
+	// Resumed - Files the interrupted scrub had already finished.
+	Resumed int
+	// Finished - False if ctx stopped the scrub part way through.  Run
+	// again to pick up where it stopped.
+	Finished bool
+}
+
+// OK - True if nothing is corrupt, missing or unreadable.  Untracked files
+// are only worth a look.
+func (r Report) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.Unreadable) == 0
+}
+
+// recorded - A digest recorded for a file at import time, and where it
+// was found.
+type recorded struct {
+	digest cardfileutil.FileDigest
+	source string
+}
+
+// ledgerTarget - A copied file listed in a ledger, before its path is
+// resolved.
+type ledgerTarget struct {
+	ledgerDir  string
+	targetName string
+	rec        recorded
+}
+
+// library - What the walk of the roots found.
+type library struct {
+	// files - Every file that should have a digest.
+	files map[string]bool
+	// expected - Recorded digests, by absolute path.
+	expected map[string][]recorded
+	ledgers  []ledgerTarget
+}
+
+// Run - Walk the library roots, hash every file again, and compare it to
+// the digests recorded when it was imported: in the ledger of the target
+// directory it was imported into, in any SHA256SUMS, MD5SUMS or BagIt
+// manifest, and in its user.cardslurp.* extended attributes.  Files with
+// no recorded digest are reported as untracked, without reading them.
+//
+// Every finished file is recorded in opts.StateFile.  If ctx is cancelled
+// (or times out), the scrub stops after the current file, and the next
+// Run picks up from there.  A scrub that finishes removes the state file.
+func Run(ctx context.Context, opts Opts) (Report, error) {
+
+	rv := Report{}
+
+	roots := make([]string, 0, len(opts.Roots))
+	for _, root := range opts.Roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return rv, fmt.Errorf("error making %s absolute: %w", root, err)
+		}
+		roots = append(roots, absRoot)
+	}
+
+	lib, err := walkLibrary(roots)
+	if err != nil {
+		return rv, err
+	}
+
+	st, err := openState(opts.StateFile, roots, opts.Restart)
+	if err != nil {
+		return rv, err
+	}
+	rv.Resumed = len(st.done)
+
+	paths := make([]string, 0, len(lib.files)+len(lib.expected))
+	for p := range lib.files {
+		paths = append(paths, p)
+	}
+	for p := range lib.expected {
+		if !lib.files[p] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	t := &throttle{rate: opts.Rate, start: time.Now()}
+	rv.Finished = true
+	for _, p := range paths {
+
+		if _, ok := st.done[p]; ok {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			rv.Finished = false
+			break
+		}
+
+		f := scrubFile(ctx, opts.Hasher, t, p, lib.files[p], lib.expected[p])
+		if ctx.Err() != nil {
+			// Stopped part way through the file, so it is done again
+			// next time.
+			rv.Finished = false
+			break
+		}
+
+		err = st.record(f)
+		if err != nil {
+			_ = st.close(false)
+			return rv, err
+		}
+	}
+
+	err = st.close(rv.Finished)
+	if err != nil {
+		return rv, err
+	}
+
+	rv.add(st.done)
+
+	return rv, nil
+}
+
+// add - Sort findings into the report.
+func (r *Report) add(done map[string]Finding) {
+
+	r.Corrupt = make([]Finding, 0)
+	r.Missing = make([]Finding, 0)
+	r.Untracked = make([]Finding, 0)
+	r.Unreadable = make([]Finding, 0)
+
+	for _, f := range done {
+		switch f.Result {
+		case ResultOK:
+			r.Verified++
+		case ResultCorrupt:
+			r.Corrupt = append(r.Corrupt, f)
+		case ResultMissing:
+			r.Missing = append(r.Missing, f)
+		case ResultUntracked:
+			r.Untracked = append(r.Untracked, f)
+		case ResultUnreadable:
+			r.Unreadable = append(r.Unreadable, f)
+		}
+	}
+
+	for _, l := range [][]Finding{r.Corrupt, r.Missing, r.Untracked, r.Unreadable} {
+		sort.Slice(l, func(i, j int) bool { return l[i].Path < l[j].Path })
+	}
+}
+
+// scrubFile - Check one file against what was recorded for it.
+func scrubFile(ctx context.Context, hasher Hasher, t *throttle, fileName string,
+	exists bool, expected []recorded) Finding {
+
+	rv := Finding{Path: fileName}
+
+	if !exists {
+		rv.Result = ResultMissing
+		rv.Detail = "recorded in " + expected[0].source
+		return rv
+	}
+
+	xattrs, err := cardfileutil.ReadDigestXattrs(fileName)
+	if err != nil {
+		rv.Result = ResultUnreadable
+		rv.Detail = err.Error()
+		return rv
+	}
+	for _, d := range xattrs {
+		expected = addRecorded(expected, recorded{digest: d, source: "xattr"})
+	}
+
+	if len(expected) == 0 {
+		rv.Result = ResultUntracked
+		return rv
+	}
+
+	algos := make([]cardfileutil.HashAlgo, 0)
+	for _, e := range expected {
+		if !containsAlgo(algos, e.digest.Algo) {
+			algos = append(algos, e.digest.Algo)
+		}
+	}
+
+	fi, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Gone since the walk.
+		rv.Result = ResultMissing
+		rv.Detail = "recorded in " + expected[0].source
+		return rv
+	}
+	if err != nil {
+		rv.Result = ResultUnreadable
+		rv.Detail = err.Error()
+		return rv
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	digests, err := hasher.HashAll(&throttledReader{ctx: ctx, r: fi, t: t}, algos)
+	if err != nil {
+		rv.Result = ResultUnreadable
+		rv.Detail = fmt.Sprintf("error hashing: %s", err.Error())
+		return rv
+	}
+
+	bad := make([]string, 0)
+	for _, e := range expected {
+		for _, d := range digests {
+			if d.Algo == e.digest.Algo && !d.Equal(e.digest) {
+				bad = append(bad, fmt.Sprintf("%s %s, expected %s (%s)", d.Algo,
+					hex.EncodeToString(d.Sum), hex.EncodeToString(e.digest.Sum), e.source))
+			}
+		}
+	}
+
+	if len(bad) != 0 {
+		rv.Result = ResultCorrupt
+		rv.Detail = strings.Join(bad, "; ")
+		return rv
+	}
+
+	rv.Result = ResultOK
+	return rv
+}
+
+func containsAlgo(algos []cardfileutil.HashAlgo, algo cardfileutil.HashAlgo) bool {
+	for _, a := range algos {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// addRecorded - Add a recorded digest, unless the same digest is already
+// there.  Different digests for the same algorithm are all kept, since
+// the sources disagreeing is worth reporting.
+func addRecorded(list []recorded, r recorded) []recorded {
+	for _, e := range list {
+		if e.digest.Equal(r.digest) {
+			return list
+		}
+	}
+	return append(list, r)
+}
+
+// walkLibrary - Find the files under roots, and the digests recorded in
+// their ledgers and manifests.  Hidden files and directories are skipped,
+// since that is where cardslurp keeps its own bookkeeping, and so are the
+// manifests and the ASC MHL folder.
+func walkLibrary(roots []string) (*library, error) {
+
+	rv := &library{
+		files:    make(map[string]bool),
+		expected: make(map[string][]recorded),
+		ledgers:  make([]ledgerTarget, 0),
+	}
+
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error walking %s: %w", path, err)
+			}
+
+			name := d.Name()
+			if path == root {
+				return nil
+			}
+
+			if d.IsDir() {
+				if strings.HasPrefix(name, ".") || name == mhl.DirName {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			switch {
+			case name == ledger.FileName:
+				return rv.readLedger(path)
+			case manifest.IsManifestName(name):
+				return rv.readManifest(path)
+			case strings.HasPrefix(name, ".") || isTagFile(name):
+				return nil
+			}
+
+			if d.Type().IsRegular() {
+				rv.files[path] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error walking library root %s: %w", root, err)
+		}
+	}
+
+	// The targets in a ledger are resolved once every file is known,
+	// since the library may have moved since the import.
+	for _, lt := range rv.ledgers {
+		path := rv.resolveTarget(lt.ledgerDir, lt.targetName)
+		rv.expected[path] = addRecorded(rv.expected[path], lt.rec)
+	}
+
+	return rv, nil
+}
+
+// isTagFile - BagIt files that are not payload.
+func isTagFile(name string) bool {
+	return name == "bagit.txt" || name == "bag-info.txt" ||
+		(strings.HasPrefix(name, "tagmanifest-") && strings.HasSuffix(name, ".txt"))
+}
+
+// readLedger - Collect the digests of the files a ledger says were copied.
+func (l *library) readLedger(fileName string) error {
+
+	recs, err := ledger.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		if rec.Status != ledger.StatusCopied || rec.Digest == "" {
+			continue
+		}
+		digest, err := cardfileutil.ParseFileDigest(rec.Digest)
+		if err != nil {
+			fmt.Printf("Skipping digest of %s in ledger %s: %s\n", rec.TargetName,
+				fileName, err.Error())
+			continue
+		}
+		l.ledgers = append(l.ledgers, ledgerTarget{
+			ledgerDir:  filepath.Dir(fileName),
+			targetName: rec.TargetName,
+			rec:        recorded{digest: digest, source: "ledger"},
+		})
+	}
+
+	return nil
+}
+
+// readManifest - Collect the digests listed in a checksum manifest.
+func (l *library) readManifest(fileName string) error {
+
+	entries, err := manifest.Read(fileName)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fileName)
+	source := filepath.Base(fileName)
+	for _, ent := range entries {
+		sum, err := hex.DecodeString(ent.Sum)
+		if err != nil {
+			return fmt.Errorf("error decoding digest of %s in %s: %w", ent.Rel, fileName, err)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(ent.Rel))
+		l.expected[path] = addRecorded(l.expected[path], recorded{
+			digest: cardfileutil.FileDigest{Algo: ent.Algo, Sum: sum},
+			source: source,
+		})
+	}
+
+	return nil
+}
+
+// resolveTarget - Where a file a ledger lists is now.  The ledger sits in
+// the directory the file was imported into, but the target name is the
+// path at import time, which no longer leads there if the library was
+// moved or mounted somewhere else.  So, if the recorded path is not under
+// the ledger's directory, the longest trailing part of it that names a
+// file under the directory is used.  A file that can not be found is
+// reported under its recorded name.
+func (l *library) resolveTarget(ledgerDir string, targetName string) string {
+
+	if filepath.IsAbs(targetName) {
+		rel, err := filepath.Rel(ledgerDir, targetName)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Clean(targetName)
+		}
+	}
+
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(targetName)), "/")
+	for i := range parts {
+		candidate := filepath.Join(ledgerDir, filepath.FromSlash(strings.Join(parts[i:], "/")))
+		if l.files[candidate] {
+			return candidate
+		}
+	}
+
+	return targetName
+}
+
+// throttle - Paces reads to a number of bytes per second, across every
+// file in the scrub, so it can run next to other work on a NAS.
+type throttle struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+// wait - Account for n bytes, and sleep until reading them fits the rate.
+func (t *throttle) wait(ctx context.Context, n int) error {
+
+	if t.rate <= 0 {
+		return nil
+	}
+
+	t.read += int64(n)
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader - Reads at the pace of a throttle, and stops when ctx
+// is done.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		werr := r.t.wait(r.ctx, n)
+		if werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
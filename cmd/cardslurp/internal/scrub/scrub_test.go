@@ -0,0 +1,280 @@
+package scrub
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// writeLibrary - A library with a ledger written where the target
+// directory used to be mounted, a SHA256SUMS manifest, and a file nothing
+// knows about.
+func writeLibrary(t *testing.T) string {
+
+	root := t.TempDir()
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+
+	writeFile := func(name string, data string) cardfileutil.FileDigest {
+		fileName := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			t.Fatal("error making dir: " + err.Error())
+		}
+		err = os.WriteFile(fileName, []byte(data), 0644)
+		if err != nil {
+			t.Fatal("error writing file: " + err.Error())
+		}
+		digest, err := cfu.HashFile(fileName)
+		if err != nil {
+			t.Fatal("error hashing file: " + err.Error())
+		}
+		return digest
+	}
+
+	// Imported to /Volumes/ssd/shoot, then moved to the library.
+	err := os.MkdirAll(filepath.Join(root, "shoot"), 0755)
+	if err != nil {
+		t.Fatal("error making dir: " + err.Error())
+	}
+	imp, err := ledger.Open(filepath.Join(root, "shoot"), "test-session")
+	if err != nil {
+		t.Fatal("error opening ledger: " + err.Error())
+	}
+	for _, name := range []string{"2026/IMG_0001.CR3", "2026/IMG_0002.CR3", "2026/IMG_0003.CR3"} {
+		digest := writeFile("shoot/"+name, "image "+name)
+		err = imp.Append(ledger.Record{
+			Status:     ledger.StatusCopied,
+			TargetName: "/Volumes/ssd/shoot/" + name,
+			Digest:     digest.String(),
+		})
+		if err != nil {
+			t.Fatal("error appending to ledger: " + err.Error())
+		}
+	}
+	err = imp.Close()
+	if err != nil {
+		t.Fatal("error closing ledger: " + err.Error())
+	}
+
+	digest := writeFile("archive/C0001.MP4", "clip C0001")
+	err = os.WriteFile(filepath.Join(root, "archive", "SHA256SUMS"),
+		[]byte(strings.TrimPrefix(digest.String(), "sha256:")+"  C0001.MP4\n"), 0644)
+	if err != nil {
+		t.Fatal("error writing manifest: " + err.Error())
+	}
+
+	writeFile("notes.txt", "not imported")
+
+	return root
+}
+
+func TestScrub(t *testing.T) {
+
+	root := writeLibrary(t)
+	stateFile := filepath.Join(root, DefaultStateName)
+	cfu := cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+		cardfileutil.DefaultFileMode)
+	opts := Opts{Roots: []string{root}, StateFile: stateFile, Hasher: cfu}
+
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if !report.OK() || !report.Finished || report.Verified != 4 || len(report.Untracked) != 1 {
+		t.Fatalf("expected 4 verified and 1 untracked file, got %+v", report)
+	}
+
+	// Bit rot, and a lost file.
+	err = os.WriteFile(filepath.Join(root, "shoot", "2026", "IMG_0001.CR3"),
+		[]byte("image 2026/IMG_0009.CR3"), 0644)
+	if err != nil {
+		t.Fatal("error altering file: " + err.Error())
+	}
+	err = os.Remove(filepath.Join(root, "archive", "C0001.MP4"))
+	if err != nil {
+		t.Fatal("error removing file: " + err.Error())
+	}
+
+	report, err = Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if report.OK() || report.Verified != 2 {
+		t.Errorf("expected 2 verified files, got %+v", report)
+	}
+	if len(report.Corrupt) != 1 ||
+		report.Corrupt[0].Path != filepath.Join(root, "shoot", "2026", "IMG_0001.CR3") ||
+		!strings.Contains(report.Corrupt[0].Detail, "(ledger)") {
+		t.Errorf("unexpected corrupt files %v", report.Corrupt)
+	}
+	if len(report.Missing) != 1 ||
+		report.Missing[0].Path != filepath.Join(root, "archive", "C0001.MP4") {
+		t.Errorf("unexpected missing files %v", report.Missing)
+	}
+
+	_, err = os.Stat(stateFile)
+	if err == nil {
+		t.Error("finished scrub left its state file")
+	}
+}
+
+// cancelAfterHash - Stops the scrub after it hashes a number of files,
+// like a Ctrl-C part way through.
+type cancelAfterHash struct {
+	*cardfileutil.CardFileUtil
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	left   int
+	hashed int
+}
+
+func (c *cancelAfterHash) HashAll(r io.Reader, algos []cardfileutil.HashAlgo) ([]cardfileutil.FileDigest, error) {
+	c.mu.Lock()
+	c.hashed++
+	c.left--
+	if c.left == 0 && c.cancel != nil {
+		c.cancel()
+	}
+	c.mu.Unlock()
+	return c.CardFileUtil.HashAll(r, algos)
+}
+
+func TestScrubResume(t *testing.T) {
+
+	root := writeLibrary(t)
+	stateFile := filepath.Join(t.TempDir(), "scrub.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hasher := &cancelAfterHash{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+		cancel: cancel,
+		left:   2,
+	}
+	opts := Opts{Roots: []string{root}, StateFile: stateFile, Hasher: hasher}
+
+	report, err := Run(ctx, opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if report.Finished {
+		t.Fatal("expected the scrub to stop part way through")
+	}
+	_, err = os.Stat(stateFile)
+	if err != nil {
+		t.Fatal("interrupted scrub did not keep its state file: " + err.Error())
+	}
+
+	hasher.cancel = nil
+	hasher.hashed = 0
+	report, err = Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if !report.Finished || report.Resumed == 0 || report.Verified != 4 || len(report.Untracked) != 1 {
+		t.Errorf("expected the resumed scrub to cover the whole library, got %+v", report)
+	}
+	// The file being hashed when the scrub stopped is done again, but not
+	// the ones before it.
+	if hasher.hashed != 3 {
+		t.Errorf("resumed scrub hashed %d files, expected 3", hasher.hashed)
+	}
+
+	// Restart ignores what an unfinished scrub did.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hasher.cancel = cancel
+	hasher.left = 1
+	_, err = Run(ctx, opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	hasher.cancel = nil
+	hasher.hashed = 0
+	opts.Restart = true
+	report, err = Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if report.Resumed != 0 || hasher.hashed != 4 {
+		t.Errorf("expected a restarted scrub to hash all 4 files, got %d (%+v)", hasher.hashed, report)
+	}
+}
+
+// TestScrubResumeTornState - A scrub that died part way through writing a
+// line resumes without losing the lines it writes after it.
+func TestScrubResumeTornState(t *testing.T) {
+
+	root := writeLibrary(t)
+	stateFile := filepath.Join(t.TempDir(), "scrub.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hasher := &cancelAfterHash{
+		CardFileUtil: cardfileutil.NewCardFileUtil(16384, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+		cancel: cancel,
+		left:   2,
+	}
+	opts := Opts{Roots: []string{root}, StateFile: stateFile, Hasher: hasher}
+
+	_, err := Run(ctx, opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+
+	fi, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("error opening state file: " + err.Error())
+	}
+	_, err = fi.WriteString(`{"path":"` + root)
+	if err != nil {
+		t.Fatal("error writing state file: " + err.Error())
+	}
+	err = fi.Close()
+	if err != nil {
+		t.Fatal("error closing state file: " + err.Error())
+	}
+
+	// Stopped again, after one more file.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hasher.cancel = cancel
+	hasher.left = 2
+	_, err = Run(ctx, opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+
+	_, done, _, err := readState(stateFile)
+	if err != nil {
+		t.Fatal("error reading state file: " + err.Error())
+	}
+	// One file from before the torn line, and two from after it, one of
+	// which is the untracked file.
+	if len(done) != 3 {
+		t.Errorf("expected 3 files in the state, got %d", len(done))
+	}
+
+	hasher.cancel = nil
+	hasher.hashed = 0
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal("error scrubbing: " + err.Error())
+	}
+	if !report.Finished || report.Verified != 4 {
+		t.Errorf("expected the resumed scrub to cover the whole library, got %+v", report)
+	}
+	if hasher.hashed != 2 {
+		t.Errorf("resumed scrub hashed %d files, expected 2", hasher.hashed)
+	}
+}
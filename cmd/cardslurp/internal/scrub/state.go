@@ -0,0 +1,195 @@
+package scrub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+)
+
+// DefaultStateName - Name of the state file, when it is kept in the first
+// library root.  It is hidden, like the ledger.
+const DefaultStateName = ".cardslurp-scrub.jsonl"
+
+// header - The first line of the state file.  A state file for other
+// roots is not resumed.
+type header struct {
+	Roots     []string  `json:"roots"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// state - Append only record of the files a scrub has finished with.
+// Every line is synced before the next file is read, so an interrupted
+// scrub picks up after the last file it finished.
+type state struct {
+	fi       *os.File
+	fileName string
+	hdr      header
+	// done - Findings of the interrupted scrub, and of this one.
+	done map[string]Finding
+}
+
+// openState - Resume the scrub of roots in fileName, or start a new one
+// if there is nothing to resume, the state is for other roots, or restart
+// is set.
+func openState(fileName string, roots []string, restart bool) (*state, error) {
+
+	rv := &state{
+		fileName: fileName,
+		done:     make(map[string]Finding),
+	}
+
+	if !restart {
+		hdr, done, complete, err := readState(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if hdr != nil && slices.Equal(hdr.Roots, roots) {
+			rv.hdr = *hdr
+			rv.done = done
+			rv.fi, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("error opening scrub state %s: %w", fileName, err)
+			}
+			// Cut off a torn last line, so the next line does not get
+			// glued onto it.
+			err = rv.fi.Truncate(complete)
+			if err != nil {
+				_ = rv.fi.Close()
+				return nil, fmt.Errorf("error truncating scrub state %s: %w", fileName, err)
+			}
+			return rv, nil
+		}
+		if hdr != nil {
+			fmt.Printf("Note: %s is for a scrub of other roots, starting over\n", fileName)
+		}
+	}
+
+	rv.hdr = header{Roots: roots, StartedAt: time.Now().UTC()}
+	line, err := json.Marshal(rv.hdr)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling scrub state: %w", err)
+	}
+
+	rv.fi, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating scrub state %s: %w", fileName, err)
+	}
+	err = rv.write(append(line, '\n'))
+	if err != nil {
+		_ = rv.fi.Close()
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// readState - The header and findings in a state file, or a nil header
+// if there is none.  A last line without a newline is the tail of an
+// interrupted write, and is skipped, and so is a line that does not
+// parse.  complete is the length of the file up to the end of the last
+// whole line.
+func readState(fileName string) (*header, map[string]Finding, int64, error) {
+
+	fi, err := os.Open(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error opening scrub state %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	var hdr *header
+	var complete int64
+	done := make(map[string]Finding)
+	reader := bufio.NewReader(fi)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("error reading scrub state %s: %w", fileName, err)
+		}
+		complete += int64(len(line))
+
+		if hdr == nil {
+			var h header
+			err = json.Unmarshal(line, &h)
+			if err != nil || len(h.Roots) == 0 {
+				return nil, nil, 0, nil
+			}
+			hdr = &h
+			continue
+		}
+		var f Finding
+		err = json.Unmarshal(line, &f)
+		if err != nil || f.Path == "" {
+			continue
+		}
+		done[f.Path] = f
+	}
+
+	return hdr, done, complete, nil
+}
+
+func (s *state) write(line []byte) error {
+
+	// A single write per line, so a crash can at worst leave a truncated
+	// last line.
+	_, err := s.fi.Write(line)
+	if err != nil {
+		return fmt.Errorf("error writing scrub state %s: %w", s.fileName, err)
+	}
+
+	err = s.fi.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing scrub state %s: %w", s.fileName, err)
+	}
+
+	return nil
+}
+
+// record - Write one finding, and fsync it before returning.
+func (s *state) record(f Finding) error {
+
+	line, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("error marshaling scrub finding: %w", err)
+	}
+
+	err = s.write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	s.done[f.Path] = f
+
+	return nil
+}
+
+// close - Close the state file.  A finished scrub has nothing to resume,
+// so its state file is removed.
+func (s *state) close(finished bool) error {
+
+	err := s.fi.Close()
+	if err != nil {
+		return fmt.Errorf("error closing scrub state %s: %w", s.fileName, err)
+	}
+
+	if finished {
+		err = os.Remove(s.fileName)
+		if err != nil {
+			return fmt.Errorf("error removing scrub state %s: %w", s.fileName, err)
+		}
+	}
+
+	return nil
+}
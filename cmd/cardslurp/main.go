@@ -1,17 +1,49 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/filecontrol"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/journal"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/ledger"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/libindex"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/manifest"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
 	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		os.Exit(runScrub(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "resume" {
+		opts, sess, err := GetResumeOpts(os.Args[2:])
+		if err != nil {
+			panic("error processing command line arguments: " + err.Error())
+		}
+		os.Exit(runImport(opts, &sess))
+	}
+
 	// Get command line options.
 	opts, err := GetOpts()
 	if err != nil {
@@ -19,31 +51,409 @@ func main() {
 		panic("error processing command line arguments: " + err.Error())
 	}
 
-	cfu := cardfileutil.NewCardFileUtil(opts.VerifyChunkSize, opts.VerifyPasses)
+	if opts.DryRun {
+		os.Exit(runDryRun(opts))
+	}
+
+	os.Exit(runImport(opts, nil))
+}
+
+// runDryRun - List what the discovery filter keeps and drops on each card,
+// and why, without copying anything or writing to the target.
+func runDryRun(opts CmdOpts) int {
+
+	filter, err := filecontrol.NewFilter(opts.Filter)
+	if err != nil {
+		panic("error making discovery filter: " + err.Error())
+	}
+
+	for _, card := range opts.MountList {
+		err = filecontrol.ListCard(card, filter, os.Stdout)
+		if err != nil {
+			panic("error listing card: " + err.Error())
+		}
+	}
+
+	return exitOK
+}
+
+// Exit codes, so a wrapper script can tell what kind of failure happened.
+// Bad options and setup errors panic, which exits with 2.
+const (
+	exitOK          = 0
+	exitSourceRead  = 3
+	exitTargetWrite = 4
+	exitVerify      = 5
+	exitNaming      = 6
+	exitDiscovery   = 7
+	// exitMixed - Files failed for more than one reason.
+	exitMixed       = 8
+	exitInterrupted = 130
+)
+
+var categoryExit = map[filecontrol.ErrorCategory]int{
+	filecontrol.CategorySourceRead:  exitSourceRead,
+	filecontrol.CategoryTargetWrite: exitTargetWrite,
+	filecontrol.CategoryVerify:      exitVerify,
+	filecontrol.CategoryNaming:      exitNaming,
+	filecontrol.CategoryDiscovery:   exitDiscovery,
+}
+
+// exitCode - Exit code for the results of a run.  Failed files win over an
+// interrupt, because they need looking at.  Unreadable paths on a card
+// count as discovery failures, since their files were never found.
+func exitCode(res filecontrol.WorkerPoolFinishMsg) int {
+
+	codes := make(map[int]bool)
+	for _, f := range res.Failed {
+		codes[categoryExit[f.Category]] = true
+	}
+	if len(res.SkippedPaths) != 0 {
+		codes[exitDiscovery] = true
+	}
+
+	switch {
+	case len(codes) > 1:
+		return exitMixed
+	case len(codes) == 1:
+		for code := range codes {
+			return code
+		}
+	case res.Interrupted:
+		return exitInterrupted
+	}
+
+	return exitOK
+}
+
+// runImport - Import the cards in opts, and return the exit code.  If
+// resume is not nil, it is the interrupted session to continue, and opts
+// came from its journal.
+func runImport(opts CmdOpts, resume *journal.Session) int {
+
+	cfu := cardfileutil.NewCardFileUtil(opts.VerifyChunkSize, opts.VerifyPasses,
+		opts.HashAlgo, opts.FileMode)
+	cfu.SetRangedCopy(cardfileutil.RangedCopyOpts{
+		Threshold: opts.RangeThreshold << 20,
+		RangeSize: opts.RangeSize << 20,
+		Workers:   opts.RangeWorkers,
+		Retries:   opts.MaxRetries,
+	})
+	extras := manifest.Algos(opts.Manifests)
+	if opts.MHL {
+		// ASC MHL only takes xxh64, whatever -hash is.
+		extras = append(extras, cardfileutil.HashXXH64)
+	}
+	cfu.SetExtraDigests(extras...)
+	cfu.SetDigestXattr(opts.DigestXattr)
+	cfu.SetTargetTimeout(opts.TargetTimeout)
+
+	// The first Ctrl-C (or SIGTERM) rolls back the copies in flight, and
+	// ends the run with a summary.  After that, the default handler is
+	// back, so a second Ctrl-C quits right away.
+	ctx, stopSignals := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+
+	// Read what earlier runs imported, so an interrupted import only
+	// copies what it did not get to.
+	prior, err := ledger.ReadDir(opts.TargetDir)
+	if err != nil {
+		panic("error reading import ledger: " + err.Error())
+	}
+
+	var sessionID string
+	var jrnl *journal.Journal
+	var progress *journal.Progress
+
+	if resume != nil {
+		sessionID = resume.SessionID
+		_, progress, err = journal.Load(resume.FileName())
+		if err != nil {
+			panic("error loading journal: " + err.Error())
+		}
+		jrnl, err = journal.Reopen(*resume)
+		if err != nil {
+			panic("error opening journal: " + err.Error())
+		}
+		counts := progress.Count()
+		fmt.Printf("Resuming session %s (verified: %d - copied: %d - in progress: %d - planned: %d)\n",
+			sessionID, counts[journal.StateVerified], counts[journal.StateCopied],
+			counts[journal.StateInProgress], counts[journal.StatePlanned])
+	} else {
+		unfinished, err := journal.List(opts.TargetDir)
+		if err != nil {
+			panic("error listing journals: " + err.Error())
+		}
+		for _, sess := range unfinished {
+			fmt.Printf("Note: session %s did not finish.  \"cardslurp resume\" can pick it up.\n",
+				sess.SessionID)
+		}
+
+		sessionID, err = ledger.NewSessionID()
+		if err != nil {
+			panic("error making import session id: " + err.Error())
+		}
+	}
+	defer func() {
+		// A new session has no journal if the setup below failed.
+		if jrnl == nil {
+			return
+		}
+		err := jrnl.Close()
+		if err != nil {
+			fmt.Printf("error closing journal: %s\n", err.Error())
+		}
+	}()
+
+	importLedger, err := ledger.Open(opts.TargetDir, sessionID)
+	if err != nil {
+		// No point in continuing without a record of what we import.
+		panic("error opening import ledger: " + err.Error())
+	}
+	defer func() {
+		err := importLedger.Close()
+		if err != nil {
+			fmt.Printf("error closing import ledger: %s\n", err.Error())
+		}
+	}()
+
+	var history *mhl.Generation
+	if opts.MHL {
+		history, err = mhl.Open(opts.TargetDir)
+		if err != nil {
+			panic("error opening ASC MHL history: " + err.Error())
+		}
+	}
 
+	var manifests *manifest.Writer
+	if len(opts.Manifests) != 0 {
+		manifests, err = manifest.Open(opts.TargetDir, opts.Manifests)
+		if err != nil {
+			panic("error opening checksum manifests: " + err.Error())
+		}
+		defer func() {
+			err := manifests.Close()
+			if err != nil {
+				fmt.Printf("error closing checksum manifests: %s\n", err.Error())
+			}
+		}()
+	}
+
+	filter, err := filecontrol.NewFilter(opts.Filter)
+	if err != nil {
+		panic("error making discovery filter: " + err.Error())
+	}
+
+	poolOpts := filecontrol.WorkerPoolOpts{
+		ImportLedger:  importLedger,
+		DeviceWorkers: opts.DeviceWorkers,
+		Adaptive:      opts.Adaptive,
+		Imported:      ledger.NewImported(prior),
+		Journal:       jrnl,
+		Resume:        progress,
+		ErrorPolicy: filecontrol.ErrorPolicy{
+			Mode:   opts.OnError,
+			Budget: opts.ErrorBudget,
+		},
+		CardTimeout: opts.CardTimeout,
+		Filter:      filter,
+		History:     history,
+		Manifests:   manifests,
+	}
+
+	if progress != nil {
+		// This has to come before the name oracle, which cleans up the
+		// temp files that hold the copies to recover.
+		recovered, err := filecontrol.RecoverSession(ctx, cfu, poolOpts)
+		if err != nil {
+			panic("error recovering session: " + err.Error())
+		}
+		fmt.Printf("Recovered %d copies from the journal\n", recovered)
+	}
+
+	// A bag keeps the copies in its data folder.
 	nameOracle, err := filecontrol.NewTargetNameGenManager(
-		opts.TargetDir, cfu)
+		manifest.PayloadRoot(opts.TargetDir, opts.Manifests), opts.Layout, opts.Rename, cfu)
 	if err != nil {
 		// No point in continuing
 		panic("error making target name oracle: " + err.Error())
 	}
 
+	// Each mirror keeps its own records, so it can be checked, and
+	// imported into again, by itself.  Only the first target has the
+	// journal.
+	mirrorHistories := make([]*mhl.Generation, 0, len(opts.Mirrors))
+	for _, dir := range opts.Mirrors {
+
+		mirrorPrior, err := ledger.ReadDir(dir)
+		if err != nil {
+			panic("error reading import ledger of mirror: " + err.Error())
+		}
+
+		mirror := filecontrol.ImportTarget{Imported: ledger.NewImported(mirrorPrior)}
+
+		mirrorLedger, err := ledger.Open(dir, sessionID)
+		if err != nil {
+			panic("error opening import ledger of mirror: " + err.Error())
+		}
+		mirror.ImportLedger = mirrorLedger
+		defer func() {
+			err := mirrorLedger.Close()
+			if err != nil {
+				fmt.Printf("error closing import ledger: %s\n", err.Error())
+			}
+		}()
+
+		if opts.MHL {
+			mirror.History, err = mhl.Open(dir)
+			if err != nil {
+				panic("error opening ASC MHL history of mirror: " + err.Error())
+			}
+			mirrorHistories = append(mirrorHistories, mirror.History)
+		}
+
+		if len(opts.Manifests) != 0 {
+			mirrorManifests, err := manifest.Open(dir, opts.Manifests)
+			if err != nil {
+				panic("error opening checksum manifests of mirror: " + err.Error())
+			}
+			mirror.Manifests = mirrorManifests
+			defer func() {
+				err := mirrorManifests.Close()
+				if err != nil {
+					fmt.Printf("error closing checksum manifests: %s\n", err.Error())
+				}
+			}()
+		}
+
+		// After the manifests, which make the data folder of a bag.
+		mirror.NameOracle, err = filecontrol.NewTargetNameGenManager(
+			manifest.PayloadRoot(dir, opts.Manifests), opts.Layout, opts.Rename, cfu)
+		if err != nil {
+			panic("error making target name oracle for mirror: " + err.Error())
+		}
+
+		poolOpts.Mirrors = append(poolOpts.Mirrors, mirror)
+	}
+
+	if len(opts.LibraryRoots) != 0 {
+		libIndex, err := libindex.Load(opts.LibraryIndex, opts.HashAlgo, cfu)
+		if err != nil {
+			panic("error loading library index: " + err.Error())
+		}
+
+		fmt.Printf("Updating library index: %s\n", opts.LibraryIndex)
+		stats, err := libIndex.Update(opts.LibraryRoots)
+		if err != nil {
+			panic("error updating library index: " + err.Error())
+		}
+		fmt.Printf("Library index has %d files (hashed: %d - reused: %d - removed: %d)\n",
+			libIndex.Len(), stats.Hashed, stats.Reused, stats.Removed)
+
+		poolOpts.LibraryIndex = libIndex
+		defer func() {
+			err := libIndex.Save()
+			if err != nil {
+				fmt.Printf("error saving library index: %s\n", err.Error())
+			}
+		}()
+	}
+
+	// The journal of a new session is only created once everything else is
+	// set up, so a setup error does not leave an unfinished session for
+	// resume to pick up.
+	if jrnl == nil {
+		jrnl, err = journal.Create(opts.TargetDir, sessionID, opts)
+		if err != nil {
+			panic("error creating journal: " + err.Error())
+		}
+		poolOpts.Journal = jrnl
+	}
+
 	workerPool := filecontrol.NewWorkerPool(opts.WorkerPool, nameOracle,
-		opts.DebugMode, cfu, opts.MaxRetries)
+		opts.DebugMode, cfu, opts.MaxRetries, poolOpts)
 
-	err = filecontrol.OrchestrateLocate(opts.MountList, workerPool, opts.DebugMode)
+	err = filecontrol.OrchestrateLocate(ctx, opts.MountList, workerPool, opts.DebugMode)
 	if err != nil {
 		// No point in continuing
 		panic("error recursing card directories: " + err.Error())
 	}
 
-	finalResults, err := workerPool.ParallelFileCopy()
-	if err != nil {
-		panic("major error during parallel file copy: " + err.Error())
+	finalResults, copyErr := workerPool.ParallelFileCopy(ctx)
+	if copyErr != nil && len(finalResults.Failed) == 0 {
+		panic("major error during parallel file copy: " + copyErr.Error())
+	}
+
+	fmt.Printf("Groups: %d - Skipped: %d - Copied: %d - Failed: %d - Retries: %d\n",
+		finalResults.Groups, finalResults.Skipped, finalResults.Copied,
+		len(finalResults.Failed), finalResults.Retries)
+	if len(finalResults.Targets) > 1 {
+		for _, t := range finalResults.Targets {
+			fmt.Printf("Target %s - Copied: %d - Skipped: %d - Failed: %d\n",
+				t.Dir, t.Copied, t.Skipped, t.Failed)
+		}
+	}
+	fmt.Printf("Import session: %s (copied and skipped files are listed in %s)\n",
+		sessionID, ledger.FileName)
+
+	// Whatever was copied goes into the history, even if the run did not
+	// finish.  If this fails, the journal is kept, and resume adds the
+	// files instead.
+	var historyErr error
+	if history != nil {
+		for _, h := range append([]*mhl.Generation{history}, mirrorHistories...) {
+			mhlName, err := h.Commit(time.Now())
+			if err != nil {
+				historyErr = err
+				fmt.Printf("error writing ASC MHL history: %s\n", err.Error())
+			} else if mhlName != "" {
+				fmt.Printf("ASC MHL generation: %s\n", mhlName)
+			}
+		}
 	}
 
-	fmt.Printf("Skipped: %d - Copied: %d - Retries: %d\n",
-		finalResults.Skipped, finalResults.Copied, finalResults.Retries)
+	if len(finalResults.Failed) != 0 {
+		fmt.Printf("*** FAILED FILES ***\n")
+		for _, f := range finalResults.Failed {
+			fmt.Printf("%s: %s: %s\n", f.Category, f.File, f.Err.Error())
+		}
+	}
+
+	if len(finalResults.SkippedPaths) != 0 {
+		fmt.Printf("*** SKIPPED UNREADABLE PATHS ***\n")
+		for _, p := range finalResults.SkippedPaths {
+			fmt.Printf("%s\n", p)
+		}
+	}
+
+	if copyErr != nil {
+		fmt.Printf("*** STOPPED ***\n")
+		fmt.Printf("%s\n", copyErr.Error())
+	}
+
+	if finalResults.Interrupted || copyErr != nil || len(finalResults.Failed) != 0 ||
+		len(finalResults.SkippedPaths) != 0 || historyErr != nil {
+		if finalResults.Interrupted {
+			fmt.Printf("*** INTERRUPTED ***\n")
+		}
+		fmt.Printf("Files found but not copied: %d\n", finalResults.Remaining)
+		for _, card := range finalResults.UnfinishedCards {
+			fmt.Printf("Not completely searched: %s\n", card)
+		}
+		fmt.Printf("Run the same command again, or resume with:\n")
+		fmt.Printf("  cardslurp resume -targetdir=%q\n", opts.TargetDir)
+	} else {
+		// Every file is in the ledger, so the journal is done.
+		err = jrnl.Finish()
+		if err != nil {
+			fmt.Printf("error removing journal: %s\n", err.Error())
+		}
+	}
 
 	if len(finalResults.MinorErrs) == 0 {
 		fmt.Printf("(No errors.)\n")
@@ -54,36 +464,104 @@ func main() {
 			fmt.Printf("%s\n", finalResults.MinorErrs[y])
 		}
 	}
+
+	if historyErr != nil && exitCode(finalResults) == exitOK {
+		return exitTargetWrite
+	}
+
+	return exitCode(finalResults)
 }
 
 // CmdOpts - All of the options provided from the command line.
 type CmdOpts struct {
-	TargetDir       string
+	TargetDir string
+	// Mirrors - More target directories, which every file is copied to
+	// as well.
+	Mirrors         []string
 	MountList       []string
 	DebugMode       bool
 	WorkerPool      uint64
+	DeviceWorkers   uint64
+	Adaptive        bool
 	MaxRetries      uint64
 	VerifyPasses    uint64
 	VerifyChunkSize uint64
+	RangeThreshold  uint64
+	RangeSize       uint64
+	RangeWorkers    uint64
+	OnError         filecontrol.ErrorMode
+	ErrorBudget     uint64
+	CardTimeout     time.Duration
+	// TargetTimeout - How long a mirrored target may stall before it is
+	// dropped from the copy of a file.
+	TargetTimeout time.Duration
+	HashAlgo      cardfileutil.HashAlgo
+	FileMode      os.FileMode
+	LibraryRoots  []string
+	LibraryIndex  string
+	Layout        string
+	Rename        string
+	// Filter - Which files on the cards are imported.
+	Filter filecontrol.FilterOpts
+	DryRun bool
+	// MHL - Add a generation to the ASC MHL history of TargetDir.
+	MHL bool
+	// Manifests - Checksum manifests to write in TargetDir.
+	Manifests []manifest.Format
+	// DigestXattr - Record each copy's digest in an xattr on the copy.
+	DigestXattr bool
 }
 
 // GetOpts - Return the command line arguments in a CmdOpts struct
 func GetOpts() (CmdOpts, error) {
 
-	targetDir := flag.String("targetdir", "", "Target directory for the copied files.")
+	targetDir := flag.String("targetdir", "", "Target directory for the copied files.  A comma delimited list copies every file to each of them, reading the card once.")
 	mountListStr := flag.String("mountlist", "", "Comma delimited list of mounted cards.")
 	debugMode := flag.Bool("debugMode", false, "Print extra debug information.")
 	maxRetries := flag.Uint64("maxretries", 5, "Max number of retry attempts.")
-	verifyPasses := flag.Uint64("verifypasses", 3, "Number of file verify test passes")
+	verifyPasses := flag.Uint64("verifypasses", 3, "Number of file verify test passes over each new copy (a file already in the target is hashed once)")
 	verifyChunkSize := flag.Uint64("verifychunksize", 16384, "Size of the verify chunks")
-	workerPoolSize := flag.Uint64("workerpool", 4, "Size of the worker pool")
+	rangeThreshold := flag.Uint64("rangethreshold", 1024, "Copy files larger than this many MiB in parallel ranges (0 to disable)")
+	rangeSize := flag.Uint64("rangesize", 256, "Size of each parallel range in MiB")
+	rangeWorkers := flag.Uint64("rangeworkers", 4, "Ranges of one file copied at the same time")
+	workerPoolSize := flag.Uint64("workerpool", 4, "Max concurrent copies into each target device")
+	deviceWorkers := flag.Uint64("deviceworkers", 2, "Concurrent copies from each card reader (0 for -workerpool)")
+	adaptive := flag.Bool("adaptive", false, "Tune -deviceworkers for each card reader from measured throughput, up to -workerpool")
+	onError := flag.String("onerror", "failfast", "What to do when a file fails: failfast, continue, or budget (stop after -errorbudget failures)")
+	errorBudget := flag.Uint64("errorbudget", 10, "Failed files allowed with -onerror=budget")
+	cardTimeout := flag.Duration("cardtimeout", filecontrol.DefaultCardTimeout, "Give up on a card when one read from it stalls this long (0 to wait forever)")
+	targetTimeout := flag.Duration("targettimeout", cardfileutil.DefaultTargetTimeout, "With several -targetdir, drop a target from a file's copy when a write to it stalls this long (0 to wait forever)")
+	hashAlgoStr := flag.String("hash", "sha256", "Digest algorithm used to verify copies (sha256 or xxh64)")
+	fileModeStr := flag.String("filemode", "0644", "Octal permissions for copied files")
+	layout := flag.String("layout", "", "Subdirectory template from capture date, like {yyyy}/{yyyy-mm-dd}")
+	rename := flag.String("rename", "", "Target file name template, like {date:20060102}_{camera}_{seq:4}.{ext}")
+	libraryRootsStr := flag.String("libraryroots", "", "Comma delimited list of library directories.  Files already in the library are skipped.")
+	libraryIndex := flag.String("libraryindex", "", "Library index file (default .cardslurp-index.jsonl in the first library root)")
+	profiles := flag.String("profiles", "all", "Comma delimited camera layouts to import from: "+strings.Join(filecontrol.ProfileNames(), ", "))
+	include := flag.String("include", "", "Comma delimited glob patterns to import, even if another rule drops them")
+	exclude := flag.String("exclude", "", "Comma delimited glob patterns to leave on the card")
+	ext := flag.String("ext", "", "Comma delimited file extensions.  Only these are imported.")
+	skipExt := flag.String("skipext", "", "Comma delimited file extensions to leave on the card")
+	writeMHL := flag.Bool("mhl", false, "Add the copied files to an ASC MHL history in the ascmhl folder of -targetdir")
+	manifestsStr := flag.String("manifests", "", "Comma delimited checksum manifests to write in -targetdir: sha256sum, md5sum, bagit (copies go in its data folder)")
+	digestXattr := flag.Bool("digestxattr", false, "Record the digest of each copy in its user.cardslurp.<hash> xattr, for cardslurp scrub (Linux)")
+	dryRun := flag.Bool("dryrun", false, "List what each filter rule keeps or drops on the cards, and copy nothing")
 
 	flag.Parse()
 
-	if *targetDir == "" {
+	if *targetDir == "" && !*dryRun {
 		return CmdOpts{}, errors.New("-targetdir is a required parameter")
 	}
 
+	targets := commaList(*targetDir)
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		if seen[filepath.Clean(t)] {
+			return CmdOpts{}, fmt.Errorf("-targetdir lists %s more than once", t)
+		}
+		seen[filepath.Clean(t)] = true
+	}
+
 	if *mountListStr == "" {
 		return CmdOpts{}, errors.New("-mountlist is a required parameter")
 	}
@@ -100,18 +578,163 @@ func GetOpts() (CmdOpts, error) {
 		return CmdOpts{}, errors.New("-verifychunksize must not be zero")
 	}
 
+	if *rangeThreshold != 0 && *rangeSize == 0 {
+		return CmdOpts{}, errors.New("-rangesize must not be zero")
+	}
+
+	if *rangeThreshold != 0 && *rangeWorkers == 0 {
+		return CmdOpts{}, errors.New("-rangeworkers must not be zero")
+	}
+
+	hashAlgo, err := cardfileutil.ParseHashAlgo(*hashAlgoStr)
+	if err != nil {
+		return CmdOpts{}, fmt.Errorf("invalid -hash: %w", err)
+	}
+
+	fileMode, err := cardfileutil.ParseFileMode(*fileModeStr)
+	if err != nil {
+		return CmdOpts{}, fmt.Errorf("invalid -filemode: %w", err)
+	}
+
+	manifests, err := manifest.ParseFormats(commaList(*manifestsStr))
+	if err != nil {
+		return CmdOpts{}, fmt.Errorf("invalid -manifests: %w", err)
+	}
+
+	errorMode, err := filecontrol.ParseErrorMode(*onError)
+	if err != nil {
+		return CmdOpts{}, fmt.Errorf("invalid -onerror: %w", err)
+	}
+
+	filterOpts := filecontrol.FilterOpts{
+		Profiles: commaList(*profiles),
+		Include:  commaList(*include),
+		Exclude:  commaList(*exclude),
+		Ext:      commaList(*ext),
+		SkipExt:  commaList(*skipExt),
+	}
+	_, err = filecontrol.NewFilter(filterOpts)
+	if err != nil {
+		return CmdOpts{}, fmt.Errorf("invalid filter: %w", err)
+	}
+
+	libraryRoots := make([]string, 0)
+	if *libraryRootsStr != "" {
+		libraryRoots = strings.Split(*libraryRootsStr, ",")
+		if *libraryIndex == "" {
+			*libraryIndex = filepath.Join(libraryRoots[0], libindex.DefaultFileName)
+		}
+	}
+
 	ml := strings.Split(*mountListStr, ",")
 	if len(ml) == 0 {
 		return CmdOpts{}, errors.New("length of -mountlist must not be zero")
 	}
 
-	return CmdOpts{
-		TargetDir:       *targetDir,
+	rv := CmdOpts{
 		MountList:       ml,
 		DebugMode:       *debugMode,
 		MaxRetries:      *maxRetries,
 		VerifyPasses:    *verifyPasses,
 		VerifyChunkSize: *verifyChunkSize,
+		RangeThreshold:  *rangeThreshold,
+		RangeSize:       *rangeSize,
+		RangeWorkers:    *rangeWorkers,
+		OnError:         errorMode,
+		ErrorBudget:     *errorBudget,
+		CardTimeout:     *cardTimeout,
+		TargetTimeout:   *targetTimeout,
 		WorkerPool:      *workerPoolSize,
-	}, nil
+		DeviceWorkers:   *deviceWorkers,
+		Adaptive:        *adaptive,
+		HashAlgo:        hashAlgo,
+		FileMode:        fileMode,
+		LibraryRoots:    libraryRoots,
+		LibraryIndex:    *libraryIndex,
+		Layout:          *layout,
+		Rename:          *rename,
+		Filter:          filterOpts,
+		DryRun:          *dryRun,
+		MHL:             *writeMHL,
+		Manifests:       manifests,
+		DigestXattr:     *digestXattr,
+	}
+	if len(targets) != 0 {
+		rv.TargetDir = targets[0]
+		rv.Mirrors = targets[1:]
+	}
+
+	return rv, nil
+}
+
+// commaList - Split a comma delimited flag.  An empty flag is an empty
+// list.
+func commaList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// GetResumeOpts - Options for "cardslurp resume".  Everything except the
+// target directory comes from the journal of the interrupted session.
+func GetResumeOpts(args []string) (CmdOpts, journal.Session, error) {
+
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	targetDir := fs.String("targetdir", "", "Target directory of the interrupted import.")
+	sessionID := fs.String("session", "", "Session to resume, if there is more than one.")
+	debugMode := fs.Bool("debugMode", false, "Print extra debug information.")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return CmdOpts{}, journal.Session{}, err
+	}
+
+	if *targetDir == "" {
+		return CmdOpts{}, journal.Session{}, errors.New("-targetdir is a required parameter")
+	}
+
+	sessions, err := journal.List(*targetDir)
+	if err != nil {
+		return CmdOpts{}, journal.Session{}, err
+	}
+
+	var sess journal.Session
+	switch {
+	case *sessionID != "":
+		found := false
+		for _, s := range sessions {
+			if s.SessionID == *sessionID {
+				sess = s
+				found = true
+			}
+		}
+		if !found {
+			return CmdOpts{}, journal.Session{}, fmt.Errorf(
+				"no unfinished session %s in %s", *sessionID, *targetDir)
+		}
+	case len(sessions) == 0:
+		return CmdOpts{}, journal.Session{}, fmt.Errorf(
+			"no unfinished sessions in %s", *targetDir)
+	case len(sessions) == 1:
+		sess = sessions[0]
+	default:
+		for _, s := range sessions {
+			fmt.Printf("Unfinished session %s, started %s\n", s.SessionID,
+				s.StartedAt.Local().Format(time.RFC1123))
+		}
+		return CmdOpts{}, journal.Session{}, errors.New(
+			"more than one unfinished session, pick one with -session")
+	}
+
+	var opts CmdOpts
+	err = json.Unmarshal(sess.Options, &opts)
+	if err != nil {
+		return CmdOpts{}, journal.Session{}, fmt.Errorf(
+			"error reading options of session %s: %w", sess.SessionID, err)
+	}
+	opts.TargetDir = *targetDir
+	opts.DebugMode = *debugMode
+
+	return opts, sess, nil
 }
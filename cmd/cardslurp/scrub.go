@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/scrub"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// runScrub - "cardslurp scrub".  Hash a library again, and compare it to
+// the digests recorded when its files were imported, to catch bit rot.
+// Returns exitVerify if anything is corrupt, missing or unreadable.
+func runScrub(args []string) int {
+
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	libraryRootsStr := fs.String("libraryroots", "", "Comma delimited list of library directories to scrub.")
+	rate := fs.Uint64("rate", 0, "Read at most this many MiB per second (0 for no limit)")
+	duration := fs.Duration("duration", 0, "Stop after this long, and pick up from there on the next run (0 to run until done)")
+	stateFile := fs.String("state", "", "Scrub progress file (default .cardslurp-scrub.jsonl in the first library root)")
+	restart := fs.Bool("restart", false, "Start over, instead of resuming an unfinished scrub")
+	listUntracked := fs.Bool("listuntracked", false, "List every file that has no recorded digest")
+	verifyChunkSize := fs.Uint64("verifychunksize", 16384, "Size of the read buffer")
+
+	err := fs.Parse(args)
+	if err != nil {
+		panic("error processing command line arguments: " + err.Error())
+	}
+
+	roots := commaList(*libraryRootsStr)
+	if len(roots) == 0 {
+		panic("error processing command line arguments: -libraryroots is a required parameter")
+	}
+
+	if *verifyChunkSize == 0 {
+		panic("error processing command line arguments: -verifychunksize must not be zero")
+	}
+
+	if *stateFile == "" {
+		*stateFile = filepath.Join(roots[0], scrub.DefaultStateName)
+	}
+
+	// Ctrl-C (or SIGTERM) stops after the current file, like -duration.
+	ctx, stopSignals := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	scrubCtx := ctx
+	if *duration != 0 {
+		var cancel context.CancelFunc
+		scrubCtx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	report, err := scrub.Run(scrubCtx, scrub.Opts{
+		Roots:     roots,
+		Rate:      int64(*rate << 20),
+		StateFile: *stateFile,
+		Restart:   *restart,
+		Hasher: cardfileutil.NewCardFileUtil(*verifyChunkSize, 1, cardfileutil.HashSHA256,
+			cardfileutil.DefaultFileMode),
+	})
+	if err != nil {
+		panic("error scrubbing library: " + err.Error())
+	}
+
+	if report.Resumed != 0 {
+		fmt.Printf("Resumed an unfinished scrub (%d files were already done)\n", report.Resumed)
+	}
+
+	for _, f := range report.Corrupt {
+		fmt.Printf("CORRUPT     %s\n", f)
+	}
+	for _, f := range report.Missing {
+		fmt.Printf("MISSING     %s\n", f)
+	}
+	for _, f := range report.Unreadable {
+		fmt.Printf("UNREADABLE  %s\n", f)
+	}
+	if *listUntracked {
+		for _, f := range report.Untracked {
+			fmt.Printf("UNTRACKED   %s\n", f)
+		}
+	}
+
+	fmt.Printf("Verified: %d - Corrupt: %d - Missing: %d - Unreadable: %d - Untracked: %d\n",
+		report.Verified, len(report.Corrupt), len(report.Missing), len(report.Unreadable),
+		len(report.Untracked))
+
+	if !report.Finished {
+		fmt.Printf("Scrub stopped part way through.  Run it again to pick up where it stopped (%s).\n",
+			*stateFile)
+	}
+
+	switch {
+	case !report.OK():
+		return exitVerify
+	case !report.Finished && !errors.Is(scrubCtx.Err(), context.DeadlineExceeded):
+		return exitInterrupted
+	}
+
+	return exitOK
+}
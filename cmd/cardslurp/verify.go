@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/manifest"
+	"github.com/pheckenlively123/cardSlurp/cmd/cardslurp/internal/mhl"
+	"github.com/pheckenlively123/cardSlurp/internal/cardfileutil"
+)
+
+// runVerify - "cardslurp verify".  Check a target directory against its
+// ASC MHL history, or the files listed in a checksum manifest, and report
+// missing, altered and new files.  Returns exitVerify if anything does not
+// match.
+func runVerify(args []string) int {
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	targetDir := fs.String("targetdir", "", "Directory to check against its ASC MHL history.")
+	manifestFile := fs.String("manifest", "", "Check the files in a SHA256SUMS, MD5SUMS or BagIt manifest-sha256.txt instead.")
+	verifyChunkSize := fs.Uint64("verifychunksize", 16384, "Size of the read buffer")
+
+	err := fs.Parse(args)
+	if err != nil {
+		panic("error processing command line arguments: " + err.Error())
+	}
+
+	if *targetDir == "" && *manifestFile == "" {
+		panic("error processing command line arguments: -targetdir is a required parameter")
+	}
+
+	if *verifyChunkSize == 0 {
+		panic("error processing command line arguments: -verifychunksize must not be zero")
+	}
+
+	if *manifestFile != "" {
+		return verifyManifest(*manifestFile, *verifyChunkSize)
+	}
+
+	cfu := cardfileutil.NewCardFileUtil(*verifyChunkSize, 1, cardfileutil.HashXXH64,
+		cardfileutil.DefaultFileMode)
+
+	report, err := mhl.Verify(*targetDir, cfu)
+	if errors.Is(err, mhl.ErrNoHistory) {
+		fmt.Printf("%s has no ASC MHL history (no %s folder)\n", *targetDir, mhl.DirName)
+		return exitVerify
+	}
+	if err != nil {
+		panic("error verifying " + *targetDir + ": " + err.Error())
+	}
+
+	for _, c := range report.Chain {
+		fmt.Printf("CHAIN    %s\n", c)
+	}
+	for _, m := range report.Missing {
+		fmt.Printf("MISSING  %s\n", m)
+	}
+	for _, a := range report.Altered {
+		fmt.Printf("ALTERED  %s\n", a)
+	}
+	for _, n := range report.New {
+		fmt.Printf("NEW      %s\n", n)
+	}
+
+	fmt.Printf("Verified: %d - Missing: %d - Altered: %d - New: %d - Chain errors: %d\n",
+		report.Verified, len(report.Missing), len(report.Altered), len(report.New),
+		len(report.Chain))
+
+	if !report.OK() {
+		return exitVerify
+	}
+
+	return exitOK
+}
+
+// verifyManifest - "cardslurp verify -manifest".  Check the files listed
+// in a checksum manifest.
+func verifyManifest(manifestFile string, verifyChunkSize uint64) int {
+
+	report, err := manifest.Verify(manifestFile, func(algo cardfileutil.HashAlgo) manifest.Hasher {
+		return cardfileutil.NewCardFileUtil(verifyChunkSize, 1, algo, cardfileutil.DefaultFileMode)
+	})
+	if err != nil {
+		panic("error verifying " + manifestFile + ": " + err.Error())
+	}
+
+	for _, m := range report.Missing {
+		fmt.Printf("MISSING  %s\n", m)
+	}
+	for _, a := range report.Altered {
+		fmt.Printf("ALTERED  %s\n", a)
+	}
+	for _, n := range report.New {
+		fmt.Printf("NEW      %s\n", n)
+	}
+
+	fmt.Printf("Verified: %d - Missing: %d - Altered: %d - New: %d\n",
+		report.Verified, len(report.Missing), len(report.Altered), len(report.New))
+
+	if !report.OK() {
+		return exitVerify
+	}
+
+	return exitOK
+}
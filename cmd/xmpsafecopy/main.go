@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -25,6 +26,26 @@ func main() {
 		panic("Source and target appear to be different photo shoots")
 	}
 
+	// Clean up temp files from any earlier run that was interrupted.  A
+	// simulated run only lists them.
+	if opts.memorex {
+		stale, err := cardfileutil.ListStaleTemps(opts.target)
+		if err != nil {
+			panic("Error listing stale temp files: " + err.Error())
+		}
+		for _, name := range stale {
+			fmt.Printf("Simulating removing leftover temp file: %s\n", name)
+		}
+	} else {
+		removed, err := cardfileutil.RemoveStaleTemps(opts.target)
+		if err != nil {
+			panic("Error removing stale temp files: " + err.Error())
+		}
+		for _, rm := range removed {
+			fmt.Printf("Removed leftover temp file: %s\n", rm)
+		}
+	}
+
 	// Make a backup directory in the target directory, so we
 	// can backup the side cart files.  However, first make sure
 	// the we are not stepping on any names already present in the
@@ -66,7 +87,8 @@ func main() {
 		panic("Error globbing source: " + err.Error())
 	}
 
-	cfu := cardfileutil.NewCardFileUtil(opts.verifyChunkSize, opts.verifyPasses)
+	cfu := cardfileutil.NewCardFileUtil(opts.verifyChunkSize, opts.verifyPasses,
+		opts.hashAlgo, opts.fileMode)
 
 	// Time to make the donuts...move the files...
 	for i, cpFile := range sourceFileList {
@@ -93,17 +115,14 @@ func safeCopy(cfu *cardfileutil.CardFileUtil, opts *opts, fullSourcePath string)
 		return nil
 	}
 
-	err := cfu.CardFileCopy(fullSourcePath, targetName)
-	if err != nil {
-		return fmt.Errorf("error calling CardFileCopy: %w", err)
+	// CardFileCopy verifies the target against the digest of the source,
+	// and returns ErrVerifyMismatch if they differ.
+	_, err := cfu.CardFileCopy(context.Background(), fullSourcePath, targetName, nil)
+	if errors.Is(err, cardfileutil.ErrVerifyMismatch) {
+		return fmt.Errorf("error verifying %s copied OK: %w", fullSourcePath, err)
 	}
-
-	fileOK, err := cfu.IsFileSame(fullSourcePath, targetName)
 	if err != nil {
-		return fmt.Errorf("error calling IsFileSame: %w", err)
-	}
-	if !fileOK {
-		return fmt.Errorf("error verifying %s copied OK", fullSourcePath)
+		return fmt.Errorf("error calling CardFileCopy: %w", err)
 	}
 
 	return nil
@@ -128,6 +147,8 @@ type opts struct {
 	memorex         bool
 	verifyPasses    uint64
 	verifyChunkSize uint64
+	hashAlgo        cardfileutil.HashAlgo
+	fileMode        os.FileMode
 }
 
 func getopt() (*opts, error) {
@@ -137,6 +158,8 @@ func getopt() (*opts, error) {
 	extension := flag.String("extension", "xmp", "File extension")
 	verifyPasses := flag.Uint64("verifypasses", 3, "Number of file verify test passes")
 	verifyChunkSize := flag.Uint64("verifychunksize", 16384, "Size of the verify chunks")
+	hashAlgoStr := flag.String("hash", "sha256", "Digest algorithm used to verify copies (sha256 or xxh64)")
+	fileModeStr := flag.String("filemode", "0644", "Octal permissions for copied files")
 	memorex := flag.Bool("memorex", true, "Is it live, or is it memorex")
 
 	flag.Parse()
@@ -151,6 +174,16 @@ func getopt() (*opts, error) {
 		return &opts{}, errors.New("-source and -target must not be the same")
 	}
 
+	hashAlgo, err := cardfileutil.ParseHashAlgo(*hashAlgoStr)
+	if err != nil {
+		return &opts{}, fmt.Errorf("invalid -hash: %w", err)
+	}
+
+	fileMode, err := cardfileutil.ParseFileMode(*fileModeStr)
+	if err != nil {
+		return &opts{}, fmt.Errorf("invalid -filemode: %w", err)
+	}
+
 	return &opts{
 		source:          *source,
 		target:          *target,
@@ -158,5 +191,7 @@ func getopt() (*opts, error) {
 		memorex:         *memorex,
 		verifyPasses:    *verifyPasses,
 		verifyChunkSize: *verifyChunkSize,
+		hashAlgo:        hashAlgo,
+		fileMode:        fileMode,
 	}, nil
 }
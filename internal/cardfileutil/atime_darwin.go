@@ -0,0 +1,19 @@
+//go:build darwin
+
+package cardfileutil
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime - Last access time of a file, or the mtime if the platform
+// does not expose it.
+func accessTime(info fs.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(st.Atimespec.Sec, st.Atimespec.Nsec)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package cardfileutil
+
+import (
+	"io/fs"
+	"time"
+)
+
+// accessTime - Last access time of a file, or the mtime if the platform
+// does not expose it.
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package cardfileutil
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime - Last access time of a file, or the mtime if the platform
+// does not expose it.
+func accessTime(info fs.FileInfo) time.Time {
+	attr, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(0, attr.LastAccessTime.Nanoseconds())
+}
@@ -0,0 +1,74 @@
+package cardfileutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix - Every temporary target ends with this, so leftovers from a
+// crash can be recognized and cleaned up on the next run.
+const tempSuffix = ".cardslurp-tmp"
+
+// tempNameFor - Hidden temporary name in the same directory as the target.
+// It has to be the same directory, so the final rename is atomic.
+func tempNameFor(toFile string) (string, error) {
+
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("error making temp name nonce: %w", err)
+	}
+
+	dir, base := filepath.Split(toFile)
+	return filepath.Join(dir,
+		"."+base+"."+hex.EncodeToString(nonce)+tempSuffix), nil
+}
+
+// IsTempName - True if fileName looks like a temporary file left behind
+// by CardFileCopy.
+func IsTempName(fileName string) bool {
+	return strings.HasPrefix(fileName, ".") && strings.HasSuffix(fileName, tempSuffix)
+}
+
+// ListStaleTemps - Temporary files left in dir by an interrupted copy.
+func ListStaleTemps(dir string) ([]string, error) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", dir, err)
+	}
+
+	rv := make([]string, 0)
+	for _, ent := range entries {
+		if ent.Type().IsRegular() && IsTempName(ent.Name()) {
+			rv = append(rv, filepath.Join(dir, ent.Name()))
+		}
+	}
+
+	return rv, nil
+}
+
+// RemoveStaleTemps - Delete the temporary files ListStaleTemps finds in
+// dir.  Returns the names that were removed.
+func RemoveStaleTemps(dir string) ([]string, error) {
+
+	stale, err := ListStaleTemps(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0, len(stale))
+	for _, fullName := range stale {
+		err = os.Remove(fullName)
+		if err != nil {
+			return removed, fmt.Errorf("error removing %s: %w", fullName, err)
+		}
+		removed = append(removed, fullName)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package cardfileutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// dropFileCache - MacOS has no fadvise, but F_NOCACHE turns off caching
+// for reads through this descriptor, which is the closest equivalent.
+// Returns true if the flag was set.
+func dropFileCache(fi *os.File) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fi.Fd(),
+		syscall.F_NOCACHE, 1)
+	return errno == 0
+}
@@ -0,0 +1,21 @@
+//go:build linux && (amd64 || arm64)
+
+package cardfileutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// posixFadvDontNeed - POSIX_FADV_DONTNEED from fcntl.h.
+const posixFadvDontNeed = 4
+
+// dropFileCache - Ask the kernel to evict the file's pages from the page
+// cache, so the next read comes from the disk.  Dirty pages can not be
+// evicted, so the file needs to be synced first.  Returns true if the
+// kernel accepted the request.
+func dropFileCache(fi *os.File) bool {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, fi.Fd(), 0, 0,
+		posixFadvDontNeed, 0, 0)
+	return errno == 0
+}
@@ -0,0 +1,11 @@
+//go:build !(linux && (amd64 || arm64)) && !darwin
+
+package cardfileutil
+
+import "os"
+
+// dropFileCache - No portable way to bypass the cache here, so each pass
+// may be served from memory.  Returns false so the report says so.
+func dropFileCache(fi *os.File) bool {
+	return false
+}
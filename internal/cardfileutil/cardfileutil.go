@@ -1,22 +1,40 @@
 package cardfileutil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 // Make these functions methods of an object, so I can mock them.
 type CardFileUtil struct {
 	transBufferSize    uint64
 	verificationPasses uint64
+	hashAlgo           HashAlgo
+	fileMode           os.FileMode
+	ranged             RangedCopyOpts
+	extraAlgos         []HashAlgo
+	digestXattr        bool
+	targetTimeout      time.Duration
+	// rangeFault - Test hook, called after each range is written.
+	rangeFault func(to *os.File, index int, offset int64)
+	// mirrorFault - Test hook, called before each write to a target of
+	// CardFileMirror.
+	mirrorFault func(index int)
 }
 
-func NewCardFileUtil(transBufferSize uint64, verificationPasses uint64) *CardFileUtil {
+func NewCardFileUtil(transBufferSize uint64, verificationPasses uint64,
+	hashAlgo HashAlgo, fileMode os.FileMode) *CardFileUtil {
 	return &CardFileUtil{
 		transBufferSize:    transBufferSize,
 		verificationPasses: verificationPasses,
+		hashAlgo:           hashAlgo,
+		fileMode:           fileMode,
 	}
 }
 
@@ -27,97 +45,423 @@ func closeDefer(fi *os.File, errorFile string) {
 	}
 }
 
-// IsFileSame - Do a byte by byte comparison of the two files.
+// ctxReader - Reader that fails with the context's error once it is
+// cancelled, so a long copy stops within one buffer of a cancel.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ErrSourceRead - The source could not be opened or read.  It is wrapped
+// around the underlying error, so a caller can tell a bad card from a bad
+// target.
+var ErrSourceRead = errors.New("error reading source")
+
+// ErrNothingToResume - ResumeCopy found neither the temp file nor the
+// target, because the copy was rolled back before the process stopped.
+// The file simply has to be copied again.
+var ErrNothingToResume = errors.New("no copy left to resume")
+
+// sourceErr - Mark err as a failure reading the source.
+func sourceErr(err error) error {
+	return fmt.Errorf("%w: %w", ErrSourceRead, err)
+}
+
+// sourceReader - Reader that marks its errors with ErrSourceRead.  io.EOF
+// is passed through untouched.
+type sourceReader struct {
+	r io.Reader
+}
+
+func (s sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceErr(err)
+	}
+	return n, err
+}
+
+// IsFileSame - Check if toFile already holds a copy of fromFile, to decide
+// whether a file can be skipped.  Files of different sizes are not read at
+// all.  Otherwise each file is hashed once, so the card is only read once.
+// The -verifypasses passes are for fresh copies (see CardFileCopy).
 func (c *CardFileUtil) IsFileSame(fromFile string, toFile string) (bool, error) {
 
-	// While it is tempting to just read the whole file into ram with
-	// os.ReadFile(), this approach will fail with video files.  They
-	// can be huge.
+	fromInfo, err := os.Stat(fromFile)
+	if err != nil {
+		return false, fmt.Errorf("error calling stat on %s: %w", fromFile, err)
+	}
+	toInfo, err := os.Stat(toFile)
+	if err != nil {
+		return false, fmt.Errorf("error calling stat on %s: %w", toFile, err)
+	}
+	if fromInfo.Size() != toInfo.Size() {
+		return false, nil
+	}
+
+	fromDigest, err := c.HashFile(fromFile)
+	if err != nil {
+		return false, err
+	}
+	toDigest, err := c.HashFile(toFile)
+	if err != nil {
+		return false, err
+	}
+
+	return fromDigest.Equal(toDigest), nil
+}
+
+// CopyResult - What CardFileCopy learned about the file it copied.
+type CopyResult struct {
+	Digest FileDigest
+	Verify VerifyResult
+	// RangeRetries - Ranges of a ranged copy that were copied again after
+	// failing verification.
+	RangeRetries uint64
+	// Extra - The digests asked for with SetExtraDigests.
+	Extra []FileDigest
+}
+
+// DigestFor - The digest of the copy with algo, if it was computed.
+func (r CopyResult) DigestFor(algo HashAlgo) (FileDigest, bool) {
+	if r.Digest.Algo == algo {
+		return r.Digest, true
+	}
+	for _, d := range r.Extra {
+		if d.Algo == algo {
+			return d, true
+		}
+	}
+	return FileDigest{}, false
+}
+
+// CardFileCopy - Copy one file to another.  The source is hashed as it is
+// written, and then only the target is read back to verify it.  This way
+// the card is only read once.  A failed verification returns the result
+// along with ErrVerifyMismatch, so the caller can decide to retry.
+//
+// The target gets the source's mtime and atime, the configured file mode,
+// and (on Linux) the source's user.* extended attributes.  These are checked
+// too, and a difference returns ErrMetadataMismatch.
+//
+// Files above the SetRangedCopy threshold are copied and verified in
+// parallel ranges, and only a range that fails is copied again.
+//
+// The data is written to a hidden temporary file next to the target, which
+// is fsynced and verified before it is renamed into place.  A crash part
+// way through can only leave a temporary file behind, never a partial
+// file under the final name.  RemoveStaleTemps cleans those up.
+//
+// Cancelling ctx stops the copy, removes the temporary file, and returns
+// an error that wraps ctx.Err().  The target is either complete and
+// verified, or not there at all.
+//
+// If obs is not nil, it is told the temporary name before anything is
+// written, and the digest once the data is synced, so a journal can pick
+// up after a crash (see ResumeCopy).
+func (c *CardFileUtil) CardFileCopy(ctx context.Context, fromFile string,
+	toFile string, obs CopyObserver) (CopyResult, error) {
+
+	tempName, err := tempNameFor(toFile)
+	if err != nil {
+		return CopyResult{}, err
+	}
+
+	if obs != nil {
+		err = obs.Started(tempName)
+		if err != nil {
+			return CopyResult{}, err
+		}
+	}
+
+	rv, err := c.copyToTemp(ctx, fromFile, tempName, obs)
+	if err != nil {
+		removeTemp(tempName)
+		return rv, err
+	}
+
+	err = commitTemp(ctx, fromFile, tempName, toFile)
+	if err != nil {
+		return rv, err
+	}
+
+	return rv, nil
+}
+
+// CopyObserver - Told about the progress of a CardFileCopy.  An error from
+// either method stops the copy.
+type CopyObserver interface {
+	// Started - The copy will be written to tempName.
+	Started(tempName string) error
+	// Copied - The data in tempName is on the disk, and should have this
+	// digest, but it has not been verified yet.
+	Copied(tempName string, digest FileDigest) error
+}
+
+// commitTemp - Rename a finished temp file to its real name, and make sure
+// the rename is on the disk.  The temp file is removed on failure.
+func commitTemp(ctx context.Context, fromFile string, tempName string, toFile string) error {
+
+	// Last chance to back out, before the file gets its real name.
+	err := ctx.Err()
+	if err != nil {
+		removeTemp(tempName)
+		return fmt.Errorf("copy of %s cancelled: %w", fromFile, err)
+	}
+
+	err = os.Rename(tempName, toFile)
+	if err != nil {
+		removeTemp(tempName)
+		return fmt.Errorf("error renaming %s to %s: %w", tempName, toFile, err)
+	}
+
+	return syncDir(filepath.Dir(toFile))
+}
+
+// ResumeCopy - Finish a copy that an earlier process wrote to tempName and
+// synced, but never verified, given the source digest it recorded.  The
+// card is not read again, except for its metadata.  If the earlier process
+// got as far as the rename, the target itself is verified instead.
+//
+// A temp file of the wrong size, or one that does not match digest, is
+// removed, and ErrVerifyMismatch is returned, so the caller can copy the
+// file again from scratch.
+//
+// If neither tempName nor toFile exist, the copy was rolled back, and
+// ErrNothingToResume is returned.
+func (c *CardFileUtil) ResumeCopy(ctx context.Context, fromFile string, tempName string,
+	toFile string, digest FileDigest) (CopyResult, error) {
+
+	rv := CopyResult{Digest: digest}
 
 	from, err := os.Open(fromFile)
 	if err != nil {
-		return false, errors.New("Error opening: " + fromFile)
+		return rv, sourceErr(fmt.Errorf("error opening from file: %w", err))
 	}
 	defer closeDefer(from, fromFile)
 
-	to, err := os.Open(toFile)
+	meta, err := readMetadata(from)
 	if err != nil {
-		return false, errors.New("Error opening: " + toFile)
+		return rv, sourceErr(err)
 	}
-	defer closeDefer(to, toFile)
 
-	nibFrom := make([]byte, c.transBufferSize)
-	nibTo := make([]byte, c.transBufferSize)
+	_, err = os.Stat(tempName)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, err = os.Stat(toFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return rv, fmt.Errorf("%s: %w", toFile, ErrNothingToResume)
+		}
+
+		// Renamed into place before the process stopped.
+		rv.Verify, err = c.verifyDigest(ctx, toFile, digest)
+		if err != nil {
+			return rv, fmt.Errorf("error verifying %s: %w", toFile, err)
+		}
+		if !rv.Verify.OK() {
+			return rv, fmt.Errorf("%s (%s): %w", toFile, rv.Verify, ErrVerifyMismatch)
+		}
+	} else {
+		err = c.resumeTemp(ctx, fromFile, tempName, meta, &rv)
+		if err != nil {
+			removeTemp(tempName)
+			return rv, err
+		}
+
+		err = commitTemp(ctx, fromFile, tempName, toFile)
+		if err != nil {
+			return rv, err
+		}
+	}
 
-	for i := 0; i < int(c.verificationPasses); i++ {
+	// The source is not read again, so the extra digests come from the
+	// verified target.
+	rv.Extra, err = c.HashExtras(ctx, toFile)
+	if err != nil {
+		return rv, err
+	}
 
-	VERIFYLOOP:
-		for {
-			readFrom, errFrom := from.Read(nibFrom)
-			readTo, errTo := to.Read(nibTo)
+	return rv, nil
+}
 
-			if errors.Is(errFrom, io.EOF) && errors.Is(errTo, io.EOF) {
-				// The two files finished at the same time, which is
-				// what we want, if they are the same.
-				break VERIFYLOOP
-			}
+// resumeTemp - Verify an existing temp file and carry over the metadata,
+// like the second half of copyToTemp.
+func (c *CardFileUtil) resumeTemp(ctx context.Context, fromFile string, tempName string,
+	meta fileMetadata, rv *CopyResult) error {
 
-			if readFrom != readTo {
-				return false, nil
-			}
+	info, err := os.Stat(tempName)
+	if err != nil {
+		return fmt.Errorf("error calling stat on %s: %w", tempName, err)
+	}
+	if info.Size() != meta.size {
+		return fmt.Errorf("%s has %d of %d bytes: %w", tempName, info.Size(),
+			meta.size, ErrVerifyMismatch)
+	}
 
-			for x := range nibFrom {
-				if nibFrom[x] != nibTo[x] {
-					return false, nil
-				}
-			}
+	err = os.Chmod(tempName, c.fileMode)
+	if err != nil {
+		return fmt.Errorf("error setting mode on %s: %w", tempName, err)
+	}
 
-			// One of the files finished before the other.
-			if errors.Is(errFrom, io.EOF) {
-				return false, nil
-			}
+	meta.xattrs, err = copyUserXattrs(fromFile, tempName)
+	if err != nil {
+		return err
+	}
 
-			// One of the files finished before the other.
-			if errors.Is(errTo, io.EOF) {
-				return false, nil
-			}
+	rv.Verify, err = c.verifyDigest(ctx, tempName, rv.Digest)
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %w", tempName, err)
+	}
+	if !rv.Verify.OK() {
+		return fmt.Errorf("%s (%s): %w", fromFile, rv.Verify, ErrVerifyMismatch)
+	}
 
-			// Process any weird errors.
-			if errFrom != nil {
-				return false, fmt.Errorf(
-					"unexpected error reading from from file during validation: %w", errFrom)
-			}
+	err = c.recordDigest(tempName, rv.Digest, &meta)
+	if err != nil {
+		return err
+	}
 
-			// Process any weird errors.
-			if errTo != nil {
-				return false, fmt.Errorf(
-					"unexpected error reading from to during validation: %w", errTo)
-			}
-		}
+	err = applyTimes(tempName, meta)
+	if err != nil {
+		return err
 	}
 
-	return true, nil
+	return c.verifyMetadata(tempName, meta)
 }
 
-// CardFileCopy - Copy one file to another.
-func (c *CardFileUtil) CardFileCopy(fromFile string, toFile string) error {
+// copyToTemp - Copy, sync and verify fromFile into tempName, carrying
+// over the metadata.
+func (c *CardFileUtil) copyToTemp(ctx context.Context, fromFile string,
+	tempName string, obs CopyObserver) (CopyResult, error) {
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	extras, err := c.extraHashes()
+	if err != nil {
+		return CopyResult{}, err
+	}
 
 	from, err := os.Open(fromFile)
 	if err != nil {
-		return fmt.Errorf("error opening from file: %w", err)
+		return CopyResult{}, sourceErr(fmt.Errorf("error opening from file: %w", err))
 	}
 	defer closeDefer(from, fromFile)
 
-	to, err := os.OpenFile(toFile, os.O_RDWR|os.O_CREATE, 0755)
+	meta, err := readMetadata(from)
 	if err != nil {
-		return fmt.Errorf("error opening to file: %w", err)
+		return CopyResult{}, sourceErr(err)
 	}
-	defer closeDefer(to, toFile)
 
-	_, err = io.Copy(to, from)
+	// O_EXCL, because the temp name should never exist already.
+	to, err := os.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_EXCL, c.fileMode)
 	if err != nil {
-		return fmt.Errorf("error copying from to to: %w", err)
+		return CopyResult{}, fmt.Errorf("error opening to file: %w", err)
 	}
+	defer closeDefer(to, tempName)
 
-	return nil
+	ranged := c.useRanges(meta.size)
+	rv := CopyResult{}
+
+	if ranged {
+		rv, err = c.copyRanges(ctx, from, to, tempName, meta.size)
+		if err != nil {
+			return rv, fmt.Errorf("error copying %s in ranges: %w", fromFile, err)
+		}
+		if !rv.Verify.OK() {
+			return rv, fmt.Errorf("%s (%s): %w", fromFile, rv.Verify, ErrVerifyMismatch)
+		}
+	} else {
+		src := ctxReader{ctx: ctx, r: sourceReader{r: from}}
+		ws := []io.Writer{to, h}
+		for _, e := range extras {
+			ws = append(ws, e)
+		}
+		_, err = io.CopyBuffer(io.MultiWriter(ws...), src, make([]byte, c.transBufferSize))
+		if err != nil {
+			return CopyResult{}, fmt.Errorf("error copying from to to: %w", err)
+		}
+		rv.Digest = FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}
+		rv.Extra = c.extraSums(extras)
+	}
+
+	// Ranged copies verify each range as it is written.
+	err = c.finishTemp(ctx, fromFile, to, tempName, meta, obs, !ranged, &rv)
+	if err != nil {
+		return rv, err
+	}
+
+	return rv, nil
+}
+
+// finishTemp - The second half of a copy, once all the data is in
+// tempName and rv.Digest is set: the mode, xattrs and times are carried
+// over, and the data is synced and, if verify is set, verified.
+func (c *CardFileUtil) finishTemp(ctx context.Context, fromFile string, to *os.File,
+	tempName string, meta fileMetadata, obs CopyObserver, verify bool, rv *CopyResult) error {
+
+	// The umask applied when the file was created, so set the mode
+	// explicitly.
+	err := to.Chmod(c.fileMode)
+	if err != nil {
+		return fmt.Errorf("error setting mode on %s: %w", tempName, err)
+	}
+
+	meta.xattrs, err = copyUserXattrs(fromFile, tempName)
+	if err != nil {
+		return err
+	}
+
+	// Get the data onto the disk before it gets a real name.  This also
+	// matters for verification, because dirty pages can not be evicted
+	// from the page cache.
+	err = to.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing %s: %w", tempName, err)
+	}
+
+	if obs != nil {
+		err = obs.Copied(tempName, rv.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	if verify {
+		rv.Verify, err = c.verifyDigest(ctx, tempName, rv.Digest)
+		if err != nil {
+			return fmt.Errorf("error verifying %s: %w", tempName, err)
+		}
+		if !rv.Verify.OK() {
+			return fmt.Errorf("%s (%s): %w", fromFile, rv.Verify, ErrVerifyMismatch)
+		}
+	}
+
+	err = c.recordDigest(tempName, rv.Digest, &meta)
+	if err != nil {
+		return err
+	}
+
+	// Set the times last, after anything that could touch the mtime.
+	err = applyTimes(tempName, meta)
+	if err != nil {
+		return err
+	}
+
+	return c.verifyMetadata(tempName, meta)
+}
+
+func removeTemp(tempName string) {
+	err := os.Remove(tempName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("error removing temp file %s: %s\n", tempName, err.Error())
+	}
 }
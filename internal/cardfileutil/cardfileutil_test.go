@@ -1,8 +1,17 @@
 package cardfileutil
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestIsFileSame(t *testing.T) {
@@ -12,7 +21,7 @@ func TestIsFileSame(t *testing.T) {
 	// Torture test for boundary conditions.  :-)
 	for transBuff := 1; transBuff <= maxTransBuff; transBuff++ {
 
-		cfu := NewCardFileUtil(uint64(transBuff), 3)
+		cfu := NewCardFileUtil(uint64(transBuff), 3, HashSHA256, DefaultFileMode)
 		sameStat, err := cfu.IsFileSame("testData/same_a.txt", "testData/same_b.txt")
 		if err != nil {
 			fmt.Print("Error calling IsFileSame: " + err.Error() + "\n")
@@ -37,17 +46,18 @@ func TestIsFileSame(t *testing.T) {
 func TestCopyCardFile(t *testing.T) {
 
 	maxTransBuff := 8192
+	victim := filepath.Join(t.TempDir(), "victim.txt")
 
 	for transBuff := 1; transBuff <= maxTransBuff; transBuff++ {
 
-		cfu := NewCardFileUtil(uint64(transBuff), 3)
+		cfu := NewCardFileUtil(uint64(transBuff), 3, HashSHA256, DefaultFileMode)
 
-		err := cfu.CardFileCopy("testData/same_a.txt", "testData/victim.txt")
+		_, err := cfu.CardFileCopy(context.Background(), "testData/same_a.txt", victim, nil)
 		if err != nil {
 			t.Fatal("Error calling CardFileCopy: " + err.Error())
 		}
 
-		sameStat, err := cfu.IsFileSame("testData/same_a.txt", "testData/victim.txt")
+		sameStat, err := cfu.IsFileSame("testData/same_a.txt", victim)
 		if err != nil {
 			t.Fatal("Error calling IsFileSame: " + err.Error())
 		}
@@ -57,3 +67,419 @@ func TestCopyCardFile(t *testing.T) {
 		}
 	}
 }
+
+func TestXXH64(t *testing.T) {
+
+	// Reference values from the xxHash project.
+	vectors := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"abc": 0x44bc2cf5ad770999,
+	}
+
+	for input, want := range vectors {
+		h := newXXH64()
+		_, _ = h.Write([]byte(input))
+		if h.Sum64() != want {
+			t.Errorf("xxh64(%q) = %x, want %x", input, h.Sum64(), want)
+		}
+	}
+
+	// Feeding the same data in odd sized pieces must not change the result.
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	whole := newXXH64()
+	_, _ = whole.Write(data)
+	for step := 1; step <= 65; step++ {
+		pieces := newXXH64()
+		for i := 0; i < len(data); i += step {
+			_, _ = pieces.Write(data[i:min(i+step, len(data))])
+		}
+		if pieces.Sum64() != whole.Sum64() {
+			t.Errorf("xxh64 with step %d = %x, want %x", step, pieces.Sum64(), whole.Sum64())
+		}
+	}
+}
+
+func TestCardFileCopyDigest(t *testing.T) {
+
+	victim := filepath.Join(t.TempDir(), "victim.txt")
+
+	for _, algo := range []HashAlgo{HashSHA256, HashXXH64} {
+
+		cfu := NewCardFileUtil(16384, 3, algo, DefaultFileMode)
+
+		res, err := cfu.CardFileCopy(context.Background(), "testData/same_a.txt", victim, nil)
+		if err != nil {
+			t.Fatal("Error calling CardFileCopy: " + err.Error())
+		}
+		digest := res.Digest
+
+		sourceDigest, err := cfu.HashFile("testData/same_a.txt")
+		if err != nil {
+			t.Fatal("Error calling HashFile: " + err.Error())
+		}
+
+		if !digest.Equal(sourceDigest) {
+			t.Errorf("%s: copy digest %s does not match source digest %s",
+				algo, digest, sourceDigest)
+		}
+
+		vr, err := cfu.VerifyDigest("testData/diff_b.txt", digest)
+		if err != nil {
+			t.Fatal("Error calling VerifyDigest: " + err.Error())
+		}
+		if vr.OK() {
+			t.Errorf("%s: different file matched the source digest", algo)
+		}
+	}
+}
+
+func TestCardFileCopyExtraDigests(t *testing.T) {
+
+	dir := t.TempDir()
+	fromFile := filepath.Join(dir, "MVI_0001.MOV")
+	data := writeRandomFile(t, fromFile, 300007)
+	sha := sha256.Sum256(data)
+	md := md5.Sum(data)
+
+	cfu := NewCardFileUtil(4096, 1, HashXXH64, DefaultFileMode)
+	cfu.SetExtraDigests(HashSHA256, HashMD5, HashXXH64)
+
+	check := func(what string, res CopyResult) {
+		if len(res.Extra) != 2 {
+			t.Fatalf("%s: expected 2 extra digests, got %v", what, res.Extra)
+		}
+		d, ok := res.DigestFor(HashSHA256)
+		if !ok || !bytes.Equal(d.Sum, sha[:]) {
+			t.Errorf("%s: sha256 is %s, expected %x", what, d, sha)
+		}
+		d, ok = res.DigestFor(HashMD5)
+		if !ok || !bytes.Equal(d.Sum, md[:]) {
+			t.Errorf("%s: md5 is %s, expected %x", what, d, md)
+		}
+		_, ok = res.DigestFor(HashXXH64)
+		if !ok {
+			t.Errorf("%s: the copy digest is missing", what)
+		}
+	}
+
+	res, err := cfu.CardFileCopy(context.Background(), fromFile,
+		filepath.Join(dir, "copy.MOV"), nil)
+	if err != nil {
+		t.Fatal("error calling CardFileCopy: " + err.Error())
+	}
+	check("copy", res)
+
+	// The copy is already renamed, so this hashes the target.
+	res, err = cfu.ResumeCopy(context.Background(), fromFile,
+		filepath.Join(dir, ".copy.MOV.0123456789abcdef"+tempSuffix),
+		filepath.Join(dir, "copy.MOV"), res.Digest)
+	if err != nil {
+		t.Fatal("error calling ResumeCopy: " + err.Error())
+	}
+	check("resume", res)
+
+	cfu.SetRangedCopy(RangedCopyOpts{
+		Threshold: 1000,
+		RangeSize: 65543,
+		Workers:   4,
+		Retries:   2,
+	})
+	res, err = cfu.CardFileCopy(context.Background(), fromFile,
+		filepath.Join(dir, "ranged.MOV"), nil)
+	if err != nil {
+		t.Fatal("error calling CardFileCopy: " + err.Error())
+	}
+	check("ranged copy", res)
+}
+
+func TestVerifyPasses(t *testing.T) {
+
+	cfu := NewCardFileUtil(7, 4, HashSHA256, DefaultFileMode)
+
+	digest, err := cfu.HashFile("testData/same_a.txt")
+	if err != nil {
+		t.Fatal("Error calling HashFile: " + err.Error())
+	}
+
+	// Every pass has to actually read the file.  If the file is not
+	// rewound, passes after the first hash an empty read and fail.
+	vr, err := cfu.VerifyDigest("testData/same_b.txt", digest)
+	if err != nil {
+		t.Fatal("Error calling VerifyDigest: " + err.Error())
+	}
+	if len(vr.Passes) != 4 {
+		t.Fatalf("expected 4 passes, got %d", len(vr.Passes))
+	}
+	if !vr.OK() {
+		t.Errorf("identical file failed verification: %s", vr)
+	}
+
+	// A mismatch is reported on every pass, not just the first one.
+	vr, err = cfu.VerifyDigest("testData/diff_b.txt", digest)
+	if err != nil {
+		t.Fatal("Error calling VerifyDigest: " + err.Error())
+	}
+	for i, p := range vr.Passes {
+		if p.Match {
+			t.Errorf("pass %d of a different file matched", i+1)
+		}
+	}
+}
+
+func TestCardFileCopyAtomic(t *testing.T) {
+
+	targetDir := t.TempDir()
+	target := filepath.Join(targetDir, "victim.txt")
+
+	// Leave a longer file under the target name, plus a temp file from
+	// a pretend crash.
+	err := os.WriteFile(target, bytes.Repeat([]byte("x"), 100000), 0644)
+	if err != nil {
+		t.Fatal("Error writing old target: " + err.Error())
+	}
+	staleTemp := filepath.Join(targetDir, ".victim.txt.0123456789abcdef"+tempSuffix)
+	err = os.WriteFile(staleTemp, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal("Error writing stale temp: " + err.Error())
+	}
+
+	// Listing them leaves them alone.
+	stale, err := ListStaleTemps(targetDir)
+	if err != nil {
+		t.Fatal("Error calling ListStaleTemps: " + err.Error())
+	}
+	if len(stale) != 1 || stale[0] != staleTemp {
+		t.Errorf("expected %s to be listed, got %v", staleTemp, stale)
+	}
+
+	removed, err := RemoveStaleTemps(targetDir)
+	if err != nil {
+		t.Fatal("Error calling RemoveStaleTemps: " + err.Error())
+	}
+	if len(removed) != 1 || removed[0] != staleTemp {
+		t.Errorf("expected %s to be removed, got %v", staleTemp, removed)
+	}
+
+	cfu := NewCardFileUtil(16384, 1, HashSHA256, DefaultFileMode)
+	_, err = cfu.CardFileCopy(context.Background(), "testData/same_a.txt", target, nil)
+	if err != nil {
+		t.Fatal("Error calling CardFileCopy: " + err.Error())
+	}
+
+	// The old contents must be fully replaced, not overwritten in place.
+	sameStat, err := cfu.IsFileSame("testData/same_a.txt", target)
+	if err != nil {
+		t.Fatal("Error calling IsFileSame: " + err.Error())
+	}
+	if !sameStat {
+		t.Error("target still contains data from the old file")
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal("Error reading target dir: " + err.Error())
+	}
+	for _, ent := range entries {
+		if IsTempName(ent.Name()) {
+			t.Errorf("temp file left behind: %s", ent.Name())
+		}
+	}
+}
+
+func TestCardFileCopyMetadata(t *testing.T) {
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	target := filepath.Join(dir, "target.txt")
+
+	err := os.WriteFile(source, []byte("some image data"), 0600)
+	if err != nil {
+		t.Fatal("Error writing source: " + err.Error())
+	}
+
+	// Something obviously not "now", so a copy time can't sneak through.
+	mtime := time.Date(2019, 6, 1, 12, 30, 15, 0, time.UTC)
+	atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(source, atime, mtime)
+	if err != nil {
+		t.Fatal("Error setting source times: " + err.Error())
+	}
+
+	cfu := NewCardFileUtil(16384, 1, HashSHA256, 0640)
+	_, err = cfu.CardFileCopy(context.Background(), source, target, nil)
+	if err != nil {
+		t.Fatal("Error calling CardFileCopy: " + err.Error())
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal("Error calling stat on target: " + err.Error())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("target mtime is %s, expected %s", info.ModTime(), mtime)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Errorf("target mode is %s, expected %s", info.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+
+	mode, err := ParseFileMode("0644")
+	if err != nil || mode != 0644 {
+		t.Errorf("ParseFileMode(0644) = %s, %v", mode, err)
+	}
+
+	for _, bad := range []string{"", "999", "abc", "10644"} {
+		_, err = ParseFileMode(bad)
+		if err == nil {
+			t.Errorf("ParseFileMode(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestCardFileCopyCancelled(t *testing.T) {
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "victim.txt")
+
+	cfu := NewCardFileUtil(16384, 1, HashSHA256, DefaultFileMode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cfu.CardFileCopy(ctx, "testData/same_a.txt", target, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// Nothing should be left behind, not even the temp file.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("error reading " + dir + ": " + err.Error())
+	}
+	if len(entries) != 0 {
+		t.Fatalf("cancelled copy left %d files behind", len(entries))
+	}
+}
+
+var errCrash = errors.New("simulated crash")
+
+// crashObserver - Saves the temp file as it was when the data was synced,
+// then stops the copy, like a machine going to sleep before verification.
+type crashObserver struct {
+	saved  []byte
+	digest FileDigest
+}
+
+func (c *crashObserver) Started(tempName string) error {
+	return nil
+}
+
+func (c *crashObserver) Copied(tempName string, digest FileDigest) error {
+	var err error
+	c.saved, err = os.ReadFile(tempName)
+	if err != nil {
+		return err
+	}
+	c.digest = digest
+	return errCrash
+}
+
+func TestCardFileCopySourceRead(t *testing.T) {
+
+	dir := t.TempDir()
+	cfu := NewCardFileUtil(16384, 1, HashSHA256, DefaultFileMode)
+
+	// A missing source, and a source that can be opened, but not read.
+	for _, from := range []string{"testData/missing.txt", dir} {
+		_, err := cfu.CardFileCopy(context.Background(), from,
+			filepath.Join(dir, "target.txt"), nil)
+		if !errors.Is(err, ErrSourceRead) {
+			t.Fatalf("copying %s: expected ErrSourceRead, got %v", from, err)
+		}
+	}
+
+	// A target that can not be written is not a source problem.
+	_, err := cfu.CardFileCopy(context.Background(), "testData/same_a.txt",
+		filepath.Join(dir, "missing", "target.txt"), nil)
+	if err == nil || errors.Is(err, ErrSourceRead) {
+		t.Fatalf("expected a target error, got %v", err)
+	}
+}
+
+func TestResumeCopy(t *testing.T) {
+
+	dir := t.TempDir()
+	source := "testData/same_a.txt"
+	target := filepath.Join(dir, "victim.txt")
+	tempName := filepath.Join(dir, ".victim.txt.0123456789abcdef"+tempSuffix)
+
+	cfu := NewCardFileUtil(16384, 2, HashSHA256, DefaultFileMode)
+
+	obs := &crashObserver{}
+	_, err := cfu.CardFileCopy(context.Background(), source, target, obs)
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("expected the simulated crash, got %v", err)
+	}
+
+	// Put the temp file back, as the crash would have left it.
+	err = os.WriteFile(tempName, obs.saved, 0600)
+	if err != nil {
+		t.Fatal("error restoring temp file: " + err.Error())
+	}
+
+	res, err := cfu.ResumeCopy(context.Background(), source, tempName, target, obs.digest)
+	if err != nil {
+		t.Fatal("error calling ResumeCopy: " + err.Error())
+	}
+	if !res.Verify.OK() {
+		t.Fatalf("unexpected verify result: %s", res.Verify)
+	}
+
+	same, err := cfu.IsFileSame(source, target)
+	if err != nil {
+		t.Fatal("error calling IsFileSame: " + err.Error())
+	}
+	if !same {
+		t.Fatal("resumed copy does not match the source")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal("error calling stat on target: " + err.Error())
+	}
+	if info.Mode().Perm() != DefaultFileMode {
+		t.Errorf("resumed copy has mode %o", info.Mode().Perm())
+	}
+
+	// Already renamed, so the target itself is checked.
+	_, err = cfu.ResumeCopy(context.Background(), source, tempName, target, obs.digest)
+	if err != nil {
+		t.Fatal("error resuming a renamed copy: " + err.Error())
+	}
+
+	// A partial temp file is thrown away.
+	err = os.WriteFile(tempName, obs.saved[:len(obs.saved)/2], 0600)
+	if err != nil {
+		t.Fatal("error writing partial temp file: " + err.Error())
+	}
+	_, err = cfu.ResumeCopy(context.Background(), source, tempName,
+		filepath.Join(dir, "other.txt"), obs.digest)
+	if !errors.Is(err, ErrVerifyMismatch) {
+		t.Fatalf("expected ErrVerifyMismatch for a partial temp, got %v", err)
+	}
+	_, err = os.Stat(tempName)
+	if err == nil {
+		t.Error("partial temp file was not removed")
+	}
+
+	// A copy that was rolled back left nothing behind to resume.
+	_, err = cfu.ResumeCopy(context.Background(), source, tempName,
+		filepath.Join(dir, "other.txt"), obs.digest)
+	if !errors.Is(err, ErrNothingToResume) {
+		t.Fatalf("expected ErrNothingToResume for a rolled back copy, got %v", err)
+	}
+}
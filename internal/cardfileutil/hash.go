@@ -0,0 +1,216 @@
+package cardfileutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// HashAlgo - Name of a supported digest algorithm.
+type HashAlgo string
+
+const (
+	// HashSHA256 - Cryptographic digest.  Slower, but safe to use as
+	// evidence that a file has not changed.
+	HashSHA256 HashAlgo = "sha256"
+	// HashXXH64 - Fast non-cryptographic digest.
+	HashXXH64 HashAlgo = "xxh64"
+	// HashMD5 - Only for checksum manifests, which a lot of archive tools
+	// still expect.  ParseHashAlgo does not accept it, so copies are never
+	// verified with it.
+	HashMD5 HashAlgo = "md5"
+)
+
+var (
+	// ErrVerifyMismatch - The target did not hash to the same digest as
+	// the source.  The caller may want to retry the copy.
+	ErrVerifyMismatch = errors.New("target digest does not match source digest")
+)
+
+// ParseHashAlgo - Convert a command line string to a HashAlgo.
+func ParseHashAlgo(name string) (HashAlgo, error) {
+	switch HashAlgo(name) {
+	case HashSHA256, HashXXH64:
+		return HashAlgo(name), nil
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", name)
+	}
+}
+
+func newHash(algo HashAlgo) (hash.Hash, error) {
+	switch algo {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashXXH64:
+		return newXXH64(), nil
+	case HashMD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algo)
+	}
+}
+
+// FileDigest - Digest of a file's contents, along with the algorithm used.
+type FileDigest struct {
+	Algo HashAlgo
+	Sum  []byte
+}
+
+// String - Render the digest as algo:hex, which is how it gets recorded.
+func (f FileDigest) String() string {
+	return string(f.Algo) + ":" + hex.EncodeToString(f.Sum)
+}
+
+// ParseFileDigest - Convert a digest recorded as algo:hex back to a
+// FileDigest.
+func ParseFileDigest(digestStr string) (FileDigest, error) {
+
+	algoStr, hexSum, found := strings.Cut(digestStr, ":")
+	if !found {
+		return FileDigest{}, fmt.Errorf("digest %s is not algo:hex", digestStr)
+	}
+
+	algo, err := ParseHashAlgo(algoStr)
+	if err != nil {
+		return FileDigest{}, err
+	}
+
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return FileDigest{}, fmt.Errorf("error decoding digest %s: %w", digestStr, err)
+	}
+
+	return FileDigest{Algo: algo, Sum: sum}, nil
+}
+
+// Equal - True if both digests use the same algorithm and sum.
+func (f FileDigest) Equal(other FileDigest) bool {
+	return f.Algo == other.Algo && bytes.Equal(f.Sum, other.Sum)
+}
+
+// SetExtraDigests - Also compute digests of each copy with these
+// algorithms, from the same read of the source, for checksum manifests
+// and the ASC MHL history.  They are returned in CopyResult.Extra.  The
+// configured algorithm is always in CopyResult.Digest, so it is left out.
+func (c *CardFileUtil) SetExtraDigests(algos ...HashAlgo) {
+	c.extraAlgos = make([]HashAlgo, 0, len(algos))
+	for _, a := range algos {
+		if a != c.hashAlgo {
+			c.extraAlgos = append(c.extraAlgos, a)
+		}
+	}
+}
+
+// extraHashes - One hash for each extra digest.
+func (c *CardFileUtil) extraHashes() ([]hash.Hash, error) {
+	rv := make([]hash.Hash, 0, len(c.extraAlgos))
+	for _, a := range c.extraAlgos {
+		h, err := newHash(a)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, h)
+	}
+	return rv, nil
+}
+
+// extraSums - The extra digests, once hs has seen all the data.
+func (c *CardFileUtil) extraSums(hs []hash.Hash) []FileDigest {
+	rv := make([]FileDigest, 0, len(hs))
+	for i, h := range hs {
+		rv = append(rv, FileDigest{Algo: c.extraAlgos[i], Sum: h.Sum(nil)})
+	}
+	return rv
+}
+
+// HashExtras - Compute the extra digests of a file that was already
+// copied, for copies that were finished by ResumeCopy, or that a resumed
+// session verified without recording them.
+func (c *CardFileUtil) HashExtras(ctx context.Context, fileName string) ([]FileDigest, error) {
+
+	if len(c.extraAlgos) == 0 {
+		return nil, nil
+	}
+
+	hs, err := c.extraHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", fileName, err)
+	}
+	defer closeDefer(fi, fileName)
+
+	ws := make([]io.Writer, 0, len(hs))
+	for _, h := range hs {
+		ws = append(ws, h)
+	}
+	_, err = io.CopyBuffer(io.MultiWriter(ws...), ctxReader{ctx: ctx, r: fi},
+		make([]byte, c.transBufferSize))
+	if err != nil {
+		return nil, fmt.Errorf("error hashing %s: %w", fileName, err)
+	}
+
+	return c.extraSums(hs), nil
+}
+
+// HashAll - Compute the digest of everything r returns with each of algos,
+// reading it only once.  The caller owns r, so it can pace or watch the
+// read.
+func (c *CardFileUtil) HashAll(r io.Reader, algos []HashAlgo) ([]FileDigest, error) {
+
+	hs := make([]hash.Hash, 0, len(algos))
+	ws := make([]io.Writer, 0, len(algos))
+	for _, a := range algos {
+		h, err := newHash(a)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, h)
+		ws = append(ws, h)
+	}
+
+	_, err := io.CopyBuffer(io.MultiWriter(ws...), r, make([]byte, c.transBufferSize))
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]FileDigest, 0, len(hs))
+	for i, h := range hs {
+		rv = append(rv, FileDigest{Algo: algos[i], Sum: h.Sum(nil)})
+	}
+
+	return rv, nil
+}
+
+// HashFile - Compute the digest of a single file with the configured algorithm.
+func (c *CardFileUtil) HashFile(fileName string) (FileDigest, error) {
+
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return FileDigest{}, fmt.Errorf("error opening %s: %w", fileName, err)
+	}
+	defer closeDefer(fi, fileName)
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return FileDigest{}, err
+	}
+
+	_, err = io.CopyBuffer(h, fi, make([]byte, c.transBufferSize))
+	if err != nil {
+		return FileDigest{}, fmt.Errorf("error hashing %s: %w", fileName, err)
+	}
+
+	return FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}, nil
+}
@@ -0,0 +1,140 @@
+package cardfileutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// DefaultFileMode - Permissions given to copied files, unless configured
+// otherwise.  Photos and videos are data, so nothing should be executable.
+const DefaultFileMode os.FileMode = 0644
+
+// mtimeTolerance - FAT, exFAT and some SMB shares only store modification
+// times with two second resolution, so allow that much slop when checking
+// that the mtime was preserved.
+const mtimeTolerance = 2 * time.Second
+
+// DigestXattrPrefix - With SetDigestXattr, the verified digest of each
+// copy is recorded in the user.cardslurp.<algo> extended attribute, as
+// hex, so it travels with the file.
+const DigestXattrPrefix = "user.cardslurp."
+
+var (
+	// ErrMetadataMismatch - The target's timestamps, permissions or
+	// extended attributes do not match what was applied.
+	ErrMetadataMismatch = errors.New("target metadata does not match source")
+)
+
+// ParseFileMode - Convert an octal string like "0644" from the command
+// line to a file mode.
+func ParseFileMode(modeStr string) (os.FileMode, error) {
+
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing file mode %s: %w", modeStr, err)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("file mode %s has bits outside of 0777", modeStr)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// fileMetadata - The parts of the source metadata that are carried over
+// to the target.
+type fileMetadata struct {
+	modTime    time.Time
+	accessTime time.Time
+	xattrs     map[string][]byte
+	// size - Not carried over, but it decides how the file is copied.
+	size int64
+}
+
+// readMetadata - Collect the metadata of the source file.
+func readMetadata(from *os.File) (fileMetadata, error) {
+
+	info, err := from.Stat()
+	if err != nil {
+		return fileMetadata{}, fmt.Errorf("error calling stat on %s: %w", from.Name(), err)
+	}
+
+	return fileMetadata{
+		modTime:    info.ModTime(),
+		accessTime: accessTime(info),
+		size:       info.Size(),
+	}, nil
+}
+
+// applyTimes - Set the source timestamps on the target.  This has to be
+// the last thing done to the target, because any later write resets the
+// mtime.
+func applyTimes(toFile string, meta fileMetadata) error {
+
+	err := os.Chtimes(toFile, meta.accessTime, meta.modTime)
+	if err != nil {
+		return fmt.Errorf("error setting times on %s: %w", toFile, err)
+	}
+
+	return nil
+}
+
+// SetDigestXattr - Record the verified digest of each copy on the copy
+// itself (see DigestXattrPrefix).  Only Linux has this, and targets
+// without xattr support are left without it.
+func (c *CardFileUtil) SetDigestXattr(on bool) {
+	c.digestXattr = on
+}
+
+// recordDigest - With SetDigestXattr, record the digest on the target.
+// verifyMetadata checks it along with the copied xattrs.
+func (c *CardFileUtil) recordDigest(toFile string, digest FileDigest, meta *fileMetadata) error {
+
+	if !c.digestXattr {
+		return nil
+	}
+
+	name, val, err := setDigestXattr(toFile, digest)
+	if err != nil || name == "" {
+		return err
+	}
+	if meta.xattrs == nil {
+		meta.xattrs = make(map[string][]byte)
+	}
+	meta.xattrs[name] = val
+
+	return nil
+}
+
+// verifyMetadata - Confirm the target has the mtime, permissions and xattrs
+// that were applied.  The atime is not checked, because reading the file
+// during verification is allowed to update it.
+func (c *CardFileUtil) verifyMetadata(toFile string, meta fileMetadata) error {
+
+	info, err := os.Stat(toFile)
+	if err != nil {
+		return fmt.Errorf("error calling stat on %s: %w", toFile, err)
+	}
+
+	diff := info.ModTime().Sub(meta.modTime)
+	if diff < -mtimeTolerance || diff > mtimeTolerance {
+		return fmt.Errorf("%s mtime is %s, expected %s: %w", toFile,
+			info.ModTime(), meta.modTime, ErrMetadataMismatch)
+	}
+
+	// Windows only has a read only bit, so the mode can not round trip.
+	if runtime.GOOS != "windows" && info.Mode().Perm() != c.fileMode {
+		return fmt.Errorf("%s mode is %s, expected %s: %w", toFile,
+			info.Mode().Perm(), c.fileMode, ErrMetadataMismatch)
+	}
+
+	err = verifyUserXattrs(toFile, meta.xattrs)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMetadataMismatch, err)
+	}
+
+	return nil
+}
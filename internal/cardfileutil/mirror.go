@@ -0,0 +1,418 @@
+package cardfileutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTargetStalled - A mirror target stopped taking writes for longer than
+// the target timeout (see SetTargetTimeout), so it was dropped.
+var ErrTargetStalled = errors.New("target stopped taking writes")
+
+// errAllTargetsFailed - Every target of a mirrored copy failed, so there
+// is no point in reading the rest of the source.
+var errAllTargetsFailed = errors.New("every target failed")
+
+// DefaultTargetTimeout - How long a mirror target may go without taking a
+// write before it is dropped.
+const DefaultTargetTimeout = time.Minute
+
+// mirrorQueueDepth - How many buffers each mirror target may fall behind
+// the source before the read waits for it.
+const mirrorQueueDepth = 8
+
+// SetTargetTimeout - How long a target of CardFileMirror may go without
+// taking a write before it is dropped, so a stalled NAS does not hold up
+// the other targets.  0 waits forever.
+func (c *CardFileUtil) SetTargetTimeout(timeout time.Duration) {
+	c.targetTimeout = timeout
+}
+
+// mirrorChunk - One buffer read from the source, shared by the targets.
+// It goes back to the pool once every target has written it.
+type mirrorChunk struct {
+	data []byte
+	refs atomic.Int32
+	pool *sync.Pool
+}
+
+func (m *mirrorChunk) release() {
+	if m.refs.Add(-1) == 0 {
+		m.pool.Put(m)
+	}
+}
+
+// mirrorTarget - One target of CardFileMirror.  Its own goroutine writes
+// the buffers it is sent, so a slow target only holds up the source once
+// its queue is full.
+type mirrorTarget struct {
+	index    int
+	toFile   string
+	tempName string
+	obs      CopyObserver
+	to       *os.File
+	queue    chan *mirrorChunk
+	// done - Closed when the writer goroutine returns.  writeErr is only
+	// read after that.
+	done     chan struct{}
+	writeErr error
+	// written - Buffers written so far, to tell a slow target from a
+	// stalled one.
+	written atomic.Uint64
+	// abandoned - Set when the target is dropped, so the writer does not
+	// write anything more.
+	abandoned atomic.Bool
+	// err - Why this target was dropped.  Only touched by the goroutine
+	// reading the source, and then by finishMirror.
+	err         error
+	queueClosed bool
+}
+
+// writer - Write each buffer sent to the target, until the queue is closed
+// or a write fails.
+func (t *mirrorTarget) writer(fault func(index int)) {
+
+	defer close(t.done)
+
+	for chunk := range t.queue {
+		if t.writeErr != nil || t.abandoned.Load() {
+			chunk.release()
+			continue
+		}
+		if fault != nil {
+			fault(t.index)
+		}
+		_, err := t.to.Write(chunk.data)
+		chunk.release()
+		if err != nil {
+			t.writeErr = fmt.Errorf("error writing %s: %w", t.tempName, err)
+			continue
+		}
+		t.written.Add(1)
+	}
+}
+
+// live - True if the target is still being written.
+func (t *mirrorTarget) live() bool {
+	return t.err == nil
+}
+
+// closeQueue - Tell the writer there is nothing more to write.
+func (t *mirrorTarget) closeQueue() {
+	if !t.queueClosed {
+		t.queueClosed = true
+		close(t.queue)
+	}
+}
+
+// drop - Stop sending to the target.  A writer stuck in a write is left to
+// finish by itself, and nothing more is written.
+func (t *mirrorTarget) drop(err error) {
+	t.err = err
+	t.abandoned.Store(true)
+	t.closeQueue()
+}
+
+// send - Queue one buffer for the target.  A target that failed a write, or
+// that takes no writes for the target timeout, is dropped.
+func (c *CardFileUtil) send(ctx context.Context, t *mirrorTarget, chunk *mirrorChunk) error {
+
+	// Most of the time there is room, and no timer is needed.
+	select {
+	case t.queue <- chunk:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if c.targetTimeout > 0 {
+		timer := time.NewTimer(c.targetTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case t.queue <- chunk:
+		return nil
+	case <-t.done:
+		chunk.release()
+		t.drop(t.writeErr)
+		return nil
+	case <-timeout:
+		chunk.release()
+		t.drop(fmt.Errorf("%s: %w for %s", t.tempName, ErrTargetStalled, c.targetTimeout))
+		return nil
+	case <-ctx.Done():
+		chunk.release()
+		return ctx.Err()
+	}
+}
+
+// waitWriter - Wait for the writer of a target to drain its queue.  It is
+// dropped if it makes no progress for the target timeout.
+func (c *CardFileUtil) waitWriter(ctx context.Context, t *mirrorTarget) error {
+
+	var tick <-chan time.Time
+	if c.targetTimeout > 0 {
+		ticker := time.NewTicker(c.targetTimeout)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last := t.written.Load()
+	for {
+		select {
+		case <-t.done:
+			return t.writeErr
+		case <-ctx.Done():
+			t.abandoned.Store(true)
+			return ctx.Err()
+		case <-tick:
+			now := t.written.Load()
+			if now == last {
+				t.abandoned.Store(true)
+				return fmt.Errorf("%s: %w for %s", t.tempName, ErrTargetStalled, c.targetTimeout)
+			}
+			last = now
+		}
+	}
+}
+
+// CardFileMirror - CardFileCopy to several targets, reading the source
+// only once.  Each buffer read from the source is queued for every
+// target, and each target has its own goroutine writing its queue, so the
+// targets are written at the same time.  Then each target is synced,
+// verified against the source digest and renamed into place by itself, in
+// parallel, so a slow target does not hold up the verification of a fast
+// one.
+//
+// A target that can not be written, or that takes no writes for the target
+// timeout (see SetTargetTimeout), is dropped, and the others carry on.
+// The results and errors are per target, in the order of toFiles, and mean
+// the same as those of CardFileCopy.  An error reading the source, or a
+// cancel, fails every target.  obs may be nil, or hold a nil observer for
+// any target.
+//
+// Mirrored copies are not split into ranges (see SetRangedCopy), so the
+// source is read front to back, once.
+func (c *CardFileUtil) CardFileMirror(ctx context.Context, fromFile string,
+	toFiles []string, obs []CopyObserver) ([]CopyResult, []error) {
+
+	rv := make([]CopyResult, len(toFiles))
+	errs := make([]error, len(toFiles))
+
+	targets := make([]*mirrorTarget, 0, len(toFiles))
+	for i, toFile := range toFiles {
+		t := &mirrorTarget{
+			index:  i,
+			toFile: toFile,
+			queue:  make(chan *mirrorChunk, mirrorQueueDepth),
+			done:   make(chan struct{}),
+		}
+		if obs != nil {
+			t.obs = obs[i]
+		}
+
+		var err error
+		t.tempName, err = tempNameFor(toFile)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if t.obs != nil {
+			err = t.obs.Started(t.tempName)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		targets = append(targets, t)
+	}
+
+	meta, digest, extras, err := c.mirrorToTemps(ctx, fromFile, targets)
+	for _, t := range targets {
+		if t.live() && err != nil {
+			t.drop(err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *mirrorTarget) {
+			defer wg.Done()
+			rv[t.index] = CopyResult{Digest: digest, Extra: extras}
+			errs[t.index] = c.finishMirror(ctx, fromFile, t, meta, &rv[t.index])
+		}(t)
+	}
+	wg.Wait()
+
+	return rv, errs
+}
+
+// mirrorToTemps - Open the temp file of every target, start its writer,
+// and copy the source into all of them.  Targets that fail are dropped,
+// and the error is only for a failure that hits all of them.  The queues
+// of the targets still live are closed when it returns.
+func (c *CardFileUtil) mirrorToTemps(ctx context.Context, fromFile string,
+	targets []*mirrorTarget) (fileMetadata, FileDigest, []FileDigest, error) {
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return fileMetadata{}, FileDigest{}, nil, err
+	}
+	extras, err := c.extraHashes()
+	if err != nil {
+		return fileMetadata{}, FileDigest{}, nil, err
+	}
+	ws := []io.Writer{h}
+	for _, e := range extras {
+		ws = append(ws, e)
+	}
+	hashes := io.MultiWriter(ws...)
+
+	from, err := os.Open(fromFile)
+	if err != nil {
+		return fileMetadata{}, FileDigest{}, nil,
+			sourceErr(fmt.Errorf("error opening from file: %w", err))
+	}
+	defer closeDefer(from, fromFile)
+
+	meta, err := readMetadata(from)
+	if err != nil {
+		return fileMetadata{}, FileDigest{}, nil, sourceErr(err)
+	}
+
+	for _, t := range targets {
+		// O_EXCL, because the temp name should never exist already.
+		t.to, err = os.OpenFile(t.tempName, os.O_RDWR|os.O_CREATE|os.O_EXCL, c.fileMode)
+		if err != nil {
+			t.to = nil
+			close(t.done)
+			t.drop(fmt.Errorf("error opening to file: %w", err))
+			continue
+		}
+		go t.writer(c.mirrorFault)
+	}
+	defer func() {
+		for _, t := range targets {
+			t.closeQueue()
+		}
+	}()
+
+	pool := &sync.Pool{}
+	pool.New = func() any {
+		return &mirrorChunk{data: make([]byte, c.transBufferSize), pool: pool}
+	}
+
+	src := ctxReader{ctx: ctx, r: sourceReader{r: from}}
+	for {
+		chunk := pool.Get().(*mirrorChunk)
+		n, err := src.Read(chunk.data[:cap(chunk.data)])
+		if n > 0 {
+			chunk.data = chunk.data[:n]
+			_, _ = hashes.Write(chunk.data)
+
+			live := make([]*mirrorTarget, 0, len(targets))
+			for _, t := range targets {
+				if t.live() {
+					live = append(live, t)
+				}
+			}
+			if len(live) == 0 {
+				return meta, FileDigest{}, nil, errAllTargetsFailed
+			}
+
+			// One reference for each target, and one for the loop,
+			// so the chunk can not go back to the pool early.
+			chunk.refs.Store(int32(len(live)) + 1)
+			for _, t := range live {
+				sendErr := c.send(ctx, t, chunk)
+				if sendErr != nil {
+					return meta, FileDigest{}, nil, sendErr
+				}
+			}
+			chunk.release()
+		} else {
+			pool.Put(chunk)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return meta, FileDigest{}, nil, fmt.Errorf("error copying from to to: %w", err)
+		}
+	}
+
+	return meta, FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}, c.extraSums(extras), nil
+}
+
+// finishMirror - Wait for the writer of one target of CardFileMirror, then
+// sync, verify and commit it, or clean it up if it failed.
+func (c *CardFileUtil) finishMirror(ctx context.Context, fromFile string, t *mirrorTarget,
+	meta fileMetadata, rv *CopyResult) error {
+
+	err := t.err
+	if t.to == nil {
+		removeTemp(t.tempName)
+		return err
+	}
+
+	if err == nil {
+		err = c.waitWriter(ctx, t)
+	}
+	if err == nil {
+		err = c.finishTemp(ctx, fromFile, t.to, t.tempName, meta, t.obs, true, rv)
+		closeDefer(t.to, t.tempName)
+		if err != nil {
+			removeTemp(t.tempName)
+			return err
+		}
+		return commitTemp(ctx, fromFile, t.tempName, t.toFile)
+	}
+
+	// Closing the file would wait for a write in progress, so a writer
+	// that is stuck cleans up after itself, whenever its write returns.
+	cleanup := func() {
+		closeDefer(t.to, t.tempName)
+		removeTemp(t.tempName)
+	}
+	if c.writerStopped(t) {
+		cleanup()
+	} else {
+		go func() {
+			<-t.done
+			cleanup()
+		}()
+	}
+
+	return err
+}
+
+// writerStopped - Wait up to the target timeout for the writer of a
+// dropped target to return.
+func (c *CardFileUtil) writerStopped(t *mirrorTarget) bool {
+
+	if c.targetTimeout == 0 {
+		<-t.done
+		return true
+	}
+
+	timer := time.NewTimer(c.targetTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,133 @@
+package cardfileutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCardFileMirror(t *testing.T) {
+
+	dir := t.TempDir()
+	source := "testData/same_a.txt"
+	toFiles := []string{
+		filepath.Join(dir, "ssd", "victim.txt"),
+		filepath.Join(dir, "missing", "victim.txt"),
+		filepath.Join(dir, "nas", "victim.txt"),
+	}
+	for _, d := range []string{"ssd", "nas"} {
+		err := os.Mkdir(filepath.Join(dir, d), 0755)
+		if err != nil {
+			t.Fatal("error making target dir: " + err.Error())
+		}
+	}
+
+	cfu := NewCardFileUtil(16384, 2, HashSHA256, DefaultFileMode)
+	cfu.SetExtraDigests(HashMD5)
+
+	want, err := cfu.HashFile(source)
+	if err != nil {
+		t.Fatal("error hashing source: " + err.Error())
+	}
+
+	// The target that can not be written fails by itself.
+	res, errs := cfu.CardFileMirror(context.Background(), source, toFiles, nil)
+	if errs[1] == nil || errors.Is(errs[1], ErrSourceRead) {
+		t.Errorf("expected a target error for %s, got %v", toFiles[1], errs[1])
+	}
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Fatalf("error mirroring to %s: %s", toFiles[i], errs[i].Error())
+		}
+		if !res[i].Digest.Equal(want) || !res[i].Verify.OK() || len(res[i].Extra) != 1 {
+			t.Errorf("unexpected result for %s: %+v", toFiles[i], res[i])
+		}
+		same, err := cfu.IsFileSame(source, toFiles[i])
+		if err != nil {
+			t.Fatal("error calling IsFileSame: " + err.Error())
+		}
+		if !same {
+			t.Errorf("%s does not match the source", toFiles[i])
+		}
+	}
+
+	// A source that can not be read fails every target, and leaves nothing
+	// behind.
+	_, errs = cfu.CardFileMirror(context.Background(), "testData/missing.txt",
+		[]string{filepath.Join(dir, "ssd", "other.txt"), filepath.Join(dir, "nas", "other.txt")}, nil)
+	for i, err := range errs {
+		if !errors.Is(err, ErrSourceRead) {
+			t.Errorf("target %d: expected ErrSourceRead, got %v", i, err)
+		}
+	}
+	for _, d := range []string{"ssd", "nas"} {
+		entries, err := os.ReadDir(filepath.Join(dir, d))
+		if err != nil {
+			t.Fatal("error reading target dir: " + err.Error())
+		}
+		if len(entries) != 1 {
+			t.Errorf("expected only victim.txt in %s, got %d files", d, len(entries))
+		}
+	}
+}
+
+func TestCardFileMirrorStalledTarget(t *testing.T) {
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "MVI_0001.MOV")
+	writeRandomFile(t, source, 300007)
+	toFiles := []string{
+		filepath.Join(dir, "ssd.MOV"),
+		filepath.Join(dir, "nas.MOV"),
+	}
+
+	cfu := NewCardFileUtil(4096, 1, HashSHA256, DefaultFileMode)
+	cfu.SetTargetTimeout(100 * time.Millisecond)
+
+	// The NAS takes its first write, and then hangs.
+	hang := make(chan struct{})
+	cfu.mirrorFault = func(index int) {
+		if index == 1 {
+			<-hang
+		}
+	}
+
+	start := time.Now()
+	_, errs := cfu.CardFileMirror(context.Background(), source, toFiles, nil)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the stalled target held up the copy for %s", time.Since(start))
+	}
+	if errs[0] != nil {
+		t.Fatal("error mirroring to the SSD: " + errs[0].Error())
+	}
+	if !errors.Is(errs[1], ErrTargetStalled) {
+		t.Errorf("expected ErrTargetStalled for the NAS, got %v", errs[1])
+	}
+
+	same, err := cfu.IsFileSame(source, toFiles[0])
+	if err != nil {
+		t.Fatal("error calling IsFileSame: " + err.Error())
+	}
+	if !same {
+		t.Error("the SSD copy does not match the source")
+	}
+
+	// Once the write returns, the NAS temp file is cleaned up.
+	close(hang)
+	for i := 0; ; i++ {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal("error reading target dir: " + err.Error())
+		}
+		if len(entries) == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected only the source and the SSD copy, got %d files", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
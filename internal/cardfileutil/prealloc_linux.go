@@ -0,0 +1,19 @@
+//go:build linux
+
+package cardfileutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate - Reserve the blocks for the whole file up front, so the
+// ranges written in parallel do not fragment it.  Filesystems without
+// fallocate get a plain truncate.
+func preallocate(fi *os.File, size int64) error {
+	err := syscall.Fallocate(int(fi.Fd()), 0, 0, size)
+	if err == nil {
+		return nil
+	}
+	return fi.Truncate(size)
+}
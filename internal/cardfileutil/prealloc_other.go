@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cardfileutil
+
+import "os"
+
+// preallocate - Size the file up front, so each range can be written in
+// place.
+func preallocate(fi *os.File, size int64) error {
+	return fi.Truncate(size)
+}
@@ -0,0 +1,325 @@
+package cardfileutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// RangedCopyOpts - Settings for copying very large files in parallel byte
+// ranges.  The zero value turns ranged copies off.
+type RangedCopyOpts struct {
+	// Threshold - Files larger than this many bytes are copied in ranges.
+	// Zero turns ranged copies off.
+	Threshold uint64
+	// RangeSize - Bytes in each range.  The last range may be shorter.
+	RangeSize uint64
+	// Workers - Ranges copied at the same time.
+	Workers uint64
+	// Retries - Times a range that fails verification is copied again,
+	// before the whole file is reported as a mismatch.
+	Retries uint64
+}
+
+// SetRangedCopy - Copy files above opts.Threshold in parallel ranges.  A
+// single huge video file otherwise keeps one worker busy while the rest
+// sit idle at the end of an import.
+func (c *CardFileUtil) SetRangedCopy(opts RangedCopyOpts) {
+	if opts.Workers == 0 {
+		opts.Workers = 1
+	}
+	c.ranged = opts
+}
+
+func (c *CardFileUtil) useRanges(size int64) bool {
+	return c.ranged.Threshold != 0 && c.ranged.RangeSize != 0 &&
+		uint64(size) > c.ranged.Threshold
+}
+
+// byteRange - One piece of a ranged copy.
+type byteRange struct {
+	index  int
+	offset int64
+	length int64
+}
+
+func splitRanges(size int64, rangeSize int64) []byteRange {
+	rv := make([]byteRange, 0, size/rangeSize+1)
+	for off := int64(0); off < size; off += rangeSize {
+		length := rangeSize
+		if size-off < length {
+			length = size - off
+		}
+		rv = append(rv, byteRange{index: len(rv), offset: off, length: length})
+	}
+	return rv
+}
+
+// rangeResult - Outcome of the last attempt at one range.
+type rangeResult struct {
+	verify  VerifyResult
+	retries uint64
+	// digest - Of the range as it was read from the source, the last time.
+	digest FileDigest
+	err    error
+}
+
+// copyRanges - Copy from into the preallocated to in ranges, with
+// c.ranged.Workers ranges in flight at once.  Each range is hashed as it is
+// read from the card, written with WriteAt, synced, and then verified by
+// reading back just that range of the target.  A range that does not match
+// is copied again by itself, so a bad read late in a 40 GB file does not
+// cost the whole file.
+//
+// The whole file digest, which the ledger and library index use, and any
+// extra digests, can not be put together from the ranges, so the source is
+// read once more in order, alongside the ranges.  That pass hashes each
+// range too, and a range that read differently the two times fails the
+// copy.  The first error, or a cancel, stops any more ranges being started.
+func (c *CardFileUtil) copyRanges(ctx context.Context, from *os.File, to *os.File,
+	toName string, size int64) (CopyResult, error) {
+
+	err := preallocate(to, size)
+	if err != nil {
+		return CopyResult{}, fmt.Errorf("error preallocating %s: %w", toName, err)
+	}
+
+	ranges := splitRanges(size, int64(c.ranged.RangeSize))
+	results := make([]rangeResult, len(ranges))
+
+	// Canceling rctx stops the ranges in flight as well as the feeder.
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failErr error
+	failOnce := sync.Once{}
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failErr = err
+			cancel()
+		})
+	}
+
+	wg := &sync.WaitGroup{}
+
+	var whole sourceHashes
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		whole, err = c.hashSource(rctx, from, ranges)
+		if err != nil {
+			fail(err)
+		}
+	}()
+
+	work := make(chan byteRange)
+	for i := uint64(0); i < c.ranged.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, c.transBufferSize)
+			for r := range work {
+				if rctx.Err() != nil {
+					continue
+				}
+				results[r.index] = c.copyOneRange(rctx, from, to, toName, r, buf)
+				if results[r.index].err != nil {
+					fail(results[r.index].err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, r := range ranges {
+		select {
+		case work <- r:
+		case <-rctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	rv := CopyResult{
+		Verify: VerifyResult{
+			Passes: make([]PassResult, c.verificationPasses),
+		},
+	}
+	for i := range rv.Verify.Passes {
+		rv.Verify.Passes[i] = PassResult{Match: true, CacheDropped: true}
+	}
+
+	if failErr != nil {
+		return rv, failErr
+	}
+	// A cancel between two ranges stops the feeder before anything fails.
+	err = ctx.Err()
+	if err != nil {
+		return rv, err
+	}
+
+	for i, res := range results {
+		rv.RangeRetries += res.retries
+		for j, p := range res.verify.Passes {
+			rv.Verify.Passes[j].Match = rv.Verify.Passes[j].Match && p.Match
+			rv.Verify.Passes[j].CacheDropped = rv.Verify.Passes[j].CacheDropped && p.CacheDropped
+		}
+		if !res.digest.Equal(whole.ranges[i]) {
+			return rv, sourceErr(fmt.Errorf("bytes %d-%d of %s read differently twice",
+				ranges[i].offset, ranges[i].offset+ranges[i].length, from.Name()))
+		}
+	}
+	if !rv.Verify.OK() {
+		return rv, nil
+	}
+
+	rv.Digest = whole.digest
+	rv.Extra = whole.extra
+
+	return rv, nil
+}
+
+// sourceHashes - What hashSource found.
+type sourceHashes struct {
+	digest FileDigest
+	extra  []FileDigest
+	// ranges - The digest of each range, in order.
+	ranges []FileDigest
+}
+
+// hashSource - Read from front to back, hashing the whole file, for the
+// digest and any extra digests, and each of the ranges.  It reads with
+// ReadAt, so it does not disturb the range workers.
+func (c *CardFileUtil) hashSource(ctx context.Context, from *os.File,
+	ranges []byteRange) (sourceHashes, error) {
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return sourceHashes{}, err
+	}
+	extras, err := c.extraHashes()
+	if err != nil {
+		return sourceHashes{}, err
+	}
+	rh, err := newHash(c.hashAlgo)
+	if err != nil {
+		return sourceHashes{}, err
+	}
+
+	ws := []io.Writer{h, rh}
+	for _, e := range extras {
+		ws = append(ws, e)
+	}
+	hashes := io.MultiWriter(ws...)
+
+	rv := sourceHashes{ranges: make([]FileDigest, len(ranges))}
+	buf := make([]byte, c.transBufferSize)
+	for _, r := range ranges {
+		rh.Reset()
+		src := ctxReader{ctx: ctx,
+			r: sourceReader{r: io.NewSectionReader(from, r.offset, r.length)}}
+		_, err = io.CopyBuffer(hashes, src, buf)
+		if err != nil {
+			return rv, fmt.Errorf("error hashing bytes %d-%d of %s: %w",
+				r.offset, r.offset+r.length, from.Name(), err)
+		}
+		rv.ranges[r.index] = FileDigest{Algo: c.hashAlgo, Sum: rh.Sum(nil)}
+	}
+
+	rv.digest = FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}
+	rv.extra = c.extraSums(extras)
+
+	return rv, nil
+}
+
+// copyOneRange - Copy and verify one range, retrying just this range on a
+// mismatch.
+func (c *CardFileUtil) copyOneRange(ctx context.Context, from *os.File, to *os.File,
+	toName string, r byteRange, buf []byte) rangeResult {
+
+	rv := rangeResult{}
+
+	for {
+		h, err := newHash(c.hashAlgo)
+		if err != nil {
+			rv.err = err
+			return rv
+		}
+
+		src := ctxReader{ctx: ctx,
+			r: sourceReader{r: io.NewSectionReader(from, r.offset, r.length)}}
+		dst := io.NewOffsetWriter(to, r.offset)
+		_, err = io.CopyBuffer(io.MultiWriter(dst, h), src, buf)
+		if err != nil {
+			rv.err = fmt.Errorf("error copying bytes %d-%d: %w",
+				r.offset, r.offset+r.length, err)
+			return rv
+		}
+		if c.rangeFault != nil {
+			c.rangeFault(to, r.index, r.offset)
+		}
+
+		err = to.Sync()
+		if err != nil {
+			rv.err = fmt.Errorf("error syncing %s: %w", toName, err)
+			return rv
+		}
+
+		rv.digest = FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}
+		rv.verify, err = c.verifyRange(ctx, toName, r, rv.digest, buf)
+		if err != nil {
+			rv.err = err
+			return rv
+		}
+		if rv.verify.OK() || rv.retries >= c.ranged.Retries {
+			return rv
+		}
+
+		rv.retries++
+		fmt.Printf("Retrying bytes %d-%d of %s (%s)\n", r.offset,
+			r.offset+r.length, from.Name(), rv.verify)
+	}
+}
+
+// verifyRange - VerifyDigest for one range of the target.  Each range
+// opens the target itself, so the ranges do not share a file offset.
+func (c *CardFileUtil) verifyRange(ctx context.Context, toName string, r byteRange,
+	digest FileDigest, buf []byte) (VerifyResult, error) {
+
+	to, err := os.Open(toName)
+	if err != nil {
+		return VerifyResult{}, fmt.Errorf("error opening %s: %w", toName, err)
+	}
+	defer closeDefer(to, toName)
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	rv := VerifyResult{
+		Passes: make([]PassResult, 0, c.verificationPasses),
+	}
+
+	for i := 0; i < int(c.verificationPasses); i++ {
+
+		dropped := dropFileCache(to)
+
+		h.Reset()
+		_, err = io.CopyBuffer(h, ctxReader{ctx: ctx, r: io.NewSectionReader(to, r.offset, r.length)}, buf)
+		if err != nil {
+			return rv, fmt.Errorf("error hashing bytes %d-%d of %s on pass %d: %w",
+				r.offset, r.offset+r.length, toName, i+1, err)
+		}
+
+		rv.Passes = append(rv.Passes, PassResult{
+			Match:        digest.Equal(FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}),
+			CacheDropped: dropped,
+		})
+	}
+
+	return rv, nil
+}
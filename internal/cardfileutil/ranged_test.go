@@ -0,0 +1,183 @@
+package cardfileutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeRandomFile(t *testing.T, fileName string, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	err := os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		t.Fatal("error writing " + fileName + ": " + err.Error())
+	}
+	return data
+}
+
+func TestRangedCopy(t *testing.T) {
+
+	dir := t.TempDir()
+	fromFile := filepath.Join(dir, "MVI_0001.MOV")
+	toFile := filepath.Join(dir, "copy.MOV")
+	data := writeRandomFile(t, fromFile, 1000003)
+
+	cfu := NewCardFileUtil(4096, 2, HashXXH64, DefaultFileMode)
+	cfu.SetRangedCopy(RangedCopyOpts{
+		Threshold: 1000,
+		RangeSize: 65543,
+		Workers:   4,
+		Retries:   2,
+	})
+
+	res, err := cfu.CardFileCopy(context.Background(), fromFile, toFile, nil)
+	if err != nil {
+		t.Fatal("error calling CardFileCopy: " + err.Error())
+	}
+
+	got, err := os.ReadFile(toFile)
+	if err != nil {
+		t.Fatal("error reading copy: " + err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("ranged copy does not match the source")
+	}
+
+	want, err := cfu.HashFile(fromFile)
+	if err != nil {
+		t.Fatal("error hashing source: " + err.Error())
+	}
+	if !res.Digest.Equal(want) {
+		t.Fatalf("digest %s, want %s", res.Digest, want)
+	}
+	if !res.Verify.OK() || len(res.Verify.Passes) != 2 {
+		t.Fatalf("unexpected verify result: %s", res.Verify)
+	}
+	if res.RangeRetries != 0 {
+		t.Fatalf("%d range retries without a fault", res.RangeRetries)
+	}
+}
+
+func TestRangedCopyRetriesRange(t *testing.T) {
+
+	dir := t.TempDir()
+	fromFile := filepath.Join(dir, "MVI_0002.MOV")
+	toFile := filepath.Join(dir, "copy.MOV")
+	data := writeRandomFile(t, fromFile, 300000)
+
+	cfu := NewCardFileUtil(4096, 1, HashSHA256, DefaultFileMode)
+	cfu.SetRangedCopy(RangedCopyOpts{
+		Threshold: 1000,
+		RangeSize: 100000,
+		Workers:   3,
+		Retries:   2,
+	})
+
+	// Corrupt the middle range the first time it is written.
+	mu := sync.Mutex{}
+	writes := make(map[int]int)
+	cfu.rangeFault = func(to *os.File, index int, offset int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		writes[index]++
+		if index == 1 && writes[index] == 1 {
+			_, _ = to.WriteAt([]byte("bad"), offset+10)
+		}
+	}
+
+	res, err := cfu.CardFileCopy(context.Background(), fromFile, toFile, nil)
+	if err != nil {
+		t.Fatal("error calling CardFileCopy: " + err.Error())
+	}
+	if res.RangeRetries != 1 {
+		t.Fatalf("%d range retries, want 1", res.RangeRetries)
+	}
+	if writes[0] != 1 || writes[1] != 2 || writes[2] != 1 {
+		t.Fatalf("range writes %v, want only range 1 copied twice", writes)
+	}
+
+	got, err := os.ReadFile(toFile)
+	if err != nil {
+		t.Fatal("error reading copy: " + err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("ranged copy does not match the source after a retry")
+	}
+}
+
+func TestRangedCopyOutOfRetries(t *testing.T) {
+
+	dir := t.TempDir()
+	fromFile := filepath.Join(dir, "MVI_0003.MOV")
+	toFile := filepath.Join(dir, "copy.MOV")
+	writeRandomFile(t, fromFile, 50000)
+
+	cfu := NewCardFileUtil(4096, 1, HashSHA256, DefaultFileMode)
+	cfu.SetRangedCopy(RangedCopyOpts{
+		Threshold: 1000,
+		RangeSize: 20000,
+		Workers:   2,
+		Retries:   1,
+	})
+	cfu.rangeFault = func(to *os.File, index int, offset int64) {
+		if index == 2 {
+			_, _ = to.WriteAt([]byte("bad"), offset)
+		}
+	}
+
+	res, err := cfu.CardFileCopy(context.Background(), fromFile, toFile, nil)
+	if !errors.Is(err, ErrVerifyMismatch) {
+		t.Fatalf("expected ErrVerifyMismatch, got %v", err)
+	}
+	if res.RangeRetries != 1 {
+		t.Fatalf("%d range retries, want 1", res.RangeRetries)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("error reading " + dir + ": " + err.Error())
+	}
+	if len(entries) != 1 {
+		t.Fatalf("failed copy left %d files behind", len(entries)-1)
+	}
+}
+
+func TestRangedCopyStopsOnError(t *testing.T) {
+
+	dir := t.TempDir()
+	fromFile := filepath.Join(dir, "MVI_0004.MOV")
+	toFile := filepath.Join(dir, "copy.MOV")
+	writeRandomFile(t, fromFile, 100000)
+
+	cfu := NewCardFileUtil(4096, 1, HashSHA256, DefaultFileMode)
+	cfu.SetRangedCopy(RangedCopyOpts{
+		Threshold: 1000,
+		RangeSize: 10000,
+		Workers:   1,
+		Retries:   1,
+	})
+
+	// Moving the temp file away makes the verify of every range fail to
+	// open it, so only the first range should be copied.
+	copied := 0
+	cfu.rangeFault = func(to *os.File, index int, offset int64) {
+		copied++
+		if index == 0 {
+			_ = os.Rename(to.Name(), filepath.Join(dir, "moved"))
+		}
+	}
+
+	_, err := cfu.CardFileCopy(context.Background(), fromFile, toFile, nil)
+	if err == nil {
+		t.Fatal("expected an error with the temp file gone")
+	}
+	if copied != 1 {
+		t.Fatalf("%d ranges copied after the first error, want 0", copied-1)
+	}
+}
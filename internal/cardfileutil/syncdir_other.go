@@ -0,0 +1,25 @@
+//go:build !windows
+
+package cardfileutil
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncDir - Flush the directory entry, so a rename survives a power loss.
+func syncDir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory %s: %w", dir, err)
+	}
+	defer closeDefer(d, dir)
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing directory %s: %w", dir, err)
+	}
+
+	return nil
+}
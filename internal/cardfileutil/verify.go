@@ -0,0 +1,109 @@
+package cardfileutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PassResult - Outcome of a single verification pass.
+type PassResult struct {
+	Match bool
+	// CacheDropped - True if the page cache was bypassed for this pass.
+	// When false, the pass may have been served from memory.
+	CacheDropped bool
+}
+
+// VerifyResult - Outcome of every verification pass, in order.
+type VerifyResult struct {
+	Passes []PassResult
+}
+
+// OK - True if there was at least one pass, and every pass matched.
+func (v VerifyResult) OK() bool {
+	if len(v.Passes) == 0 {
+		return false
+	}
+	for _, p := range v.Passes {
+		if !p.Match {
+			return false
+		}
+	}
+	return true
+}
+
+// String - One line summary of the passes, for logs and error messages.
+func (v VerifyResult) String() string {
+	parts := make([]string, 0, len(v.Passes))
+	for i, p := range v.Passes {
+		status := "ok"
+		if !p.Match {
+			status = "MISMATCH"
+		}
+		if !p.CacheDropped {
+			status += " (cached)"
+		}
+		parts = append(parts, fmt.Sprintf("pass %d: %s", i+1, status))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// VerifyDigest - Hash only the target file, and compare it to a digest
+// computed earlier.  This avoids reading the source a second time.  The
+// target is rewound and evicted from the page cache before each of the
+// verificationPasses passes, so each pass re-reads it from the disk.
+// Every pass is run, even after a mismatch, so the result shows whether
+// a problem is consistent or intermittent.
+func (c *CardFileUtil) VerifyDigest(toFile string, digest FileDigest) (VerifyResult, error) {
+	return c.verifyDigest(context.Background(), toFile, digest)
+}
+
+// verifyDigest - VerifyDigest, stopping early if ctx is cancelled.
+func (c *CardFileUtil) verifyDigest(ctx context.Context, toFile string,
+	digest FileDigest) (VerifyResult, error) {
+
+	if digest.Algo != c.hashAlgo {
+		return VerifyResult{}, fmt.Errorf(
+			"digest algorithm %s does not match configured %s", digest.Algo, c.hashAlgo)
+	}
+
+	to, err := os.Open(toFile)
+	if err != nil {
+		return VerifyResult{}, fmt.Errorf("error opening %s: %w", toFile, err)
+	}
+	defer closeDefer(to, toFile)
+
+	h, err := newHash(c.hashAlgo)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	buf := make([]byte, c.transBufferSize)
+	rv := VerifyResult{
+		Passes: make([]PassResult, 0, c.verificationPasses),
+	}
+
+	for i := 0; i < int(c.verificationPasses); i++ {
+
+		_, err = to.Seek(0, io.SeekStart)
+		if err != nil {
+			return rv, fmt.Errorf("error rewinding %s: %w", toFile, err)
+		}
+		dropped := dropFileCache(to)
+
+		h.Reset()
+		_, err = io.CopyBuffer(h, ctxReader{ctx: ctx, r: to}, buf)
+		if err != nil {
+			return rv, fmt.Errorf("error hashing %s on pass %d: %w", toFile, i+1, err)
+		}
+
+		rv.Passes = append(rv.Passes, PassResult{
+			Match:        digest.Equal(FileDigest{Algo: c.hashAlgo, Sum: h.Sum(nil)}),
+			CacheDropped: dropped,
+		})
+	}
+
+	return rv, nil
+}
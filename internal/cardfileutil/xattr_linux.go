@@ -0,0 +1,168 @@
+//go:build linux
+
+package cardfileutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// userXattrPrefix - Only the user namespace is copied.  The others need
+// privileges, or belong to the filesystem.
+const userXattrPrefix = "user."
+
+// xattrUnsupported - True for the errors a filesystem returns when it
+// has no xattr support at all.  Camera cards (FAT, exFAT) and many network
+// shares are like this, and that is not a reason to fail the copy.
+func xattrUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// listUserXattrs - Names of the user.* extended attributes on a file.
+func listUserXattrs(fileName string) ([]string, error) {
+
+	sz, err := syscall.Listxattr(fileName, nil)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing xattrs of %s: %w", fileName, err)
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(fileName, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error listing xattrs of %s: %w", fileName, err)
+	}
+
+	rv := make([]string, 0)
+	for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+		if strings.HasPrefix(name, userXattrPrefix) {
+			rv = append(rv, name)
+		}
+	}
+
+	return rv, nil
+}
+
+func getXattr(fileName string, name string) ([]byte, error) {
+
+	sz, err := syscall.Getxattr(fileName, name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading xattr %s of %s: %w", name, fileName, err)
+	}
+
+	buf := make([]byte, sz)
+	sz, err = syscall.Getxattr(fileName, name, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading xattr %s of %s: %w", name, fileName, err)
+	}
+
+	return buf[:sz], nil
+}
+
+// copyUserXattrs - Copy the user.* extended attributes from one file to
+// another.  Returns the attributes that were copied, so they can be
+// verified later.
+func copyUserXattrs(fromFile string, toFile string) (map[string][]byte, error) {
+
+	names, err := listUserXattrs(fromFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make(map[string][]byte, len(names))
+	for _, name := range names {
+		val, err := getXattr(fromFile, name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = syscall.Setxattr(toFile, name, val, 0)
+		if err != nil {
+			if xattrUnsupported(err) {
+				fmt.Printf("Target filesystem does not support xattrs, not copying them for: %s\n",
+					toFile)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("error writing xattr %s of %s: %w", name, toFile, err)
+		}
+		rv[name] = val
+	}
+
+	return rv, nil
+}
+
+// verifyUserXattrs - Confirm the attributes returned by copyUserXattrs
+// are present on the target.
+func verifyUserXattrs(toFile string, want map[string][]byte) error {
+
+	for name, val := range want {
+		got, err := getXattr(toFile, name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, val) {
+			return fmt.Errorf("xattr %s differs on %s", name, toFile)
+		}
+	}
+
+	return nil
+}
+
+// setDigestXattr - Record digest on fileName.  Returns the attribute, or
+// no name if the filesystem has no xattrs.
+func setDigestXattr(fileName string, digest FileDigest) (string, []byte, error) {
+
+	name := DigestXattrPrefix + string(digest.Algo)
+	val := []byte(hex.EncodeToString(digest.Sum))
+	err := syscall.Setxattr(fileName, name, val, 0)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return "", nil, nil
+		}
+		return "", nil, fmt.Errorf("error writing xattr %s of %s: %w", name, fileName, err)
+	}
+
+	return name, val, nil
+}
+
+// ReadDigestXattrs - The digests recorded on a file with SetDigestXattr.
+// Attributes for algorithms this version does not know are ignored.
+func ReadDigestXattrs(fileName string) ([]FileDigest, error) {
+
+	names, err := listUserXattrs(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]FileDigest, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, DigestXattrPrefix) {
+			continue
+		}
+		algo := HashAlgo(strings.TrimPrefix(name, DigestXattrPrefix))
+		_, err = newHash(algo)
+		if err != nil {
+			continue
+		}
+		val, err := getXattr(fileName, name)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := hex.DecodeString(string(val))
+		if err != nil {
+			return nil, fmt.Errorf("xattr %s of %s is not a hex digest", name, fileName)
+		}
+		rv = append(rv, FileDigest{Algo: algo, Sum: sum})
+	}
+
+	return rv, nil
+}
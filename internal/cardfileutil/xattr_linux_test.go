@@ -0,0 +1,74 @@
+//go:build linux
+
+package cardfileutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyUserXattrs(t *testing.T) {
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	target := filepath.Join(dir, "target.txt")
+
+	err := os.WriteFile(source, []byte("some image data"), 0600)
+	if err != nil {
+		t.Fatal("Error writing source: " + err.Error())
+	}
+
+	err = syscall.Setxattr(source, "user.cardslurp.test", []byte("keep me"), 0)
+	if err != nil {
+		t.Skip("filesystem does not support user xattrs: " + err.Error())
+	}
+
+	cfu := NewCardFileUtil(16384, 1, HashSHA256, DefaultFileMode)
+	_, err = cfu.CardFileCopy(context.Background(), source, target, nil)
+	if err != nil {
+		t.Fatal("Error calling CardFileCopy: " + err.Error())
+	}
+
+	val, err := getXattr(target, "user.cardslurp.test")
+	if err != nil {
+		t.Fatal("Error reading xattr from target: " + err.Error())
+	}
+	if string(val) != "keep me" {
+		t.Errorf("target xattr is %q, expected %q", val, "keep me")
+	}
+}
+
+func TestDigestXattr(t *testing.T) {
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	target := filepath.Join(dir, "target.txt")
+
+	err := os.WriteFile(source, []byte("some image data"), 0600)
+	if err != nil {
+		t.Fatal("Error writing source: " + err.Error())
+	}
+
+	err = syscall.Setxattr(source, "user.cardslurp.test", []byte("keep me"), 0)
+	if err != nil {
+		t.Skip("filesystem does not support user xattrs: " + err.Error())
+	}
+
+	cfu := NewCardFileUtil(16384, 1, HashXXH64, DefaultFileMode)
+	cfu.SetDigestXattr(true)
+	res, err := cfu.CardFileCopy(context.Background(), source, target, nil)
+	if err != nil {
+		t.Fatal("Error calling CardFileCopy: " + err.Error())
+	}
+
+	digests, err := ReadDigestXattrs(target)
+	if err != nil {
+		t.Fatal("Error reading digest xattrs: " + err.Error())
+	}
+	if len(digests) != 1 || !digests[0].Equal(res.Digest) {
+		t.Errorf("target digest xattrs are %v, expected %s", digests, res.Digest)
+	}
+}
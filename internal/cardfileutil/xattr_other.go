@@ -0,0 +1,23 @@
+//go:build !linux
+
+package cardfileutil
+
+// copyUserXattrs - Extended attributes are only carried over on Linux.
+func copyUserXattrs(fromFile string, toFile string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// verifyUserXattrs - Extended attributes are only carried over on Linux.
+func verifyUserXattrs(toFile string, want map[string][]byte) error {
+	return nil
+}
+
+// setDigestXattr - Extended attributes are only written on Linux.
+func setDigestXattr(fileName string, digest FileDigest) (string, []byte, error) {
+	return "", nil, nil
+}
+
+// ReadDigestXattrs - Extended attributes are only read on Linux.
+func ReadDigestXattrs(fileName string) ([]FileDigest, error) {
+	return nil, nil
+}
@@ -0,0 +1,143 @@
+package cardfileutil
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// This is a small, dependency free implementation of XXH64.  It is much
+// faster than SHA-256, which matters when the card reader is fast enough
+// that hashing becomes the bottleneck.  It is not a cryptographic hash.
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+type xxh64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	memUsed        int
+}
+
+// newXXH64 - Constructor for an XXH64 hash with a seed of zero.
+func newXXH64() hash.Hash64 {
+	x := &xxh64{}
+	x.Reset()
+	return x
+}
+
+func (x *xxh64) Reset() {
+	// Go evaluates constant expressions with arbitrary precision, so
+	// route the primes through a variable to get the wrap around.
+	p1 := xxhPrime1
+	x.v1 = p1 + xxhPrime2
+	x.v2 = xxhPrime2
+	x.v3 = 0
+	x.v4 = -p1
+	x.total = 0
+	x.memUsed = 0
+}
+
+func (x *xxh64) Size() int { return 8 }
+
+func (x *xxh64) BlockSize() int { return 32 }
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	acc *= xxhPrime1
+	return acc
+}
+
+func xxhMergeRound(acc, val uint64) uint64 {
+	val = xxhRound(0, val)
+	acc ^= val
+	acc = acc*xxhPrime1 + xxhPrime4
+	return acc
+}
+
+func (x *xxh64) Write(b []byte) (int, error) {
+
+	n := len(b)
+	x.total += uint64(n)
+
+	// Top off any partial stripe left over from the last write.
+	if x.memUsed > 0 {
+		c := copy(x.mem[x.memUsed:], b)
+		x.memUsed += c
+		b = b[c:]
+		if x.memUsed < len(x.mem) {
+			return n, nil
+		}
+		x.stripe(x.mem[:])
+		x.memUsed = 0
+	}
+
+	for len(b) >= 32 {
+		x.stripe(b[:32])
+		b = b[32:]
+	}
+
+	x.memUsed = copy(x.mem[:], b)
+
+	return n, nil
+}
+
+func (x *xxh64) stripe(b []byte) {
+	x.v1 = xxhRound(x.v1, binary.LittleEndian.Uint64(b[0:8]))
+	x.v2 = xxhRound(x.v2, binary.LittleEndian.Uint64(b[8:16]))
+	x.v3 = xxhRound(x.v3, binary.LittleEndian.Uint64(b[16:24]))
+	x.v4 = xxhRound(x.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (x *xxh64) Sum64() uint64 {
+
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v1, 1) + bits.RotateLeft64(x.v2, 7) +
+			bits.RotateLeft64(x.v3, 12) + bits.RotateLeft64(x.v4, 18)
+		h = xxhMergeRound(h, x.v1)
+		h = xxhMergeRound(h, x.v2)
+		h = xxhMergeRound(h, x.v3)
+		h = xxhMergeRound(h, x.v4)
+	} else {
+		h = xxhPrime5
+	}
+
+	h += x.total
+
+	b := x.mem[:x.memUsed]
+	for ; len(b) >= 8; b = b[8:] {
+		k1 := xxhRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h ^= k1
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+// Sum - Append the canonical (big endian) form of the hash to b.
+func (x *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, x.Sum64())
+}
@@ -0,0 +1,584 @@
+package mediameta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ISO base media file format (ISO/IEC 14496-12) support.  This covers MP4
+// and MOV video, HEIF/HEIC stills, and Canon CR3 raw files.  Everything is
+// stored as nested boxes, and we only descend into the few that hold
+// metadata.  The media data itself (mdat) is always skipped.
+
+// Limits that keep a corrupt file from sending us off reading garbage.
+const (
+	maxBoxDepth    = 8
+	maxBoxPayload  = 1 << 20
+	maxBoxesPerLvl = 4096
+)
+
+// The ISO and QuickTime epoch.
+var epoch1904 = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Canon stores the CR3 metadata in a uuid box with this ID, with the TIFF
+// structures in CMT1 (IFD0) and CMT2 (EXIF) boxes.
+var canonCR3UUID = []byte{
+	0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0,
+	0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48,
+}
+
+var errBadBox = errors.New("malformed ISO-BMFF box")
+
+// isBMFF - Check for the ftyp box every ISO-BMFF file starts with.  Old
+// QuickTime files may start with another box, like wide or moov.
+func isBMFF(magic []byte) bool {
+	if len(magic) < 8 {
+		return false
+	}
+	switch string(magic[4:8]) {
+	case "ftyp", "moov", "wide", "mdat", "free", "skip":
+		return true
+	default:
+		return false
+	}
+}
+
+// box - Where one box and its payload are in the file.
+type box struct {
+	typ   string
+	start int64
+	data  int64
+	end   int64
+}
+
+// walkBoxes - Call fn for each box between start and end.
+func walkBoxes(r io.ReaderAt, start int64, end int64, fn func(b box) error) error {
+
+	hdr := make([]byte, 16)
+	off := start
+
+	for i := 0; off+8 <= end; i++ {
+		if i >= maxBoxesPerLvl {
+			return fmt.Errorf("too many boxes at %d: %w", start, errBadBox)
+		}
+
+		_, err := r.ReadAt(hdr[:8], off)
+		if err != nil {
+			return fmt.Errorf("error reading box header at %d: %w", off, err)
+		}
+
+		b := box{
+			typ:   string(hdr[4:8]),
+			start: off,
+			data:  off + 8,
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch size {
+		case 0:
+			// The box runs to the end of its parent.
+			size = end - off
+		case 1:
+			// A 64 bit size follows the type.
+			_, err = r.ReadAt(hdr[8:16], off+8)
+			if err != nil {
+				return fmt.Errorf("error reading box size at %d: %w", off, err)
+			}
+			large := binary.BigEndian.Uint64(hdr[8:16])
+			if large > uint64(end-off) {
+				return fmt.Errorf("box %s at %d is too large: %w", b.typ, off, errBadBox)
+			}
+			size = int64(large)
+			b.data += 8
+		}
+
+		b.end = off + size
+		if b.end > end || b.end < b.data {
+			return fmt.Errorf("box %s at %d has a bad size: %w", b.typ, off, errBadBox)
+		}
+
+		err = fn(b)
+		if err != nil {
+			return err
+		}
+
+		off = b.end
+	}
+
+	return nil
+}
+
+// readPayload - Read the payload of a small box into memory.
+func readPayload(r io.ReaderAt, b box) ([]byte, error) {
+	n := b.end - b.data
+	if n > maxBoxPayload {
+		return nil, fmt.Errorf("box %s at %d is too large to read: %w", b.typ, b.start, errBadBox)
+	}
+	buf := make([]byte, n)
+	_, err := r.ReadAt(buf, b.data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading box %s at %d: %w", b.typ, b.start, err)
+	}
+	return buf, nil
+}
+
+// bmffParser - State collected while walking the boxes.  Metadata found
+// in different places is ranked, so the best source wins in the end.
+type bmffParser struct {
+	r io.ReaderAt
+	// exif - From Canon's CMT boxes or a HEIF Exif item.
+	exif Metadata
+	// keys - From QuickTime meta keys, which phones write.
+	keys Metadata
+	// movie - From mvhd, tkhd and the QuickTime user data.
+	movie Metadata
+	// iinf and iloc for the HEIF Exif item.
+	exifItemID uint32
+	itemLocs   map[uint32][2]int64
+}
+
+// parseBMFF - Read the metadata from an ISO-BMFF file.
+func parseBMFF(r io.ReaderAt, size int64, md *Metadata) error {
+
+	p := &bmffParser{r: r, itemLocs: make(map[uint32][2]int64)}
+
+	err := walkBoxes(r, 0, size, func(b box) error {
+		switch b.typ {
+		case "moov":
+			return p.walk(b, 1)
+		case "meta":
+			return p.heifMeta(b)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Phones and stills cameras write a real local time, with an offset.
+	// The mvhd time is UTC at best, and often the camera's local time
+	// mislabeled as UTC, so it is the last resort.
+	*md = p.exif
+	mergeMetadata(md, p.keys)
+	mergeMetadata(md, p.movie)
+
+	return nil
+}
+
+// walk - Descend into a container box, looking at the children we know.
+func (p *bmffParser) walk(parent box, depth int) error {
+
+	if depth > maxBoxDepth {
+		return fmt.Errorf("boxes nested too deeply at %d: %w", parent.start, errBadBox)
+	}
+
+	return walkBoxes(p.r, parent.data, parent.end, func(b box) error {
+		switch b.typ {
+		case "trak", "udta":
+			return p.walk(b, depth+1)
+		case "mvhd":
+			return p.mvhd(b)
+		case "tkhd":
+			return p.tkhd(b)
+		case "meta":
+			return p.quickTimeMeta(b)
+		case "uuid":
+			return p.canonUUID(b)
+		case "\xa9mak":
+			p.movie.Make = p.userDataString(b)
+		case "\xa9mod":
+			p.movie.Model = p.userDataString(b)
+		}
+		return nil
+	})
+}
+
+// mvhd - The movie header has the creation time and duration.
+func (p *bmffParser) mvhd(b box) error {
+
+	buf, err := readPayload(p.r, b)
+	if err != nil {
+		return err
+	}
+
+	var created uint64
+	var timescale uint32
+	var duration uint64
+
+	switch {
+	case len(buf) >= 32 && buf[0] == 1:
+		created = binary.BigEndian.Uint64(buf[4:12])
+		timescale = binary.BigEndian.Uint32(buf[20:24])
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	case len(buf) >= 20 && buf[0] == 0:
+		created = uint64(binary.BigEndian.Uint32(buf[4:8]))
+		timescale = binary.BigEndian.Uint32(buf[12:16])
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	default:
+		return fmt.Errorf("bad mvhd at %d: %w", b.start, errBadBox)
+	}
+
+	// Cameras with an unset clock write zero.
+	if created != 0 && created < 1<<40 {
+		p.movie.CaptureTime = epoch1904.Add(time.Duration(created) * time.Second)
+	}
+	if timescale != 0 {
+		p.movie.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+
+	return nil
+}
+
+// tkhd - Track headers have the frame size.  Audio tracks have a size of
+// zero, so the largest track wins.
+func (p *bmffParser) tkhd(b box) error {
+
+	buf, err := readPayload(p.r, b)
+	if err != nil {
+		return err
+	}
+
+	// The width and height are the last 8 bytes, as 16.16 fixed point.
+	if len(buf) < 84 {
+		return fmt.Errorf("bad tkhd at %d: %w", b.start, errBadBox)
+	}
+	width := int(binary.BigEndian.Uint32(buf[len(buf)-8:]) >> 16)
+	height := int(binary.BigEndian.Uint32(buf[len(buf)-4:]) >> 16)
+
+	if width*height > p.movie.Width*p.movie.Height {
+		p.movie.Width = width
+		p.movie.Height = height
+	}
+
+	return nil
+}
+
+// userDataString - A QuickTime user data text atom: a 16 bit length and
+// a 16 bit language code, followed by the text.
+func (p *bmffParser) userDataString(b box) string {
+
+	buf, err := readPayload(p.r, b)
+	if err != nil || len(buf) < 4 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if n > len(buf)-4 {
+		n = len(buf) - 4
+	}
+	return strings.TrimSpace(strings.TrimRight(string(buf[4:4+n]), "\x00"))
+}
+
+// quickTimeMeta - A QuickTime meta box, with keys naming the entries in
+// ilst.  Unlike the ISO meta box, this one has no version and flags.
+func (p *bmffParser) quickTimeMeta(parent box) error {
+
+	keys := make(map[uint32]string)
+	values := make(map[uint32]string)
+
+	data := parent.data
+	hdr := make([]byte, 8)
+	_, err := p.r.ReadAt(hdr, data)
+	if err == nil && binary.BigEndian.Uint32(hdr[:4]) == 0 {
+		// Some writers use the ISO form anyway.
+		data += 4
+	}
+	parent.data = data
+
+	err = walkBoxes(p.r, parent.data, parent.end, func(b box) error {
+		switch b.typ {
+		case "keys":
+			buf, err := readPayload(p.r, b)
+			if err != nil {
+				return err
+			}
+			parseKeys(buf, keys)
+		case "ilst":
+			return walkBoxes(p.r, b.data, b.end, func(item box) error {
+				idx := binary.BigEndian.Uint32([]byte(item.typ))
+				return walkBoxes(p.r, item.data, item.end, func(d box) error {
+					if d.typ != "data" {
+						return nil
+					}
+					buf, err := readPayload(p.r, d)
+					if err != nil {
+						return err
+					}
+					// Type indicator 1 is UTF-8 text.
+					if len(buf) >= 8 && binary.BigEndian.Uint32(buf[:4]) == 1 {
+						values[idx] = strings.TrimSpace(string(buf[8:]))
+					}
+					return nil
+				})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for idx, key := range keys {
+		val := values[idx]
+		switch key {
+		case "com.apple.quicktime.make":
+			p.keys.Make = val
+		case "com.apple.quicktime.model":
+			p.keys.Model = val
+		case "com.apple.quicktime.creationdate":
+			p.keys.CaptureTime = isoTime(val)
+		}
+	}
+
+	return nil
+}
+
+// parseKeys - The keys box: a version and flags, a count, and then each
+// key as a size, a namespace and the name.  Keys are numbered from 1.
+func parseKeys(buf []byte, keys map[uint32]string) {
+
+	if len(buf) < 8 {
+		return
+	}
+	count := binary.BigEndian.Uint32(buf[4:8])
+	off := 8
+	for i := uint32(1); i <= count && off+8 <= len(buf); i++ {
+		size := int(binary.BigEndian.Uint32(buf[off : off+4]))
+		if size < 8 || off+size > len(buf) {
+			return
+		}
+		keys[i] = string(buf[off+8 : off+size])
+		off += size
+	}
+}
+
+// isoTime - Parse the ISO 8601 times phones write, with or without a
+// colon in the offset.
+func isoTime(val string) time.Time {
+	for _, layout := range []string{
+		"2006-01-02T15:04:05Z0700",
+		"2006-01-02T15:04:05Z07:00",
+		"2006-01-02T15:04:05.999999999Z0700",
+		"2006-01-02T15:04:05.999999999Z07:00",
+	} {
+		rv, err := time.Parse(layout, val)
+		if err == nil {
+			return rv
+		}
+	}
+	return time.Time{}
+}
+
+// canonUUID - The CR3 metadata box.  CMT1 is a TIFF whose IFD0 has the
+// camera, and CMT2 is a TIFF whose IFD0 is the EXIF IFD.
+func (p *bmffParser) canonUUID(b box) error {
+
+	id := make([]byte, 16)
+	if b.end-b.data < 16 {
+		return nil
+	}
+	_, err := p.r.ReadAt(id, b.data)
+	if err != nil {
+		return fmt.Errorf("error reading uuid at %d: %w", b.start, err)
+	}
+	if !bytes.Equal(id, canonCR3UUID) {
+		return nil
+	}
+
+	return walkBoxes(p.r, b.data+16, b.end, func(c box) error {
+		switch c.typ {
+		case "CMT1":
+			ifd0 := Metadata{}
+			err := parseTIFF(p.r, c.data, c.end, &ifd0)
+			if err != nil {
+				return err
+			}
+			mergeMetadata(&p.exif, ifd0)
+		case "CMT2":
+			exif := Metadata{}
+			err := parseExifTIFF(p.r, c.data, c.end, &exif)
+			if err != nil {
+				return err
+			}
+			if !exif.CaptureTime.IsZero() {
+				p.exif.CaptureTime = exif.CaptureTime
+			}
+			if exif.Serial != "" {
+				p.exif.Serial = exif.Serial
+			}
+		}
+		return nil
+	})
+}
+
+// heifMeta - The top level HEIF meta box.  The EXIF data is stored as an
+// item, so find its ID in iinf and its location in iloc.
+func (p *bmffParser) heifMeta(parent box) error {
+
+	// The ISO meta box has a version and flags.
+	err := walkBoxes(p.r, parent.data+4, parent.end, func(b box) error {
+		switch b.typ {
+		case "iinf":
+			return p.iinf(b)
+		case "iloc":
+			return p.iloc(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	loc, ok := p.itemLocs[p.exifItemID]
+	if p.exifItemID == 0 || !ok {
+		return nil
+	}
+
+	// The Exif item starts with the offset to the TIFF header, which
+	// usually skips an "Exif\0\0" prefix.
+	prefix := make([]byte, 4)
+	_, err = p.r.ReadAt(prefix, loc[0])
+	if err != nil {
+		return fmt.Errorf("error reading Exif item at %d: %w", loc[0], err)
+	}
+	tiffStart := loc[0] + 4 + int64(binary.BigEndian.Uint32(prefix))
+	end := loc[0] + loc[1]
+	if tiffStart >= end {
+		return fmt.Errorf("bad Exif item at %d: %w", loc[0], errBadBox)
+	}
+
+	return parseTIFF(p.r, tiffStart, end, &p.exif)
+}
+
+// iinf - Item information.  We only want the ID of the Exif item.
+func (p *bmffParser) iinf(b box) error {
+
+	hdr := make([]byte, 4)
+	_, err := p.r.ReadAt(hdr, b.data)
+	if err != nil {
+		return fmt.Errorf("error reading iinf at %d: %w", b.start, err)
+	}
+	// Version 0 has a 16 bit entry count, later versions 32 bits.
+	first := b.data + 6
+	if hdr[0] != 0 {
+		first = b.data + 8
+	}
+
+	return walkBoxes(p.r, first, b.end, func(infe box) error {
+		if infe.typ != "infe" {
+			return nil
+		}
+		buf, err := readPayload(p.r, infe)
+		if err != nil {
+			return err
+		}
+		// Only versions 2 and 3 have an item type.
+		switch {
+		case len(buf) >= 12 && buf[0] == 2:
+			if string(buf[8:12]) == "Exif" {
+				p.exifItemID = uint32(binary.BigEndian.Uint16(buf[4:6]))
+			}
+		case len(buf) >= 14 && buf[0] == 3:
+			if string(buf[10:14]) == "Exif" {
+				p.exifItemID = binary.BigEndian.Uint32(buf[4:8])
+			}
+		}
+		return nil
+	})
+}
+
+// iloc - Item locations.  Only items stored at a file offset, which is
+// how the Exif item is always stored, are recorded.
+func (p *bmffParser) iloc(b box) error {
+
+	buf, err := readPayload(p.r, b)
+	if err != nil {
+		return err
+	}
+	if len(buf) < 8 {
+		return fmt.Errorf("bad iloc at %d: %w", b.start, errBadBox)
+	}
+
+	version := buf[0]
+	offsetSize := int(buf[4] >> 4)
+	lengthSize := int(buf[4] & 0x0F)
+	baseOffsetSize := int(buf[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(buf[5] & 0x0F)
+	}
+
+	rd := &fieldReader{buf: buf, off: 6}
+
+	var itemCount uint64
+	if version < 2 {
+		itemCount = rd.uint(2)
+	} else {
+		itemCount = rd.uint(4)
+	}
+
+	for i := uint64(0); i < itemCount && rd.err == nil; i++ {
+		var itemID uint64
+		if version < 2 {
+			itemID = rd.uint(2)
+		} else {
+			itemID = rd.uint(4)
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = rd.uint(2) & 0x0F
+		}
+		rd.uint(2) // data_reference_index
+		baseOffset := rd.uint(baseOffsetSize)
+		extentCount := rd.uint(2)
+		for e := uint64(0); e < extentCount && rd.err == nil; e++ {
+			rd.uint(indexSize)
+			extentOffset := rd.uint(offsetSize)
+			extentLength := rd.uint(lengthSize)
+			// The Exif item is always a single extent.
+			if e == 0 && method == 0 {
+				p.itemLocs[uint32(itemID)] = [2]int64{
+					int64(baseOffset + extentOffset), int64(extentLength)}
+			}
+		}
+	}
+
+	if rd.err != nil {
+		return fmt.Errorf("bad iloc at %d: %w", b.start, rd.err)
+	}
+
+	return nil
+}
+
+// fieldReader - Reads big endian integers of varying sizes, remembering
+// the first error so the caller only has to check once.
+type fieldReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (f *fieldReader) uint(size int) uint64 {
+	if f.err != nil || size == 0 {
+		return 0
+	}
+	if size != 2 && size != 4 && size != 8 {
+		f.err = fmt.Errorf("field size %d: %w", size, errBadBox)
+		return 0
+	}
+	if f.off+size > len(f.buf) {
+		f.err = fmt.Errorf("field past the end of the box: %w", errBadBox)
+		return 0
+	}
+	var rv uint64
+	for _, c := range f.buf[f.off : f.off+size] {
+		rv = rv<<8 | uint64(c)
+	}
+	f.off += size
+	return rv
+}
@@ -0,0 +1,220 @@
+package mediameta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// bx - Make a box from its type and payload pieces.
+func bx(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out[:4], uint32(8+len(body)))
+	copy(out[4:8], typ)
+	return append(out, body...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func mvhdBox(created time.Time, timescale uint32, duration uint32) []byte {
+	payload := make([]byte, 100)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(created.Sub(epoch1904)/time.Second))
+	binary.BigEndian.PutUint32(payload[12:16], timescale)
+	binary.BigEndian.PutUint32(payload[16:20], duration)
+	return bx("mvhd", payload)
+}
+
+func tkhdBox(width uint32, height uint32) []byte {
+	payload := make([]byte, 84)
+	binary.BigEndian.PutUint32(payload[76:80], width<<16)
+	binary.BigEndian.PutUint32(payload[80:84], height<<16)
+	return bx("tkhd", payload)
+}
+
+func userDataBox(typ string, val string) []byte {
+	return bx(typ, be16(uint16(len(val))), be16(0x55c4), []byte(val))
+}
+
+var ftypBox = bx("ftyp", []byte("isom"), be32(0), []byte("isomiso2mp41"))
+
+func TestReadMP4(t *testing.T) {
+
+	created := time.Date(2024, 3, 7, 18, 45, 12, 0, time.UTC)
+	mp4 := bytes.Join([][]byte{
+		ftypBox,
+		bx("mdat", make([]byte, 1000)),
+		bx("moov",
+			mvhdBox(created, 1000, 12500),
+			bx("trak", tkhdBox(3840, 2160)),
+			bx("trak", tkhdBox(0, 0)),
+			bx("udta",
+				userDataBox("\xa9mak", "Sony"),
+				userDataBox("\xa9mod", "ILCE-7M4"))),
+	}, nil)
+
+	md, err := readBytes(t, mp4)
+	if err != nil {
+		t.Fatal("error reading MP4 metadata: " + err.Error())
+	}
+	if !md.CaptureTime.Equal(created) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, created)
+	}
+	if md.Duration != 12500*time.Millisecond {
+		t.Errorf("duration %s, want 12.5s", md.Duration)
+	}
+	if md.Width != 3840 || md.Height != 2160 {
+		t.Errorf("size %dx%d, want 3840x2160", md.Width, md.Height)
+	}
+	if md.Make != "Sony" || md.Model != "ILCE-7M4" {
+		t.Errorf("unexpected camera: %s / %s", md.Make, md.Model)
+	}
+}
+
+func TestReadQuickTimeKeys(t *testing.T) {
+
+	key := func(name string) []byte {
+		return bytes.Join([][]byte{be32(uint32(8 + len(name))), []byte("mdta"), []byte(name)}, nil)
+	}
+	item := func(idx uint32, val string) []byte {
+		return bx(string(be32(idx)), bx("data", be32(1), be32(0), []byte(val)))
+	}
+
+	mov := bytes.Join([][]byte{
+		bx("ftyp", []byte("qt  "), be32(0), []byte("qt  ")),
+		bx("moov",
+			mvhdBox(time.Date(2024, 3, 8, 1, 45, 12, 0, time.UTC), 600, 600),
+			bx("meta",
+				bx("hdlr", make([]byte, 24)),
+				bx("keys", be32(0), be32(3),
+					key("com.apple.quicktime.make"),
+					key("com.apple.quicktime.model"),
+					key("com.apple.quicktime.creationdate")),
+				bx("ilst",
+					item(1, "Apple"),
+					item(2, "iPhone 15 Pro"),
+					item(3, "2024-03-07T18:45:12-0700")))),
+	}, nil)
+
+	md, err := readBytes(t, mov)
+	if err != nil {
+		t.Fatal("error reading MOV metadata: " + err.Error())
+	}
+
+	// The creation date key has the real offset, so it wins over mvhd.
+	want := time.Date(2024, 3, 7, 18, 45, 12, 0, time.FixedZone("", -7*3600))
+	if !md.CaptureTime.Equal(want) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, want)
+	}
+	_, offset := md.CaptureTime.Zone()
+	if offset != -7*3600 {
+		t.Errorf("capture time offset %d, want %d", offset, -7*3600)
+	}
+	if md.Make != "Apple" || md.Model != "iPhone 15 Pro" {
+		t.Errorf("unexpected camera: %s / %s", md.Make, md.Model)
+	}
+	if md.Duration != time.Second {
+		t.Errorf("duration %s, want 1s", md.Duration)
+	}
+}
+
+func TestReadCR3(t *testing.T) {
+
+	cmt1 := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{
+			asciiTag(tagMake, "Canon"),
+			asciiTag(tagModel, "Canon EOS R5"),
+			shortTag(tagOrientation, 1),
+		}, nil)
+	cmt2 := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2024:03:07 18:45:12"),
+			asciiTag(tagOffsetTimeOriginal, "+01:00"),
+			asciiTag(tagBodySerialNumber, "012345678901"),
+		}, nil)
+
+	cr3 := bytes.Join([][]byte{
+		bx("ftyp", []byte("crx "), be32(1), []byte("crx isom")),
+		bx("moov",
+			bx("uuid", canonCR3UUID, bx("CMT1", cmt1), bx("CMT2", cmt2)),
+			mvhdBox(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), 1, 0)),
+		bx("mdat", make([]byte, 64)),
+	}, nil)
+
+	md, err := readBytes(t, cr3)
+	if err != nil {
+		t.Fatal("error reading CR3 metadata: " + err.Error())
+	}
+
+	want := time.Date(2024, 3, 7, 18, 45, 12, 0, time.FixedZone("", 3600))
+	if !md.CaptureTime.Equal(want) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, want)
+	}
+	if md.Make != "Canon" || md.Model != "Canon EOS R5" || md.Serial != "012345678901" {
+		t.Errorf("unexpected camera: %+v", md)
+	}
+	if md.Orientation != 1 {
+		t.Errorf("unexpected orientation: %d", md.Orientation)
+	}
+}
+
+func TestReadHEIC(t *testing.T) {
+
+	tiff := buildTIFF(binary.BigEndian, 42,
+		[]testTag{
+			asciiTag(tagMake, "Apple"),
+			asciiTag(tagModel, "iPhone 15 Pro"),
+			shortTag(tagOrientation, 6),
+		},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2024:03:07 18:45:12"),
+			asciiTag(tagSubSecTimeOriginal, "5"),
+			asciiTag(tagOffsetTimeOriginal, "-07:00"),
+		})
+	exifItem := bytes.Join([][]byte{be32(6), []byte("Exif\x00\x00"), tiff}, nil)
+
+	ftyp := bx("ftyp", []byte("heic"), be32(0), []byte("mif1heic"))
+
+	// The item location is absolute, so build the meta box once to find
+	// out how big it is.
+	meta := func(itemOffset uint32) []byte {
+		return bx("meta", be32(0),
+			bx("hdlr", make([]byte, 24)),
+			bx("iinf", be32(0), be16(2),
+				bx("infe", []byte{2, 0, 0, 0}, be16(1), be16(0), []byte("hvc1"), []byte{0}),
+				bx("infe", []byte{2, 0, 0, 0}, be16(2), be16(0), []byte("Exif"), []byte{0})),
+			bx("iloc", be32(0), []byte{0x44, 0x00}, be16(1),
+				be16(2), be16(0), be16(1), be32(itemOffset), be32(uint32(len(exifItem)))))
+	}
+	itemOffset := uint32(len(ftyp) + len(meta(0)) + 8)
+
+	heic := bytes.Join([][]byte{ftyp, meta(itemOffset), bx("mdat", exifItem)}, nil)
+
+	md, err := readBytes(t, heic)
+	if err != nil {
+		t.Fatal("error reading HEIC metadata: " + err.Error())
+	}
+
+	want := time.Date(2024, 3, 7, 18, 45, 12, 500000000, time.FixedZone("", -7*3600))
+	if !md.CaptureTime.Equal(want) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, want)
+	}
+	if md.Model != "iPhone 15 Pro" || md.Orientation != 6 {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+}
+
+func TestReadBadBoxes(t *testing.T) {
+
+	// A box that claims to be bigger than the file.
+	bad := append(bytes.Clone(ftypBox), bx("moov", mvhdBox(time.Now(), 1, 1))...)
+	binary.BigEndian.PutUint32(bad[len(ftypBox):], 1<<30)
+
+	_, err := readBytes(t, bad)
+	if err == nil {
+		t.Error("expected an error for an oversized box")
+	}
+}
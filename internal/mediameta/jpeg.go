@@ -0,0 +1,67 @@
+package mediameta
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// JPEG markers we care about.
+const (
+	jpegAPP1 = 0xE1
+	jpegSOS  = 0xDA
+	jpegEOI  = 0xD9
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// parseJPEG - Walk the JPEG segments starting at base, looking for the
+// APP1 segment with the EXIF data.  The walk stops at the start of the
+// image data, so only the headers are read.
+func parseJPEG(r io.ReaderAt, base int64, size int64, md *Metadata) error {
+
+	off := base + 2
+	seg := make([]byte, 4)
+
+	for off+4 <= size {
+		_, err := r.ReadAt(seg, off)
+		if err != nil {
+			return fmt.Errorf("error reading JPEG segment at %d: %w", off, err)
+		}
+
+		if seg[0] != 0xFF {
+			return fmt.Errorf("bad JPEG marker at %d", off)
+		}
+		marker := seg[1]
+
+		// Markers can be padded with extra 0xFF bytes.
+		if marker == 0xFF {
+			off++
+			continue
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			return nil
+		}
+
+		segLen := int64(seg[2])<<8 | int64(seg[3])
+		if segLen < 2 {
+			return fmt.Errorf("bad JPEG segment length at %d", off)
+		}
+
+		if marker == jpegAPP1 && segLen >= 2+int64(len(exifHeader))+8 {
+			hdr := make([]byte, len(exifHeader))
+			_, err = r.ReadAt(hdr, off+4)
+			if err != nil {
+				return fmt.Errorf("error reading APP1 header at %d: %w", off, err)
+			}
+			if bytes.Equal(hdr, exifHeader) {
+				tiffStart := off + 4 + int64(len(exifHeader))
+				return parseTIFF(r, tiffStart, off+2+segLen, md)
+			}
+		}
+
+		off += 2 + segLen
+	}
+
+	return nil
+}
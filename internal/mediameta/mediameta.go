@@ -0,0 +1,108 @@
+// Package mediameta reads capture metadata (when, and with what camera)
+// from photo and video files, without any dependencies outside the
+// standard library.  It only reads the few headers it needs, so it is
+// cheap enough to run on every file found on a card.
+package mediameta
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// ErrNoMetadata - The file is not a format we understand, or it has
+	// none of the fields we look for.  Callers should fall back to the
+	// filesystem.
+	ErrNoMetadata = errors.New("no supported metadata")
+)
+
+// Metadata - What we learned about how and when a file was shot.  Any
+// field may be empty, when the file does not have it.
+type Metadata struct {
+	// CaptureTime - DateTimeOriginal, with SubSecTime and OffsetTime
+	// applied when present.  Without an offset, the camera's clock is
+	// assumed to be in the local time zone.
+	CaptureTime time.Time
+	Make        string
+	Model       string
+	Serial      string
+	// Orientation - EXIF orientation, 1 through 8.  Zero if unknown.
+	Orientation int
+	// Duration, Width and Height - Only set for video.
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+// IsZero - True if nothing useful was found.
+func (m Metadata) IsZero() bool {
+	return m.CaptureTime.IsZero() && m.Make == "" && m.Model == "" &&
+		m.Serial == "" && m.Orientation == 0 && m.Duration == 0 &&
+		m.Width == 0 && m.Height == 0
+}
+
+// ReadFile - Read the capture metadata from a file.  JPEG, the TIFF based
+// raw formats (CR2, NEF, ARW, ORF, RW2 and DNG) and the ISO-BMFF formats
+// (CR3, HEIF/HEIC, MP4 and MOV) are supported.  The format is
+// detected from the file's contents, not its extension.
+func ReadFile(fileName string) (Metadata, error) {
+
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error opening %s: %w", fileName, err)
+	}
+	defer func() {
+		_ = fi.Close()
+	}()
+
+	info, err := fi.Stat()
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error getting info for %s: %w", fileName, err)
+	}
+
+	md, err := Read(fi, info.Size())
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error reading metadata from %s: %w", fileName, err)
+	}
+
+	return md, nil
+}
+
+// Read - Read the capture metadata from the first size bytes of r.
+func Read(r io.ReaderAt, size int64) (Metadata, error) {
+
+	magic := make([]byte, 12)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Metadata{}, fmt.Errorf("error reading file header: %w", err)
+	}
+	magic = magic[:n]
+
+	md := Metadata{}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xFF, 0xD8, 0xFF}):
+		err = parseJPEG(r, 0, size, &md)
+	case isTIFF(magic):
+		// CR2, NEF, ARW, ORF, RW2 and DNG are all TIFF underneath.
+		err = parseTIFF(r, 0, size, &md)
+	case isBMFF(magic):
+		// CR3, HEIF/HEIC, MP4 and MOV.
+		err = parseBMFF(r, size, &md)
+	default:
+		return Metadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if md.IsZero() {
+		return Metadata{}, ErrNoMetadata
+	}
+
+	return md, nil
+}
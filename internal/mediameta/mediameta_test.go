@@ -0,0 +1,242 @@
+package mediameta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTag - A tag for buildTIFF.  Either str or num is used.
+type testTag struct {
+	tag uint16
+	str string
+	num uint32
+	typ uint16
+}
+
+func asciiTag(tag uint16, val string) testTag {
+	return testTag{tag: tag, str: val, typ: typeASCII}
+}
+
+func shortTag(tag uint16, val uint32) testTag {
+	return testTag{tag: tag, num: val, typ: typeShort}
+}
+
+// buildTIFF - Make a minimal TIFF with an IFD0 and, if exif is not empty,
+// an EXIF IFD.  magic lets us fake the raw format variants.
+func buildTIFF(order binary.ByteOrder, magic uint16, ifd0 []testTag, exif []testTag) []byte {
+
+	ifdSize := func(tags []testTag) int { return 2 + 12*len(tags) + 4 }
+
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, testTag{tag: tagExifIFD, typ: typeLong})
+	}
+
+	ifd0Off := 8
+	exifOff := ifd0Off + ifdSize(ifd0)
+	dataOff := exifOff
+	if len(exif) > 0 {
+		dataOff += ifdSize(exif)
+	}
+
+	data := &bytes.Buffer{}
+	writeIFD := func(buf *bytes.Buffer, tags []testTag) {
+		_ = binary.Write(buf, order, uint16(len(tags)))
+		for _, tg := range tags {
+			_ = binary.Write(buf, order, tg.tag)
+			_ = binary.Write(buf, order, tg.typ)
+			switch tg.typ {
+			case typeASCII:
+				val := append([]byte(tg.str), 0)
+				_ = binary.Write(buf, order, uint32(len(val)))
+				if len(val) <= 4 {
+					buf.Write(append(val, make([]byte, 4-len(val))...))
+				} else {
+					_ = binary.Write(buf, order, uint32(dataOff+data.Len()))
+					data.Write(val)
+				}
+			case typeShort:
+				_ = binary.Write(buf, order, uint32(1))
+				_ = binary.Write(buf, order, uint16(tg.num))
+				_ = binary.Write(buf, order, uint16(0))
+			case typeLong:
+				_ = binary.Write(buf, order, uint32(1))
+				val := tg.num
+				if tg.tag == tagExifIFD {
+					val = uint32(exifOff)
+				}
+				_ = binary.Write(buf, order, val)
+			}
+		}
+		_ = binary.Write(buf, order, uint32(0))
+	}
+
+	out := &bytes.Buffer{}
+	if order == binary.BigEndian {
+		out.WriteString("MM")
+	} else {
+		out.WriteString("II")
+	}
+	_ = binary.Write(out, order, magic)
+	_ = binary.Write(out, order, uint32(ifd0Off))
+	writeIFD(out, ifd0)
+	if len(exif) > 0 {
+		writeIFD(out, exif)
+	}
+	out.Write(data.Bytes())
+
+	return out.Bytes()
+}
+
+// wrapJPEG - Put a TIFF structure in the APP1 segment of a tiny JPEG.
+func wrapJPEG(tiff []byte) []byte {
+	out := &bytes.Buffer{}
+	out.Write([]byte{0xFF, 0xD8})
+	// An APP0 segment first, like most cameras write.
+	out.Write([]byte{0xFF, 0xE0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0x00})
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	out.Write([]byte{0xFF, jpegAPP1})
+	_ = binary.Write(out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write([]byte{0xFF, jpegSOS, 0x00, 0x02, 0xFF, jpegEOI})
+	return out.Bytes()
+}
+
+func readBytes(t *testing.T, data []byte) (Metadata, error) {
+	t.Helper()
+	return Read(bytes.NewReader(data), int64(len(data)))
+}
+
+func TestReadJPEG(t *testing.T) {
+
+	tiff := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{
+			asciiTag(tagMake, "Canon"),
+			asciiTag(tagModel, "Canon EOS R5"),
+			shortTag(tagOrientation, 6),
+			asciiTag(tagDateTime, "2024:03:08 09:00:00"),
+		},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2024:03:07 18:45:12"),
+			asciiTag(tagSubSecTimeOriginal, "25"),
+			asciiTag(tagOffsetTimeOriginal, "-07:00"),
+			asciiTag(tagBodySerialNumber, "012345678901"),
+		})
+
+	md, err := readBytes(t, wrapJPEG(tiff))
+	if err != nil {
+		t.Fatal("error reading JPEG metadata: " + err.Error())
+	}
+
+	want := time.Date(2024, 3, 7, 18, 45, 12, 250000000, time.FixedZone("", -7*3600))
+	if !md.CaptureTime.Equal(want) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, want)
+	}
+	_, offset := md.CaptureTime.Zone()
+	if offset != -7*3600 {
+		t.Errorf("capture time offset %d, want %d", offset, -7*3600)
+	}
+	if md.Make != "Canon" || md.Model != "Canon EOS R5" {
+		t.Errorf("unexpected camera: %s / %s", md.Make, md.Model)
+	}
+	if md.Serial != "012345678901" {
+		t.Errorf("unexpected serial: %s", md.Serial)
+	}
+	if md.Orientation != 6 {
+		t.Errorf("unexpected orientation: %d", md.Orientation)
+	}
+}
+
+func TestReadRawTIFF(t *testing.T) {
+
+	// Big endian, like NEF, with no offset or sub seconds.
+	nef := buildTIFF(binary.BigEndian, 42,
+		[]testTag{
+			asciiTag(tagMake, "NIKON CORPORATION"),
+			asciiTag(tagModel, "NIKON Z 6"),
+		},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2023:12:31 23:59:59"),
+		})
+
+	md, err := readBytes(t, nef)
+	if err != nil {
+		t.Fatal("error reading NEF metadata: " + err.Error())
+	}
+	want := time.Date(2023, 12, 31, 23, 59, 59, 0, time.Local)
+	if !md.CaptureTime.Equal(want) {
+		t.Errorf("capture time %s, want %s", md.CaptureTime, want)
+	}
+	if md.Model != "NIKON Z 6" {
+		t.Errorf("unexpected model: %s", md.Model)
+	}
+
+	// Olympus ORF uses its own magic number.
+	orf := buildTIFF(binary.LittleEndian, 0x4F52,
+		[]testTag{asciiTag(tagModel, "E-M1MarkII")}, nil)
+	md, err = readBytes(t, orf)
+	if err != nil {
+		t.Fatal("error reading ORF metadata: " + err.Error())
+	}
+	if md.Model != "E-M1MarkII" || !md.CaptureTime.IsZero() {
+		t.Errorf("unexpected ORF metadata: %+v", md)
+	}
+
+	// A camera with an unset clock.
+	unset := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{asciiTag(tagModel, "DSC-RX100")},
+		[]testTag{asciiTag(tagDateTimeOriginal, "0000:00:00 00:00:00")})
+	md, err = readBytes(t, unset)
+	if err != nil {
+		t.Fatal("error reading metadata: " + err.Error())
+	}
+	if !md.CaptureTime.IsZero() {
+		t.Errorf("blank date should give a zero time, got %s", md.CaptureTime)
+	}
+}
+
+func TestReadUnsupported(t *testing.T) {
+
+	_, err := readBytes(t, []byte("just some text, not a photo"))
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("expected ErrNoMetadata for text, got %v", err)
+	}
+
+	// A JPEG without EXIF.
+	_, err = readBytes(t, []byte{0xFF, 0xD8, 0xFF, jpegSOS, 0x00, 0x02})
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("expected ErrNoMetadata for bare JPEG, got %v", err)
+	}
+
+	// A truncated file must fail cleanly.
+	tiff := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{asciiTag(tagModel, "Canon EOS R5")}, nil)
+	_, err = readBytes(t, tiff[:12])
+	if err == nil {
+		t.Error("expected an error for a truncated TIFF")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "IMG_0001.JPG")
+	tiff := buildTIFF(binary.LittleEndian, 42,
+		[]testTag{asciiTag(tagModel, "Canon EOS R5")},
+		[]testTag{asciiTag(tagDateTimeOriginal, "2024:03:07 18:45:12")})
+	err := os.WriteFile(fileName, wrapJPEG(tiff), 0644)
+	if err != nil {
+		t.Fatal("error writing test file: " + err.Error())
+	}
+
+	md, err := ReadFile(fileName)
+	if err != nil {
+		t.Fatal("error reading test file: " + err.Error())
+	}
+	if md.Model != "Canon EOS R5" || md.CaptureTime.IsZero() {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+}
@@ -0,0 +1,358 @@
+package mediameta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TIFF tags we read.  IFD0 has the camera, the EXIF IFD has the capture
+// time and serial number.
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTime         = 0x9010
+	tagOffsetTimeOriginal = 0x9011
+	tagSubSecTime         = 0x9290
+	tagSubSecTimeOriginal = 0x9291
+	tagBodySerialNumber   = 0xA431
+	tagDNGCameraSerial    = 0xC62F
+	// Panasonic RW2 files keep the EXIF data in an embedded JPEG.
+	tagRW2JpgFromRaw = 0x002E
+)
+
+// TIFF field types we read.
+const (
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeUndefined = 7
+)
+
+// Limits that keep a corrupt file from sending us off reading garbage.
+const (
+	maxIFDEntries = 1024
+	maxStringLen  = 256
+)
+
+var errBadTIFF = errors.New("malformed TIFF structure")
+
+// isTIFF - Check for a TIFF header.  Besides the standard magic of 42,
+// Olympus ORF uses "RO" and "RS", and Panasonic RW2 uses 0x55.
+func isTIFF(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	switch string(magic[:4]) {
+	case "II*\x00", "MM\x00*", "IIRO", "IIRS", "IIU\x00":
+		return true
+	default:
+		return false
+	}
+}
+
+// ifdEntry - One 12 byte IFD entry.  value holds the data when it fits in
+// four bytes, and the offset to it otherwise.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value [4]byte
+}
+
+// tiffReader - Reads a TIFF structure starting at base.  All TIFF offsets
+// are relative to base, which is not zero for EXIF inside a JPEG.
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	limit int64
+	order binary.ByteOrder
+}
+
+func (t *tiffReader) readAt(buf []byte, off uint32) error {
+	start := t.base + int64(off)
+	if start+int64(len(buf)) > t.limit {
+		return fmt.Errorf("offset %d is past the end of the data: %w", off, errBadTIFF)
+	}
+	_, err := t.r.ReadAt(buf, start)
+	if err != nil {
+		return fmt.Errorf("error reading TIFF data at %d: %w", start, err)
+	}
+	return nil
+}
+
+// readIFD - Read the entries of the IFD at off.
+func (t *tiffReader) readIFD(off uint32) (map[uint16]ifdEntry, error) {
+
+	cnt := make([]byte, 2)
+	err := t.readAt(cnt, off)
+	if err != nil {
+		return nil, err
+	}
+	count := t.order.Uint16(cnt)
+	if count > maxIFDEntries {
+		return nil, fmt.Errorf("IFD at %d has %d entries: %w", off, count, errBadTIFF)
+	}
+
+	raw := make([]byte, 12*int(count))
+	err = t.readAt(raw, off+2)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make(map[uint16]ifdEntry, count)
+	for i := 0; i < int(count); i++ {
+		e := raw[i*12 : (i+1)*12]
+		entry := ifdEntry{
+			tag:   t.order.Uint16(e[0:2]),
+			typ:   t.order.Uint16(e[2:4]),
+			count: t.order.Uint32(e[4:8]),
+		}
+		copy(entry.value[:], e[8:12])
+		rv[entry.tag] = entry
+	}
+
+	return rv, nil
+}
+
+// bytesOf - The raw bytes of an ASCII or UNDEFINED entry.
+func (t *tiffReader) bytesOf(e ifdEntry) ([]byte, error) {
+
+	if e.typ != typeASCII && e.typ != typeUndefined {
+		return nil, fmt.Errorf("tag %#x has type %d: %w", e.tag, e.typ, errBadTIFF)
+	}
+
+	n := e.count
+	if n > maxStringLen {
+		n = maxStringLen
+	}
+	if n <= 4 {
+		return e.value[:n], nil
+	}
+
+	buf := make([]byte, n)
+	err := t.readAt(buf, t.order.Uint32(e.value[:]))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// stringOf - An ASCII entry, trimmed of the NUL terminator and padding.
+func (t *tiffReader) stringOf(e ifdEntry) (string, error) {
+	b, err := t.bytesOf(e)
+	if err != nil {
+		return "", err
+	}
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		b = b[:idx]
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// uintOf - The first value of a SHORT or LONG entry.
+func (t *tiffReader) uintOf(e ifdEntry) (uint32, error) {
+	switch e.typ {
+	case typeShort:
+		return uint32(t.order.Uint16(e.value[:2])), nil
+	case typeLong:
+		return t.order.Uint32(e.value[:]), nil
+	default:
+		return 0, fmt.Errorf("tag %#x has type %d: %w", e.tag, e.typ, errBadTIFF)
+	}
+}
+
+// lookupString - String value of tag, or empty if it is missing or broken.
+// A single bad tag should not cost us the rest of the metadata.
+func (t *tiffReader) lookupString(ifd map[uint16]ifdEntry, tag uint16) string {
+	e, ok := ifd[tag]
+	if !ok {
+		return ""
+	}
+	s, err := t.stringOf(e)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// openTIFF - Check the TIFF header at base and read IFD0.
+func openTIFF(r io.ReaderAt, base int64, limit int64) (*tiffReader, map[uint16]ifdEntry, error) {
+
+	t := &tiffReader{r: r, base: base, limit: limit, order: binary.LittleEndian}
+
+	hdr := make([]byte, 8)
+	err := t.readAt(hdr, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch string(hdr[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("bad byte order %q: %w", hdr[:2], errBadTIFF)
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(hdr[4:8]))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return t, ifd0, nil
+}
+
+// parseTIFF - Read the metadata from a TIFF structure at base.  limit is
+// the end of the data that belongs to it.
+func parseTIFF(r io.ReaderAt, base int64, limit int64, md *Metadata) error {
+
+	t, ifd0, err := openTIFF(r, base, limit)
+	if err != nil {
+		return err
+	}
+
+	md.Make = t.lookupString(ifd0, tagMake)
+	md.Model = t.lookupString(ifd0, tagModel)
+	md.Serial = t.lookupString(ifd0, tagDNGCameraSerial)
+	if e, ok := ifd0[tagOrientation]; ok {
+		orientation, err := t.uintOf(e)
+		if err == nil && orientation >= 1 && orientation <= 8 {
+			md.Orientation = int(orientation)
+		}
+	}
+
+	md.CaptureTime = exifTime(t.lookupString(ifd0, tagDateTime), "", "")
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exifOff, err := t.uintOf(e)
+		if err != nil {
+			return err
+		}
+		exif, err := t.readIFD(exifOff)
+		if err != nil {
+			return err
+		}
+		t.applyExif(exif, md)
+	}
+
+	// RW2 keeps its IFD0 for raw data, and the real EXIF in a JPEG.
+	if e, ok := ifd0[tagRW2JpgFromRaw]; ok && e.typ == typeUndefined {
+		jpegStart := base + int64(t.order.Uint32(e.value[:]))
+		jpegEnd := jpegStart + int64(e.count)
+		if jpegEnd <= limit {
+			embedded := Metadata{}
+			err = parseJPEG(r, jpegStart, jpegEnd, &embedded)
+			if err == nil {
+				mergeMetadata(md, embedded)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseExifTIFF - Read a TIFF structure whose IFD0 is an EXIF IFD.  CR3
+// files store their EXIF this way.
+func parseExifTIFF(r io.ReaderAt, base int64, limit int64, md *Metadata) error {
+
+	t, exif, err := openTIFF(r, base, limit)
+	if err != nil {
+		return err
+	}
+	t.applyExif(exif, md)
+
+	return nil
+}
+
+// applyExif - Take the capture time and serial number from an EXIF IFD.
+func (t *tiffReader) applyExif(exif map[uint16]ifdEntry, md *Metadata) {
+
+	// Prefer the time the shutter fired over the time the file was
+	// last written, which is all DateTime promises.
+	if dto := t.lookupString(exif, tagDateTimeOriginal); dto != "" {
+		md.CaptureTime = exifTime(dto,
+			t.lookupString(exif, tagSubSecTimeOriginal),
+			t.lookupString(exif, tagOffsetTimeOriginal))
+	} else if !md.CaptureTime.IsZero() {
+		// Only the IFD0 DateTime, but it may still have an offset.
+		dateTime := md.CaptureTime.Format("2006:01:02 15:04:05")
+		md.CaptureTime = exifTime(dateTime,
+			t.lookupString(exif, tagSubSecTime),
+			t.lookupString(exif, tagOffsetTime))
+	}
+
+	if serial := t.lookupString(exif, tagBodySerialNumber); serial != "" {
+		md.Serial = serial
+	}
+}
+
+// mergeMetadata - Fill the empty fields of md from other.
+func mergeMetadata(md *Metadata, other Metadata) {
+	if md.CaptureTime.IsZero() {
+		md.CaptureTime = other.CaptureTime
+	}
+	if md.Make == "" {
+		md.Make = other.Make
+	}
+	if md.Model == "" {
+		md.Model = other.Model
+	}
+	if md.Serial == "" {
+		md.Serial = other.Serial
+	}
+	if md.Orientation == 0 {
+		md.Orientation = other.Orientation
+	}
+	if md.Duration == 0 {
+		md.Duration = other.Duration
+	}
+	if md.Width == 0 && md.Height == 0 {
+		md.Width = other.Width
+		md.Height = other.Height
+	}
+}
+
+// exifTime - Build a time from the EXIF date, sub second and offset
+// strings.  Returns the zero time if the date is missing or blank, which
+// cameras write as "0000:00:00 00:00:00" when the clock was never set.
+func exifTime(dateTime string, subSec string, offset string) time.Time {
+
+	loc := time.Local
+	if len(offset) == 6 && (offset[0] == '+' || offset[0] == '-') {
+		hours, errH := strconv.Atoi(offset[1:3])
+		mins, errM := strconv.Atoi(offset[4:6])
+		if errH == nil && errM == nil {
+			secs := hours*3600 + mins*60
+			if offset[0] == '-' {
+				secs = -secs
+			}
+			loc = time.FixedZone(offset, secs)
+		}
+	}
+
+	rv, err := time.ParseInLocation("2006:01:02 15:04:05", dateTime, loc)
+	if err != nil {
+		return time.Time{}
+	}
+
+	// SubSecTime is the digits after the decimal point.
+	digits := strings.TrimSpace(subSec)
+	if digits != "" && len(digits) <= 9 {
+		frac, err := strconv.Atoi(digits + strings.Repeat("0", 9-len(digits)))
+		if err == nil {
+			rv = rv.Add(time.Duration(frac))
+		}
+	}
+
+	return rv
+}